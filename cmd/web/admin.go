@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+)
+
+// createAdmin creates an activated user holding every permission so that the first
+// administrator can be bootstrapped without editing the database by hand.
+func createAdmin(ctx context.Context, models *db.Models, username, email, password string) (*db.User, error) {
+	user := &db.User{
+		Username: username,
+		Email:    email,
+		Password: db.Password{
+			Plain: &password,
+		},
+	}
+
+	user.Normalize()
+
+	if user.ValidateUser(models.Rules); !user.Validator.Valid() {
+		fields := make([]string, 0, len(user.Validator.Errors))
+		for field, message := range user.Validator.Errors {
+			fields = append(fields, fmt.Sprintf("%s %s", field, message))
+		}
+		sort.Strings(fields)
+
+		return nil, fmt.Errorf("invalid admin user: %s", strings.Join(fields, "; "))
+	}
+
+	err := models.Users.Create(ctx, user)
+	if err != nil {
+		return nil, fmt.Errorf("could not create admin user: %w", err)
+	}
+
+	err = models.Users.Activate(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not activate admin user: %w", err)
+	}
+	user.Activated = true
+
+	err = models.Permissions.Add(ctx, user.ID, db.PermissionReadUser, db.PermissionWriteUser, db.PermissionAdminUser)
+	if err != nil {
+		return nil, fmt.Errorf("could not grant admin permissions: %w", err)
+	}
+
+	return user, nil
+}
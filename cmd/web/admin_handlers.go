@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/validator"
+	"github.com/sushihentaime/user-management-service/pkg/jsonParser"
+)
+
+type updateUserStatusInput struct {
+	Activated *bool `json:"activated" validate:"required"`
+}
+
+// activate or deactivate a user's account, deactivating also revokes all of their sessions
+func (app *application) updateUserStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var input updateUserStatusInput
+
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	err = jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
+
+	if *input.Activated {
+		err = models.Users.Activate(r.Context(), dbUser.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = models.Permissions.Add(r.Context(), dbUser.ID, app.config.Auth.ActivationPermissions...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = models.Tokens.Delete(r.Context(), dbUser.ID, db.TokenScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		err = models.Users.Deactivate(r.Context(), dbUser.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = models.Tokens.DeleteAllForUser(r.Context(), dbUser.ID, db.TokenScopeAccess, db.TokenScopeRefresh)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	dbUser.Activated = *input.Activated
+
+	app.loggerFor(r).Info("user status changed", "event", eventUserStatusChanged, "target_user_id", dbUser.ID, "activated", dbUser.Activated)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": dbUser}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// look up a user by their email address for support staff who only have the email to go on
+func (app *application) getUserByEmailHandler(w http.ResponseWriter, r *http.Request) {
+	dbUser := &db.User{
+		Email: app.readString(r.URL.Query(), "email", ""),
+	}
+
+	dbUser.Normalize()
+
+	if dbUser.ValidateEmail(app.models.Rules); !dbUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, dbUser.Validator.Errors)
+		return
+	}
+
+	dbUser, err := app.models.Users.GetByEmail(r.Context(), dbUser.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": dbUser}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// list the most recent emails that could not be sent to a user, for support triage
+func (app *application) listEmailFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	filters := app.readFilters(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	events, metadata, err := app.models.EmailLog.GetForUser(r.Context(), dbUser.ID, db.EmailStatusFailed, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"emails": events}.withMetadata(metadata), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// issue a short lived access token for a user so that support can reproduce their issues. The token
+// is flagged with the admin's ID and the impersonation is recorded in the audit log.
+func (app *application) impersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	admin := app.getUserContext(r)
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
+
+	token, err := models.Tokens.CreateImpersonationToken(r.Context(), dbUser.ID, admin.ID, app.config.Auth.ImpersonationTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = models.Audit.Insert(r.Context(), &db.AuditEvent{ActorID: admin.ID, TargetUserID: dbUser.ID, Action: db.AuditActionImpersonate})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("impersonation started", "event", eventImpersonationStarted, "target_user_id", dbUser.ID)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"access_token": token, "user": newUserResponse(dbUser)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// revoke every impersonation token issued for a user
+func (app *application) endImpersonationsHandler(w http.ResponseWriter, r *http.Request) {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	admin := app.getUserContext(r)
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteImpersonationTokens(r.Context(), dbUser.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Audit.Insert(r.Context(), &db.AuditEvent{ActorID: admin.ID, TargetUserID: dbUser.ID, Action: db.AuditActionEndImpersonations})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("impersonations ended", "event", eventImpersonationsEnded, "target_user_id", dbUser.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "impersonation tokens revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// lock (suspend) a user's account and revoke all of their sessions, locked users can't log in
+func (app *application) lockUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserLocked(w, r, true)
+}
+
+// unlock a user's account so that they can log in again
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserLocked(w, r, false)
+}
+
+func (app *application) setUserLocked(w http.ResponseWriter, r *http.Request, locked bool) {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	admin := app.getUserContext(r)
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
+
+	action := db.AuditActionUnlock
+	if locked {
+		action = db.AuditActionLock
+
+		err = models.Users.Lock(r.Context(), dbUser.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = models.Tokens.DeleteAllForUser(r.Context(), dbUser.ID, db.TokenScopeAccess, db.TokenScopeRefresh)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		err = models.Users.Unlock(r.Context(), dbUser.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = models.Audit.Insert(r.Context(), &db.AuditEvent{ActorID: admin.ID, TargetUserID: dbUser.ID, Action: action})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	dbUser.Locked = locked
+
+	if locked {
+		app.loggerFor(r).Info("user locked", "event", eventUserLocked, "target_user_id", dbUser.ID)
+	} else {
+		app.loggerFor(r).Info("user unlocked", "event", eventUserUnlocked, "target_user_id", dbUser.ID)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": dbUser}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// list every permission that can be granted, so that admin UIs don't have to hardcode them
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.ListAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// maxBulkGrantUsers bounds how many users a single bulk grant may name.
+const maxBulkGrantUsers = 100
+
+type grantPermissionInput struct {
+	Usernames  []string      `json:"usernames" validate:"required"`
+	Permission db.Permission `json:"permission" validate:"required"`
+}
+
+// grantResult reports the outcome of a bulk grant for one username.
+type grantResult struct {
+	Username string `json:"username"`
+	Granted  bool   `json:"granted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// grant a permission to a batch of users, unknown usernames are reported in the results instead of
+// failing the whole batch
+func (app *application) grantPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	var input grantPermissionInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	v.Check(len(input.Usernames) > 0, "usernames", "must not be empty")
+	v.Check(len(input.Usernames) <= maxBulkGrantUsers, "usernames", fmt.Sprintf("must not contain more than %d usernames", maxBulkGrantUsers))
+	v.Check(input.Permission.Valid(), "permission", "is not a known permission")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
+	admin := app.getUserContext(r)
+
+	results := []grantResult{}
+	seen := make(map[string]bool, len(input.Usernames))
+	granted := 0
+
+	for _, username := range input.Usernames {
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+
+		dbUser, err := models.Users.GetByUsername(r.Context(), username)
+		if err != nil {
+			switch {
+			case errors.Is(err, db.ErrNotFound):
+				results = append(results, grantResult{Username: username, Error: "user not found"})
+				continue
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		err = models.Permissions.Add(r.Context(), dbUser.ID, input.Permission)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = models.Audit.Insert(r.Context(), &db.AuditEvent{ActorID: admin.ID, TargetUserID: dbUser.ID, Action: db.AuditActionGrantPermission})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		results = append(results, grantResult{Username: username, Granted: true})
+		granted++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("permissions granted", "event", eventPermissionsGranted, "permission", input.Permission, "granted", granted)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permission": input.Permission, "results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// revoke every token of the scope given by the scope query parameter for a user, e.g. all of their
+// outstanding password reset tokens
+func (app *application) revokeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	scope := db.TokenScope(app.readString(r.URL.Query(), "scope", ""))
+
+	v := validator.New()
+	v.Check(scope != "", "scope", "must be provided")
+	v.Check(scope.Valid(), "scope", "is not a known token scope")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	admin := app.getUserContext(r)
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.Delete(r.Context(), dbUser.ID, scope)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Audit.Insert(r.Context(), &db.AuditEvent{ActorID: admin.ID, TargetUserID: dbUser.ID, Action: db.AuditActionRevokeTokens})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("tokens revoked", "event", eventTokensRevoked, "target_user_id", dbUser.ID, "scope", scope)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": fmt.Sprintf("all %s tokens revoked", scope)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// expiringSessions are the sessions of a user about to expire.
+type expiringSessions struct {
+	UserID   int           `json:"user_id"`
+	Sessions []*db.Session `json:"sessions"`
+}
+
+// list the sessions of every user expiring within the "within" query parameter, an hour by default,
+// grouped by user. Truncated is set when there were more than db.MaxExpiringTokens of them.
+func (app *application) listExpiringSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	within := app.readDuration(r.URL.Query(), "within", time.Hour, v)
+	v.Check(within > 0, "within", "must be greater than zero")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tokens, err := app.models.Tokens.GetExpiringSoon(r.Context(), within)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the tokens are ordered by user
+	users := []*expiringSessions{}
+	for _, token := range tokens {
+		if len(users) == 0 || users[len(users)-1].UserID != token.UserID {
+			users = append(users, &expiringSessions{UserID: token.UserID})
+		}
+
+		group := users[len(users)-1]
+		group.Sessions = append(group.Sessions, &db.Session{ID: hex.EncodeToString(token.Hash), CreatedAt: token.CreatedAt, Expiry: token.Expiry})
+	}
+
+	body := envelope{
+		"users":     users,
+		"within":    within.String(),
+		"truncated": len(tokens) == db.MaxExpiringTokens,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateUserStatusHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	testCases := []struct {
+		name          string
+		permissions   []db.Permission
+		targetActive  bool
+		activated     bool
+		wantStatus    int
+		wantActivated bool
+	}{
+		{
+			name:          "Activate user",
+			permissions:   []db.Permission{db.PermissionAdminUser},
+			targetActive:  false,
+			activated:     true,
+			wantStatus:    http.StatusOK,
+			wantActivated: true,
+		},
+		{
+			name:          "Deactivate user revokes sessions",
+			permissions:   []db.Permission{db.PermissionAdminUser},
+			targetActive:  true,
+			activated:     false,
+			wantStatus:    http.StatusOK,
+			wantActivated: false,
+		},
+		{
+			name:          "Non-admin is rejected",
+			permissions:   []db.Permission{db.PermissionReadUser, db.PermissionWriteUser},
+			targetActive:  true,
+			activated:     false,
+			wantStatus:    http.StatusForbidden,
+			wantActivated: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, adminToken := createTestUser(t, app, "admin", tt.permissions...)
+			target, targetToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+			if !tt.targetActive {
+				err := app.models.Users.Deactivate(context.Background(), target.ID)
+				assert.NoError(t, err)
+			}
+
+			status, _, body := ts.do(t, http.MethodPut, "/v1/admin/users/testuser/status", adminToken.Plain, map[string]any{"activated": tt.activated})
+			assert.Equal(t, tt.wantStatus, status, "want %d; got %d", tt.wantStatus, status)
+
+			dbUser, err := app.models.Users.GetByUsername(context.Background(), target.Username)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantActivated, dbUser.Activated)
+
+			if tt.wantStatus == http.StatusOK {
+				user := body["user"].(map[string]any)
+				assert.Equal(t, target.Username, user["username"])
+				assert.Equal(t, tt.wantActivated, user["activated"])
+			}
+
+			_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, targetToken.Hash)
+			if tt.wantStatus == http.StatusOK && !tt.activated {
+				assert.ErrorIs(t, err, db.ErrNotFound)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if tt.wantStatus == http.StatusOK && tt.activated {
+				permissions, err := app.models.Permissions.Get(context.Background(), target.ID)
+				assert.NoError(t, err)
+				assert.Contains(t, *permissions, db.PermissionWriteUser)
+			}
+
+			t.Cleanup(func() {
+				err := cleanup(app)
+				assert.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestGetUserByEmailHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	_, userToken := createTestUser(t, app, "other", db.PermissionReadUser)
+	target, _ := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	testCases := []struct {
+		name       string
+		token      string
+		email      string
+		wantStatus int
+	}{
+		{name: "Found", token: adminToken.Plain, email: target.Email, wantStatus: http.StatusOK},
+		{name: "Not found", token: adminToken.Plain, email: "unknown@example.com", wantStatus: http.StatusNotFound},
+		{name: "Invalid email", token: adminToken.Plain, email: "not-an-email", wantStatus: http.StatusUnprocessableEntity},
+		{name: "Missing email", token: adminToken.Plain, email: "", wantStatus: http.StatusUnprocessableEntity},
+		{name: "Non-admin is rejected", token: userToken.Plain, email: target.Email, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, body := ts.do(t, http.MethodGet, "/v1/admin/users?email="+url.QueryEscape(tt.email), tt.token, nil)
+			assert.Equal(t, tt.wantStatus, status, "want %d; got %d", tt.wantStatus, status)
+
+			if tt.wantStatus == http.StatusOK {
+				user := body["user"].(map[string]any)
+				assert.Equal(t, target.Username, user["username"])
+				assert.Equal(t, target.Email, user["email"])
+				assert.NotContains(t, user, "password")
+			}
+		})
+	}
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestListEmailFailuresHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	_, userToken := createTestUser(t, app, "other", db.PermissionReadUser)
+	target, _ := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	for _, event := range []*db.EmailEvent{
+		{UserID: target.ID, Recipient: target.Email, Template: "mail.html", Status: db.EmailStatusSent},
+		{UserID: target.ID, Recipient: target.Email, Template: "reset_pwd.html", Status: db.EmailStatusFailed, Error: "connection refused"},
+	} {
+		err := app.models.EmailLog.Insert(context.Background(), event)
+		assert.NoError(t, err)
+	}
+
+	status, _, body := ts.do(t, http.MethodGet, "/v1/admin/users/testuser/emails/failed", adminToken.Plain, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	emails := body["emails"].([]any)
+	if assert.Len(t, emails, 1) {
+		email := emails[0].(map[string]any)
+		assert.Equal(t, "reset_pwd.html", email["template"])
+		assert.Equal(t, "failed", email["status"])
+		assert.Equal(t, "connection refused", email["error"])
+	}
+
+	status, _, _ = ts.do(t, http.MethodGet, "/v1/admin/users/unknown/emails/failed", adminToken.Plain, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _, _ = ts.do(t, http.MethodGet, "/v1/admin/users/testuser/emails/failed", userToken.Plain, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestImpersonateUserHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	_, otherToken := createTestUser(t, app, "other", db.PermissionReadUser, db.PermissionWriteUser)
+	target, targetToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	t.Run("Non-admin is rejected", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/admin/users/testuser/impersonate", otherToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		var count int
+		err := app.models.DB.QueryRow("SELECT COUNT(*) FROM audit_log").Scan(&count)
+		assert.NoError(t, err)
+		assert.Zero(t, count)
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/admin/users/unknown/impersonate", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	var impersonationToken string
+
+	t.Run("Admin receives a flagged token for the user", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPost, "/v1/admin/users/testuser/impersonate", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusCreated, status)
+
+		impersonationToken = body["access_token"].(map[string]any)["token"].(string)
+		assert.Equal(t, "testuser", body["user"].(map[string]any)["username"])
+
+		status, _, body = ts.do(t, http.MethodGet, "/v1/users/me", impersonationToken, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "testuser", body["user"].(map[string]any)["username"])
+
+		var impersonatorID int
+		var expiry time.Time
+		err := app.models.DB.QueryRow("SELECT impersonator_id, expiry FROM tokens WHERE hash = $1", db.HashToken(impersonationToken)).Scan(&impersonatorID, &expiry)
+		assert.NoError(t, err)
+		assert.Equal(t, admin.ID, impersonatorID)
+		assert.WithinDuration(t, time.Now().Add(app.config.Auth.ImpersonationTTL), expiry, 5*time.Second)
+	})
+
+	t.Run("Impersonation is audited", func(t *testing.T) {
+		var actorID, targetUserID int
+		var action string
+		err := app.models.DB.QueryRow("SELECT actor_id, target_user_id, action FROM audit_log").Scan(&actorID, &targetUserID, &action)
+		assert.NoError(t, err)
+		assert.Equal(t, admin.ID, actorID)
+		assert.Equal(t, target.ID, targetUserID)
+		assert.Equal(t, string(db.AuditActionImpersonate), action)
+	})
+
+	t.Run("Ending impersonations revokes only the flagged tokens", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/admin/users/testuser/impersonate", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+
+		status, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", impersonationToken, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		status, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", targetToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestListPermissionsHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	_, userToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	status, _, body := ts.do(t, http.MethodGet, "/v1/admin/permissions", adminToken.Plain, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []any{string(db.PermissionAdminUser), string(db.PermissionReadUser), string(db.PermissionWriteUser)}, body["permissions"])
+
+	status, _, _ = ts.do(t, http.MethodGet, "/v1/admin/permissions", userToken.Plain, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestGrantPermissionHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	_, otherToken := createTestUser(t, app, "other", db.PermissionReadUser, db.PermissionWriteUser)
+	alice, _ := createTestUser(t, app, "alice", db.PermissionReadUser)
+	bob, _ := createTestUser(t, app, "bob", db.PermissionReadUser)
+
+	t.Run("Mixed batch", func(t *testing.T) {
+		input := map[string]any{
+			"usernames":  []string{"alice", "unknown", "bob", "alice"},
+			"permission": db.PermissionWriteUser,
+		}
+
+		status, _, body := ts.do(t, http.MethodPost, "/v1/admin/permissions/grant", adminToken.Plain, input)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, string(db.PermissionWriteUser), body["permission"])
+		assert.Equal(t, []any{
+			map[string]any{"username": "alice", "granted": true},
+			map[string]any{"username": "unknown", "granted": false, "error": "user not found"},
+			map[string]any{"username": "bob", "granted": true},
+		}, body["results"])
+
+		for _, user := range []*db.User{alice, bob} {
+			permissions, err := app.models.Permissions.Get(context.Background(), user.ID)
+			assert.NoError(t, err)
+			assert.True(t, permissions.Include(db.PermissionWriteUser), "%s should have been granted the permission", user.Username)
+
+			var count int
+			err = app.models.DB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE target_user_id = $1 AND action = $2", user.ID, db.AuditActionGrantPermission).Scan(&count)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count, "the grant to %s must be audited", user.Username)
+		}
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		testCases := []struct {
+			name      string
+			input     map[string]any
+			wantField string
+		}{
+			{"Unknown permission", map[string]any{"usernames": []string{"alice"}, "permission": "user:delete"}, "permission"},
+			{"Empty usernames", map[string]any{"usernames": []string{}, "permission": db.PermissionWriteUser}, "usernames"},
+			{"Missing usernames", map[string]any{"permission": db.PermissionWriteUser}, "usernames"},
+		}
+
+		for _, tt := range testCases {
+			t.Run(tt.name, func(t *testing.T) {
+				status, _, body := ts.do(t, http.MethodPost, "/v1/admin/permissions/grant", adminToken.Plain, tt.input)
+				assert.Equal(t, http.StatusUnprocessableEntity, status)
+				assert.Contains(t, body["error"].(map[string]any)["fields"], tt.wantField)
+			})
+		}
+	})
+
+	t.Run("Non-admin is rejected", func(t *testing.T) {
+		input := map[string]any{"usernames": []string{"other"}, "permission": db.PermissionAdminUser}
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/admin/permissions/grant", otherToken.Plain, input)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestRevokeTokensHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	_, otherToken := createTestUser(t, app, "other", db.PermissionReadUser, db.PermissionWriteUser)
+	target, targetToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	for _, scope := range []db.TokenScope{db.TokenScopeResetPwd, db.TokenScopeResetPwd, db.TokenScopeActivation} {
+		_, err := app.models.Tokens.CreateToken(context.Background(), target.ID, time.Hour, scope)
+		assert.NoError(t, err)
+	}
+
+	countTokens := func(scope db.TokenScope) int {
+		var count int
+		err := app.models.DB.QueryRow(`
+			SELECT COUNT(*) FROM tokens t INNER JOIN scopes s ON t.scope_id = s.id
+			WHERE t.user_id = $1 AND s.name = $2`, target.ID, scope).Scan(&count)
+		assert.NoError(t, err)
+		return count
+	}
+
+	t.Run("Invalid scope", func(t *testing.T) {
+		for _, query := range []string{"", "?scope=token:unknown"} {
+			status, _, body := ts.do(t, http.MethodDelete, "/v1/admin/users/testuser/tokens"+query, adminToken.Plain, nil)
+			assert.Equal(t, http.StatusUnprocessableEntity, status)
+			assert.Contains(t, body["error"].(map[string]any)["fields"], "scope")
+		}
+	})
+
+	t.Run("Non-admin is rejected", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/admin/users/testuser/tokens?scope=token:resetpwd", otherToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, 2, countTokens(db.TokenScopeResetPwd))
+	})
+
+	t.Run("Only the given scope is revoked", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/admin/users/testuser/tokens?scope=token:resetpwd", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+
+		assert.Zero(t, countTokens(db.TokenScopeResetPwd))
+		assert.Equal(t, 1, countTokens(db.TokenScopeActivation))
+
+		_, err := app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, targetToken.Hash)
+		assert.NoError(t, err, "the user's sessions must survive")
+
+		var action string
+		err = app.models.DB.QueryRow("SELECT action FROM audit_log WHERE target_user_id = $1", target.ID).Scan(&action)
+		assert.NoError(t, err)
+		assert.Equal(t, string(db.AuditActionRevokeTokens), action)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestLockUserHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	_, otherToken := createTestUser(t, app, "other", db.PermissionReadUser)
+	target, targetToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	login := loginUserInput{Username: "testuser", Password: "Test1234!"}
+
+	t.Run("Non-admin is rejected", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/admin/users/testuser/lock", otherToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Locking revokes sessions and blocks login", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPost, "/v1/admin/users/testuser/lock", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, true, body["user"].(map[string]any)["locked"])
+
+		_, err := app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, targetToken.Hash)
+		assert.ErrorIs(t, err, db.ErrNotFound)
+
+		status, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", targetToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		status, _, body = ts.post(t, "/v1/users/authenticate", login)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, errCodeAccountLocked, body["error"].(map[string]any)["code"])
+
+		var actorID int
+		err = app.models.DB.QueryRow("SELECT actor_id FROM audit_log WHERE target_user_id = $1 AND action = $2", target.ID, db.AuditActionLock).Scan(&actorID)
+		assert.NoError(t, err)
+		assert.Equal(t, admin.ID, actorID)
+	})
+
+	t.Run("Unlocking restores login", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodDelete, "/v1/admin/users/testuser/lock", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, false, body["user"].(map[string]any)["locked"])
+
+		status, _, _ = ts.post(t, "/v1/users/authenticate", login)
+		assert.Equal(t, http.StatusOK, status)
+
+		var count int
+		err := app.models.DB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE target_user_id = $1 AND action = $2", target.ID, db.AuditActionUnlock).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/admin/users/unknown/lock", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestListExpiringSessionsHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	first, _ := createTestUser(t, app, "first", db.PermissionReadUser)
+	second, _ := createTestUser(t, app, "second", db.PermissionReadUser)
+
+	// the tokens issued by createTestUser expire in a day
+	expiring := map[int][]string{}
+	for _, tt := range []struct {
+		userID    int
+		expiresIn time.Duration
+		want      bool
+	}{
+		{userID: first.ID, expiresIn: 10 * time.Minute, want: true},
+		{userID: first.ID, expiresIn: 50 * time.Minute, want: true},
+		{userID: first.ID, expiresIn: 2 * time.Hour},
+		{userID: first.ID, expiresIn: -5 * time.Minute},
+		{userID: second.ID, expiresIn: 30 * time.Minute, want: true},
+	} {
+		token, err := app.models.Tokens.CreateToken(context.Background(), tt.userID, tt.expiresIn, db.TokenScopeAccess)
+		assert.NoError(t, err)
+
+		if tt.want {
+			expiring[tt.userID] = append(expiring[tt.userID], hex.EncodeToString(token.Hash))
+		}
+	}
+
+	_, err := app.models.Tokens.CreateToken(context.Background(), first.ID, 10*time.Minute, db.TokenScopeRefresh)
+	assert.NoError(t, err)
+	_, err = app.models.Tokens.CreateImpersonationToken(context.Background(), second.ID, admin.ID, 10*time.Minute)
+	assert.NoError(t, err)
+
+	t.Run("Within the window", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodGet, "/v1/admin/sessions/expiring?within=1h", adminToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "1h0m0s", body["within"])
+		assert.Equal(t, false, body["truncated"])
+
+		got := map[int][]string{}
+		for _, u := range body["users"].([]any) {
+			u := u.(map[string]any)
+			userID := int(u["user_id"].(float64))
+			for _, session := range u["sessions"].([]any) {
+				got[userID] = append(got[userID], session.(map[string]any)["id"].(string))
+			}
+		}
+
+		assert.Equal(t, expiring, got)
+	})
+
+	t.Run("Invalid window", func(t *testing.T) {
+		for _, within := range []string{"soon", "-1h", "0s"} {
+			status, _, _ := ts.do(t, http.MethodGet, "/v1/admin/sessions/expiring?within="+within, adminToken.Plain, nil)
+			assert.Equal(t, http.StatusUnprocessableEntity, status, within)
+		}
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAdmin(t *testing.T) {
+	app := newTestApplication(t)
+
+	t.Run("Valid input", func(t *testing.T) {
+		user, err := createAdmin(context.Background(), app.models, "admin", "admin@example.com", "Test1234!")
+		assert.NoError(t, err)
+		assert.True(t, user.Activated)
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), "admin")
+		assert.NoError(t, err)
+		assert.True(t, dbUser.Activated)
+		assert.Equal(t, "admin@example.com", dbUser.Email)
+
+		permissions, err := app.models.Permissions.Get(context.Background(), dbUser.ID)
+		assert.NoError(t, err)
+		assert.True(t, permissions.Include(db.PermissionAdminUser))
+		assert.True(t, permissions.Include(db.PermissionReadUser))
+		assert.True(t, permissions.Include(db.PermissionWriteUser))
+
+		_, err = createAdmin(context.Background(), app.models, "admin", "admin2@example.com", "Test1234!")
+		assert.ErrorIs(t, err, db.ErrDuplicateUsername)
+
+		t.Cleanup(func() {
+			err := cleanup(app)
+			assert.NoError(t, err)
+		})
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		_, err := createAdmin(context.Background(), app.models, "admin", "not-an-email", "weak")
+		assert.EqualError(t, err, "invalid admin user: email must be a valid email address; password must be 8-72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol")
+
+		_, err = app.models.Users.GetByUsername(context.Background(), "admin")
+		assert.ErrorIs(t, err, db.ErrNotFound)
+	})
+}
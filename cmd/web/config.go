@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	models "github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/joho/godotenv"
+)
+
+// configError lists every problem found in the configuration so that they can all be fixed at once.
+type configError struct {
+	problems []string
+	// reported holds the variables that already have a problem, range checks skip them
+	reported map[string]bool
+}
+
+func (e *configError) Error() string {
+	return "invalid configuration: " + strings.Join(e.problems, "; ")
+}
+
+func (e *configError) add(key, format string, args ...any) {
+	if e.reported == nil {
+		e.reported = map[string]bool{}
+	}
+
+	e.reported[key] = true
+	e.problems = append(e.problems, key+" "+fmt.Sprintf(format, args...))
+}
+
+// check reports a problem with key unless ok or key already has a problem.
+func (e *configError) check(ok bool, key, format string, args ...any) {
+	if !ok && !e.reported[key] {
+		e.add(key, format, args...)
+	}
+}
+
+// loadConfig layers the given env files, later files overriding earlier ones, under the
+// variables in environ, which override all files. Files that don't exist are skipped so a
+// deployment can be configured through the environment alone.
+func loadConfig(files []string, environ []string) (config, error) {
+	vars := map[string]string{}
+
+	for _, file := range files {
+		fileVars, err := godotenv.Read(file)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return config{}, fmt.Errorf("reading %s: %w", file, err)
+		}
+
+		for key, value := range fileVars {
+			vars[key] = value
+		}
+	}
+
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		vars[key] = value
+	}
+
+	var cfg config
+	cfgErr := &configError{}
+
+	err := env.ParseWithOptions(&cfg, env.Options{Environment: vars})
+	if err != nil {
+		var aggregate env.AggregateError
+		if !errors.As(err, &aggregate) {
+			return config{}, err
+		}
+
+		for _, err := range aggregate.Errors {
+			var (
+				notSet env.EnvVarIsNotSetError
+				empty  env.EmptyEnvVarError
+				parse  env.ParseError
+			)
+
+			switch {
+			case errors.As(err, &notSet):
+				cfgErr.add(notSet.Key, "must be set")
+			case errors.As(err, &empty):
+				cfgErr.add(empty.Key, "must not be empty")
+			case errors.As(err, &parse):
+				cfgErr.add(parse.Name, "has an invalid value: %v", parse.Err)
+			default:
+				cfgErr.problems = append(cfgErr.problems, err.Error())
+			}
+		}
+	}
+
+	cfg.validate(cfgErr)
+
+	if len(cfgErr.problems) > 0 {
+		return config{}, cfgErr
+	}
+
+	return cfg, nil
+}
+
+// validate checks the ranges the env tags can't express.
+func (cfg *config) validate(cfgErr *configError) {
+	_, port, err := net.SplitHostPort(cfg.Port)
+	cfgErr.check(err == nil, "PORT", "must be in the form [host]:port, got %q", cfg.Port)
+	if err == nil {
+		checkPort(cfgErr, "PORT", port)
+	}
+
+	baseURL, err := url.Parse(cfg.BaseURL)
+	cfgErr.check(err == nil && (baseURL.Scheme == "http" || baseURL.Scheme == "https") && baseURL.Host != "", "BASE_URL", "must be an absolute http or https URL, got %q", cfg.BaseURL)
+	checkLinkPath(cfgErr, "LINK_ACTIVATION_PATH", cfg.Links.ActivationPath)
+	checkLinkPath(cfgErr, "LINK_RESET_PASSWORD_PATH", cfg.Links.ResetPasswordPath)
+	checkLinkPath(cfgErr, "LINK_VERIFY_EMAIL_PATH", cfg.Links.VerifyEmailPath)
+	checkLinkPath(cfgErr, "LINK_EMAIL_ROLLBACK_PATH", cfg.Links.EmailRollbackPath)
+	for _, origin := range cfg.AllowedRedirectOrigins {
+		u, err := url.Parse(origin)
+		cfgErr.check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && (u.Path == "" || u.Path == "/") && u.User == nil && u.RawQuery == "" && u.Fragment == "",
+			"ALLOWED_REDIRECT_ORIGINS", "must only contain http or https origins, got %q", origin)
+	}
+
+	for flag, percent := range cfg.FeatureFlags {
+		cfgErr.check(slices.Contains(featureFlags, flag), "FEATURE_FLAGS", "must only contain known flags (%s), got %q", strings.Join(featureFlags, ", "), flag)
+		cfgErr.check(percent >= 0 && percent <= 100, "FEATURE_FLAGS", "must set percentages between 0 and 100, got %s=%d", flag, percent)
+	}
+
+	cfgErr.check((cfg.TLS.CertFile == "") == (cfg.TLS.KeyFile == ""), "TLS_CERT_FILE", "and TLS_KEY_FILE must be set together")
+	_, ok := tlsVersions[cfg.TLS.MinVersion]
+	cfgErr.check(ok, "TLS_MIN_VERSION", "must be \"1.2\" or \"1.3\", got %q", cfg.TLS.MinVersion)
+	cfgErr.check(len(cfg.TLS.CipherSuites) == 0 || cfg.TLS.MinVersion != "1.3", "TLS_CIPHER_SUITES", "has no effect with TLS_MIN_VERSION 1.3, TLS 1.3 cipher suites can't be configured")
+	for _, name := range cfg.TLS.CipherSuites {
+		_, ok := tls12CipherSuite(name)
+		cfgErr.check(ok, "TLS_CIPHER_SUITES", "contains an unsupported cipher suite %q", name)
+	}
+
+	checkPort(cfgErr, "DB_PORT", strconv.Itoa(cfg.DB.DB_PORT))
+	switch cfg.Mail.DryRun {
+	case "":
+		// the SMTP settings are only needed when emails are actually sent
+		cfgErr.check(cfg.Mail.Host != "", "SMTP_HOST", "must be set")
+		cfgErr.check(cfg.Mail.Port != 0, "SMTP_PORT", "must be set")
+		checkPort(cfgErr, "SMTP_PORT", strconv.Itoa(cfg.Mail.Port))
+		cfgErr.check(cfg.Mail.Username != "", "SMTP_USERNAME", "must be set")
+		cfgErr.check(cfg.Mail.Password != "", "SMTP_PASSWORD", "must be set")
+	case mailDryRunLog:
+	case mailDryRunFile:
+		cfgErr.check(cfg.Mail.DryRunDir != "", "MAIL_DRY_RUN_DIR", "must be set when MAIL_DRY_RUN is %q", mailDryRunFile)
+	default:
+		cfgErr.check(false, "MAIL_DRY_RUN", "must be %q, %q or empty, got %q", mailDryRunLog, mailDryRunFile, cfg.Mail.DryRun)
+	}
+
+	cfgErr.check(cfg.MaxBackgroundTasks >= 0, "MAX_BACKGROUND_TASKS", "must not be negative, got %d", cfg.MaxBackgroundTasks)
+	cfgErr.check(cfg.BackgroundQueueSize >= 0, "BACKGROUND_QUEUE_SIZE", "must not be negative, got %d", cfg.BackgroundQueueSize)
+	cfgErr.check(cfg.SlowRequestThreshold >= 0, "SLOW_REQUEST_THRESHOLD", "must not be negative, got %s", cfg.SlowRequestThreshold)
+
+	cfgErr.check(cfg.CORS.MaxAge >= 0, "CORS_MAX_AGE", "must not be negative, got %s", cfg.CORS.MaxAge)
+	// browsers refuse credentialed responses that allow any origin
+	cfgErr.check(!cfg.CORS.AllowCredentials || !slices.Contains(cfg.CORS.TrustedOrigins, "*"), "CORS_ALLOW_CREDENTIALS", "can't be combined with the \"*\" origin in CORS_TRUSTED_ORIGINS")
+
+	cfgErr.check(cfg.Metrics.RefreshInterval >= 0, "METRICS_REFRESH_INTERVAL", "must not be negative, got %s", cfg.Metrics.RefreshInterval)
+	cfgErr.check(cfg.Metrics.RefreshInterval == 0 || cfg.Metrics.Token != "", "METRICS_TOKEN", "must be set when METRICS_REFRESH_INTERVAL is positive")
+
+	if cfg.Tracing.Enabled {
+		switch cfg.Tracing.Exporter {
+		case tracingExporterOTLP:
+			_, port, err := net.SplitHostPort(cfg.Tracing.Endpoint)
+			cfgErr.check(err == nil, "TRACING_ENDPOINT", "must be in the form host:port, got %q", cfg.Tracing.Endpoint)
+			if err == nil {
+				checkPort(cfgErr, "TRACING_ENDPOINT", port)
+			}
+		case tracingExporterStdout:
+		default:
+			cfgErr.check(false, "TRACING_EXPORTER", "must be %q or %q, got %q", tracingExporterOTLP, tracingExporterStdout, cfg.Tracing.Exporter)
+		}
+		cfgErr.check(cfg.Tracing.SampleRatio >= 0 && cfg.Tracing.SampleRatio <= 1, "TRACING_SAMPLE_RATIO", "must be between 0 and 1, got %g", cfg.Tracing.SampleRatio)
+	}
+
+	cfgErr.check(cfg.DB.MaxOpenConns > 0, "DB_MAX_OPEN_CONNS", "must be positive, got %d", cfg.DB.MaxOpenConns)
+	cfgErr.check(cfg.DB.MaxIdleConns > 0, "DB_MAX_IDLE_CONNS", "must be positive, got %d", cfg.DB.MaxIdleConns)
+	cfgErr.check(cfg.DB.MaxIdleTime > 0, "DB_CONN_MAX_IDLE_TIME", "must be positive, got %s", cfg.DB.MaxIdleTime)
+
+	cfgErr.check(cfg.Auth.PasswordResetCooldown >= 0, "AUTH_PASSWORD_RESET_COOLDOWN", "must not be negative, got %s", cfg.Auth.PasswordResetCooldown)
+	cfgErr.check(cfg.Auth.UsernameRecoveryCooldown >= 0, "AUTH_USERNAME_RECOVERY_COOLDOWN", "must not be negative, got %s", cfg.Auth.UsernameRecoveryCooldown)
+	cfgErr.check(cfg.Auth.PasswordResetMode == passwordResetLink || cfg.Auth.PasswordResetMode == passwordResetOTP, "AUTH_PASSWORD_RESET_MODE", "must be %q or %q, got %q", passwordResetLink, passwordResetOTP, cfg.Auth.PasswordResetMode)
+	cfgErr.check(cfg.Auth.IdleTimeout >= 0, "AUTH_IDLE_TIMEOUT", "must not be negative, got %s", cfg.Auth.IdleTimeout)
+	cfgErr.check(cfg.Auth.LastUsedInterval > 0, "AUTH_LAST_USED_INTERVAL", "must be positive, got %s", cfg.Auth.LastUsedInterval)
+	// a token used within the idle timeout must never look idle because its last use wasn't written
+	cfgErr.check(cfg.Auth.IdleTimeout == 0 || cfg.Auth.LastUsedInterval < cfg.Auth.IdleTimeout, "AUTH_LAST_USED_INTERVAL", "must be shorter than AUTH_IDLE_TIMEOUT, got %s", cfg.Auth.LastUsedInterval)
+	cfgErr.check(cfg.Auth.MaxSessionLifetime > 0, "AUTH_MAX_SESSION_LIFETIME", "must be positive, got %s", cfg.Auth.MaxSessionLifetime)
+	cfgErr.check(cfg.Auth.EmailRollbackWindow > 0, "AUTH_EMAIL_ROLLBACK_WINDOW", "must be positive, got %s", cfg.Auth.EmailRollbackWindow)
+	cfgErr.check(cfg.Auth.ImpersonationTTL > 0, "AUTH_IMPERSONATION_TTL", "must be positive, got %s", cfg.Auth.ImpersonationTTL)
+	cfgErr.check(cfg.Auth.MaxActiveTokens >= 0, "AUTH_MAX_ACTIVE_TOKENS", "must not be negative, got %d", cfg.Auth.MaxActiveTokens)
+	cfgErr.check(cfg.Auth.PermissionLookupRetries >= 0, "AUTH_PERMISSION_LOOKUP_RETRIES", "must not be negative, got %d", cfg.Auth.PermissionLookupRetries)
+	cfgErr.check(cfg.Auth.PermissionLookupRetryDelay >= 0, "AUTH_PERMISSION_LOOKUP_RETRY_DELAY", "must not be negative, got %s", cfg.Auth.PermissionLookupRetryDelay)
+	cfgErr.check(cfg.Auth.MaxUsernameLength >= 3 && cfg.Auth.MaxUsernameLength <= models.UsernameLengthLimit, "AUTH_MAX_USERNAME_LENGTH", "must be between 3 and %d, got %d", models.UsernameLengthLimit, cfg.Auth.MaxUsernameLength)
+	cfgErr.check(cfg.Auth.MaxEmailLength >= 6 && cfg.Auth.MaxEmailLength <= models.EmailLengthLimit, "AUTH_MAX_EMAIL_LENGTH", "must be between 6 and %d, got %d", models.EmailLengthLimit, cfg.Auth.MaxEmailLength)
+
+	_, err = regexp.Compile(cfg.Auth.UsernamePattern)
+	cfgErr.check(err == nil, "AUTH_USERNAME_PATTERN", "is not a valid regular expression: %v", err)
+}
+
+func checkLinkPath(cfgErr *configError, key, value string) {
+	cfgErr.check(strings.HasPrefix(value, "/") && strings.Contains(value, linkTokenPlaceholder), key, "must start with / and contain %s, got %q", linkTokenPlaceholder, value)
+}
+
+func checkPort(cfgErr *configError, key, value string) {
+	port, err := strconv.Atoi(value)
+	cfgErr.check(err == nil && port >= 1 && port <= 65535, key, "must be between 1 and 65535, got %s", value)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validEnviron() []string {
+	return []string{
+		"PORT=:3000",
+		"ENV=test",
+		"DB_HOST=localhost",
+		"DB_PORT=5432",
+		"POSTGRES_USER=postgres",
+		"POSTGRES_PASSWORD=password",
+		"POSTGRES_DB=ums",
+		"DB_MAX_OPEN_CONNS=25",
+		"DB_MAX_IDLE_CONNS=25",
+		"DB_CONN_MAX_IDLE_TIME=15m",
+		"SMTP_HOST=localhost",
+		"SMTP_PORT=2525",
+		"SMTP_USERNAME=user",
+		"SMTP_PASSWORD=password",
+		"SMTP_SENDER=test@example.com",
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("Valid environment", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, ":3000", cfg.Port)
+		assert.Equal(t, 5432, cfg.DB.DB_PORT)
+	})
+
+	t.Run("Files are layered under the environment", func(t *testing.T) {
+		dir := t.TempDir()
+
+		base := filepath.Join(dir, ".env")
+		err := os.WriteFile(base, []byte("ENV=base\nLOG_LEVEL=DEBUG\nSMTP_SENDER=base@example.com\n"), 0o600)
+		assert.NoError(t, err)
+
+		local := filepath.Join(dir, ".env.local")
+		err = os.WriteFile(local, []byte("ENV=local\nSMTP_SENDER=local@example.com\n"), 0o600)
+		assert.NoError(t, err)
+
+		environ := []string{}
+		for _, kv := range validEnviron() {
+			if kv != "ENV=test" && kv != "SMTP_SENDER=test@example.com" {
+				environ = append(environ, kv)
+			}
+		}
+		environ = append(environ, "SMTP_SENDER=env@example.com")
+
+		cfg, err := loadConfig([]string{base, local, filepath.Join(dir, "missing.env")}, environ)
+		assert.NoError(t, err)
+		assert.Equal(t, "local", cfg.Env)
+		assert.Equal(t, "DEBUG", cfg.LogLevel.String())
+		assert.Equal(t, "env@example.com", cfg.Mail.Sender)
+	})
+
+	t.Run("Missing fields are reported together", func(t *testing.T) {
+		_, err := loadConfig(nil, []string{"PORT=:3000", "ENV=test", "DB_PORT=5432"})
+
+		var cfgErr *configError
+		if !errors.As(err, &cfgErr) {
+			t.Fatalf("expected a configError, got %v", err)
+		}
+
+		for _, problem := range []string{
+			"DB_HOST must be set",
+			"POSTGRES_USER must be set",
+			"DB_MAX_OPEN_CONNS must be set",
+			"SMTP_HOST must be set",
+			"SMTP_PORT must be set",
+		} {
+			assert.Contains(t, cfgErr.problems, problem)
+		}
+
+		// a missing variable is only reported once, not again by the range checks
+		assert.NotContains(t, err.Error(), "DB_MAX_OPEN_CONNS must be positive")
+		assert.NotContains(t, err.Error(), "must be between")
+	})
+
+	t.Run("Out of range values are reported together", func(t *testing.T) {
+		environ := append(validEnviron(), "PORT=:0", "DB_PORT=70000", "DB_MAX_OPEN_CONNS=0", "AUTH_MAX_ACTIVE_TOKENS=-1", "AUTH_USERNAME_PATTERN=^[a-z", "AUTH_IDLE_TIMEOUT=30s", "BASE_URL=app.example.com", "LINK_ACTIVATION_PATH=/activate")
+
+		_, err := loadConfig(nil, environ)
+
+		var cfgErr *configError
+		if !errors.As(err, &cfgErr) {
+			t.Fatalf("expected a configError, got %v", err)
+		}
+
+		assert.ElementsMatch(t, []string{
+			"PORT must be between 1 and 65535, got 0",
+			"DB_PORT must be between 1 and 65535, got 70000",
+			`BASE_URL must be an absolute http or https URL, got "app.example.com"`,
+			`LINK_ACTIVATION_PATH must start with / and contain {token}, got "/activate"`,
+			"DB_MAX_OPEN_CONNS must be positive, got 0",
+			"AUTH_LAST_USED_INTERVAL must be shorter than AUTH_IDLE_TIMEOUT, got 1m0s",
+			"AUTH_MAX_ACTIVE_TOKENS must not be negative, got -1",
+			"AUTH_USERNAME_PATTERN is not a valid regular expression: error parsing regexp: missing closing ]: `[a-z`",
+		}, cfgErr.problems)
+	})
+
+	t.Run("SMTP settings are optional in dry run mode", func(t *testing.T) {
+		environ := []string{}
+		for _, kv := range validEnviron() {
+			if !strings.HasPrefix(kv, "SMTP_") || strings.HasPrefix(kv, "SMTP_SENDER=") {
+				environ = append(environ, kv)
+			}
+		}
+
+		_, err := loadConfig(nil, environ)
+		assert.ErrorContains(t, err, "SMTP_HOST must be set")
+
+		cfg, err := loadConfig(nil, append(environ, "MAIL_DRY_RUN=file"))
+		assert.NoError(t, err)
+		assert.Equal(t, "tmp/mail", cfg.Mail.DryRunDir)
+
+		_, err = loadConfig(nil, append(environ, "MAIL_DRY_RUN=smtp"))
+		assert.ErrorContains(t, err, `MAIL_DRY_RUN must be "log", "file" or empty, got "smtp"`)
+	})
+	t.Run("CORS credentials can't be combined with any origin", func(t *testing.T) {
+		cfg, err := loadConfig(nil, append(validEnviron(), "CORS_TRUSTED_ORIGINS=https://app.example.com", "CORS_ALLOW_CREDENTIALS=true", "CORS_MAX_AGE=10m"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://app.example.com"}, cfg.CORS.TrustedOrigins)
+		assert.True(t, cfg.CORS.AllowCredentials)
+
+		_, err = loadConfig(nil, append(validEnviron(), "CORS_TRUSTED_ORIGINS=*", "CORS_ALLOW_CREDENTIALS=true"))
+		assert.ErrorContains(t, err, `CORS_ALLOW_CREDENTIALS can't be combined with the "*" origin in CORS_TRUSTED_ORIGINS`)
+
+		_, err = loadConfig(nil, append(validEnviron(), "CORS_MAX_AGE=-1s"))
+		assert.ErrorContains(t, err, "CORS_MAX_AGE must not be negative, got -1s")
+	})
+	t.Run("Password reset mode", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, passwordResetLink, cfg.Auth.PasswordResetMode)
+
+		cfg, err = loadConfig(nil, append(validEnviron(), "AUTH_PASSWORD_RESET_MODE=otp"))
+		assert.NoError(t, err)
+		assert.Equal(t, passwordResetOTP, cfg.Auth.PasswordResetMode)
+
+		_, err = loadConfig(nil, append(validEnviron(), "AUTH_PASSWORD_RESET_MODE=sms"))
+		assert.ErrorContains(t, err, `AUTH_PASSWORD_RESET_MODE must be "link" or "otp", got "sms"`)
+	})
+	t.Run("Max session lifetime", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, 7*24*time.Hour, cfg.Auth.MaxSessionLifetime)
+
+		_, err = loadConfig(nil, append(validEnviron(), "AUTH_MAX_SESSION_LIFETIME=0s"))
+		assert.ErrorContains(t, err, "AUTH_MAX_SESSION_LIFETIME must be positive, got 0s")
+	})
+	t.Run("Email rollback window", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, 7*24*time.Hour, cfg.Auth.EmailRollbackWindow)
+
+		_, err = loadConfig(nil, append(validEnviron(), "AUTH_EMAIL_ROLLBACK_WINDOW=-1h"))
+		assert.ErrorContains(t, err, "AUTH_EMAIL_ROLLBACK_WINDOW must be positive, got -1h0m0s")
+	})
+	t.Run("Max username and email length", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, 25, cfg.Auth.MaxUsernameLength)
+		assert.Equal(t, 254, cfg.Auth.MaxEmailLength)
+
+		_, err = loadConfig(nil, append(validEnviron(), "AUTH_MAX_USERNAME_LENGTH=65", "AUTH_MAX_EMAIL_LENGTH=255"))
+		assert.ErrorContains(t, err, "AUTH_MAX_USERNAME_LENGTH must be between 3 and 64, got 65")
+		assert.ErrorContains(t, err, "AUTH_MAX_EMAIL_LENGTH must be between 6 and 254, got 255")
+	})
+	t.Run("Account deletion", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.False(t, cfg.Auth.AccountDeletion)
+		assert.False(t, cfg.Auth.PurgeAuditOnDeletion)
+
+		cfg, err = loadConfig(nil, append(validEnviron(), "AUTH_ACCOUNT_DELETION=true", "AUTH_PURGE_AUDIT_ON_DELETION=true"))
+		assert.NoError(t, err)
+		assert.True(t, cfg.Auth.AccountDeletion)
+		assert.True(t, cfg.Auth.PurgeAuditOnDeletion)
+	})
+	t.Run("Username recovery cooldown", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, 5*time.Minute, cfg.Auth.UsernameRecoveryCooldown)
+
+		_, err = loadConfig(nil, append(validEnviron(), "AUTH_USERNAME_RECOVERY_COOLDOWN=-1m"))
+		assert.ErrorContains(t, err, "AUTH_USERNAME_RECOVERY_COOLDOWN must not be negative, got -1m0s")
+	})
+	t.Run("Permission lookup retries", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Zero(t, cfg.Auth.PermissionLookupRetries)
+		assert.Equal(t, 50*time.Millisecond, cfg.Auth.PermissionLookupRetryDelay)
+
+		_, err = loadConfig(nil, append(validEnviron(), "AUTH_PERMISSION_LOOKUP_RETRIES=-1"))
+		assert.ErrorContains(t, err, "AUTH_PERMISSION_LOOKUP_RETRIES must not be negative, got -1")
+	})
+	t.Run("Allowed redirect origins", func(t *testing.T) {
+		cfg, err := loadConfig(nil, append(validEnviron(), "ALLOWED_REDIRECT_ORIGINS=https://m.example.com,http://localhost:8080"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://m.example.com", "http://localhost:8080"}, cfg.AllowedRedirectOrigins)
+
+		_, err = loadConfig(nil, append(validEnviron(), "ALLOWED_REDIRECT_ORIGINS=https://m.example.com/app"))
+		assert.ErrorContains(t, err, `ALLOWED_REDIRECT_ORIGINS must only contain http or https origins, got "https://m.example.com/app"`)
+	})
+	t.Run("Feature flags", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"secondary_emails": 100}, cfg.FeatureFlags)
+
+		cfg, err = loadConfig(nil, append(validEnviron(), "FEATURE_FLAGS=secondary_emails=25"))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"secondary_emails": 25}, cfg.FeatureFlags)
+
+		_, err = loadConfig(nil, append(validEnviron(), "FEATURE_FLAGS=secondary_email=25"))
+		assert.ErrorContains(t, err, `FEATURE_FLAGS must only contain known flags (secondary_emails), got "secondary_email"`)
+
+		_, err = loadConfig(nil, append(validEnviron(), "FEATURE_FLAGS=secondary_emails=150"))
+		assert.ErrorContains(t, err, "FEATURE_FLAGS must set percentages between 0 and 100, got secondary_emails=150")
+	})
+	t.Run("Metrics need a scrape token", func(t *testing.T) {
+		cfg, err := loadConfig(nil, append(validEnviron(), "METRICS_REFRESH_INTERVAL=1m", "METRICS_TOKEN=secret"))
+		assert.NoError(t, err)
+		assert.Equal(t, "secret", cfg.Metrics.Token)
+
+		_, err = loadConfig(nil, append(validEnviron(), "METRICS_REFRESH_INTERVAL=1m"))
+		assert.ErrorContains(t, err, "METRICS_TOKEN must be set when METRICS_REFRESH_INTERVAL is positive")
+	})
+	t.Run("Tracing", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.False(t, cfg.Tracing.Enabled)
+		assert.Equal(t, "otlp", cfg.Tracing.Exporter)
+		assert.Equal(t, "localhost:4318", cfg.Tracing.Endpoint)
+		assert.Equal(t, 1.0, cfg.Tracing.SampleRatio)
+
+		// the settings are only checked when tracing is enabled
+		_, err = loadConfig(nil, append(validEnviron(), "TRACING_EXPORTER=zipkin"))
+		assert.NoError(t, err)
+
+		_, err = loadConfig(nil, append(validEnviron(), "TRACING_ENABLED=true", "TRACING_EXPORTER=stdout", "TRACING_SAMPLE_RATIO=0.1"))
+		assert.NoError(t, err)
+
+		_, err = loadConfig(nil, append(validEnviron(), "TRACING_ENABLED=true", "TRACING_EXPORTER=zipkin", "TRACING_SAMPLE_RATIO=2"))
+
+		var cfgErr *configError
+		if !errors.As(err, &cfgErr) {
+			t.Fatalf("expected a configError, got %v", err)
+		}
+
+		assert.ElementsMatch(t, []string{
+			`TRACING_EXPORTER must be "otlp" or "stdout", got "zipkin"`,
+			"TRACING_SAMPLE_RATIO must be between 0 and 1, got 2",
+		}, cfgErr.problems)
+
+		_, err = loadConfig(nil, append(validEnviron(), "TRACING_ENABLED=true", "TRACING_ENDPOINT=http://collector:4318"))
+		assert.ErrorContains(t, err, `TRACING_ENDPOINT must be in the form host:port, got "http://collector:4318"`)
+	})
+	t.Run("Max background tasks", func(t *testing.T) {
+		cfg, err := loadConfig(nil, validEnviron())
+		assert.NoError(t, err)
+		assert.Equal(t, 32, cfg.MaxBackgroundTasks)
+		assert.Equal(t, 1024, cfg.BackgroundQueueSize)
+
+		_, err = loadConfig(nil, append(validEnviron(), "MAX_BACKGROUND_TASKS=-1"))
+		assert.ErrorContains(t, err, "MAX_BACKGROUND_TASKS must not be negative, got -1")
+
+		_, err = loadConfig(nil, append(validEnviron(), "BACKGROUND_QUEUE_SIZE=-1"))
+		assert.ErrorContains(t, err, "BACKGROUND_QUEUE_SIZE must not be negative, got -1")
+	})
+	t.Run("TLS policy is validated", func(t *testing.T) {
+		cfg, err := loadConfig(nil, append(validEnviron(), "TLS_MIN_VERSION=1.3"))
+		assert.NoError(t, err)
+		assert.Equal(t, "1.3", cfg.TLS.MinVersion)
+
+		_, err = loadConfig(nil, append(validEnviron(), "TLS_MIN_VERSION=1.1", "TLS_CERT_FILE=cert.pem"))
+
+		var cfgErr *configError
+		if !errors.As(err, &cfgErr) {
+			t.Fatalf("expected a configError, got %v", err)
+		}
+
+		assert.ElementsMatch(t, []string{
+			"TLS_CERT_FILE and TLS_KEY_FILE must be set together",
+			`TLS_MIN_VERSION must be "1.2" or "1.3", got "1.1"`,
+		}, cfgErr.problems)
+
+		_, err = loadConfig(nil, append(validEnviron(), "TLS_CIPHER_SUITES=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_AES_128_GCM_SHA256"))
+		assert.ErrorContains(t, err, `TLS_CIPHER_SUITES contains an unsupported cipher suite "TLS_AES_128_GCM_SHA256"`)
+
+		_, err = loadConfig(nil, append(validEnviron(), "TLS_MIN_VERSION=1.3", "TLS_CIPHER_SUITES=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"))
+		assert.ErrorContains(t, err, "TLS_CIPHER_SUITES has no effect with TLS_MIN_VERSION 1.3")
+	})
+}
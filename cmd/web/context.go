@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
 
 	"github.com/sushihentaime/user-management-service/internal/db"
@@ -9,17 +10,88 @@ import (
 
 type contextKey string
 
-const userContextKey contextKey = "user"
+const (
+	userContextKey   contextKey = "user"
+	loggerContextKey contextKey = "logger"
+)
+
+// Event labels attached to log lines under the "event" key so that security relevant
+// actions can be searched for regardless of the message wording.
+const (
+	eventUserRegistered            = "user_registered"
+	eventRegistrationDuplicate     = "registration_duplicate_email"
+	eventUserActivated             = "user_activated"
+	eventLoginSuccess              = "login_success"
+	eventLoginFailure              = "login_failure"
+	eventLoginThrottled            = "login_throttled"
+	eventLoginLocked               = "login_locked"
+	eventTokenRefresh              = "token_refresh"
+	eventTokenRefreshRejected      = "token_refresh_rejected"
+	eventTokenExtended             = "token_extended"
+	eventLogout                    = "logout"
+	eventPasswordResetSent         = "password_reset_requested"
+	eventPasswordResetThrottled    = "password_reset_throttled"
+	eventPasswordResetOTPThrottled = "password_reset_otp_throttled"
+	eventUsernameReminderSent      = "username_reminder_sent"
+	eventUsernameThrottled         = "username_reminder_throttled"
+	eventPasswordChanged           = "password_changed"
+	eventSecurityQuestionsSet      = "security_questions_set"
+	eventRecoverySuccess           = "recovery_success"
+	eventRecoveryFailure           = "recovery_failure"
+	eventRecoveryThrottled         = "recovery_throttled"
+	eventAccountUpdated            = "account_updated"
+	eventAccountDeleted            = "account_deleted"
+	eventEmailRolledBack           = "email_rolled_back"
+	eventEmailAdded                = "email_added"
+	eventEmailVerified             = "email_verified"
+	eventEmailRemoved              = "email_removed"
+	eventEmailPromoted             = "email_promoted"
+	eventUserStatusChanged         = "user_status_changed"
+	eventUserLocked                = "user_locked"
+	eventUserUnlocked              = "user_unlocked"
+	eventImpersonationStarted      = "impersonation_started"
+	eventImpersonationsEnded       = "impersonations_ended"
+	eventImpersonationRejected     = "impersonation_rejected"
+	eventPermissionsGranted        = "permissions_granted"
+	eventTokensRevoked             = "tokens_revoked"
+)
 
 func (app *application) createUserContext(r *http.Request, user *db.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
 
+// getUserContext returns the user set by authenticate. It never returns nil, a request that didn't
+// pass through authenticate is treated as anonymous so that handlers can't panic on it.
 func (app *application) getUserContext(r *http.Request) *db.User {
 	user, ok := r.Context().Value(userContextKey).(*db.User)
-	if !ok {
-		return nil
+	if !ok || user == nil {
+		return db.AnonymousUser
 	}
 	return user
 }
+
+func (app *application) createLoggerContext(r *http.Request, logger *slog.Logger) *http.Request {
+	ctx := context.WithValue(r.Context(), loggerContextKey, logger)
+	return r.WithContext(ctx)
+}
+
+// loggerFor returns the request scoped logger, carrying the request's method and URI
+// and, once the request is authenticated, the user_id of the caller and the impersonator_id
+// of the admin acting as them.
+func (app *application) loggerFor(r *http.Request) *slog.Logger {
+	logger, ok := r.Context().Value(loggerContextKey).(*slog.Logger)
+	if !ok {
+		logger = app.logger
+	}
+
+	if user := app.getUserContext(r); user != nil && !user.IsAnonymous() {
+		logger = logger.With("user_id", user.ID)
+
+		if user.ImpersonatorID != 0 {
+			logger = logger.With("impersonator_id", user.ImpersonatorID)
+		}
+	}
+
+	return logger
+}
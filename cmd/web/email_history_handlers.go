@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/validator"
+	"github.com/sushihentaime/user-management-service/pkg/jsonParser"
+)
+
+type rollbackEmailInput struct {
+	Email string `json:"email" validate:"required"`
+}
+
+// emailRollbackSince is the oldest change that can still be rolled back.
+func (app *application) emailRollbackSince() time.Time {
+	return time.Now().Add(-app.config.Auth.EmailRollbackWindow)
+}
+
+// listEmailHistoryHandler returns the authenticated user's previous verified email addresses
+// that can still be rolled back to, newest first.
+func (app *application) listEmailHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	changes, err := app.models.EmailHistory.GetForUser(r.Context(), user.ID, app.emailRollbackSince())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"email_history": changes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// rollbackEmailHandler restores the previous verified email address whose rollback token, mailed
+// to that address when it was replaced, is in the request body. It needs no session, the account
+// may be in the hands of whoever changed the address.
+func (app *application) rollbackEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input tokenInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token := &db.Token{
+		Plain: input.Token,
+	}
+
+	if token.ValidateToken(); !token.Validator.Valid() {
+		app.failedValidationResponse(w, r, token.Validator.Errors)
+		return
+	}
+
+	app.rollbackEmail(w, r, 0, map[string]string{"token": "invalid or expired rollback token"}, func(models *db.Models) (int, error) {
+		return models.EmailHistory.RollbackWithToken(r.Context(), db.HashToken(token.Plain), app.emailRollbackSince())
+	})
+}
+
+// adminRollbackEmailHandler restores one of the previous verified email addresses of the user
+// named in the URL, for accounts whose owner lost access to them.
+func (app *application) adminRollbackEmailHandler(w http.ResponseWriter, r *http.Request) {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	var input rollbackEmailInput
+
+	err = jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	admin := app.getUserContext(r)
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	notFound := map[string]string{"email": "is not a previous email address of the account within the rollback window"}
+
+	app.rollbackEmail(w, r, admin.ID, notFound, func(models *db.Models) (int, error) {
+		return dbUser.ID, models.EmailHistory.Rollback(r.Context(), dbUser.ID, input.Email, app.emailRollbackSince())
+	})
+}
+
+// rollbackEmail calls rollback, which restores a previous email address as the user's verified
+// email and returns the user's ID, and revokes the user's sessions, which may belong to whoever
+// changed it, in one transaction. notFound is the response when there is nothing to restore.
+// actorID is the admin rolling back, zero when users do it themselves.
+func (app *application) rollbackEmail(w http.ResponseWriter, r *http.Request, actorID int, notFound map[string]string, rollback func(models *db.Models) (int, error)) {
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
+
+	userID, err := rollback(models)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.failedValidationResponse(w, r, notFound)
+		case errors.Is(err, db.ErrDuplicateEmail):
+			app.failedValidationResponse(w, r, map[string]string{"email": "a user with this email address already exists"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the activation tokens were sent to the address being replaced
+	err = models.Tokens.DeleteAllForUser(r.Context(), userID, db.TokenScopeAccess, db.TokenScopeRefresh, db.TokenScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if actorID != 0 {
+		err = models.Audit.Insert(r.Context(), &db.AuditEvent{ActorID: actorID, TargetUserID: userID, Action: db.AuditActionEmailRollback})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("email rolled back", "event", eventEmailRolledBack, "target_user_id", userID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "email address restored, all sessions have been revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailRollback(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, adminToken := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser, db.PermissionWriteUser)
+
+	// changeEmail returns the rollback token mailed to the replaced address
+	changeEmail := func(t *testing.T, token *db.Token, email string) string {
+		status, _, _ := ts.do(t, http.MethodPatch, "/v1/users/account/testuser", token.Plain, map[string]any{"email": email})
+		assert.Equal(t, http.StatusOK, status)
+
+		app.wg.Wait()
+
+		var rollbackToken string
+		for _, sent := range app.mailer.(*recordingMailer).Sent() {
+			if sent.templateFile == "email_changed.html" {
+				assert.Equal(t, user.Email, sent.recipient)
+				rollbackToken = sent.data.(map[string]any)["rollbackToken"].(string)
+			}
+		}
+		assert.NotEmpty(t, rollbackToken)
+
+		return rollbackToken
+	}
+
+	history := func(t *testing.T, token *db.Token) []any {
+		status, _, body := ts.do(t, http.MethodGet, "/v1/users/email-history", token.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		return body["email_history"].([]any)
+	}
+
+	var rollbackToken string
+
+	t.Run("Changes are recorded", func(t *testing.T) {
+		rollbackToken = changeEmail(t, accessToken, "attacker@example.com")
+
+		changes := history(t, accessToken)
+		assert.Len(t, changes, 1)
+		assert.Equal(t, user.Email, changes[0].(map[string]any)["email"])
+		assert.NotEmpty(t, changes[0].(map[string]any)["changed_at"])
+	})
+
+	t.Run("Unknown token", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPost, "/v1/users/email-history/rollback", "", tokenInput{Token: "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Contains(t, body["error"].(map[string]any)["fields"], "token")
+	})
+
+	t.Run("Rollback within the window", func(t *testing.T) {
+		// the link works without a session, whoever changed the address may hold the account
+		status, _, body := ts.do(t, http.MethodPost, "/v1/users/email-history/rollback", "", tokenInput{Token: rollbackToken})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "email address restored, all sessions have been revoked", body["message"])
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), user.Username)
+		assert.NoError(t, err)
+		assert.Equal(t, user.Email, dbUser.Email)
+		assert.True(t, dbUser.Activated)
+
+		status, _, _ = ts.do(t, http.MethodGet, "/v1/users/email-history", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status, "the sessions must be revoked")
+
+		accessToken, err = app.models.Tokens.CreateToken(context.Background(), user.ID, db.AuthTokenTime, db.TokenScopeAccess)
+		assert.NoError(t, err)
+		assert.Empty(t, history(t, accessToken))
+
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/email-history/rollback", "", tokenInput{Token: rollbackToken})
+		assert.Equal(t, http.StatusUnprocessableEntity, status, "the token must be single use")
+	})
+
+	t.Run("Rollback by an admin", func(t *testing.T) {
+		changeEmail(t, accessToken, "attacker@example.com")
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/admin/users/testuser/email/rollback", adminToken.Plain, rollbackEmailInput{Email: user.Email})
+		assert.Equal(t, http.StatusOK, status)
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), user.Username)
+		assert.NoError(t, err)
+		assert.Equal(t, user.Email, dbUser.Email)
+
+		var count int
+		err = app.models.DB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE target_user_id = $1 AND action = $2", user.ID, db.AuditActionEmailRollback).Scan(&count)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		accessToken, err = app.models.Tokens.CreateToken(context.Background(), user.ID, db.AuthTokenTime, db.TokenScopeAccess)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Promoting a secondary address can be rolled back", func(t *testing.T) {
+		_, err := app.models.DB.Exec("INSERT INTO user_emails (user_id, email, verified) VALUES ($1, $2, TRUE)", user.ID, "attacker@example.com")
+		assert.NoError(t, err)
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/emails/attacker@example.com/primary", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+
+		app.wg.Wait()
+
+		var rollbackToken string
+		for _, sent := range app.mailer.(*recordingMailer).Sent() {
+			if sent.templateFile == "email_changed.html" {
+				assert.Equal(t, user.Email, sent.recipient)
+				rollbackToken = sent.data.(map[string]any)["rollbackToken"].(string)
+			}
+		}
+
+		changes := history(t, accessToken)
+		if assert.Len(t, changes, 1) {
+			assert.Equal(t, user.Email, changes[0].(map[string]any)["email"])
+		}
+
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/email-history/rollback", "", tokenInput{Token: rollbackToken})
+		assert.Equal(t, http.StatusOK, status)
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), user.Username)
+		assert.NoError(t, err)
+		assert.Equal(t, user.Email, dbUser.Email)
+
+		var secondary int
+		err = app.models.DB.QueryRow("SELECT COUNT(*) FROM user_emails WHERE user_id = $1", user.ID).Scan(&secondary)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, secondary, "the restored address must leave the secondary addresses")
+
+		accessToken, err = app.models.Tokens.CreateToken(context.Background(), user.ID, db.AuthTokenTime, db.TokenScopeAccess)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Unknown address", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPost, "/v1/admin/users/testuser/email/rollback", adminToken.Plain, rollbackEmailInput{Email: "other@example.com"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Contains(t, body["error"].(map[string]any)["fields"], "email")
+	})
+
+	t.Run("Rollback after the window", func(t *testing.T) {
+		rollbackToken := changeEmail(t, accessToken, "attacker@example.com")
+
+		_, err := app.models.DB.Exec("UPDATE email_history SET changed_at = $1 WHERE user_id = $2", time.Now().Add(-app.config.Auth.EmailRollbackWindow-time.Minute), user.ID)
+		assert.NoError(t, err)
+
+		assert.Empty(t, history(t, accessToken))
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/email-history/rollback", "", tokenInput{Token: rollbackToken})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
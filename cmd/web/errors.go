@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -16,8 +23,77 @@ func (app *application) logError(r *http.Request, err error) {
 	app.logger.Error(errMsg, "method", method, "url", url, "stack", string(debug))
 }
 
-func (app *application) writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	err := app.writeJSON(w, status, envelope{"error": message}, nil)
+// Error codes are part of the API contract, clients are expected to branch on
+// them rather than on the human readable message.
+const (
+	errCodeServerError              = "server_error"
+	errCodeBadRequest               = "bad_request"
+	errCodeValidationFailed         = "validation_failed"
+	errCodeNotFound                 = "not_found"
+	errCodeMethodNotAllowed         = "method_not_allowed"
+	errCodeInvalidCredentials       = "invalid_credentials"
+	errCodeInvalidToken             = "invalid_token"
+	errCodeAuthenticationRequired   = "authentication_required"
+	errCodeForbidden                = "forbidden"
+	errCodeAccountLocked            = "account_locked"
+	errCodeInvalidRefreshToken      = "invalid_refresh_token"
+	errCodeReauthenticationRequired = "reauthentication_required"
+	errCodeSessionExpired           = "session_expired"
+	errCodeEditConflict             = "edit_conflict"
+	errCodeRateLimited              = "rate_limited"
+	errCodeInvalidCSRFToken         = "invalid_csrf_token"
+	errCodeHTTPSRequired            = "https_required"
+)
+
+// apiError is the body of every error response, written under the "error" key.
+type apiError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// problemDetails is the RFC 7807 representation of an apiError, sent to clients asking for
+// application/problem+json. The error code and invalid fields are kept as extension members.
+type problemDetails struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail"`
+	Instance string            `json:"instance,omitempty"`
+	Code     string            `json:"code"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+const problemJSONContentType = "application/problem+json"
+
+// acceptsProblemJSON reports whether the Accept header of the request lists
+// application/problem+json, in which case errors are written in that format.
+func acceptsProblemJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil || mediaType != problemJSONContentType {
+			continue
+		}
+
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func (app *application) writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, apiErr apiError) {
+	w.Header().Add("Vary", "Accept")
+
+	var err error
+	if acceptsProblemJSON(r) {
+		err = writeProblem(w, r, status, apiErr)
+	} else {
+		err = app.writeJSON(w, status, envelope{"error": apiErr}, nil)
+	}
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -25,38 +101,134 @@ func (app *application) writeErrorResponse(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// writeProblem writes apiErr as RFC 7807 problem details. There is no documentation page per
+// error, so the type is "about:blank" and the title the standard status text.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, apiErr apiError) error {
+	problem := problemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   apiErr.Message,
+		Instance: r.URL.Path,
+		Code:     apiErr.Code,
+		Fields:   apiErr.Fields,
+	}
+
+	res, err := json.MarshalIndent(problem, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	res = append(res, '\n')
+
+	w.Header().Set("Content-Type", problemJSONContentType)
+	w.WriteHeader(status)
+	w.Write(res)
+
+	return nil
+}
+
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
-	// message := "the server encountered a problem and could not process your request"
-	app.writeErrorResponse(w, r, http.StatusInternalServerError, err)
+
+	message := "the server encountered a problem and could not process your request"
+	app.writeErrorResponse(w, r, http.StatusInternalServerError, apiError{Code: errCodeServerError, Message: message})
 }
 
 func (app *application) badRequestErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.writeErrorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.writeErrorResponse(w, r, http.StatusBadRequest, apiError{Code: errCodeBadRequest, Message: err.Error()})
 }
 
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.writeErrorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	message := "the request contains invalid fields"
+	app.writeErrorResponse(w, r, http.StatusUnprocessableEntity, apiError{Code: errCodeValidationFailed, Message: message, Fields: errors})
+}
+
+func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested resource could not be found"
+	app.writeErrorResponse(w, r, http.StatusNotFound, apiError{Code: errCodeNotFound, Message: message})
+}
+
+// methodNotAllowedResponse is the router's MethodNotAllowed handler, the router has already set the
+// Allow header.
+func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
+	app.writeErrorResponse(w, r, http.StatusMethodNotAllowed, apiError{Code: errCodeMethodNotAllowed, Message: message})
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.writeErrorResponse(w, r, http.StatusUnauthorized, message)
+	app.writeErrorResponse(w, r, http.StatusUnauthorized, apiError{Code: errCodeInvalidCredentials, Message: message})
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "you must be authenticated to access this resource"
+	app.writeErrorResponse(w, r, http.StatusUnauthorized, apiError{Code: errCodeAuthenticationRequired, Message: message})
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.writeErrorResponse(w, r, http.StatusForbidden, message)
+	app.writeErrorResponse(w, r, http.StatusForbidden, apiError{Code: errCodeInvalidToken, Message: message})
 }
 
 func (app *application) unauthorizedActionResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you do not have permission to perform this action"
-	app.writeErrorResponse(w, r, http.StatusForbidden, message)
+	app.writeErrorResponse(w, r, http.StatusForbidden, apiError{Code: errCodeForbidden, Message: message})
 }
 
 func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unknown or invalid refresh token"
-	app.writeErrorResponse(w, r, http.StatusUnauthorized, message)
+	app.writeErrorResponse(w, r, http.StatusUnauthorized, apiError{Code: errCodeInvalidRefreshToken, Message: message})
+}
+
+// reauthenticationRequiredResponse follows the step-up challenge of RFC 9470 so
+// that clients know to ask the user for their credentials again.
+func (app *application) reauthenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_user_authentication", max_age=%d`, int(app.config.Auth.FreshAuthWindow.Seconds())))
+
+	message := "this action requires a recent login, please authenticate again"
+	app.writeErrorResponse(w, r, http.StatusUnauthorized, apiError{Code: errCodeReauthenticationRequired, Message: message})
+}
+
+func (app *application) sessionExpiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the session has reached its maximum lifetime, please authenticate again"
+	app.writeErrorResponse(w, r, http.StatusUnauthorized, apiError{Code: errCodeSessionExpired, Message: message})
+}
+
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your account has been locked, please contact support"
+	app.writeErrorResponse(w, r, http.StatusForbidden, apiError{Code: errCodeAccountLocked, Message: message})
+}
+
+func (app *application) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "missing or invalid CSRF token"
+	app.writeErrorResponse(w, r, http.StatusForbidden, apiError{Code: errCodeInvalidCSRFToken, Message: message})
+}
+
+func (app *application) httpsRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this API must be accessed over HTTPS"
+	app.writeErrorResponse(w, r, http.StatusBadRequest, apiError{Code: errCodeHTTPSRequired, Message: message})
+}
+
+func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has changed, please retry"
+	app.writeErrorResponse(w, r, http.StatusConflict, apiError{Code: errCodeEditConflict, Message: message})
+}
+
+// rateLimitResponse is used for every 429, Retry-After carries the remaining
+// window rounded up to whole seconds so that clients never retry too early.
+func (app *application) rateLimitResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	message := "too many requests, please try again later"
+	app.writeErrorResponse(w, r, http.StatusTooManyRequests, apiError{Code: errCodeRateLimited, Message: message})
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponses(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	testCases := []struct {
+		name       string
+		respond    func(w http.ResponseWriter, r *http.Request)
+		wantStatus int
+		wantCode   string
+		wantFields bool
+	}{
+		{
+			name: "server error",
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				app.serverErrorResponse(w, r, errors.New("connection refused"))
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   errCodeServerError,
+		},
+		{
+			name: "bad request",
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				app.badRequestErrorResponse(w, r, errors.New("body must not be empty"))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errCodeBadRequest,
+		},
+		{
+			name: "failed validation",
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				app.failedValidationResponse(w, r, map[string]string{"email": "must be provided"})
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   errCodeValidationFailed,
+			wantFields: true,
+		},
+		{
+			name:       "not found",
+			respond:    app.notFoundResponse,
+			wantStatus: http.StatusNotFound,
+			wantCode:   errCodeNotFound,
+		},
+		{
+			name:       "invalid credentials",
+			respond:    app.invalidCredentialsResponse,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeInvalidCredentials,
+		},
+		{
+			name:       "method not allowed",
+			respond:    app.methodNotAllowedResponse,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   errCodeMethodNotAllowed,
+		},
+		{
+			name:       "authentication required",
+			respond:    app.authenticationRequiredResponse,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeAuthenticationRequired,
+		},
+		{
+			name:       "invalid authentication token",
+			respond:    app.invalidAuthenticationTokenResponse,
+			wantStatus: http.StatusForbidden,
+			wantCode:   errCodeInvalidToken,
+		},
+		{
+			name:       "unauthorized action",
+			respond:    app.unauthorizedActionResponse,
+			wantStatus: http.StatusForbidden,
+			wantCode:   errCodeForbidden,
+		},
+		{
+			name:       "invalid refresh token",
+			respond:    app.invalidRefreshTokenResponse,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeInvalidRefreshToken,
+		},
+		{
+			name:       "reauthentication required",
+			respond:    app.reauthenticationRequiredResponse,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeReauthenticationRequired,
+		},
+		{
+			name:       "session expired",
+			respond:    app.sessionExpiredResponse,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   errCodeSessionExpired,
+		},
+		{
+			name:       "edit conflict",
+			respond:    app.editConflictResponse,
+			wantStatus: http.StatusConflict,
+			wantCode:   errCodeEditConflict,
+		},
+		{
+			name:       "invalid csrf token",
+			respond:    app.invalidCSRFTokenResponse,
+			wantStatus: http.StatusForbidden,
+			wantCode:   errCodeInvalidCSRFToken,
+		},
+		{
+			name: "rate limited",
+			respond: func(w http.ResponseWriter, r *http.Request) {
+				app.rateLimitResponse(w, r, time.Minute)
+			},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   errCodeRateLimited,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			tt.respond(rr, r)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+			var body map[string]json.RawMessage
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			assert.NoError(t, err)
+			assert.Len(t, body, 1, "the error must be the only top-level key")
+
+			var apiErr map[string]any
+			err = json.Unmarshal(body["error"], &apiErr)
+			assert.NoError(t, err)
+
+			assert.Equal(t, tt.wantCode, apiErr["code"])
+			assert.NotEmpty(t, apiErr["message"])
+
+			_, hasFields := apiErr["fields"]
+			assert.Equal(t, tt.wantFields, hasFields)
+		})
+	}
+}
+
+func TestProblemJSONErrors(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	t.Run("Problem details", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/users/new?lang=en", nil)
+		r.Header.Set("Accept", "application/problem+json")
+
+		app.failedValidationResponse(rr, r, map[string]string{"email": "must be provided"})
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+		assert.Contains(t, rr.Header().Values("Vary"), "Accept")
+
+		var body map[string]any
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "about:blank", body["type"])
+		assert.Equal(t, "Unprocessable Entity", body["title"])
+		assert.Equal(t, float64(http.StatusUnprocessableEntity), body["status"])
+		assert.Equal(t, "the request contains invalid fields", body["detail"])
+		assert.Equal(t, "/v1/users/new", body["instance"])
+		assert.Equal(t, errCodeValidationFailed, body["code"])
+		assert.Equal(t, map[string]any{"email": "must be provided"}, body["fields"])
+		assert.NotContains(t, body, "error")
+	})
+
+	testCases := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: "application/json"},
+		{accept: "application/json", want: "application/json"},
+		{accept: "*/*", want: "application/json"},
+		{accept: "application/json, application/problem+json;q=0.5", want: "application/problem+json"},
+		{accept: "Application/Problem+JSON", want: "application/problem+json"},
+		{accept: "application/problem+json;q=0", want: "application/json"},
+	}
+
+	for _, tt := range testCases {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", tt.accept)
+
+		app.notFoundResponse(rr, r)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Equal(t, tt.want, rr.Header().Get("Content-Type"), "accept %q", tt.accept)
+	}
+}
+
+func TestRateLimitResponseRetryAfter(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	testCases := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{retryAfter: 90 * time.Second, want: "90"},
+		{retryAfter: 1500 * time.Millisecond, want: "2"},
+		{retryAfter: 10 * time.Millisecond, want: "1"},
+		{retryAfter: 0, want: "1"},
+	}
+
+	for _, tt := range testCases {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+
+		app.rateLimitResponse(rr, r, tt.retryAfter)
+
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, tt.want, rr.Header().Get("Retry-After"), "retry after %s", tt.retryAfter)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Feature flags gate behavior changes while they are rolled out, FEATURE_FLAGS sets the percentage
+// of users each one is enabled for. A flag missing from it is disabled.
+const (
+	// flagSecondaryEmails lets users add secondary email addresses to their account.
+	flagSecondaryEmails = "secondary_emails"
+)
+
+// featureFlags lists every flag FEATURE_FLAGS may set.
+var featureFlags = []string{flagSecondaryEmails}
+
+// featureEnabled reports whether the flag is enabled for the user.
+func (app *application) featureEnabled(flag string, userID int) bool {
+	percent := app.config.FeatureFlags[flag]
+
+	switch {
+	case percent <= 0:
+		return false
+	case percent >= 100:
+		return true
+	}
+
+	return featureBucket(flag, userID) < percent
+}
+
+// featureBucket places the user in one of 100 buckets for the flag. It only depends on the flag and
+// the user ID, so users keep their answer as the rollout percentage grows, and the flag is part of
+// the hash so that every flag is rolled out to a different subset of users first.
+func featureBucket(flag string, userID int) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d", flag, userID)
+
+	return int(h.Sum32() % 100)
+}
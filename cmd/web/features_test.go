@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatureEnabled(t *testing.T) {
+	app := &application{}
+	app.config.FeatureFlags = map[string]int{"off": 0, "on": 100, "quarter": 25, "half": 50}
+
+	t.Run("Missing and boundary percentages", func(t *testing.T) {
+		for userID := 1; userID <= 100; userID++ {
+			assert.False(t, app.featureEnabled("missing", userID))
+			assert.False(t, app.featureEnabled("off", userID))
+			assert.True(t, app.featureEnabled("on", userID))
+		}
+	})
+
+	t.Run("Deterministic bucketing", func(t *testing.T) {
+		for userID := 1; userID <= 100; userID++ {
+			assert.Equal(t, featureBucket("quarter", userID), featureBucket("quarter", userID))
+			assert.Equal(t, app.featureEnabled("quarter", userID), app.featureEnabled("quarter", userID))
+		}
+
+		// a fixed value guards against the hash changing between releases, which would reshuffle
+		// every rollout in progress
+		assert.Equal(t, 85, featureBucket("secondary_emails", 42))
+	})
+
+	t.Run("Percentage of users", func(t *testing.T) {
+		enabled := 0
+		for userID := 1; userID <= 10000; userID++ {
+			if app.featureEnabled("quarter", userID) {
+				enabled++
+			}
+		}
+
+		assert.InDelta(t, 2500, enabled, 250)
+	})
+
+	t.Run("Growing a rollout keeps users enabled", func(t *testing.T) {
+		grown := &application{}
+		grown.config.FeatureFlags = map[string]int{"quarter": 50}
+
+		for userID := 1; userID <= 1000; userID++ {
+			if app.featureEnabled("quarter", userID) {
+				assert.True(t, grown.featureEnabled("quarter", userID), "user %d", userID)
+			}
+		}
+	})
+
+	t.Run("Flags are bucketed independently", func(t *testing.T) {
+		same := 0
+		for userID := 1; userID <= 1000; userID++ {
+			if featureBucket("quarter", userID) == featureBucket("half", userID) {
+				same++
+			}
+		}
+
+		assert.Less(t, same, 100)
+	})
+}
+
+func TestSecondaryEmailsFlag(t *testing.T) {
+	user := &db.User{ID: 1, Username: "testuser", Email: "testuser@example.com", Activated: true}
+
+	app := &application{
+		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		models: &db.Models{Rules: db.NewUserRules()},
+	}
+
+	addEmail := func(t *testing.T) int {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users/emails", strings.NewReader(`{"email": "invalid"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r = app.createUserContext(r, user)
+
+		w := httptest.NewRecorder()
+		app.addUserEmailHandler(w, r)
+
+		return w.Code
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		app.config.FeatureFlags = nil
+		assert.Equal(t, http.StatusNotFound, addEmail(t))
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		app.config.FeatureFlags = map[string]int{flagSecondaryEmails: 100}
+		// the request gets past the flag and fails on the invalid email
+		assert.Equal(t, http.StatusUnprocessableEntity, addEmail(t))
+	})
+}
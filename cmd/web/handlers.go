@@ -1,35 +1,72 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/validator"
 	"github.com/sushihentaime/user-management-service/pkg/jsonParser"
 )
 
+// fields tagged `validate:"required"` are checked right after decoding, before any other validation
 type createUserInput struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required"`
+	Email    string `json:"email" validate:"required"`
+	Password string `json:"password" validate:"required"`
+	// RedirectURL is where the activation link points instead of BASE_URL, see redirectBase.
+	RedirectURL string `json:"redirect_url"`
+}
+
+// userResponse is the public view of a newly registered user, the activation token is
+// only ever sent to the user's email address.
+type userResponse struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Activated bool      `json:"activated"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newUserResponse(user *db.User) userResponse {
+	return userResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		Activated: user.Activated,
+		CreatedAt: user.CreatedAt,
+	}
 }
 
 type tokenInput struct {
-	Token string `json:"token"`
+	Token string `json:"token" validate:"required"`
 }
 
 type loginUserInput struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 type requestPwdResetInput struct {
-	Email string `json:"email"`
+	Email string `json:"email" validate:"required"`
+	// RedirectURL is where the reset link points instead of BASE_URL, see redirectBase.
+	RedirectURL string `json:"redirect_url"`
 }
 
 type updatePwdInput struct {
-	Token    string `json:"token"`
-	Password string `json:"password"`
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type changePwdInput struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
 }
 
 func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +78,46 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// a retried request carrying the same Idempotency-Key gets the original response back
+	var idempotency *db.IdempotencyRecord
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		idempotency = &db.IdempotencyRecord{Key: key, UserID: app.getUserContext(r).ID}
+		if idempotency.ValidateKey(); !idempotency.Validator.Valid() {
+			app.failedValidationResponse(w, r, idempotency.Validator.Errors)
+			return
+		}
+
+		// the password is left out, a fast hash of it must not be stored
+		payload := input
+		payload.Password = ""
+
+		idempotency.Fingerprint, err = idempotencyFingerprint(r, payload)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		stored, err := app.models.Idempotency.Get(r.Context(), key)
+		switch {
+		case err == nil && (stored.UserID != idempotency.UserID || !bytes.Equal(stored.Fingerprint, idempotency.Fingerprint)):
+			app.failedValidationResponse(w, r, map[string]string{"Idempotency-Key": "was already used for a different request"})
+			return
+		case err == nil:
+			app.replayIdempotentResponse(w, r, stored)
+			return
+		case !errors.Is(err, db.ErrNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	user := &db.User{
 		Username: input.Username,
 		Email:    input.Email,
@@ -49,7 +126,26 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		},
 	}
 
-	if user.ValidateUser(); !user.Validator.Valid() {
+	user.Normalize()
+	user.ValidateUser(app.models.Rules)
+	user.Validator.Check(!app.models.Rules.IsReservedUsername(user.Username), "username", "is reserved")
+	linkBase := app.redirectBase(user.Validator, input.RedirectURL)
+	if !user.Validator.Valid() {
+		app.failedValidationResponse(w, r, user.Validator.Errors)
+		return
+	}
+
+	// report a taken username and email together, the insert below still catches concurrent signups
+	usernameTaken, emailTaken, err := app.models.Users.Taken(r.Context(), user.Username, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user.Validator.Check(!usernameTaken, "username", "a user with this username already exists")
+	// a private registration must not reveal the email, it is handled as a duplicate on insert
+	user.Validator.Check(!emailTaken || app.config.Auth.PrivateRegistration, "email", "a user with this email address already exists")
+	if !user.Validator.Valid() {
 		app.failedValidationResponse(w, r, user.Validator.Errors)
 		return
 	}
@@ -67,12 +163,23 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 	}
 	defer tx.Rollback()
 
-	err = app.models.Users.Insert(user)
+	err = app.models.Users.Insert(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrDuplicateUsername):
 			user.Validator.AddError("username", "a user with this username already exists")
 			app.failedValidationResponse(w, r, user.Validator.Errors)
+		case errors.Is(err, db.ErrDuplicateEmail) && app.config.Auth.PrivateRegistration:
+			// answer exactly like a successful signup and let the owner of the address know instead
+			app.backgroundTask(func(ctx context.Context) {
+				err := app.sendEmail(ctx, 0, user.Email, "registration_attempt.html", map[string]any{"email": user.Email})
+				if err != nil {
+					app.logger.Error(err.Error())
+				}
+			})
+
+			app.loggerFor(r).Info("registration attempted with an existing email", "event", eventRegistrationDuplicate)
+			app.writeRegistrationResponse(w, r, idempotency, http.StatusAccepted, registrationAcceptedResponse)
 		case errors.Is(err, db.ErrDuplicateEmail):
 			user.Validator.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, user.Validator.Errors)
@@ -82,13 +189,13 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Permissions.Add(user.ID, db.PermissionReadUser)
+	err = app.models.Permissions.Add(r.Context(), user.ID, app.config.Auth.SignupPermissions...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.CreateToken(user.ID, db.ActivationTokenTime, db.TokenScopeActivation)
+	token, err := app.models.Tokens.CreateToken(r.Context(), user.ID, db.ActivationTokenTime, db.TokenScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -100,12 +207,10 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	app.backgroundTask(func() {
-		data := map[string]any{
-			"activationToken": token.Plain,
-		}
+	app.backgroundTask(func(ctx context.Context) {
+		data := app.activationEmailData(user, token, linkBase)
 
-		err = app.mailer.Send(user.Email, "mail.html", data)
+		err = app.sendEmail(ctx, user.ID, user.Email, "mail.html", data)
 		if err != nil {
 			app.logger.Error(err.Error())
 		}
@@ -113,7 +218,29 @@ func (app *application) createUserHandler(w http.ResponseWriter, r *http.Request
 		app.logger.Info("email sent", "email", user.Email, "type", "activation")
 	})
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"token": token.Plain}, nil)
+	app.loggerFor(r).Info("user registered", "event", eventUserRegistered, "user_id", user.ID)
+
+	if app.config.Auth.PrivateRegistration {
+		app.writeRegistrationResponse(w, r, idempotency, http.StatusAccepted, registrationAcceptedResponse)
+		return
+	}
+
+	app.writeRegistrationResponse(w, r, idempotency, http.StatusCreated, envelope{"user": newUserResponse(user)})
+}
+
+// registrationAcceptedResponse answers every signup with a new username when
+// config.Auth.PrivateRegistration is set, so it doesn't reveal whether the email was registered.
+var registrationAcceptedResponse = envelope{"message": "please check your email to complete the registration"}
+
+func (app *application) writeRegistrationResponse(w http.ResponseWriter, r *http.Request, idempotency *db.IdempotencyRecord, status int, response envelope) {
+	if idempotency != nil {
+		err := app.storeIdempotentResponse(r.Context(), idempotency, status, response)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	err := app.writeJSON(w, status, response, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -129,6 +256,12 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	token := &db.Token{
 		Plain: input.Token,
 	}
@@ -147,7 +280,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 	defer tx.Rollback()
 
-	user, err := app.models.Users.GetToken(db.TokenScopeActivation, tokenHash)
+	user, err := app.models.Users.GetToken(r.Context(), db.TokenScopeActivation, tokenHash)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
@@ -158,19 +291,19 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Users.Activate(user.ID)
+	err = app.models.Users.Activate(r.Context(), user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Permissions.Add(user.ID, db.PermissionWriteUser)
+	err = app.models.Permissions.Add(r.Context(), user.ID, app.config.Auth.ActivationPermissions...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Tokens.Delete(user.ID, db.TokenScopeActivation)
+	err = app.models.Tokens.Delete(r.Context(), user.ID, db.TokenScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -182,6 +315,8 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.loggerFor(r).Info("user activated", "event", eventUserActivated, "user_id", user.ID)
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user account successfully activated"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -199,6 +334,12 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	user := &db.User{
 		Username: input.Username,
 		Password: db.Password{
@@ -206,16 +347,31 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 		},
 	}
 
-	if user.ValidateLoginUser(); !user.Validator.Valid() {
+	user.Normalize()
+
+	if user.ValidateLoginUser(app.models.Rules); !user.Validator.Valid() {
 		app.failedValidationResponse(w, r, user.Validator.Errors)
 		return
 	}
 
-	dbUser, err := app.models.Users.GetByUsername(input.Username)
+	// throttled per username rather than per client, so attempts spread over many addresses are slowed down as well
+	if wait := app.loginThrottle.Wait(user.Username); wait > 0 {
+		app.loggerFor(r).Warn("login throttled", "event", eventLoginThrottled)
+		app.rateLimitResponse(w, r, wait)
+		return
+	}
+
+	loginFailed := func() {
+		app.loginThrottle.Failure(user.Username)
+		app.loggerFor(r).Info("login failed", "event", eventLoginFailure)
+		app.invalidCredentialsResponse(w, r)
+	}
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), user.Username)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
-			app.invalidCredentialsResponse(w, r)
+			loginFailed()
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -224,12 +380,21 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 
 	match, err := dbUser.Password.Compare(input.Password)
 	if err != nil {
-		app.invalidCredentialsResponse(w, r)
+		loginFailed()
 		return
 	}
 
 	if !match {
-		app.invalidCredentialsResponse(w, r)
+		loginFailed()
+		return
+	}
+
+	app.loginThrottle.Success(user.Username)
+
+	// only told once the password matched, so that the lock doesn't reveal the account exists
+	if dbUser.Locked {
+		app.loggerFor(r).Info("login rejected, account locked", "event", eventLoginLocked, "user_id", dbUser.ID)
+		app.accountLockedResponse(w, r)
 		return
 	}
 
@@ -240,47 +405,86 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 	}
 	defer tx.Rollback()
 
-	dbAuthToken, err := app.models.Tokens.Get(dbUser.ID, db.TokenScopeAccess)
-	if err != nil {
-		switch {
-		case errors.Is(err, db.ErrNotFound):
-		default:
+	models := app.models.WithTx(tx)
+
+	if app.config.Auth.SingleSession {
+		err = models.Tokens.DeleteAllForUser(r.Context(), dbUser.ID, db.TokenScopeAccess, db.TokenScopeRefresh)
+		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 	}
 
-	dbRefreshToken, err := app.models.Tokens.Get(dbUser.ID, db.TokenScopeRefresh)
+	authToken, refreshToken, err := models.Tokens.CreatePair(r.Context(), dbUser.ID, time.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.Get(r.Context(), dbUser.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("user logged in", "event", eventLoginSuccess, "user_id", dbUser.ID)
+
+	err = app.writeAuthTokens(w, authToken, refreshToken, permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// resendActivationHandler sends the authenticated user a new activation token, at most once
+// per configured cooldown. Users who were activated before, such as those an admin deactivated,
+// can't reactivate themselves this way.
+func (app *application) resendActivationHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	if user.Activated {
+		app.badRequestErrorResponse(w, r, errors.New("the account is already activated"))
+		return
+	}
+
+	claimed, retryAfter, err := app.models.Users.ClaimActivationResend(r.Context(), user.ID, app.config.Auth.ActivationResendCooldown)
 	if err != nil {
 		switch {
-		case errors.Is(err, db.ErrNotFound):
+		case errors.Is(err, db.ErrActivatedBefore):
+			app.badRequestErrorResponse(w, r, errors.New("the account was activated before and can't be activated again by email"))
 		default:
 			app.serverErrorResponse(w, r, err)
-			return
 		}
+		return
+	}
 
+	if !claimed {
+		app.rateLimitResponse(w, r, retryAfter)
+		return
 	}
 
-	if dbAuthToken != nil || dbRefreshToken != nil {
-		err = app.models.Tokens.Delete(dbUser.ID, db.TokenScopeAccess)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
-		err = app.models.Tokens.Delete(dbUser.ID, db.TokenScopeRefresh)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
 
-	authToken, err := app.models.Tokens.CreateToken(dbUser.ID, db.AuthTokenTime, db.TokenScopeAccess)
+	err = models.Tokens.Delete(r.Context(), user.ID, db.TokenScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	refreshToken, err := app.models.Tokens.CreateToken(dbUser.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+	token, err := models.Tokens.CreateToken(r.Context(), user.ID, db.ActivationTokenTime, db.TokenScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -292,9 +496,18 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"access_token": map[string]any{
-		"token": authToken.Plain, "expiry": authToken.Expiry}, "refresh_token": map[string]any{
-		"token": refreshToken.Plain, "expiry": refreshToken.Expiry}}, nil)
+	app.backgroundTask(func(ctx context.Context) {
+		data := app.activationEmailData(user, token, app.config.BaseURL)
+
+		err := app.sendEmail(ctx, user.ID, user.Email, "mail.html", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		app.logger.Info("email sent", "email", user.Email, "type", "activation")
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "a new activation email has been sent"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -305,9 +518,15 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 func (app *application) refreshAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input tokenInput
 
-	err := jsonParser.ParseJSON(w, r, &input)
+	err := app.readRefreshToken(w, r, &input)
 	if err != nil {
-		app.invalidCredentialsResponse(w, r)
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
@@ -322,65 +541,199 @@ func (app *application) refreshAuthTokenHandler(w http.ResponseWriter, r *http.R
 
 	tokenHash := db.HashToken(token.Plain)
 
-	user, err := app.models.Users.GetToken(db.TokenScopeRefresh, tokenHash)
+	pair, err := app.refreshes.Do(hex.EncodeToString(tokenHash), func() (*tokenPair, error) {
+		return app.rotateRefreshToken(r.Context(), tokenHash)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
+			// the client isn't told why, but the log tells a misused access token from a stale one
+			app.loggerFor(r).Warn("refresh token rejected", "event", eventTokenRefreshRejected, "reason", app.refreshRejectionReason(r.Context(), tokenHash))
 			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, errAccountLocked):
+			app.loggerFor(r).Warn("refresh token rejected", "event", eventTokenRefreshRejected, "reason", refreshRejectedLocked)
+			app.accountLockedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	tx, err := app.models.DB.Begin()
+	app.loggerFor(r).Info("tokens refreshed", "event", eventTokenRefresh, "user_id", pair.userID)
+
+	err = app.writeAuthTokens(w, pair.accessToken, pair.refreshToken, pair.permissions)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
+
+// Reasons logged for a rejected refresh token.
+const (
+	refreshRejectedNotFound   = "not_found"
+	refreshRejectedWrongScope = "wrong_scope"
+	refreshRejectedExpired    = "expired"
+	refreshRejectedLocked     = "account_locked"
+)
+
+// refreshRejectionReason tells why the token with tokenHash can't be used for a refresh.
+func (app *application) refreshRejectionReason(ctx context.Context, tokenHash []byte) string {
+	token, err := app.models.Tokens.Lookup(ctx, tokenHash)
+	switch {
+	case err != nil:
+		return refreshRejectedNotFound
+	case token.Scope != db.TokenScopeRefresh:
+		return refreshRejectedWrongScope
+	case !token.Expiry.After(time.Now()):
+		return refreshRejectedExpired
+	default:
+		// rotated by a concurrent request since the rotation failed
+		return refreshRejectedNotFound
+	}
+}
+
+// errAccountLocked is returned by rotateRefreshToken for a token of a locked user.
+var errAccountLocked = errors.New("account locked")
+
+// rotateRefreshToken replaces the refresh token with tokenHash by a new token pair.
+func (app *application) rotateRefreshToken(ctx context.Context, tokenHash []byte) (*tokenPair, error) {
+	user, err := app.models.Users.GetToken(ctx, db.TokenScopeRefresh, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// locking revokes the user's tokens, this covers a token issued while the lock was applied
+	if user.Locked {
+		return nil, errAccountLocked
+	}
+
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Rollback()
 
-	err = app.models.Tokens.Delete(user.ID, db.TokenScopeRefresh)
+	models := app.models.WithTx(tx)
+
+	// the lock is held until the transaction ends, so a concurrent rotation of the same user's
+	// tokens waits here and then finds the presented token already gone
+	err = models.Tokens.LockUserTokens(ctx, tx, user.ID)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return nil, err
 	}
 
-	err = app.models.Tokens.Delete(user.ID, db.TokenScopeAccess)
+	refreshToken, err := models.Tokens.GetByHash(ctx, db.TokenScopeRefresh, tokenHash)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return nil, err
 	}
 
-	newAccessToken, err := app.models.Tokens.CreateToken(user.ID, db.AuthTokenTime, db.TokenScopeAccess)
+	// outside of single session mode only the presented refresh token and the access token issued
+	// with it are rotated so that the user's other sessions stay valid
+	if app.config.Auth.SingleSession {
+		err = models.Tokens.DeleteAllForUser(ctx, user.ID, db.TokenScopeAccess, db.TokenScopeRefresh)
+	} else {
+		err = models.Tokens.DeletePair(ctx, tokenHash)
+	}
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return nil, err
 	}
 
-	newRefreshToken, err := app.models.Tokens.CreateToken(user.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+	// the new pair keeps the session's login time, a refresh doesn't count as a fresh login
+	newAccessToken, newRefreshToken, err := models.Tokens.CreatePair(ctx, user.ID, refreshToken.AuthenticatedAt)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return nil, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		return nil, err
+	}
+
+	permissions, err := app.models.Permissions.Get(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{userID: user.ID, accessToken: newAccessToken, refreshToken: newRefreshToken, permissions: permissions}, nil
+}
+
+// extendAuthTokenHandler replaces the presented access token by one with a fresh expiry, letting
+// clients keep a session alive without the refresh token. Sessions can't be extended past
+// config.Auth.MaxSessionLifetime after login.
+func (app *application) extendAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+	tokenHash := db.HashToken(app.requestToken(r))
+
+	token, err := app.models.Tokens.GetByHash(r.Context(), db.TokenScopeAccess, tokenHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if time.Since(token.CreatedAt) >= app.config.Auth.MaxSessionLifetime {
+		app.sessionExpiredResponse(w, r)
+		return
+	}
+
+	newToken, err := app.models.Tokens.Extend(r.Context(), tokenHash, db.AuthTokenTime, app.config.Auth.MaxSessionLifetime)
+	if err != nil {
+		switch {
+		// revoked or extended by a concurrent request, or an impersonation token
+		case errors.Is(err, db.ErrNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"access_token": map[string]any{
-		"token": newAccessToken.Plain, "expiry": newAccessToken.Expiry}, "refresh_token": map[string]any{"token": newRefreshToken.Plain, "expiry": newRefreshToken.Expiry}}, nil)
+	app.loggerFor(r).Info("access token extended", "event", eventTokenExtended, "user_id", user.ID)
+
+	accessBody := map[string]any{"token": newToken.Plain, "expiry": newToken.Expiry, "expires_in": expiresIn(newToken.Expiry)}
+	if app.config.Auth.CookieTokens {
+		setTokenCookie(w, accessTokenCookieName, "/", newToken.Plain, newToken.Expiry)
+		delete(accessBody, "token")
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"access_token": accessBody}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-// logout user by deleting access token and refresh token
+// log out by revoking the user's access and refresh tokens. Clients left without a usable access
+// token send no Authorization header and present their refresh token instead.
 func (app *application) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
-	user := app.getUserContext(r)
+	user, err := app.accessTokenUser(r)
+	if err != nil && !errors.Is(err, errInvalidAccessToken) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var userID int
+
+	switch {
+	case err == nil && !user.IsAnonymous():
+		r = app.createUserContext(r, user)
+		userID = user.ID
+	// an expired access token must not keep the user from logging out, the refresh token is
+	// accepted in its place
+	case err != nil && !app.hasRefreshToken(r):
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	default:
+		refreshToken, ok := app.readValidRefreshToken(w, r)
+		if !ok {
+			return
+		}
+		userID = refreshToken.UserID
+	}
 
 	tx, err := app.models.DB.Begin()
 	if err != nil {
@@ -389,13 +742,13 @@ func (app *application) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Re
 	}
 	defer tx.Rollback()
 
-	err = app.models.Tokens.Delete(user.ID, db.TokenScopeAccess)
+	err = app.models.Tokens.Delete(r.Context(), userID, db.TokenScopeAccess)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Tokens.Delete(user.ID, db.TokenScopeRefresh)
+	err = app.models.Tokens.Delete(r.Context(), userID, db.TokenScopeRefresh)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -407,6 +760,12 @@ func (app *application) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	if app.config.Auth.CookieTokens {
+		clearTokenCookies(w)
+	}
+
+	app.loggerFor(r).Info("user logged out", "event", eventLogout, "user_id", userID)
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully logged out"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -414,80 +773,162 @@ func (app *application) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Re
 	}
 }
 
-func (app *application) requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
-	var input requestPwdResetInput
+// readValidRefreshToken reads the refresh token of the request and returns it if it exists and hasn't
+// expired, otherwise the error response has been written.
+func (app *application) readValidRefreshToken(w http.ResponseWriter, r *http.Request) (*db.Token, bool) {
+	var input tokenInput
 
-	err := jsonParser.ParseJSON(w, r, &input)
+	err := app.readRefreshToken(w, r, &input)
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
-		return
+		return nil, false
 	}
 
-	dbUser := &db.User{
-		Email: input.Email,
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
 	}
 
-	if dbUser.ValidateEmail(); !dbUser.Validator.Valid() {
-		app.failedValidationResponse(w, r, dbUser.Validator.Errors)
-		return
+	token := &db.Token{Plain: input.Token}
+	if token.ValidateToken(); !token.Validator.Valid() {
+		app.failedValidationResponse(w, r, token.Validator.Errors)
+		return nil, false
 	}
 
-	user, err := app.models.Users.GetByEmail(dbUser.Email)
+	dbToken, err := app.models.Tokens.GetByHash(r.Context(), db.TokenScopeRefresh, db.HashToken(token.Plain))
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.invalidRefreshTokenResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
-		return
+		return nil, false
 	}
 
-	prevToken, err := app.models.Tokens.Get(user.ID, db.TokenScopeResetPwd)
-	if err != nil {
-		switch {
-		case errors.Is(err, db.ErrNotFound):
-		default:
-			app.serverErrorResponse(w, r, err)
-			return
-		}
+	if time.Now().After(dbToken.Expiry) {
+		app.invalidRefreshTokenResponse(w, r)
+		return nil, false
 	}
 
-	if prevToken != nil {
-		err = app.models.Tokens.Delete(user.ID, db.TokenScopeResetPwd)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
-	}
+	return dbToken, true
+}
 
-	token, err := app.models.Tokens.CreateToken(user.ID, db.ResetPwdTokenTime, db.TokenScopeResetPwd)
+const passwordResetRequestedMessage = "if the email address belongs to an account, a password reset email has been sent to it"
+
+// requestPasswordResetHandler emails a password reset link or OTP to the account with the email.
+// The response is the same whether the address belongs to an account, the email was throttled or
+// it was sent, and the token is never part of it.
+func (app *application) requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var input requestPwdResetInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.badRequestErrorResponse(w, r, err)
 		return
 	}
 
-	app.backgroundTask(func() {
-		data := map[string]any{
-			"email":              user.Email,
-			"resetPasswordToken": token.Plain,
-		}
-
-		err = app.mailer.Send(user.Email, "reset_pwd.html", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-		app.logger.Info("email sent", "email", user.Email, "type", "reset pwd")
-	})
+	dbUser := &db.User{
+		Email: input.Email,
+	}
+
+	dbUser.Normalize()
+	dbUser.ValidateEmail(app.models.Rules)
+
+	linkBase := app.redirectBase(dbUser.Validator, input.RedirectURL)
+	if !dbUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, dbUser.Validator.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), dbUser.Email)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		user = nil
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil {
+		err = app.sendPasswordReset(r, user, linkBase)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"token": token.Plain}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": passwordResetRequestedMessage}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
+// sendPasswordReset issues a new password reset link or OTP to the user, depending on the reset
+// mode, unless one was sent within the cooldown. The previous token then stays usable.
+func (app *application) sendPasswordReset(r *http.Request, user *db.User, linkBase string) error {
+	claimed, err := app.models.Users.ClaimPasswordResetEmail(r.Context(), user.ID, app.config.Auth.PasswordResetCooldown)
+	if err != nil {
+		return err
+	}
+
+	if !claimed {
+		app.loggerFor(r).Info("password reset throttled", "event", eventPasswordResetThrottled, "user_id", user.ID)
+		return nil
+	}
+
+	if app.config.Auth.PasswordResetMode == passwordResetOTP {
+		otp, err := app.models.Tokens.CreateOTP(r.Context(), user.ID, db.ResetPwdOTPTime, db.TokenScopeResetPwdOTP)
+		if err != nil {
+			return err
+		}
+
+		app.backgroundTask(func(ctx context.Context) {
+			err := app.sendEmail(ctx, user.ID, user.Email, "reset_pwd_otp.html", app.passwordResetOTPEmailData(user, otp))
+			if err != nil {
+				app.logger.Error(err.Error())
+				return
+			}
+
+			app.logger.Info("email sent", "email", user.Email, "type", "reset pwd otp")
+		})
+
+		app.loggerFor(r).Info("password reset requested", "event", eventPasswordResetSent, "user_id", user.ID)
+		return nil
+	}
+
+	err = app.models.Tokens.Delete(r.Context(), user.ID, db.TokenScopeResetPwd)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.CreateToken(r.Context(), user.ID, db.ResetPwdTokenTime, db.TokenScopeResetPwd)
+	if err != nil {
+		return err
+	}
+
+	app.backgroundTask(func(ctx context.Context) {
+		err := app.sendEmail(ctx, user.ID, user.Email, "reset_pwd.html", app.passwordResetEmailData(user, token, linkBase))
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		app.logger.Info("email sent", "email", user.Email, "type", "reset pwd")
+	})
+
+	app.loggerFor(r).Info("password reset requested", "event", eventPasswordResetSent, "user_id", user.ID)
+	return nil
+}
+
 func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	var input updatePwdInput
 
@@ -497,6 +938,12 @@ func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	token := &db.Token{
 		Plain: input.Token,
 	}
@@ -512,25 +959,154 @@ func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if user.ValidatePassword(); !user.Validator.Valid() {
+	tokenHash := db.HashToken(token.Plain)
+
+	tokenUser, err := app.models.Users.GetToken(r.Context(), db.TokenScopeResetPwd, tokenHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the token stays valid until the password is changed, but only for a limited number of failed attempts
+	if user.ValidatePassword(app.models.Rules); !user.Validator.Valid() {
+		attempts, err := app.models.Tokens.IncrementAttempts(r.Context(), tokenHash)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if attempts >= db.MaxTokenAttempts {
+			err = app.models.Tokens.DeleteByHash(r.Context(), tokenHash)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
 		app.failedValidationResponse(w, r, user.Validator.Errors)
 		return
 	}
 
-	tokenHash := db.HashToken(token.Plain)
+	// the token lookup already returns the full account, including the verified email address on file
+	app.resetPassword(w, r, tokenUser, input.Password, db.TokenScopeResetPwd, false)
+}
+
+type updatePwdOTPInput struct {
+	Email    string `json:"email" validate:"required"`
+	OTP      string `json:"otp" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// updatePasswordWithOTPHandler redeems a password reset OTP. The OTP is looked up by the user's
+// email since it can't identify the token on its own, and it is revoked after MaxTokenAttempts
+// wrong guesses. Wrong guesses are also throttled per email like logins, requesting a new OTP
+// starts its attempts over but not the throttle.
+func (app *application) updatePasswordWithOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input updatePwdOTPInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := &db.User{
+		Email: input.Email,
+		Password: db.Password{
+			Plain: &input.Password,
+		},
+	}
+
+	user.Normalize()
+
+	if user.ValidateEmail(app.models.Rules); !user.Validator.Valid() {
+		app.failedValidationResponse(w, r, user.Validator.Errors)
+		return
+	}
+
+	otp := &db.Token{Plain: input.OTP}
+	if otp.ValidateOTP(); !otp.Validator.Valid() {
+		app.failedValidationResponse(w, r, otp.Validator.Errors)
+		return
+	}
+
+	if user.ValidatePassword(app.models.Rules); !user.Validator.Valid() {
+		app.failedValidationResponse(w, r, user.Validator.Errors)
+		return
+	}
+
+	if wait := app.otpThrottle.Wait(user.Email); wait > 0 {
+		app.loggerFor(r).Warn("password reset otp throttled", "event", eventPasswordResetOTPThrottled)
+		app.rateLimitResponse(w, r, wait)
+		return
+	}
+
+	failed := func() {
+		app.otpThrottle.Failure(user.Email)
+		app.invalidCredentialsResponse(w, r)
+	}
 
-	tokenUser, err := app.models.Users.GetToken(db.TokenScopeResetPwd, tokenHash)
+	dbUser, err := app.models.Users.GetByEmail(r.Context(), user.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
-			app.invalidCredentialsResponse(w, r)
+			failed()
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err := app.models.Tokens.Get(r.Context(), dbUser.ID, db.TokenScopeResetPwdOTP)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			failed()
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	dbUser, err := app.models.Users.GetByUsername(tokenUser.Username)
+	if time.Now().After(token.Expiry) {
+		failed()
+		return
+	}
+
+	if subtle.ConstantTimeCompare(token.Hash, db.HashOTP(dbUser.ID, otp.Plain)) != 1 {
+		attempts, err := app.models.Tokens.IncrementAttempts(r.Context(), token.Hash)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if attempts >= db.MaxTokenAttempts {
+			err = app.models.Tokens.DeleteByHash(r.Context(), token.Hash)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		failed()
+		return
+	}
+
+	app.otpThrottle.Success(user.Email)
+
+	// the email lookup only returns the public fields, the update needs the full account and its version
+	tokenUser, err := app.models.Users.GetToken(r.Context(), db.TokenScopeResetPwdOTP, token.Hash)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
@@ -541,7 +1117,14 @@ func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = dbUser.Password.Set(input.Password)
+	app.resetPassword(w, r, tokenUser, input.Password, db.TokenScopeResetPwdOTP, false)
+}
+
+// resetPassword sets the password of the user who redeemed a password reset token of the scope, or
+// who changed it themselves, and revokes the user's tokens of that scope. With revokeOtherSessions
+// every session but the one of the request's access token is revoked as well.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request, user *db.User, password string, scope db.TokenScope, revokeOtherSessions bool) {
+	err := user.Password.Set(password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -554,29 +1137,55 @@ func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Req
 	}
 	defer tx.Rollback()
 
-	err = app.models.Users.Update(dbUser)
+	models := app.models.WithTx(tx)
+
+	err = models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
-		case errors.Is(err, db.ErrNotFound):
-			app.invalidCredentialsResponse(w, r)
+		case errors.Is(err, db.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.models.Tokens.Delete(dbUser.ID, db.TokenScopeResetPwd)
+	err = models.Tokens.Delete(r.Context(), user.ID, scope)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if revokeOtherSessions {
+		err = models.Tokens.DeleteOtherSessions(r.Context(), user.ID, db.HashToken(app.requestToken(r)))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.backgroundTask(func(ctx context.Context) {
+		data := map[string]any{
+			"email": user.Email,
+		}
+
+		err := app.sendEmail(ctx, user.ID, user.Email, "password_changed.html", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		app.logger.Info("email sent", "email", user.Email, "type", "password changed")
+	})
+
+	app.loggerFor(r).Info("password changed", "event", eventPasswordChanged, "user_id", user.ID)
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "password successfully updated"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -584,6 +1193,28 @@ func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Req
 	}
 }
 
+// return the authenticated user's profile and permissions, anonymous requests get a 401 so that
+// clients can use this to check whether they are logged in
+func (app *application) getCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+	if user.IsAnonymous() {
+		app.authenticationRequiredResponse(w, r)
+		return
+	}
+
+	permissions, err := app.models.Permissions.Get(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
 func (app *application) getAccountHandler(w http.ResponseWriter, r *http.Request) {
 	userParam, err := app.readStringParam(r, "username")
 	if err != nil {
@@ -597,7 +1228,7 @@ func (app *application) getAccountHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	dbUser, err := app.models.Users.GetByUsername(user.Username)
+	dbUser, err := app.models.Users.GetByID(r.Context(), user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
@@ -608,7 +1239,67 @@ func (app *application) getAccountHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": dbUser}, nil)
+	// clients polling the account only get a body when it changed
+	headers := make(http.Header)
+	headers.Set("ETag", userETag(dbUser))
+	headers.Set("Cache-Control", "private, no-cache")
+
+	if etagMatches(r, headers.Get("ETag")) {
+		for key, value := range headers {
+			w.Header()[key] = value
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": dbUser}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// list the permissions of an account, only the account owner and admins may view them
+func (app *application) getAccountPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	if user.Username != *userParam {
+		callerPermissions, err := app.models.Permissions.Get(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !callerPermissions.Include(db.PermissionAdminUser) {
+			app.unauthorizedActionResponse(w, r)
+			return
+		}
+	}
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), *userParam)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.models.Permissions.Get(r.Context(), dbUser.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -616,45 +1307,108 @@ func (app *application) getAccountHandler(w http.ResponseWriter, r *http.Request
 }
 
 type updateAccountInput struct {
-	Email    string `json:"email,omitempty"`
-	Password string `json:"password,omitempty"`
+	Email string `json:"email,omitempty"`
+	// nil leaves the profile field unchanged, an empty string clears it
+	DisplayName *string `json:"display_name,omitempty"`
+	AvatarURL   *string `json:"avatar_url,omitempty"`
 }
 
-// only allow user to update their account's email and password
+// patchAccountInput distinguishes an absent field (nil, left unchanged) from one that is
+// present but empty. Email can't be cleared, display name and avatar can.
+type patchAccountInput struct {
+	Email       *string `json:"email"`
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+}
+
+// only allow user to update their account's email and profile. An empty email is treated as
+// unchanged, use the PATCH endpoint to tell an absent field from an empty one. The password is
+// changed through changePasswordHandler, which requires the current one.
 func (app *application) updateAccountHandler(w http.ResponseWriter, r *http.Request) {
 	var input updateAccountInput
 
-	userParam, err := app.readStringParam(r, "username")
+	if !app.isAccountOwner(w, r) {
+		return
+	}
+
+	err := jsonParser.ParseJSON(w, r, &input)
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
 		return
 	}
 
-	user := app.getUserContext(r)
-	if user.Username != *userParam {
-		app.unauthorizedActionResponse(w, r)
+	app.updateAccount(w, r, patchAccountInput{
+		Email:       nilIfEmpty(input.Email),
+		DisplayName: input.DisplayName,
+		AvatarURL:   input.AvatarURL,
+	})
+}
+
+func (app *application) patchAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input patchAccountInput
+
+	if !app.isAccountOwner(w, r) {
 		return
 	}
 
-	err = jsonParser.ParseJSON(w, r, &input)
+	err := jsonParser.ParseJSON(w, r, &input)
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
 		return
 	}
 
+	v := validator.New()
+	v.Check(input.Email == nil || *input.Email != "", "email", "must not be empty")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.updateAccount(w, r, input)
+}
+
+// changePasswordHandler sets a new password for the authenticated user once they proved they know
+// the current one, so that a hijacked session alone isn't enough to take over the account.
+func (app *application) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input changePwdInput
+
+	if !app.isAccountOwner(w, r) {
+		return
+	}
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	inputUser := &db.User{
-		Email: input.Email,
 		Password: db.Password{
-			Plain: &input.Password,
+			Plain: &input.NewPassword,
 		},
 	}
 
-	if inputUser.ValidateUpdateUser(); !inputUser.Validator.Valid() {
-		app.failedValidationResponse(w, r, inputUser.Validator.Errors)
+	if inputUser.ValidatePassword(app.models.Rules); !inputUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, map[string]string{"new_password": inputUser.Validator.Errors["password"]})
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	// wrong current passwords count as failed logins, otherwise the session could be used to guess it
+	if wait := app.loginThrottle.Wait(user.Username); wait > 0 {
+		app.loggerFor(r).Warn("password change throttled", "event", eventLoginThrottled)
+		app.rateLimitResponse(w, r, wait)
 		return
 	}
 
-	dbUser, err := app.models.Users.GetByUsername(user.Username)
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), user.Username)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrNotFound):
@@ -665,20 +1419,133 @@ func (app *application) updateAccountHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	if input.Password != "" {
-		err = dbUser.Password.Set(input.Password)
-		if err != nil {
+	match, err := dbUser.Password.Compare(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.loginThrottle.Failure(user.Username)
+		app.loggerFor(r).Info("password change rejected, wrong current password", "event", eventLoginFailure)
+		app.failedValidationResponse(w, r, map[string]string{"current_password": "is incorrect"})
+		return
+	}
+
+	app.loginThrottle.Success(user.Username)
+
+	if input.NewPassword == input.CurrentPassword {
+		app.failedValidationResponse(w, r, map[string]string{"new_password": "must be different from the current password"})
+		return
+	}
+
+	// the session used to change the password is kept, any other one may be the attacker's
+	app.resetPassword(w, r, dbUser, input.NewPassword, db.TokenScopeResetPwd, true)
+}
+
+// deleteAccountHandler permanently deletes the authenticated user's account together with their
+// tokens, permissions and the rest of their data.
+func (app *application) deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.isAccountOwner(w, r) {
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	err := app.models.Users.DeleteAccount(r.Context(), user.ID, app.config.Auth.PurgeAuditOnDeletion)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
 			app.serverErrorResponse(w, r, err)
-			return
+		}
+		return
+	}
+
+	app.loggerFor(r).Info("account deleted", "event", eventAccountDeleted, "user_id", user.ID)
+
+	if app.config.Auth.CookieTokens {
+		clearTokenCookies(w)
+	}
 
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isAccountOwner reports whether the authenticated user is the owner of the account named
+// in the URL, sending an error response when it isn't.
+func (app *application) isAccountOwner(w http.ResponseWriter, r *http.Request) bool {
+	userParam, err := app.readStringParam(r, "username")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return false
+	}
+
+	user := app.getUserContext(r)
+	if user.Username != *userParam {
+		app.unauthorizedActionResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// updateAccount applies the non-nil fields of input to the authenticated user's account.
+func (app *application) updateAccount(w http.ResponseWriter, r *http.Request, input patchAccountInput) {
+	user := app.getUserContext(r)
+
+	inputUser := &db.User{
+		DisplayName: input.DisplayName,
+		AvatarURL:   input.AvatarURL,
+	}
+	if input.Email != nil {
+		inputUser.Email = *input.Email
+	}
+	inputUser.Normalize()
+
+	inputUser.ValidateUpdateUser(app.models.Rules)
+	// an email of only whitespace would otherwise be taken as no email change
+	inputUser.Validator.Check(input.Email == nil || inputUser.Email != "", "email", "must be provided")
+
+	if !inputUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, inputUser.Validator.Errors)
+		return
+	}
+
+	dbUser, err := app.models.Users.GetByUsername(r.Context(), user.Username)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
 	}
 
-	if inputUser.Email != "" {
+	// a verified address that gets replaced is kept so that the change can be rolled back
+	var previousEmail string
+
+	if input.Email != nil {
+		if dbUser.Activated && !strings.EqualFold(dbUser.Email, inputUser.Email) {
+			previousEmail = dbUser.Email
+		}
+
 		dbUser.Email = inputUser.Email
 		dbUser.Activated = false
 	}
 
+	if input.DisplayName != nil {
+		dbUser.DisplayName = nilIfEmpty(*input.DisplayName)
+	}
+
+	if input.AvatarURL != nil {
+		dbUser.AvatarURL = nilIfEmpty(*input.AvatarURL)
+	}
+
+	// profile only changes don't require the email address to be verified again
+	credentialsChanged := input.Email != nil
+
 	tx, err := app.models.DB.Begin()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -686,7 +1553,9 @@ func (app *application) updateAccountHandler(w http.ResponseWriter, r *http.Requ
 	}
 	defer tx.Rollback()
 
-	err = app.models.Users.Update(dbUser)
+	models := app.models.WithTx(tx)
+
+	err = models.Users.Update(r.Context(), dbUser)
 	if err != nil {
 		switch {
 		case errors.Is(err, db.ErrDuplicateUsername):
@@ -695,64 +1564,144 @@ func (app *application) updateAccountHandler(w http.ResponseWriter, r *http.Requ
 		case errors.Is(err, db.ErrDuplicateEmail):
 			dbUser.Validator.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, dbUser.Validator.Errors)
+		case errors.Is(err, db.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	token, err := app.models.Tokens.Get(dbUser.ID, db.TokenScopeActivation)
-	if err != nil {
-		switch {
-		case errors.Is(err, db.ErrNotFound):
-		default:
+	var change *db.EmailChange
+
+	if previousEmail != "" {
+		change = &db.EmailChange{UserID: dbUser.ID, Email: previousEmail}
+
+		err = models.EmailHistory.Insert(r.Context(), change)
+		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 	}
 
-	if token != nil {
-		err = app.models.Tokens.Delete(dbUser.ID, db.TokenScopeActivation)
+	var newToken *db.Token
+
+	if credentialsChanged {
+		token, err := models.Tokens.Get(r.Context(), dbUser.ID, db.TokenScopeActivation)
+		if err != nil {
+			switch {
+			case errors.Is(err, db.ErrNotFound):
+			default:
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		if token != nil {
+			err = models.Tokens.Delete(r.Context(), dbUser.ID, db.TokenScopeActivation)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		newToken, err = models.Tokens.CreateToken(r.Context(), dbUser.ID, db.ActivationTokenTime, db.TokenScopeActivation)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 	}
 
-	newToken, err := app.models.Tokens.CreateToken(dbUser.ID, db.ActivationTokenTime, db.TokenScopeActivation)
+	err = tx.Commit()
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = tx.Commit()
+	if newToken != nil {
+		app.backgroundTask(func(ctx context.Context) {
+			data := app.activationEmailData(dbUser, newToken, app.config.BaseURL)
+
+			err := app.sendEmail(ctx, dbUser.ID, dbUser.Email, "mail.html", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+
+			app.logger.Info("email sent", "email", dbUser.Email, "type", "reset pwd")
+		})
+	}
+
+	if change != nil {
+		app.sendEmailChangedNotice(change, dbUser.Email)
+	}
+
+	app.loggerFor(r).Info("account updated", "event", eventAccountUpdated)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": dbUser}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
 
-	app.backgroundTask(func() {
-		data := map[string]any{
-			"activationToken": newToken.Plain,
+func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "available"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// list the authenticated user's active sessions. Pagination is offset based unless a
+// cursor parameter is given, an empty cursor selecting the first page of the keyset variant.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	qs := r.URL.Query()
+	v := validator.New()
+
+	var (
+		sessions []*db.Session
+		metadata db.Metadata
+		err      error
+	)
+
+	if qs.Has("cursor") {
+		filters := app.readCursorFilters(qs, v)
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
 		}
 
-		err = app.mailer.Send(dbUser.Email, "mail.html", data)
-		if err != nil {
-			app.logger.Error(err.Error())
+		sessions, metadata, err = app.models.Tokens.GetSessionsAfter(r.Context(), user.ID, filters)
+	} else {
+		filters := app.readFilters(qs, v)
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
 		}
 
-		app.logger.Info("email sent", "email", dbUser.Email, "type", "reset pwd")
-	})
+		sessions, metadata, err = app.models.Tokens.GetSessions(r.Context(), user.ID, filters)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrInvalidCursor):
+			app.failedValidationResponse(w, r, map[string]string{"cursor": "must be a valid cursor"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": dbUser}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}.withMetadata(metadata), nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.writeJSON(w, http.StatusOK, envelope{"status": "available"}, nil)
+func (app *application) versionHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"version": version, "commit": commit, "build_time": buildTime}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -2,9 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,6 +33,7 @@ func TestCreateUserHandler(t *testing.T) {
 		setup      func() error
 		wantStatus int
 		wantBody   envelope
+		wantToken  bool
 	}{
 		{
 			name: "valid payload",
@@ -43,8 +52,29 @@ func TestCreateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"email": "must be a valid email address",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"email": "must be a valid email address",
+					},
+				},
+			},
+		}, {
+			name: "over-length email",
+			payload: createUserInput{
+				Username: "testuser",
+				Email:    strings.Repeat("a", 243) + "@example.com",
+				Password: "Test1234!",
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody: envelope{
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"email": "must not be more than 254 characters long",
+					},
 				},
 			},
 		}, {
@@ -64,7 +94,7 @@ func TestCreateUserHandler(t *testing.T) {
 						Plain: &password,
 					},
 				}
-				err := app.models.Users.Create(user)
+				err := app.models.Users.Create(context.Background(), user)
 				if err != nil {
 					return err
 				}
@@ -72,8 +102,12 @@ func TestCreateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"username": "a user with this username already exists",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"username": "a user with this username already exists",
+					},
 				},
 			}}, {
 			name: "duplicate email",
@@ -93,7 +127,7 @@ func TestCreateUserHandler(t *testing.T) {
 					},
 				}
 
-				err := app.models.Users.Create(user)
+				err := app.models.Users.Create(context.Background(), user)
 				if err != nil {
 					return err
 				}
@@ -101,8 +135,44 @@ func TestCreateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"email": "a user with this email address already exists",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"email": "a user with this email address already exists",
+					},
+				},
+			},
+		},
+		{
+			name: "duplicate username and email",
+			payload: createUserInput{
+				Username: "testuser",
+				Email:    "testuser@example.com",
+				Password: "Test1234!",
+			},
+			setup: func() error {
+				password := "Test1234!"
+
+				user := &db.User{
+					Username: "testuser",
+					Email:    "testuser@example.com",
+					Password: db.Password{
+						Plain: &password,
+					},
+				}
+
+				return app.models.Users.Create(context.Background(), user)
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody: envelope{
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"username": "a user with this username already exists",
+						"email":    "a user with this email address already exists",
+					},
 				},
 			},
 		},
@@ -115,8 +185,12 @@ func TestCreateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"password": "must be 8-72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"password": "must be 8-72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol",
+					},
 				},
 			},
 		},
@@ -129,8 +203,12 @@ func TestCreateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"username": "must contain only letters and numbers",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"username": "must contain only letters and numbers",
+					},
 				},
 			},
 		}, {
@@ -142,8 +220,12 @@ func TestCreateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"email": "must be a valid email address",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"email": "must be a valid email address",
+					},
 				},
 			},
 		}, {
@@ -156,7 +238,10 @@ func TestCreateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusBadRequest,
 			wantBody: envelope{
-				"error": "request body contains unknown field \"name\"",
+				"error": apiError{
+					Code:    errCodeBadRequest,
+					Message: "request body contains unknown field \"name\"",
+				},
 			},
 		},
 	}
@@ -181,7 +266,7 @@ func TestCreateUserHandler(t *testing.T) {
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
 			if tt.wantStatus == http.StatusCreated {
-				dbUser, err := app.models.Users.GetByUsername(tt.payload.(createUserInput).Username)
+				dbUser, err := app.models.Users.GetByUsername(context.Background(), tt.payload.(createUserInput).Username)
 				fmt.Printf("%+v", dbUser)
 				assert.NoError(t, err)
 				assert.NotNil(t, dbUser)
@@ -189,12 +274,12 @@ func TestCreateUserHandler(t *testing.T) {
 				assert.False(t, dbUser.Activated)
 				assert.Equal(t, 1, dbUser.Version)
 
-				dbToken, err := app.models.Tokens.Get(dbUser.ID, db.TokenScopeActivation)
+				dbToken, err := app.models.Tokens.Get(context.Background(), dbUser.ID, db.TokenScopeActivation)
 				assert.NoError(t, err)
 				assert.NotNil(t, dbToken)
 				assert.Equal(t, dbUser.ID, dbToken.UserID)
 
-				permissions, err := app.models.Permissions.Get(dbUser.ID)
+				permissions, err := app.models.Permissions.Get(context.Background(), dbUser.ID)
 				assert.NoError(t, err)
 				assert.NotNil(t, permissions)
 				assert.Len(t, *permissions, 1)
@@ -233,6 +318,143 @@ func TestCreateUserHandler(t *testing.T) {
 	}
 }
 
+func TestCreateUserHandlerIdempotency(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	send := func(key string, payload createUserInput) (int, http.Header, envelope) {
+		jsonPayload, err := json.Marshal(payload)
+		assert.NoError(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/users/new", bytes.NewReader(jsonPayload))
+		assert.NoError(t, err)
+		req.Header.Set("Idempotency-Key", key)
+
+		res, err := ts.Client().Do(req)
+		assert.NoError(t, err)
+
+		return readResponse(t, res)
+	}
+
+	payload := createUserInput{
+		Username: "testuser",
+		Email:    "testuser@example.com",
+		Password: "Test1234!",
+	}
+
+	status, headers, firstBody := send("signup-key-1", payload)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Empty(t, headers.Get("Idempotent-Replayed"))
+
+	status, headers, replayBody := send("signup-key-1", payload)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "true", headers.Get("Idempotent-Replayed"))
+	assert.JSONEq(t, firstBody.JSON(), replayBody.JSON())
+
+	var count int
+	err := app.models.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// a different key is processed as a new request
+	status, _, _ = send("signup-key-2", payload)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	// a key sent again with another payload is rejected rather than replayed
+	other := payload
+	other.Username = "otheruser"
+	other.Email = "otheruser@example.com"
+
+	status, headers, body := send("signup-key-1", other)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Empty(t, headers.Get("Idempotent-Replayed"))
+	assert.Contains(t, body["error"].(map[string]any)["fields"], "Idempotency-Key")
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestCreateUserHandlerRedirectURL(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.AllowedRedirectOrigins = []string{"https://m.example.com"}
+	ts := newTestServer(t, app.routes())
+
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+
+	t.Run("Disallowed redirect target", func(t *testing.T) {
+		status, _, body := ts.post(t, "/v1/users/new", createUserInput{
+			Username:    "testuser",
+			Email:       "testuser@example.com",
+			Password:    "Test1234!",
+			RedirectURL: "https://evil.example.com",
+		})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, "must be an allowed redirect URL", body["error"].(map[string]any)["fields"].(map[string]any)["redirect_url"])
+
+		_, err := app.models.Users.GetByUsername(context.Background(), "testuser")
+		assert.ErrorIs(t, err, db.ErrNotFound)
+	})
+
+	t.Run("Allowed redirect target", func(t *testing.T) {
+		status, _, _ := ts.post(t, "/v1/users/new", createUserInput{
+			Username:    "testuser",
+			Email:       "testuser@example.com",
+			Password:    "Test1234!",
+			RedirectURL: "https://m.example.com",
+		})
+		assert.Equal(t, http.StatusCreated, status)
+
+		app.wg.Wait()
+		sent := mailer.Sent()
+		if assert.Len(t, sent, 1) {
+			assert.Regexp(t, `^https://m\.example\.com/activate\?token=`, sent[0].data.(map[string]any)["activationURL"])
+		}
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestCreateUserHandlerNormalizesInput(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	status, _, _ := ts.do(t, http.MethodPost, "/v1/users/new", "", createUserInput{
+		Username: " testuser ",
+		Email:    " TestUser@Example.com ",
+		Password: "Test1234!",
+	})
+	assert.Equal(t, http.StatusCreated, status)
+
+	user, err := app.models.Users.GetByUsername(context.Background(), "testuser")
+	assert.NoError(t, err)
+	assert.Equal(t, "testuser", user.Username)
+	assert.Equal(t, "testuser@example.com", user.Email)
+
+	err = app.models.Users.Activate(context.Background(), user.ID)
+	assert.NoError(t, err)
+
+	t.Run("Login with surrounding whitespace", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/authenticate", "", loginUserInput{Username: " testuser ", Password: "Test1234!"})
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Password is not trimmed", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/authenticate", "", loginUserInput{Username: "testuser", Password: " Test1234! "})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
 func TestActivateUserHandler(t *testing.T) {
 	app := newTestApplication(t)
 	ts := newTestServer(t, app.routes())
@@ -248,11 +470,11 @@ func TestActivateUserHandler(t *testing.T) {
 	}
 
 	setup := func(expiration time.Duration) (*db.Token, error) {
-		err := app.models.Users.Create(&validUser)
+		err := app.models.Users.Create(context.Background(), &validUser)
 		if err != nil {
 			return nil, err
 		}
-		validToken, err := app.models.Tokens.CreateToken(validUser.ID, expiration, db.TokenScopeActivation)
+		validToken, err := app.models.Tokens.CreateToken(context.Background(), validUser.ID, expiration, db.TokenScopeActivation)
 		if err != nil {
 			return nil, err
 		}
@@ -287,8 +509,12 @@ func TestActivateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"token": "must be 26 bytes long",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"token": "must be 26 bytes long",
+					},
 				},
 			},
 		},
@@ -303,8 +529,12 @@ func TestActivateUserHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"token": "invalid or expired activation token",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"token": "invalid or expired activation token",
+					},
 				},
 			},
 		},
@@ -330,17 +560,17 @@ func TestActivateUserHandler(t *testing.T) {
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
 			if tt.wantStatus == http.StatusOK {
-				activatedUser, err := app.models.Users.GetByUsername(validUser.Username)
+				activatedUser, err := app.models.Users.GetByUsername(context.Background(), validUser.Username)
 				assert.NoError(t, err)
 				assert.True(t, activatedUser.Activated)
 
 				// Check that the token has been deleted from the database.
-				_, err = app.models.Tokens.Get(validToken.UserID, db.TokenScopeActivation)
+				_, err = app.models.Tokens.Get(context.Background(), validToken.UserID, db.TokenScopeActivation)
 				if err != db.ErrNotFound {
 					t.Errorf("want token to be deleted from the database")
 				}
 
-				permissions, err := app.models.Permissions.Get(activatedUser.ID)
+				permissions, err := app.models.Permissions.Get(context.Background(), activatedUser.ID)
 				assert.NoError(t, err)
 				assert.NotNil(t, permissions)
 				assert.Contains(t, *permissions, db.PermissionWriteUser)
@@ -352,7 +582,7 @@ func TestActivateUserHandler(t *testing.T) {
 				err := app.models.DB.QueryRow("SELECT COUNT(*) FROM tokens").Scan(&count)
 				assert.NoError(t, err)
 
-				permissions, err := app.models.Permissions.Get(validUser.ID)
+				permissions, err := app.models.Permissions.Get(context.Background(), validUser.ID)
 				assert.NoError(t, err)
 				for _, p := range *permissions {
 					assert.NotEqual(t, p, db.PermissionWriteUser)
@@ -367,6 +597,49 @@ func TestActivateUserHandler(t *testing.T) {
 	}
 }
 
+func TestPermissionStages(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	app.config.Auth.SignupPermissions = nil
+	app.config.Auth.ActivationPermissions = []db.Permission{db.PermissionReadUser, db.PermissionWriteUser}
+
+	payload := createUserInput{
+		Username: "testuser",
+		Email:    "testuser@example.com",
+		Password: "Test1234!",
+	}
+
+	status, _, _ := ts.post(t, "/v1/users/new", payload)
+	assert.Equal(t, http.StatusCreated, status)
+
+	user, err := app.models.Users.GetByUsername(context.Background(), payload.Username)
+	assert.NoError(t, err)
+
+	permissions, err := app.models.Permissions.Get(context.Background(), user.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, *permissions)
+
+	// replace the emailed activation token with one we know the plain text of
+	err = app.models.Tokens.Delete(context.Background(), user.ID, db.TokenScopeActivation)
+	assert.NoError(t, err)
+
+	token, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.ActivationTokenTime, db.TokenScopeActivation)
+	assert.NoError(t, err)
+
+	status, _, _ = ts.put(t, "/v1/users/activate", tokenInput{Token: token.Plain})
+	assert.Equal(t, http.StatusOK, status)
+
+	permissions, err = app.models.Permissions.Get(context.Background(), user.ID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, db.Permissions{db.PermissionReadUser, db.PermissionWriteUser}, *permissions)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
 func TestCreateAuthTokenHandler(t *testing.T) {
 	app := newTestApplication(t)
 	ts := newTestServer(t, app.routes())
@@ -382,12 +655,12 @@ func TestCreateAuthTokenHandler(t *testing.T) {
 	}
 
 	setup := func() error {
-		err := app.models.Users.Create(&validUser)
+		err := app.models.Users.Create(context.Background(), &validUser)
 		if err != nil {
 			return err
 		}
 
-		err = app.models.Permissions.Add(validUser.ID, db.PermissionWriteUser, db.PermissionReadUser)
+		err = app.models.Permissions.Add(context.Background(), validUser.ID, db.PermissionWriteUser, db.PermissionReadUser)
 		if err != nil {
 			return err
 		}
@@ -420,7 +693,43 @@ func TestCreateAuthTokenHandler(t *testing.T) {
 			setup:      setup,
 			wantStatus: http.StatusUnauthorized,
 			wantBody: envelope{
-				"error": "invalid authentication credentials",
+				"error": apiError{
+					Code:    errCodeInvalidCredentials,
+					Message: "invalid authentication credentials",
+				},
+			},
+		},
+		{
+			name:       "Missing username and password",
+			payload:    loginUserInput{},
+			setup:      setup,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody: envelope{
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"username": "must be provided",
+						"password": "must be provided",
+					},
+				},
+			},
+		},
+		{
+			name: "Missing password",
+			payload: loginUserInput{
+				Username: validUser.Username,
+			},
+			setup:      setup,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody: envelope{
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"password": "must be provided",
+					},
+				},
 			},
 		},
 	}
@@ -443,34 +752,42 @@ func TestCreateAuthTokenHandler(t *testing.T) {
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
 			if tt.wantStatus == http.StatusOK {
-				dbAccessToken, err := app.models.Tokens.Get(validUser.ID, db.TokenScopeAccess)
+				dbAccessToken, err := app.models.Tokens.Get(context.Background(), validUser.ID, db.TokenScopeAccess)
 				assert.NoError(t, err)
 				assert.Equal(t, validUser.ID, dbAccessToken.UserID)
 				assert.Equal(t, db.TokenScopeAccess, dbAccessToken.Scope)
 				assert.WithinDuration(t, dbAccessToken.Expiry, time.Now().Add(db.AuthTokenTime), 10*time.Second)
+				assert.WithinDuration(t, dbAccessToken.CreatedAt, time.Now(), 10*time.Second)
 
-				dbRefreshToken, err := app.models.Tokens.Get(validUser.ID, db.TokenScopeRefresh)
+				dbRefreshToken, err := app.models.Tokens.Get(context.Background(), validUser.ID, db.TokenScopeRefresh)
 				assert.NoError(t, err)
 				assert.Equal(t, validUser.ID, dbRefreshToken.UserID)
 				assert.Equal(t, db.TokenScopeRefresh, dbRefreshToken.Scope)
 				assert.WithinDuration(t, dbRefreshToken.Expiry, time.Now().Add(db.RefreshTokenTime), 10*time.Second)
+				assert.WithinDuration(t, dbRefreshToken.CreatedAt, time.Now(), 10*time.Second)
 
-				permissions, err := app.models.Permissions.Get(validUser.ID)
+				permissions, err := app.models.Permissions.Get(context.Background(), validUser.ID)
 				assert.NoError(t, err)
 				assert.NotNil(t, permissions)
 				assert.Len(t, *permissions, 2)
 				assert.Contains(t, *permissions, db.PermissionWriteUser)
 				assert.Contains(t, *permissions, db.PermissionReadUser)
+
+				var wantPermissions []any
+				for _, p := range *permissions {
+					wantPermissions = append(wantPermissions, string(p))
+				}
+				assert.ElementsMatch(t, wantPermissions, body["permissions"])
 			} else {
 				var count int
 				err := app.models.DB.QueryRow("SELECT COUNT(*) FROM tokens").Scan(&count)
 				assert.NoError(t, err)
 				assert.Equal(t, 0, count)
 
-				user, err := app.models.Users.GetByUsername(validUser.Username)
+				user, err := app.models.Users.GetByUsername(context.Background(), validUser.Username)
 				assert.NoError(t, err)
 
-				permissions, err := app.models.Permissions.Get(user.ID)
+				permissions, err := app.models.Permissions.Get(context.Background(), user.ID)
 				assert.NoError(t, err)
 				assert.NotNil(t, permissions)
 				assert.Len(t, *permissions, 2)
@@ -490,6 +807,130 @@ func TestCreateAuthTokenHandler(t *testing.T) {
 	}
 }
 
+func TestCreateAuthTokenHandlerSingleSession(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	pwd := "Test1234!"
+
+	testCases := []struct {
+		name             string
+		singleSession    bool
+		wantFirstRevoked bool
+	}{
+		{
+			name:             "Single session enabled",
+			singleSession:    true,
+			wantFirstRevoked: true,
+		},
+		{
+			name:             "Single session disabled",
+			singleSession:    false,
+			wantFirstRevoked: false,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			app.config.Auth.SingleSession = tt.singleSession
+
+			validUser := db.User{
+				Username: "testuser",
+				Email:    "testuser@example.com",
+				Password: db.Password{
+					Plain: &pwd,
+				},
+			}
+			err := app.models.Users.Create(context.Background(), &validUser)
+			assert.NoError(t, err)
+
+			payload := loginUserInput{Username: validUser.Username, Password: pwd}
+
+			// first device
+			status, _, firstBody := ts.post(t, "/v1/users/authenticate", payload)
+			assert.Equal(t, http.StatusOK, status)
+
+			// second device
+			status, _, secondBody := ts.post(t, "/v1/users/authenticate", payload)
+			assert.Equal(t, http.StatusOK, status)
+
+			firstToken := firstBody["access_token"].(map[string]any)["token"].(string)
+			secondToken := secondBody["access_token"].(map[string]any)["token"].(string)
+
+			_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, db.HashToken(firstToken))
+			if tt.wantFirstRevoked {
+				assert.ErrorIs(t, err, db.ErrNotFound)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, db.HashToken(secondToken))
+			assert.NoError(t, err)
+
+			if !tt.singleSession {
+				// refreshing the first session revokes its access token, but not the second one's
+				firstRefresh := firstBody["refresh_token"].(map[string]any)["token"].(string)
+
+				status, _, _ = ts.post(t, "/v1/tokens/refresh", tokenInput{Token: firstRefresh})
+				assert.Equal(t, http.StatusOK, status)
+
+				_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, db.HashToken(firstToken))
+				assert.ErrorIs(t, err, db.ErrNotFound)
+
+				_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, db.HashToken(secondToken))
+				assert.NoError(t, err)
+			}
+
+			t.Cleanup(func() {
+				err := cleanup(app)
+				assert.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestCreateAuthTokenHandlerMaxActiveTokens(t *testing.T) {
+	app := newTestApplication(t)
+	app.models = db.NewModels(app.models.DB, app.models.Rules, 2)
+	ts := newTestServer(t, app.routes())
+
+	pwd := "Test1234!"
+
+	validUser := db.User{
+		Username: "testuser",
+		Email:    "testuser@example.com",
+		Password: db.Password{
+			Plain: &pwd,
+		},
+	}
+	err := app.models.Users.Create(context.Background(), &validUser)
+	assert.NoError(t, err)
+
+	payload := loginUserInput{Username: validUser.Username, Password: pwd}
+
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		status, _, body := ts.post(t, "/v1/users/authenticate", payload)
+		assert.Equal(t, http.StatusOK, status)
+
+		tokens = append(tokens, body["access_token"].(map[string]any)["token"].(string))
+	}
+
+	// the oldest session is evicted once the cap is exceeded
+	_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, db.HashToken(tokens[0]))
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	for _, token := range tokens[1:] {
+		_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, db.HashToken(token))
+		assert.NoError(t, err)
+	}
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
 func TestRefreshAuthTokenHandler(t *testing.T) {
 	app := newTestApplication(t)
 	ts := newTestServer(t, app.routes())
@@ -505,16 +946,20 @@ func TestRefreshAuthTokenHandler(t *testing.T) {
 	}
 
 	setup := func() (*db.Token, error) {
-		if err := app.models.Users.Create(&validUser); err != nil {
+		if err := app.models.Users.Create(context.Background(), &validUser); err != nil {
+			return nil, err
+		}
+
+		if err := app.models.Permissions.Add(context.Background(), validUser.ID, db.PermissionReadUser); err != nil {
 			return nil, err
 		}
 
-		_, err := app.models.Tokens.CreateToken(validUser.ID, db.AuthTokenTime, db.TokenScopeAccess)
+		_, err := app.models.Tokens.CreateToken(context.Background(), validUser.ID, db.AuthTokenTime, db.TokenScopeAccess)
 		if err != nil {
 			return nil, err
 		}
 
-		dbRefreshToken, err := app.models.Tokens.CreateToken(validUser.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+		dbRefreshToken, err := app.models.Tokens.CreateToken(context.Background(), validUser.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
 		if err != nil {
 			return nil, err
 		}
@@ -537,16 +982,16 @@ func TestRefreshAuthTokenHandler(t *testing.T) {
 		{
 			name: "Send an access token",
 			setup: func() (*db.Token, error) {
-				if err := app.models.Users.Create(&validUser); err != nil {
+				if err := app.models.Users.Create(context.Background(), &validUser); err != nil {
 					return nil, err
 				}
 
-				dbAuthToken, err := app.models.Tokens.CreateToken(validUser.ID, db.AuthTokenTime, db.TokenScopeAccess)
+				dbAuthToken, err := app.models.Tokens.CreateToken(context.Background(), validUser.ID, db.AuthTokenTime, db.TokenScopeAccess)
 				if err != nil {
 					return nil, err
 				}
 
-				_, err = app.models.Tokens.CreateToken(validUser.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+				_, err = app.models.Tokens.CreateToken(context.Background(), validUser.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
 				if err != nil {
 					return nil, err
 				}
@@ -555,7 +1000,29 @@ func TestRefreshAuthTokenHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnauthorized,
 			wantBody: envelope{
-				"error": "unknown or invalid refresh token",
+				"error": apiError{
+					Code:    errCodeInvalidRefreshToken,
+					Message: "unknown or invalid refresh token",
+				},
+			},
+		},
+		{
+			name: "Locked account",
+			setup: func() (*db.Token, error) {
+				token, err := setup()
+				if err != nil {
+					return nil, err
+				}
+
+				_, err = app.models.DB.Exec("UPDATE users SET locked = true WHERE id = $1", validUser.ID)
+				return token, err
+			},
+			wantStatus: http.StatusForbidden,
+			wantBody: envelope{
+				"error": apiError{
+					Code:    errCodeAccountLocked,
+					Message: "your account has been locked, please contact support",
+				},
 			},
 		},
 		{
@@ -566,8 +1033,12 @@ func TestRefreshAuthTokenHandler(t *testing.T) {
 			setup:      setup,
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"token": "must be 26 bytes long",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"token": "must be 26 bytes long",
+					},
 				},
 			},
 		},
@@ -599,17 +1070,19 @@ func TestRefreshAuthTokenHandler(t *testing.T) {
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
 			if tt.wantStatus == http.StatusOK {
-				dbAccessToken, err := app.models.Tokens.Get(validUser.ID, db.TokenScopeAccess)
+				dbAccessToken, err := app.models.Tokens.Get(context.Background(), validUser.ID, db.TokenScopeAccess)
 				assert.NoError(t, err)
 				assert.Equal(t, validUser.ID, dbAccessToken.UserID)
 				assert.Equal(t, db.TokenScopeAccess, dbAccessToken.Scope)
 				assert.WithinDuration(t, dbAccessToken.Expiry, time.Now().Add(db.AuthTokenTime), 10*time.Second)
 
-				dbRefreshToken, err := app.models.Tokens.Get(validUser.ID, db.TokenScopeRefresh)
+				dbRefreshToken, err := app.models.Tokens.Get(context.Background(), validUser.ID, db.TokenScopeRefresh)
 				assert.NoError(t, err)
 				assert.Equal(t, validUser.ID, dbRefreshToken.UserID)
 				assert.Equal(t, db.TokenScopeRefresh, dbRefreshToken.Scope)
 				assert.WithinDuration(t, dbRefreshToken.Expiry, time.Now().Add(db.RefreshTokenTime), 10*time.Second)
+
+				assert.Equal(t, []any{string(db.PermissionReadUser)}, body["permissions"])
 			} else {
 				var count int
 				err := app.models.DB.QueryRow("SELECT COUNT(*) FROM tokens").Scan(&count)
@@ -640,17 +1113,17 @@ func TestDeleteAuthTokenHandler(t *testing.T) {
 	}
 
 	setup := func() (*db.Token, error) {
-		err := app.models.Users.Insert(user)
+		err := app.models.Users.Insert(context.Background(), user)
 		if err != nil {
 			return nil, err
 		}
 
-		accessToken, err := app.models.Tokens.CreateToken(user.ID, db.AuthTokenTime, db.TokenScopeAccess)
+		accessToken, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.AuthTokenTime, db.TokenScopeAccess)
 		if err != nil {
 			return nil, err
 		}
 
-		_, err = app.models.Tokens.CreateToken(user.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+		_, err = app.models.Tokens.CreateToken(context.Background(), user.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
 		if err != nil {
 			return nil, err
 		}
@@ -681,7 +1154,10 @@ func TestDeleteAuthTokenHandler(t *testing.T) {
 				Token: "",
 			},
 			wantBody: envelope{
-				"error": "invalid or missing authentication token",
+				"error": apiError{
+					Code:    errCodeInvalidToken,
+					Message: "invalid or missing authentication token",
+				},
 			},
 		},
 		{
@@ -692,7 +1168,10 @@ func TestDeleteAuthTokenHandler(t *testing.T) {
 				Token: "invalidtoken",
 			},
 			wantBody: envelope{
-				"error": "invalid or missing authentication token",
+				"error": apiError{
+					Code:    errCodeInvalidToken,
+					Message: "invalid or missing authentication token",
+				},
 			},
 		},
 	}
@@ -728,10 +1207,10 @@ func TestDeleteAuthTokenHandler(t *testing.T) {
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
 			if tt.wantStatus == http.StatusOK {
-				_, err := app.models.Tokens.Get(user.ID, db.TokenScopeAccess)
+				_, err := app.models.Tokens.Get(context.Background(), user.ID, db.TokenScopeAccess)
 				assert.ErrorIs(t, err, db.ErrNotFound)
 
-				_, err = app.models.Tokens.Get(user.ID, db.TokenScopeRefresh)
+				_, err = app.models.Tokens.Get(context.Background(), user.ID, db.TokenScopeRefresh)
 				assert.ErrorIs(t, err, db.ErrNotFound)
 			} else {
 				var count int
@@ -748,6 +1227,174 @@ func TestDeleteAuthTokenHandler(t *testing.T) {
 	}
 }
 
+func TestDeleteAuthTokenHandlerWithRefreshToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	refreshToken, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+	assert.NoError(t, err)
+
+	// the access token has expired but hasn't been cleaned up yet
+	_, err = app.models.DB.Exec("UPDATE tokens SET expiry = NOW() - INTERVAL '1 minute' WHERE hash = $1", accessToken.Hash)
+	assert.NoError(t, err)
+
+	t.Run("Unknown refresh token", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodDelete, "/v1/tokens", "", tokenInput{Token: "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, errCodeInvalidRefreshToken, body["error"].(map[string]any)["code"])
+	})
+
+	t.Run("Access token used as refresh token", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/tokens", "", tokenInput{Token: accessToken.Plain})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Missing body", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/tokens", "", nil)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Valid refresh token", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodDelete, "/v1/tokens", "", tokenInput{Token: refreshToken.Plain})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "user successfully logged out", body["message"])
+
+		var count int
+		err := app.models.DB.QueryRow("SELECT COUNT(*) FROM tokens WHERE user_id = $1", user.ID).Scan(&count)
+		assert.NoError(t, err)
+		assert.Zero(t, count, "the user's access and refresh tokens must be revoked")
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestDeleteAuthTokenHandlerWithExpiredAccessToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	refreshToken, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+	assert.NoError(t, err)
+
+	// the access token has expired but hasn't been cleaned up yet
+	_, err = app.models.DB.Exec("UPDATE tokens SET expiry = NOW() - INTERVAL '1 minute' WHERE hash = $1", accessToken.Hash)
+	assert.NoError(t, err)
+
+	countTokens := func() int {
+		var count int
+		err := app.models.DB.QueryRow("SELECT COUNT(*) FROM tokens WHERE user_id = $1", user.ID).Scan(&count)
+		assert.NoError(t, err)
+		return count
+	}
+
+	t.Run("Without refresh token", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodDelete, "/v1/tokens", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, errCodeInvalidToken, body["error"].(map[string]any)["code"])
+		assert.Equal(t, 2, countTokens())
+	})
+
+	t.Run("Invalid refresh token", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodDelete, "/v1/tokens", accessToken.Plain, tokenInput{Token: "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, errCodeInvalidRefreshToken, body["error"].(map[string]any)["code"])
+		assert.Equal(t, 2, countTokens())
+	})
+
+	t.Run("Valid refresh token", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodDelete, "/v1/tokens", accessToken.Plain, tokenInput{Token: refreshToken.Plain})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "user successfully logged out", body["message"])
+		assert.Zero(t, countTokens(), "the user's access and refresh tokens must be revoked")
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestExtendAuthTokenHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	issuedAgo := func(t *testing.T, token *db.Token, ago time.Duration) {
+		_, err := app.models.DB.Exec("UPDATE tokens SET created_at = $1 WHERE hash = $2", time.Now().Add(-ago), token.Hash)
+		assert.NoError(t, err)
+	}
+
+	t.Run("Requires authentication", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/tokens/extend", "", nil)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Within the max session lifetime", func(t *testing.T) {
+		issuedAgo(t, accessToken, time.Hour)
+
+		status, _, body := ts.do(t, http.MethodPost, "/v1/tokens/extend", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+
+		access := body["access_token"].(map[string]any)
+		plain := access["token"].(string)
+		assert.NotEqual(t, accessToken.Plain, plain)
+
+		expiry, err := time.Parse(time.RFC3339, access["expiry"].(string))
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(db.AuthTokenTime), expiry, 5*time.Second)
+
+		newToken, err := app.models.Tokens.GetByHash(context.Background(), db.TokenScopeAccess, db.HashToken(plain))
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID, newToken.UserID)
+		assert.WithinDuration(t, time.Now().Add(-time.Hour), newToken.CreatedAt, 5*time.Second, "the session start must be kept")
+
+		// the old token is revoked
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/extend", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+
+		accessToken = newToken
+		accessToken.Plain = plain
+	})
+
+	t.Run("Expiry is capped by the max session lifetime", func(t *testing.T) {
+		issuedAgo(t, accessToken, app.config.Auth.MaxSessionLifetime-time.Hour)
+
+		status, _, body := ts.do(t, http.MethodPost, "/v1/tokens/extend", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+
+		access := body["access_token"].(map[string]any)
+		expiry, err := time.Parse(time.RFC3339, access["expiry"].(string))
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expiry, 5*time.Second)
+
+		accessToken = &db.Token{Plain: access["token"].(string)}
+		accessToken.Hash = db.HashToken(accessToken.Plain)
+	})
+
+	t.Run("Beyond the max session lifetime", func(t *testing.T) {
+		issuedAgo(t, accessToken, app.config.Auth.MaxSessionLifetime+time.Minute)
+
+		status, _, body := ts.do(t, http.MethodPost, "/v1/tokens/extend", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, errCodeSessionExpired, body["error"].(map[string]any)["code"])
+
+		_, err := app.models.Tokens.GetByHash(context.Background(), db.TokenScopeAccess, accessToken.Hash)
+		assert.NoError(t, err, "a rejected extension leaves the token as it is")
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
 func TestRequestPasswordResetHandler(t *testing.T) {
 	app := newTestApplication(t)
 	ts := newTestServer(t, app.routes())
@@ -763,7 +1410,7 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 	}
 
 	setup := func() error {
-		err := app.models.Users.Create(&validUser)
+		err := app.models.Users.Create(context.Background(), &validUser)
 		if err != nil {
 			return err
 		}
@@ -777,6 +1424,7 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 		setup      func() error
 		wantStatus int
 		wantBody   envelope
+		wantToken  bool
 	}{
 		{
 			name: "valid payload",
@@ -785,6 +1433,8 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 			},
 			setup:      setup,
 			wantStatus: http.StatusOK,
+			wantBody:   envelope{"message": passwordResetRequestedMessage},
+			wantToken:  true,
 		}, {
 			name: "invalid email",
 			payload: requestPwdResetInput{
@@ -793,20 +1443,23 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 			setup:      setup,
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"email": "must be a valid email address",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"email": "must be a valid email address",
+					},
 				},
 			},
 		}, {
+			// unknown addresses get the same answer so that the endpoint doesn't reveal which are registered
 			name: "non-existent email",
 			payload: requestPwdResetInput{
 				Email: "testuser1@example.com",
 			},
 			setup:      setup,
-			wantStatus: http.StatusUnauthorized,
-			wantBody: envelope{
-				"error": "invalid authentication credentials",
-			},
+			wantStatus: http.StatusOK,
+			wantBody:   envelope{"message": passwordResetRequestedMessage},
 		},
 	}
 
@@ -827,8 +1480,8 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
-			if tt.wantStatus == http.StatusOK {
-				dbToken, err := app.models.Tokens.Get(validUser.ID, db.TokenScopeResetPwd)
+			if tt.wantToken {
+				dbToken, err := app.models.Tokens.Get(context.Background(), validUser.ID, db.TokenScopeResetPwd)
 				assert.NoError(t, err)
 				assert.Equal(t, validUser.ID, dbToken.UserID)
 				assert.Equal(t, db.TokenScopeResetPwd, dbToken.Scope)
@@ -848,27 +1501,179 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 	}
 }
 
-func TestUpdatePasswordHandler(t *testing.T) {
+func TestPasswordResetOTP(t *testing.T) {
 	app := newTestApplication(t)
+	app.config.Auth.PasswordResetMode = passwordResetOTP
+	app.config.Auth.PasswordResetCooldown = 0
 	ts := newTestServer(t, app.routes())
 
-	pwd := "Test1234!"
+	mailer := &recordingMailer{}
+	app.mailer = mailer
 
-	validUser := db.User{
-		Username: "testuser",
-		Email:    "testuser@example.com",
-		Password: db.Password{
-			Plain: &pwd,
-		},
-	}
+	user, _ := createTestUser(t, app, "testuser")
+
+	// requestOTP issues a new OTP and returns it as emailed to the user
+	requestOTP := func(t *testing.T) string {
+		status, _, body := ts.post(t, "/v1/users/password/reset", requestPwdResetInput{Email: user.Email})
+		assert.Equal(t, http.StatusOK, status)
+		assert.NotContains(t, body, "token", "the OTP must only be sent by email")
+
+		app.wg.Wait()
+
+		sent := mailer.Sent()
+		last := sent[len(sent)-1]
+		assert.Equal(t, "reset_pwd_otp.html", last.templateFile)
+
+		otp := last.data.(map[string]any)["otp"].(string)
+		assert.Regexp(t, `^[0-9]{6}$`, otp)
+		return otp
+	}
+
+	redeem := func(t *testing.T, otp, password string) (int, envelope) {
+		status, _, body := ts.put(t, "/v1/users/password/update/otp", updatePwdOTPInput{Email: user.Email, OTP: otp, Password: password})
+		return status, body
+	}
+
+	wrongOTP := func(otp string) string {
+		if otp == "000000" {
+			return "000001"
+		}
+		return "000000"
+	}
+
+	t.Run("Malformed OTP", func(t *testing.T) {
+		status, body := redeem(t, "12ab56", "NewPass1234!")
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, "must be 6 digits", body["error"].(map[string]any)["fields"].(map[string]any)["otp"])
+	})
+
+	t.Run("Wrong OTPs revoke it after the attempt limit", func(t *testing.T) {
+		otp := requestOTP(t)
+
+		for i := 0; i < db.MaxTokenAttempts; i++ {
+			status, body := redeem(t, wrongOTP(otp), "NewPass1234!")
+			assert.Equal(t, http.StatusUnauthorized, status)
+			assert.Equal(t, errCodeInvalidCredentials, body["error"].(map[string]any)["code"])
+		}
+
+		status, _ := redeem(t, otp, "NewPass1234!")
+		assert.Equal(t, http.StatusUnauthorized, status, "the OTP must be revoked after too many wrong guesses")
+	})
+
+	t.Run("Expired OTP", func(t *testing.T) {
+		otp := requestOTP(t)
+
+		_, err := app.models.DB.Exec("UPDATE tokens SET expiry = NOW() - INTERVAL '1 minute' WHERE user_id = $1", user.ID)
+		assert.NoError(t, err)
+
+		status, _ := redeem(t, otp, "NewPass1234!")
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Requesting a new OTP doesn't reset the throttle", func(t *testing.T) {
+		throttle := app.otpThrottle
+		app.otpThrottle = newLoginThrottle(2, time.Minute, time.Minute, time.Hour)
+		defer func() { app.otpThrottle = throttle }()
+
+		for i := 0; i < 2; i++ {
+			otp := requestOTP(t)
+			status, _ := redeem(t, wrongOTP(otp), "NewPass1234!")
+			assert.Equal(t, http.StatusUnauthorized, status)
+		}
+
+		otp := requestOTP(t)
+		status, _ := redeem(t, otp, "NewPass1234!")
+		assert.Equal(t, http.StatusTooManyRequests, status, "even the correct OTP waits out the throttle")
+	})
+
+	t.Run("Correct OTP", func(t *testing.T) {
+		otp := requestOTP(t)
+
+		status, body := redeem(t, otp, "NewPass1234!")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "password successfully updated", body["message"])
+
+		dbUser, err := app.models.Users.GetByEmail(context.Background(), user.Email)
+		assert.NoError(t, err)
+		match, err := dbUser.Password.Compare("NewPass1234!")
+		assert.NoError(t, err)
+		assert.True(t, match)
+
+		status, _ = redeem(t, otp, "Another1234!")
+		assert.Equal(t, http.StatusUnauthorized, status, "the OTP can only be used once")
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestRequestPasswordResetHandlerCooldown(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.Auth.PasswordResetCooldown = 5 * time.Minute
+	ts := newTestServer(t, app.routes())
+
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+
+	user, _ := createTestUser(t, app, "testuser")
+
+	status, _, first := ts.post(t, "/v1/users/password/reset", requestPwdResetInput{Email: user.Email})
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _, second := ts.post(t, "/v1/users/password/reset", requestPwdResetInput{Email: user.Email})
+	assert.Equal(t, http.StatusOK, status, "a throttled request still reports success")
+	assert.Equal(t, first["message"], second["message"])
+
+	app.wg.Wait()
+	assert.Len(t, mailer.Sent(), 1, "the second request must not send another email")
+
+	assert.NotContains(t, first, "token", "the token must only be sent by email")
+
+	// the first token stays usable
+	dbToken, err := app.models.Tokens.Get(context.Background(), user.ID, db.TokenScopeResetPwd)
+	assert.NoError(t, err)
+	assert.Equal(t, db.HashToken(mailer.Sent()[0].data.(map[string]any)["resetPasswordToken"].(string)), dbToken.Hash)
+
+	t.Run("A new email is sent once the cooldown has passed", func(t *testing.T) {
+		_, err := app.models.DB.Exec("UPDATE users SET last_reset_sent_at = NOW() - INTERVAL '6 minutes' WHERE id = $1", user.ID)
+		assert.NoError(t, err)
+
+		status, _, _ := ts.post(t, "/v1/users/password/reset", requestPwdResetInput{Email: user.Email})
+		assert.Equal(t, http.StatusOK, status)
+
+		app.wg.Wait()
+		assert.Len(t, mailer.Sent(), 2)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestUpdatePasswordHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	pwd := "Test1234!"
+
+	validUser := db.User{
+		Username: "testuser",
+		Email:    "testuser@example.com",
+		Password: db.Password{
+			Plain: &pwd,
+		},
+	}
 
 	setup := func(expiration time.Duration) (*db.Token, error) {
-		err := app.models.Users.Create(&validUser)
+		err := app.models.Users.Create(context.Background(), &validUser)
 		if err != nil {
 			return nil, err
 		}
 
-		token, err := app.models.Tokens.CreateToken(validUser.ID, expiration, db.TokenScopeResetPwd)
+		token, err := app.models.Tokens.CreateToken(context.Background(), validUser.ID, expiration, db.TokenScopeResetPwd)
 		if err != nil {
 			return nil, err
 		}
@@ -882,6 +1687,7 @@ func TestUpdatePasswordHandler(t *testing.T) {
 		setup      func() (*db.Token, error)
 		wantStatus int
 		wantBody   envelope
+		wantToken  bool
 	}{
 		{
 			name: "valid payload",
@@ -911,8 +1717,12 @@ func TestUpdatePasswordHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnprocessableEntity,
 			wantBody: envelope{
-				"error": map[string]string{
-					"password": "must be 8-72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol",
+				"error": apiError{
+					Code:    errCodeValidationFailed,
+					Message: "the request contains invalid fields",
+					Fields: map[string]string{
+						"password": "must be 8-72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol",
+					},
 				},
 			},
 		}, {
@@ -929,7 +1739,10 @@ func TestUpdatePasswordHandler(t *testing.T) {
 			},
 			wantStatus: http.StatusUnauthorized,
 			wantBody: envelope{
-				"error": "invalid authentication credentials",
+				"error": apiError{
+					Code:    errCodeInvalidCredentials,
+					Message: "invalid authentication credentials",
+				},
 			},
 		},
 	}
@@ -954,7 +1767,7 @@ func TestUpdatePasswordHandler(t *testing.T) {
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
 			if tt.wantStatus == http.StatusOK {
-				user, err := app.models.Users.GetByUsername(validUser.Username)
+				user, err := app.models.Users.GetByUsername(context.Background(), validUser.Username)
 				assert.NoError(t, err)
 				assert.Equal(t, 2, user.Version)
 			}
@@ -968,6 +1781,67 @@ func TestUpdatePasswordHandler(t *testing.T) {
 	}
 }
 
+func TestUpdatePasswordHandlerAttempts(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	pwd := "Test1234!"
+
+	setup := func() *db.Token {
+		user := &db.User{
+			Username: "testuser",
+			Email:    "testuser@example.com",
+			Password: db.Password{
+				Plain: &pwd,
+			},
+		}
+		err := app.models.Users.Create(context.Background(), user)
+		assert.NoError(t, err)
+
+		token, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.ResetPwdTokenTime, db.TokenScopeResetPwd)
+		assert.NoError(t, err)
+
+		return token
+	}
+
+	t.Run("Token is revoked after too many failed attempts", func(t *testing.T) {
+		token := setup()
+
+		for i := 0; i < db.MaxTokenAttempts; i++ {
+			status, _, _ := ts.put(t, "/v1/users/password/update", updatePwdInput{Token: token.Plain, Password: "weak"})
+			assert.Equal(t, http.StatusUnprocessableEntity, status)
+		}
+
+		status, _, _ := ts.put(t, "/v1/users/password/update", updatePwdInput{Token: token.Plain, Password: "NewPassword123!"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		t.Cleanup(func() {
+			err := cleanup(app)
+			assert.NoError(t, err)
+		})
+	})
+
+	t.Run("Token survives fewer failed attempts and is consumed on success", func(t *testing.T) {
+		token := setup()
+
+		for i := 0; i < db.MaxTokenAttempts-1; i++ {
+			status, _, _ := ts.put(t, "/v1/users/password/update", updatePwdInput{Token: token.Plain, Password: "weak"})
+			assert.Equal(t, http.StatusUnprocessableEntity, status)
+		}
+
+		status, _, _ := ts.put(t, "/v1/users/password/update", updatePwdInput{Token: token.Plain, Password: "NewPassword123!"})
+		assert.Equal(t, http.StatusOK, status)
+
+		status, _, _ = ts.put(t, "/v1/users/password/update", updatePwdInput{Token: token.Plain, Password: "OtherPassword123!"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		t.Cleanup(func() {
+			err := cleanup(app)
+			assert.NoError(t, err)
+		})
+	})
+}
+
 func TestGetAccountHandler(t *testing.T) {
 	app := newTestApplication(t)
 	ts := newTestServer(t, app.routes())
@@ -985,27 +1859,27 @@ func TestGetAccountHandler(t *testing.T) {
 	}
 
 	setup := func(expiration time.Duration) (*db.Token, error) {
-		err := app.models.Users.Create(&validUser)
+		err := app.models.Users.Create(context.Background(), &validUser)
 		if err != nil {
 			return nil, err
 		}
 
-		err = app.models.Users.Activate(validUser.ID)
+		err = app.models.Users.Activate(context.Background(), validUser.ID)
 		if err != nil {
 			return nil, err
 		}
 
-		dbAuthToken, err := app.models.Tokens.CreateToken(validUser.ID, expiration, db.TokenScopeAccess)
+		dbAuthToken, err := app.models.Tokens.CreateToken(context.Background(), validUser.ID, expiration, db.TokenScopeAccess)
 		if err != nil {
 			return nil, err
 		}
 
-		_, err = app.models.Tokens.CreateToken(validUser.ID, expiration, db.TokenScopeRefresh)
+		_, err = app.models.Tokens.CreateToken(context.Background(), validUser.ID, expiration, db.TokenScopeRefresh)
 		if err != nil {
 			return nil, err
 		}
 
-		err = app.models.Permissions.Add(validUser.ID, db.PermissionReadUser)
+		err = app.models.Permissions.Add(context.Background(), validUser.ID, db.PermissionReadUser)
 		if err != nil {
 			return nil, err
 		}
@@ -1123,6 +1997,72 @@ func TestGetAccountHandler(t *testing.T) {
 	}
 }
 
+func TestGetAccountHandlerETag(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser, db.PermissionWriteUser)
+
+	get := func(t *testing.T, etag string) (int, http.Header) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/users/account/testuser", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+accessToken.Plain)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		res, err := ts.Client().Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		if res.StatusCode == http.StatusNotModified {
+			assert.Empty(t, body)
+		}
+
+		return res.StatusCode, res.Header
+	}
+
+	status, headers := get(t, "")
+	assert.Equal(t, http.StatusOK, status)
+	etag := headers.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	t.Run("Matching ETag", func(t *testing.T) {
+		status, headers := get(t, etag)
+		assert.Equal(t, http.StatusNotModified, status)
+		assert.Equal(t, etag, headers.Get("ETag"))
+	})
+
+	t.Run("Stale ETag", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPatch, "/v1/users/account/testuser", accessToken.Plain, map[string]any{"display_name": "Test User"})
+		assert.Equal(t, http.StatusOK, status)
+
+		status, headers := get(t, etag)
+		assert.Equal(t, http.StatusOK, status)
+		assert.NotEqual(t, etag, headers.Get("ETag"))
+	})
+
+	t.Run("Lock changes the ETag", func(t *testing.T) {
+		_, headers := get(t, "")
+		etag := headers.Get("ETag")
+
+		err := app.models.Users.Lock(context.Background(), user.ID)
+		assert.NoError(t, err)
+		err = app.models.Users.Unlock(context.Background(), user.ID)
+		assert.NoError(t, err)
+
+		status, _ := get(t, etag)
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
 func TestUpdateAccountHandler(t *testing.T) {
 	app := newTestApplication(t)
 	ts := newTestServer(t, app.routes())
@@ -1136,27 +2076,27 @@ func TestUpdateAccountHandler(t *testing.T) {
 	}
 
 	setup := func(expiration time.Duration) (*db.Token, error) {
-		err := app.models.Users.Create(&validUser)
+		err := app.models.Users.Create(context.Background(), &validUser)
 		if err != nil {
 			return nil, err
 		}
 
-		err = app.models.Users.Activate(validUser.ID)
+		err = app.models.Users.Activate(context.Background(), validUser.ID)
 		if err != nil {
 			return nil, err
 		}
 
-		dbAuthToken, err := app.models.Tokens.CreateToken(validUser.ID, expiration, db.TokenScopeAccess)
+		dbAuthToken, err := app.models.Tokens.CreateToken(context.Background(), validUser.ID, expiration, db.TokenScopeAccess)
 		if err != nil {
 			return nil, err
 		}
 
-		_, err = app.models.Tokens.CreateToken(validUser.ID, expiration, db.TokenScopeRefresh)
+		_, err = app.models.Tokens.CreateToken(context.Background(), validUser.ID, expiration, db.TokenScopeRefresh)
 		if err != nil {
 			return nil, err
 		}
 
-		err = app.models.Permissions.Add(validUser.ID, db.PermissionWriteUser, db.PermissionReadUser)
+		err = app.models.Permissions.Add(context.Background(), validUser.ID, db.PermissionWriteUser, db.PermissionReadUser)
 		if err != nil {
 			return nil, err
 		}
@@ -1182,21 +2122,6 @@ func TestUpdateAccountHandler(t *testing.T) {
 				}
 				return token, nil
 			},
-			payload: updateAccountInput{
-				Email:    "testuser1@example.com",
-				Password: "Abcd1234!",
-			},
-			wantStatus: http.StatusOK,
-		},
-		{
-			name: "Password omitted from payload",
-			setup: func() (*db.Token, error) {
-				token, err := setup(db.AuthTokenTime)
-				if err != nil {
-					return nil, err
-				}
-				return token, nil
-			},
 			payload: updateAccountInput{
 				Email: "testuser1@example.com",
 			},
@@ -1212,7 +2137,7 @@ func TestUpdateAccountHandler(t *testing.T) {
 				return token, nil
 			},
 			payload: updateAccountInput{
-				Password: "Abcd1234!",
+				DisplayName: strPtr("Test User"),
 			},
 			wantStatus: http.StatusOK,
 		}, {
@@ -1226,12 +2151,14 @@ func TestUpdateAccountHandler(t *testing.T) {
 			},
 			username: strPtr("testuser1"),
 			payload: updateAccountInput{
-				Email:    "abcd@example.com",
-				Password: "Abcd1234!",
+				Email: "abcd@example.com",
 			},
 			wantStatus: http.StatusForbidden,
 			wantBody: envelope{
-				"error": "you do not have permission to perform this action",
+				"error": apiError{
+					Code:    errCodeForbidden,
+					Message: "you do not have permission to perform this action",
+				},
 			},
 		},
 	}
@@ -1279,22 +2206,1028 @@ func TestUpdateAccountHandler(t *testing.T) {
 			assert.JSONEq(t, tt.wantBody.JSON(), body.JSON(), "want %s; got %s", tt.wantBody.JSON(), body.JSON())
 
 			if tt.wantStatus == http.StatusOK {
-				user, err := app.models.Users.GetByUsername(username)
+				user, err := app.models.Users.GetByUsername(context.Background(), username)
 				assert.NoError(t, err)
 
 				if tt.payload.Email != "" {
 					assert.Equal(t, tt.payload.Email, user.Email)
 				}
 
-				if tt.payload.Password != "" {
-					match, err := user.Password.Compare(tt.payload.Password)
-					assert.NoError(t, err)
+				// bumped once by the activation and once by the update
+				assert.Equal(t, 3, user.Version)
+			}
+
+			t.Cleanup(func() {
+				err := cleanup(app)
+				assert.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+
+	_, otherToken := createTestUser(t, app, "otheruser", db.PermissionReadUser, db.PermissionWriteUser)
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser, db.PermissionWriteUser)
+
+	change := func(t *testing.T, token string, input changePwdInput) (int, envelope) {
+		status, _, body := ts.do(t, http.MethodPut, "/v1/users/account/testuser/password", token, input)
+		return status, body
+	}
+
+	login := func(t *testing.T, password string) int {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/authenticate", "", loginUserInput{Username: user.Username, Password: password})
+		return status
+	}
+
+	t.Run("Only the owner can change the password", func(t *testing.T) {
+		status, _ := change(t, otherToken.Plain, changePwdInput{CurrentPassword: "Test1234!", NewPassword: "NewPass1234!"})
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Invalid new password", func(t *testing.T) {
+		status, body := change(t, accessToken.Plain, changePwdInput{CurrentPassword: "Test1234!", NewPassword: "short"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Contains(t, body["error"].(map[string]any)["fields"], "new_password")
+	})
+
+	t.Run("Incorrect current password", func(t *testing.T) {
+		status, body := change(t, accessToken.Plain, changePwdInput{CurrentPassword: "Wrong1234!", NewPassword: "NewPass1234!"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, "is incorrect", body["error"].(map[string]any)["fields"].(map[string]any)["current_password"])
+
+		assert.Equal(t, http.StatusOK, login(t, "Test1234!"), "the password must be unchanged")
+	})
+
+	t.Run("New password equal to the current one", func(t *testing.T) {
+		status, body := change(t, accessToken.Plain, changePwdInput{CurrentPassword: "Test1234!", NewPassword: "Test1234!"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Contains(t, body["error"].(map[string]any)["fields"], "new_password")
+	})
+
+	t.Run("Correct current password", func(t *testing.T) {
+		resetToken, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.ResetPwdTokenTime, db.TokenScopeResetPwd)
+		assert.NoError(t, err)
+
+		otherSession, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.AuthTokenTime, db.TokenScopeAccess)
+		assert.NoError(t, err)
+
+		status, body := change(t, accessToken.Plain, changePwdInput{CurrentPassword: "Test1234!", NewPassword: "NewPass1234!"})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "password successfully updated", body["message"])
+
+		assert.Equal(t, http.StatusOK, login(t, "NewPass1234!"))
+		assert.Equal(t, http.StatusUnauthorized, login(t, "Test1234!"))
+
+		// an outstanding reset link can't undo the change
+		status, _, _ = ts.put(t, "/v1/users/password/update", updatePwdInput{Token: resetToken.Plain, Password: "Other1234!"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		// only the session that changed the password survives
+		_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, otherSession.Hash)
+		assert.ErrorIs(t, err, db.ErrNotFound)
+
+		_, err = app.models.Users.GetToken(context.Background(), db.TokenScopeAccess, accessToken.Hash)
+		assert.NoError(t, err)
+
+		app.wg.Wait()
+		sent := mailer.Sent()
+		if assert.NotEmpty(t, sent) {
+			assert.Equal(t, "password_changed.html", sent[len(sent)-1].templateFile)
+		}
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestDeleteAccountHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin, _ := createTestUser(t, app, "admin", db.PermissionAdminUser)
+	other, otherToken := createTestUser(t, app, "otheruser", db.PermissionReadUser)
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser, db.PermissionWriteUser)
+
+	_, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+	assert.NoError(t, err)
+	_, err = app.models.Tokens.CreateImpersonationToken(context.Background(), other.ID, user.ID, time.Minute)
+	assert.NoError(t, err)
+
+	question := &db.SecurityQuestion{UserID: user.ID, Question: "Name of your first pet?"}
+	assert.NoError(t, question.SetAnswer("Mister Fluffy"))
+	assert.NoError(t, app.models.SecurityQuestions.Replace(context.Background(), user.ID, []*db.SecurityQuestion{question}))
+	assert.NoError(t, app.models.EmailHistory.Insert(context.Background(), &db.EmailChange{UserID: user.ID, Email: "previous@example.com"}))
+	assert.NoError(t, app.models.Audit.Insert(context.Background(), &db.AuditEvent{ActorID: admin.ID, TargetUserID: user.ID, Action: db.AuditActionLock}))
+
+	t.Run("Requires authentication", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/users/account/testuser", "", nil)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Only the owner can delete the account", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/users/account/testuser", otherToken.Plain, nil)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Requires fresh authentication", func(t *testing.T) {
+		_, err := app.models.DB.Exec("UPDATE tokens SET authenticated_at = NOW() - INTERVAL '1 hour' WHERE hash = $1", accessToken.Hash)
+		assert.NoError(t, err)
+		defer app.models.DB.Exec("UPDATE tokens SET authenticated_at = NOW() WHERE hash = $1", accessToken.Hash)
+
+		status, _, body := ts.do(t, http.MethodDelete, "/v1/users/account/testuser", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, errCodeReauthenticationRequired, body["error"].(map[string]any)["code"])
+	})
+
+	t.Run("Deletes the account and everything that belongs to it", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/users/account/testuser", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusNoContent, status)
+
+		_, err := app.models.Users.GetByUsername(context.Background(), "testuser")
+		assert.ErrorIs(t, err, db.ErrNotFound)
+
+		for _, query := range []string{
+			"SELECT COUNT(*) FROM tokens WHERE user_id = $1 OR impersonator_id = $1",
+			"SELECT COUNT(*) FROM user_permissions WHERE user_id = $1",
+			"SELECT COUNT(*) FROM security_questions WHERE user_id = $1",
+			"SELECT COUNT(*) FROM email_history WHERE user_id = $1",
+		} {
+			var count int
+			err := app.models.DB.QueryRow(query, user.ID).Scan(&count)
+			assert.NoError(t, err)
+			assert.Zero(t, count, query)
+		}
+
+		// the audit trail is kept without the deleted user
+		var target sql.NullInt64
+		err = app.models.DB.QueryRow("SELECT target_user_id FROM audit_log WHERE actor_id = $1", admin.ID).Scan(&target)
+		assert.NoError(t, err)
+		assert.False(t, target.Valid)
+
+		// the other accounts are untouched
+		status, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", otherToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Deleted account can't log in", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/authenticate", "", loginUserInput{Username: "testuser", Password: "Test1234!"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestAccountDeletionRouteDisabled(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+	ts := newTestServer(t, app.routes())
+
+	status, _, _ := ts.do(t, http.MethodDelete, "/v1/users/account/testuser", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+}
+
+func TestListSessionsHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, token := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	for i := 0; i < 4; i++ {
+		_, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.AuthTokenTime, db.TokenScopeAccess)
+		assert.NoError(t, err)
+	}
+
+	t.Run("Cursor pagination has no gaps or duplicates", func(t *testing.T) {
+		seen := map[string]bool{}
+		cursor := ""
+		pages := 0
+
+		for {
+			status, _, body := ts.do(t, http.MethodGet, "/v1/users/sessions?page_size=2&cursor="+cursor, token.Plain, nil)
+			assert.Equal(t, http.StatusOK, status)
+
+			sessions := body["sessions"].([]any)
+			assert.LessOrEqual(t, len(sessions), 2)
+
+			for _, s := range sessions {
+				id := s.(map[string]any)["id"].(string)
+				assert.False(t, seen[id], "session %s returned twice", id)
+				seen[id] = true
+			}
+
+			pages++
+			next, _ := body["metadata"].(map[string]any)["next_cursor"].(string)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+
+		assert.Len(t, seen, 5)
+		assert.Equal(t, 3, pages)
+	})
+
+	t.Run("Offset pagination", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodGet, "/v1/users/sessions?page=3&page_size=2", token.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Len(t, body["sessions"], 1)
+
+		metadata := body["metadata"].(map[string]any)
+		assert.Equal(t, float64(5), metadata["total_records"])
+		assert.Equal(t, float64(3), metadata["last_page"])
+	})
+
+	t.Run("Invalid cursor", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodGet, "/v1/users/sessions?cursor=not-a-cursor", token.Plain, nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestGetAccountPermissionsHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	testCases := []struct {
+		name            string
+		callerPerms     []db.Permission
+		path            string
+		wantStatus      int
+		wantPermissions []any
+	}{
+		{
+			name:            "Self view",
+			callerPerms:     []db.Permission{db.PermissionReadUser},
+			path:            "/v1/users/account/caller/permissions",
+			wantStatus:      http.StatusOK,
+			wantPermissions: []any{string(db.PermissionReadUser)},
+		},
+		{
+			name:            "Admin views another user",
+			callerPerms:     []db.Permission{db.PermissionReadUser, db.PermissionAdminUser},
+			path:            "/v1/users/account/target/permissions",
+			wantStatus:      http.StatusOK,
+			wantPermissions: []any{string(db.PermissionReadUser), string(db.PermissionWriteUser)},
+		},
+		{
+			name:        "Non-admin views another user",
+			callerPerms: []db.Permission{db.PermissionReadUser, db.PermissionWriteUser},
+			path:        "/v1/users/account/target/permissions",
+			wantStatus:  http.StatusForbidden,
+		},
+		{
+			name:        "Admin views unknown user",
+			callerPerms: []db.Permission{db.PermissionReadUser, db.PermissionAdminUser},
+			path:        "/v1/users/account/nobody/permissions",
+			wantStatus:  http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, token := createTestUser(t, app, "caller", tt.callerPerms...)
+			createTestUser(t, app, "target", db.PermissionReadUser, db.PermissionWriteUser)
+
+			status, _, body := ts.do(t, http.MethodGet, tt.path, token.Plain, nil)
+			assert.Equal(t, tt.wantStatus, status, "want %d; got %d", tt.wantStatus, status)
+
+			if tt.wantStatus == http.StatusOK {
+				assert.ElementsMatch(t, tt.wantPermissions, body["permissions"])
+			}
+
+			t.Cleanup(func() {
+				err := cleanup(app)
+				assert.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestCreateAuthTokenHandlerThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	app.loginThrottle = newLoginThrottle(2, time.Minute, time.Hour, time.Hour)
+	ts := newTestServer(t, app.routes())
+
+	createTestUser(t, app, "victim")
+	createTestUser(t, app, "bystander")
+
+	wrong := loginUserInput{Username: "victim", Password: "Wrong1234!"}
+
+	for i := 0; i < 2; i++ {
+		status, _, _ := ts.post(t, "/v1/users/authenticate", wrong)
+		assert.Equal(t, http.StatusUnauthorized, status)
+	}
+
+	// even the correct password is refused while the account is throttled
+	status, headers, body := ts.post(t, "/v1/users/authenticate", loginUserInput{Username: "victim", Password: "Test1234!"})
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, errCodeRateLimited, body["error"].(map[string]any)["code"])
+
+	retryAfter, err := strconv.Atoi(headers.Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 5)
+
+	// other accounts are unaffected
+	status, _, _ = ts.post(t, "/v1/users/authenticate", loginUserInput{Username: "bystander", Password: "Test1234!"})
+	assert.Equal(t, http.StatusOK, status)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestUpdateAccountHandlerProfile(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	testUser, token := createTestUser(t, app, "testuser", db.PermissionReadUser, db.PermissionWriteUser)
+
+	t.Run("Profile fields are updated and returned", func(t *testing.T) {
+		payload := map[string]any{"display_name": "Test User", "avatar_url": "https://example.com/avatar.png"}
+
+		status, _, body := ts.do(t, http.MethodPut, "/v1/users/account/testuser/update", token.Plain, payload)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "Test User", body["user"].(map[string]any)["display_name"])
+
+		status, _, body = ts.do(t, http.MethodGet, "/v1/users/account/testuser", token.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+
+		user := body["user"].(map[string]any)
+		assert.Equal(t, "Test User", user["display_name"])
+		assert.Equal(t, "https://example.com/avatar.png", user["avatar_url"])
+		assert.Equal(t, "testuser@example.com", user["email"])
 
-					assert.True(t, match)
+		// a profile only change does not issue a new activation token
+		_, err := app.models.Tokens.Get(context.Background(), testUser.ID, db.TokenScopeActivation)
+		assert.ErrorIs(t, err, db.ErrNotFound)
+	})
+
+	t.Run("Omitted fields are kept and empty fields cleared", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPut, "/v1/users/account/testuser/update", token.Plain, map[string]any{"avatar_url": ""})
+		assert.Equal(t, http.StatusOK, status)
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), "testuser")
+		assert.NoError(t, err)
+		assert.Equal(t, "Test User", *dbUser.DisplayName)
+		assert.Nil(t, dbUser.AvatarURL)
+	})
+
+	t.Run("Invalid avatar URL is rejected", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPut, "/v1/users/account/testuser/update", token.Plain, map[string]any{"avatar_url": "not a url"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, map[string]any{"avatar_url": "must be a valid http or https URL"}, body["error"].(map[string]any)["fields"])
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestUpdatePasswordHandlerNotification(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, _ := createTestUser(t, app, "testuser")
+
+	dbUser, err := app.models.Users.GetByUsername(context.Background(), user.Username)
+	assert.NoError(t, err)
+
+	dbUser.DisplayName = strPtr("Test User")
+	err = app.models.Users.Update(context.Background(), dbUser)
+	assert.NoError(t, err)
+
+	token, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.ResetPwdTokenTime, db.TokenScopeResetPwd)
+	assert.NoError(t, err)
+
+	status, _, _ := ts.put(t, "/v1/users/password/update", updatePwdInput{Token: token.Plain, Password: "NewPassword123!"})
+	assert.Equal(t, http.StatusOK, status)
+
+	app.wg.Wait()
+
+	sent := app.mailer.(*recordingMailer).Sent()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "testuser@example.com", sent[0].recipient)
+		assert.Equal(t, "password_changed.html", sent[0].templateFile)
+	}
+
+	updated, err := app.models.Users.GetByUsername(context.Background(), user.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, dbUser.Version+1, updated.Version)
+	assert.Equal(t, "Test User", *updated.DisplayName)
+
+	match, err := updated.Password.Compare("NewPassword123!")
+	assert.NoError(t, err)
+	assert.True(t, match)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestDeleteAuthTokenHandlerLogsUser(t *testing.T) {
+	var buf bytes.Buffer
+
+	app := newTestApplication(t)
+	app.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	ts := newTestServer(t, app.routes())
+
+	testUser, token := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	status, _, _ := ts.do(t, http.MethodDelete, "/v1/tokens", token.Plain, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	var found bool
+	for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var line map[string]any
+		err := json.Unmarshal(raw, &line)
+		assert.NoError(t, err)
+
+		if line["event"] == eventLogout {
+			found = true
+			assert.Equal(t, float64(testUser.ID), line["user_id"])
+		}
+	}
+	assert.True(t, found, "expected a log line with the logout event")
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestPatchAccountHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	testUser, token := createTestUser(t, app, "testuser", db.PermissionReadUser, db.PermissionWriteUser)
+	createTestUser(t, app, "otheruser", db.PermissionReadUser, db.PermissionWriteUser)
+
+	t.Run("Empty email is rejected", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPatch, "/v1/users/account/testuser", token.Plain, map[string]any{"email": ""})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, map[string]any{"email": "must not be empty"}, body["error"].(map[string]any)["fields"])
+	})
+
+	t.Run("Absent email is left unchanged", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPatch, "/v1/users/account/testuser", token.Plain, map[string]any{"display_name": "Test User"})
+		assert.Equal(t, http.StatusOK, status)
+
+		user := body["user"].(map[string]any)
+		assert.Equal(t, "Test User", user["display_name"])
+		assert.Equal(t, "testuser@example.com", user["email"])
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), "testuser")
+		assert.NoError(t, err)
+		assert.True(t, dbUser.Activated)
+
+		match, err := dbUser.Password.Compare("Test1234!")
+		assert.NoError(t, err)
+		assert.True(t, match)
+	})
+
+	t.Run("Another user's account is refused", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPatch, "/v1/users/account/otheruser", token.Plain, map[string]any{"display_name": "Hijacked"})
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Password can't be changed without the current one", func(t *testing.T) {
+		for _, method := range []string{http.MethodPatch, http.MethodPut} {
+			path := "/v1/users/account/testuser"
+			if method == http.MethodPut {
+				path += "/update"
+			}
+
+			status, _, _ := ts.do(t, method, path, token.Plain, map[string]any{"password": "NewPass1234!"})
+			assert.Equal(t, http.StatusBadRequest, status, method)
+		}
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), "testuser")
+		assert.NoError(t, err)
+
+		match, err := dbUser.Password.Compare("Test1234!")
+		assert.NoError(t, err)
+		assert.True(t, match)
+	})
+
+	t.Run("Email is updated and must be verified again", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPatch, "/v1/users/account/testuser", token.Plain, map[string]any{"email": "new@example.com"})
+		assert.Equal(t, http.StatusOK, status)
+
+		user := body["user"].(map[string]any)
+		assert.Equal(t, "new@example.com", user["email"])
+		assert.Equal(t, "Test User", user["display_name"])
+		assert.Equal(t, false, user["activated"])
+
+		_, err := app.models.Tokens.Get(context.Background(), testUser.ID, db.TokenScopeActivation)
+		assert.NoError(t, err)
+
+		// the activation token only goes to the new address, the old one gets a notice without it
+		app.wg.Wait()
+		sent := app.mailer.(*recordingMailer).Sent()
+		if assert.Len(t, sent, 2) {
+			byTemplate := map[string]sentEmail{}
+			for _, email := range sent {
+				byTemplate[email.templateFile] = email
+			}
+
+			assert.Equal(t, "new@example.com", byTemplate["mail.html"].recipient)
+			assert.Equal(t, "testuser@example.com", byTemplate["email_changed.html"].recipient)
+			assert.NotContains(t, byTemplate["email_changed.html"].data, "activationToken")
+		}
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestCreateUserHandlerReservedUsername(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	app.models.Rules.ReservedUsernames = []string{"admin", "support"}
+
+	status, _, body := ts.post(t, "/v1/users/new", createUserInput{Username: "Admin", Email: "admin@example.com", Password: "Test1234!"})
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Equal(t, map[string]any{"username": "is reserved"}, body["error"].(map[string]any)["fields"])
+
+	status, _, _ = ts.post(t, "/v1/users/new", createUserInput{Username: "administrator", Email: "administrator@example.com", Password: "Test1234!"})
+	assert.Equal(t, http.StatusCreated, status)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestCreateUserHandlerResponse(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	status, _, body := ts.post(t, "/v1/users/new", createUserInput{Username: "testuser", Email: "testuser@example.com", Password: "Test1234!"})
+	assert.Equal(t, http.StatusCreated, status)
+
+	dbUser, err := app.models.Users.GetByUsername(context.Background(), "testuser")
+	assert.NoError(t, err)
+
+	// the activation token only goes out by email
+	app.wg.Wait()
+	sent := app.mailer.(*recordingMailer).Sent()
+	assert.Len(t, sent, 1)
+	activationToken := sent[0].data.(map[string]any)["activationToken"].(string)
+
+	user := body["user"].(map[string]any)
+	assert.Equal(t, float64(dbUser.ID), user["id"])
+	assert.Equal(t, "testuser", user["username"])
+	assert.Equal(t, "testuser@example.com", user["email"])
+	assert.Equal(t, false, user["activated"])
+	assert.NotEmpty(t, user["created_at"])
+
+	assert.NotContains(t, body, "token")
+	assert.NotContains(t, body.JSON(), "Test1234!")
+	assert.NotContains(t, body.JSON(), "password")
+	assert.NotContains(t, body.JSON(), activationToken)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestCreateUserHandlerPrivateRegistration(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+
+		createTestUser(t, app, "existinguser")
+
+		status, _, body := ts.post(t, "/v1/users/new", createUserInput{Username: "newuser", Email: "existinguser@example.com", Password: "Test1234!"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, map[string]any{"email": "a user with this email address already exists"}, body["error"].(map[string]any)["fields"])
+
+		t.Cleanup(func() {
+			err := cleanup(app)
+			assert.NoError(t, err)
+		})
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		app := newTestApplication(t)
+		app.config.Auth.PrivateRegistration = true
+		ts := newTestServer(t, app.routes())
+
+		createTestUser(t, app, "existinguser")
+
+		newStatus, _, newBody := ts.post(t, "/v1/users/new", createUserInput{Username: "newuser", Email: "newuser@example.com", Password: "Test1234!"})
+		assert.Equal(t, http.StatusAccepted, newStatus)
+
+		dupStatus, _, dupBody := ts.post(t, "/v1/users/new", createUserInput{Username: "otheruser", Email: "existinguser@example.com", Password: "Test1234!"})
+		assert.Equal(t, newStatus, dupStatus)
+		assert.JSONEq(t, newBody.JSON(), dupBody.JSON(), "a duplicate email must be indistinguishable from a new one")
+
+		_, err := app.models.Users.GetByUsername(context.Background(), "otheruser")
+		assert.ErrorIs(t, err, db.ErrNotFound)
+
+		app.wg.Wait()
+		var notified bool
+		for _, sent := range app.mailer.(*recordingMailer).Sent() {
+			if sent.recipient == "existinguser@example.com" && sent.templateFile == "registration_attempt.html" {
+				notified = true
+			}
+		}
+		assert.True(t, notified, "the owner of the existing address is notified")
+
+		// usernames are public, duplicates are still reported
+		status, _, body := ts.post(t, "/v1/users/new", createUserInput{Username: "existinguser", Email: "another@example.com", Password: "Test1234!"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, map[string]any{"username": "a user with this username already exists"}, body["error"].(map[string]any)["fields"])
+
+		t.Cleanup(func() {
+			err := cleanup(app)
+			assert.NoError(t, err)
+		})
+	})
+}
+
+func TestCookieTokens(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.Auth.CookieTokens = true
+	ts := newTestServer(t, app.routes())
+
+	createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	send := func(method, path string, body any, cookies ...*http.Cookie) (int, http.Header, envelope) {
+		var reqBody io.Reader
+		if body != nil {
+			jsonBody, err := json.Marshal(body)
+			assert.NoError(t, err)
+			reqBody = bytes.NewReader(jsonBody)
+		}
+
+		req, err := http.NewRequest(method, ts.URL+path, reqBody)
+		assert.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+
+		res, err := ts.Client().Do(req)
+		assert.NoError(t, err)
+
+		return readResponse(t, res)
+	}
+
+	tokenCookies := func(headers http.Header) map[string]*http.Cookie {
+		cookies := map[string]*http.Cookie{}
+		for _, cookie := range (&http.Response{Header: headers}).Cookies() {
+			cookies[cookie.Name] = cookie
+		}
+		return cookies
+	}
+
+	status, headers, body := send(http.MethodPost, "/v1/users/authenticate", loginUserInput{Username: "testuser", Password: "Test1234!"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body["access_token"], "token", "the tokens are only sent as cookies")
+	assert.NotContains(t, body["refresh_token"], "token")
+
+	cookies := tokenCookies(headers)
+	access, refresh := cookies[accessTokenCookieName], cookies[refreshTokenCookieName]
+	if access == nil || refresh == nil {
+		t.Fatalf("expected both token cookies, got %v", cookies)
+	}
+	assert.True(t, access.HttpOnly)
+	assert.True(t, access.Secure)
+	assert.Equal(t, http.SameSiteStrictMode, access.SameSite)
+	assert.Equal(t, refreshTokenCookiePath, refresh.Path)
+
+	t.Run("The access token cookie authenticates requests", func(t *testing.T) {
+		status, _, body := send(http.MethodGet, "/v1/users/account/testuser", nil, access)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "testuser", body["user"].(map[string]any)["username"])
+
+		status, _, _ = send(http.MethodGet, "/v1/users/account/testuser", nil)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("The refresh token cookie rotates the tokens", func(t *testing.T) {
+		status, headers, _ := send(http.MethodPost, "/v1/tokens/refresh", nil, refresh)
+		assert.Equal(t, http.StatusOK, status)
+
+		rotated := tokenCookies(headers)
+		if assert.Contains(t, rotated, accessTokenCookieName) {
+			access = rotated[accessTokenCookieName]
+		}
+
+		status, _, _ = send(http.MethodGet, "/v1/users/account/testuser", nil, access)
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Logout clears the cookies", func(t *testing.T) {
+		status, headers, _ := send(http.MethodDelete, "/v1/tokens", nil, access)
+		assert.Equal(t, http.StatusOK, status)
+
+		cleared := tokenCookies(headers)
+		if assert.Contains(t, cleared, accessTokenCookieName) {
+			assert.Empty(t, cleared[accessTokenCookieName].Value)
+		}
+
+		status, _, _ = send(http.MethodGet, "/v1/users/account/testuser", nil, access)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestResendActivationHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, token := createTestUser(t, app, "testuser")
+	// as if the user had never been activated
+	_, err := app.models.DB.Exec("UPDATE users SET activated = FALSE, activated_at = NULL WHERE id = $1", user.ID)
+	assert.NoError(t, err)
+
+	mailer := app.mailer.(*recordingMailer)
+
+	t.Run("Within the cooldown after signup", func(t *testing.T) {
+		status, headers, body := ts.do(t, http.MethodPost, "/v1/users/activate/resend", token.Plain, nil)
+		assert.Equal(t, http.StatusTooManyRequests, status)
+		assert.Equal(t, errCodeRateLimited, body["error"].(map[string]any)["code"])
+
+		retryAfter, err := strconv.Atoi(headers.Get("Retry-After"))
+		assert.NoError(t, err)
+		assert.InDelta(t, 60, retryAfter, 5)
+	})
+
+	t.Run("After the cooldown", func(t *testing.T) {
+		_, err := app.models.DB.Exec("UPDATE users SET last_activation_sent_at = $1 WHERE id = $2", time.Now().Add(-2*time.Minute), user.ID)
+		assert.NoError(t, err)
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/activate/resend", token.Plain, nil)
+		assert.Equal(t, http.StatusAccepted, status)
+
+		app.wg.Wait()
+		sent := mailer.Sent()
+		if assert.Len(t, sent, 1) {
+			assert.Equal(t, user.Email, sent[0].recipient)
+			assert.Equal(t, "mail.html", sent[0].templateFile)
+		}
+
+		_, err = app.models.Tokens.Get(context.Background(), user.ID, db.TokenScopeActivation)
+		assert.NoError(t, err)
+
+		// the resend starts a new cooldown
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/activate/resend", token.Plain, nil)
+		assert.Equal(t, http.StatusTooManyRequests, status)
+		assert.Len(t, mailer.Sent(), 1)
+	})
+
+	t.Run("Already activated", func(t *testing.T) {
+		err := app.models.Users.Activate(context.Background(), user.ID)
+		assert.NoError(t, err)
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/activate/resend", token.Plain, nil)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Deactivated by an admin", func(t *testing.T) {
+		err := app.models.Users.Deactivate(context.Background(), user.ID)
+		assert.NoError(t, err)
+
+		_, err = app.models.DB.Exec("UPDATE users SET last_activation_sent_at = $1 WHERE id = $2", time.Now().Add(-2*time.Minute), user.ID)
+		assert.NoError(t, err)
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/activate/resend", token.Plain, nil)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Len(t, mailer.Sent(), 1)
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		status, _, _ := ts.post(t, "/v1/users/activate/resend", nil)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestVersionHandler(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+	ts := newTestServer(t, app.routes())
+
+	t.Run("Defaults", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodGet, "/version", "", nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, envelope{"version": "dev", "commit": "unknown", "build_time": "unknown"}, body)
+	})
+
+	t.Run("Injected values", func(t *testing.T) {
+		defer func(v, c, b string) { version, commit, buildTime = v, c, b }(version, commit, buildTime)
+		version, commit, buildTime = "1.2.0", "4cae32b", "2024-05-01T12:00:00Z"
+
+		status, _, body := ts.do(t, http.MethodGet, "/version", "", nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, envelope{"version": "1.2.0", "commit": "4cae32b", "build_time": "2024-05-01T12:00:00Z"}, body)
+	})
+}
+
+func TestRefreshAuthTokenMalformedBody(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name        string
+		body        string
+		wantMessage string
+	}{
+		{name: "Not JSON", body: "token=ABCDEFGHIJKLMNOPQRSTUVWXYZ", wantMessage: "request body contains badly-formed JSON (at character 2)"},
+		{name: "Truncated", body: `{"token": "ABCDEF`, wantMessage: "request body contains badly-formed JSON (unexpected end of input, the body may be truncated)"},
+		{name: "Wrong type", body: `{"token": 42}`, wantMessage: `request body contains an invalid value for the "token" field`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, method := range []string{http.MethodPost, http.MethodDelete} {
+				path := "/v1/tokens/refresh"
+				if method == http.MethodDelete {
+					path = "/v1/tokens"
 				}
 
-				assert.Equal(t, 2, user.Version)
+				req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(tt.body))
+				assert.NoError(t, err)
+				req.Header.Set("Content-Type", "application/json")
+
+				res, err := ts.Client().Do(req)
+				assert.NoError(t, err)
+
+				status, _, body := readResponse(t, res)
+				assert.Equal(t, http.StatusBadRequest, status, path)
+				assert.Equal(t, errCodeBadRequest, body["error"].(map[string]any)["code"], path)
+				assert.Equal(t, tt.wantMessage, body["error"].(map[string]any)["message"], path)
 			}
+		})
+	}
+}
+
+func TestRefreshAuthTokenHandlerConcurrent(t *testing.T) {
+	app := newTestApplication(t)
+	app.refreshes = newRefreshDeduper(10 * time.Second)
+	ts := newTestServer(t, app.routes())
+
+	user, _ := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	status, _, body := ts.post(t, "/v1/users/authenticate", loginUserInput{Username: "testuser", Password: "Test1234!"})
+	assert.Equal(t, http.StatusOK, status)
+	refreshToken := body["refresh_token"].(map[string]any)["token"].(string)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	bodies := make([]envelope, 2)
+
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], _, bodies[i] = ts.post(t, "/v1/tokens/refresh", tokenInput{Token: refreshToken})
+		}()
+	}
+	wg.Wait()
+
+	for i := range statuses {
+		assert.Equal(t, http.StatusOK, statuses[i])
+	}
+	tokens := func(body envelope, key string) string {
+		return body[key].(map[string]any)["token"].(string)
+	}
+	assert.Equal(t, tokens(bodies[0], "access_token"), tokens(bodies[1], "access_token"), "both requests get the same new pair")
+	assert.Equal(t, tokens(bodies[0], "refresh_token"), tokens(bodies[1], "refresh_token"))
+
+	var refreshTokens int
+	err := app.models.DB.QueryRow(`
+		SELECT COUNT(*) FROM tokens t INNER JOIN scopes s ON t.scope_id = s.id
+		WHERE t.user_id = $1 AND s.name = $2`, user.ID, db.TokenScopeRefresh).Scan(&refreshTokens)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, refreshTokens, "the rotation must not leave a second refresh token behind")
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestRotateRefreshTokenSerialized(t *testing.T) {
+	app := newTestApplication(t)
+
+	user, _ := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	refreshToken, err := app.models.Tokens.CreateToken(context.Background(), user.ID, db.RefreshTokenTime, db.TokenScopeRefresh)
+	assert.NoError(t, err)
+	tokenHash := db.HashToken(refreshToken.Plain)
+
+	// rotate directly so that only the database lock keeps the rotations apart
+	const rotations = 5
+	var wg sync.WaitGroup
+	errs := make([]error, rotations)
+
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = app.rotateRefreshToken(context.Background(), tokenHash)
+		}()
+	}
+	wg.Wait()
+
+	var succeeded int
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, db.ErrNotFound)
+	}
+	assert.Equal(t, 1, succeeded, "exactly one rotation must win")
+
+	var accessTokens, refreshTokens int
+	err = app.models.DB.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE s.name = $2), COUNT(*) FILTER (WHERE s.name = $3)
+		FROM tokens t INNER JOIN scopes s ON t.scope_id = s.id
+		WHERE t.user_id = $1`, user.ID, db.TokenScopeAccess, db.TokenScopeRefresh).Scan(&accessTokens, &refreshTokens)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, accessTokens)
+	assert.Equal(t, 1, refreshTokens)
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestSendEmailRecordsOutcome(t *testing.T) {
+	app := newTestApplication(t)
+
+	testCases := []struct {
+		name       string
+		sendErr    error
+		wantStatus db.EmailStatus
+		wantError  string
+	}{
+		{
+			name:       "Successful send",
+			wantStatus: db.EmailStatusSent,
+		},
+		{
+			name:       "Failing send",
+			sendErr:    errors.New("connection refused"),
+			wantStatus: db.EmailStatusFailed,
+			wantError:  "connection refused",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			app.mailer = &recordingMailer{err: tt.sendErr}
+
+			user, _ := createTestUser(t, app, "testuser")
+
+			err := app.sendEmail(context.Background(), user.ID, user.Email, "mail.html", nil)
+			assert.Equal(t, tt.sendErr, err)
+
+			var (
+				recipient, template, status, sendError string
+				userID                                 int
+			)
+			err = app.models.DB.QueryRow("SELECT user_id, recipient, template, status, error FROM email_log").
+				Scan(&userID, &recipient, &template, &status, &sendError)
+			assert.NoError(t, err)
+
+			assert.Equal(t, user.ID, userID)
+			assert.Equal(t, user.Email, recipient)
+			assert.Equal(t, "mail.html", template)
+			assert.Equal(t, string(tt.wantStatus), status)
+			assert.Equal(t, tt.wantError, sendError)
 
 			t.Cleanup(func() {
 				err := cleanup(app)
@@ -1303,3 +3236,91 @@ func TestUpdateAccountHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestRefreshAuthTokenHandlerKeepsAuthenticationTime(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, _ := createTestUser(t, app, "testuser", db.PermissionReadUser, db.PermissionWriteUser)
+
+	status, _, body := ts.post(t, "/v1/users/authenticate", loginUserInput{Username: "testuser", Password: "Test1234!"})
+	assert.Equal(t, http.StatusOK, status)
+	refreshToken := body["refresh_token"].(map[string]any)["token"].(string)
+
+	// the login happened before the fresh authentication window
+	_, err := app.models.DB.Exec("UPDATE tokens SET created_at = $1, authenticated_at = $1 WHERE user_id = $2", time.Now().Add(-app.config.Auth.FreshAuthWindow-time.Minute), user.ID)
+	assert.NoError(t, err)
+
+	status, _, body = ts.post(t, "/v1/tokens/refresh", tokenInput{Token: refreshToken})
+	assert.Equal(t, http.StatusOK, status)
+	accessToken := body["access_token"].(map[string]any)["token"].(string)
+
+	status, _, body = ts.do(t, http.MethodPatch, "/v1/users/account/testuser", accessToken, map[string]any{"display_name": "Test"})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, errCodeReauthenticationRequired, body["error"].(map[string]any)["code"], "a refreshed token must not pass as a fresh login")
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestRefreshAuthTokenHandlerRejectionReason(t *testing.T) {
+	var buf bytes.Buffer
+
+	app := newTestApplication(t)
+	app.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	ts := newTestServer(t, app.routes())
+
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	expiredToken, err := app.models.Tokens.CreateToken(context.Background(), user.ID, -time.Hour, db.TokenScopeRefresh)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		token      string
+		wantReason string
+	}{
+		{"Access token", accessToken.Plain, refreshRejectedWrongScope},
+		{"Unknown token", "ABCDEFGHIJKLMNOPQRSTUVWXYZ", refreshRejectedNotFound},
+		{"Expired refresh token", expiredToken.Plain, refreshRejectedExpired},
+	}
+
+	var messages []any
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+
+			status, _, body := ts.post(t, "/v1/tokens/refresh", tokenInput{Token: tt.token})
+			assert.Equal(t, http.StatusUnauthorized, status)
+
+			apiErr := body["error"].(map[string]any)
+			assert.Equal(t, errCodeInvalidRefreshToken, apiErr["code"])
+			messages = append(messages, apiErr["message"])
+
+			var found bool
+			for _, raw := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+				var line map[string]any
+				err := json.Unmarshal(raw, &line)
+				assert.NoError(t, err)
+
+				if line["event"] == eventTokenRefreshRejected {
+					found = true
+					assert.Equal(t, tt.wantReason, line["reason"])
+				}
+			}
+			assert.True(t, found, "expected a log line with the rejection reason")
+		})
+	}
+
+	for _, message := range messages {
+		assert.Equal(t, messages[0], message, "clients must not learn why the token was rejected")
+	}
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
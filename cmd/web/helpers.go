@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/mail"
+	"github.com/sushihentaime/user-management-service/internal/validator"
+	"github.com/sushihentaime/user-management-service/pkg/jsonParser"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// envelope wraps every JSON response. List responses carry their pagination
+// details under the "metadata" key, see withMetadata.
 type envelope map[string]any
 
 func (e envelope) JSON() string {
@@ -20,6 +35,11 @@ func (e envelope) JSON() string {
 	return string(json)
 }
 
+func (e envelope) withMetadata(metadata db.Metadata) envelope {
+	e["metadata"] = metadata
+	return e
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	res, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
@@ -39,10 +59,56 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
-func (app *application) backgroundTask(fn func()) {
+// newTaskQueue starts workers goroutines running the background tasks sent to the returned
+// queue, which buffers up to size tasks. It returns nil for no bound when workers is zero.
+func newTaskQueue(workers, size int) chan func() {
+	if workers <= 0 {
+		return nil
+	}
+
+	queue := make(chan func(), size)
+	for range workers {
+		go func() {
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+
+	return queue
+}
+
+// backgroundTask runs fn on the worker pool in app.tasks, tracked by the shutdown wait group. The
+// context passed to fn is cancelled when the server shuts down, long running tasks should watch it.
+// Once the queue is full the caller blocks until a worker frees a place, queued tasks still run
+// during shutdown. Without a pool every task gets its own goroutine.
+func (app *application) backgroundTask(fn func(ctx context.Context)) {
+	task := app.track(fn)
+	if app.tasks == nil {
+		go task()
+		return
+	}
+
+	app.tasks <- task
+}
+
+// goTracked runs fn in a goroutine tracked by the shutdown wait group, outside the worker pool.
+// It is meant for the few goroutines living as long as the server.
+func (app *application) goTracked(fn func(ctx context.Context)) {
+	go app.track(fn)()
+}
+
+// track adds fn to the shutdown wait group and returns it wrapped to be marked done and recover
+// from panics once run.
+func (app *application) track(fn func(ctx context.Context)) func() {
+	ctx := app.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	app.wg.Add(1)
 
-	go func() {
+	return func() {
 		defer app.wg.Done()
 
 		defer func() {
@@ -51,17 +117,273 @@ func (app *application) backgroundTask(fn func()) {
 			}
 		}()
 
-		fn()
-	}()
+		fn(ctx)
+	}
+}
+
+// sendEmail sends the email and records the outcome in the email log for support triage. userID is
+// zero when the recipient isn't a known user. Failing to record the outcome is only logged.
+func (app *application) sendEmail(ctx context.Context, userID int, recipient, templateFile string, data any, opts ...mail.SendOption) error {
+	err := app.mailer.Send(recipient, templateFile, data, opts...)
+
+	event := &db.EmailEvent{UserID: userID, Recipient: recipient, Template: templateFile, Status: db.EmailStatusSent}
+	if err != nil {
+		event.Status = db.EmailStatusFailed
+		event.Error = err.Error()
+	}
+
+	if logErr := app.models.EmailLog.Insert(ctx, event); logErr != nil {
+		app.logger.Error(logErr.Error())
+	}
+
+	return err
+}
+
+// sendEmailChangedNotice tells the address replaced by newEmail about the change, with a link to
+// undo it. This notice rather than the activation email of the new address is copied to the
+// security mailbox, its token can only restore the replaced address, not take over the account.
+func (app *application) sendEmailChangedNotice(change *db.EmailChange, newEmail string) {
+	app.backgroundTask(func(ctx context.Context) {
+		data := map[string]any{
+			"email":         change.Email,
+			"newEmail":      newEmail,
+			"rollbackToken": change.RollbackToken,
+			"rollbackURL":   app.emailLink(app.config.BaseURL, app.config.Links.EmailRollbackPath, change.RollbackToken),
+			"expiresIn":     humanDuration(app.config.Auth.EmailRollbackWindow),
+		}
+
+		err := app.sendEmail(ctx, change.UserID, change.Email, "email_changed.html", data, mail.WithSecurityCopy())
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		app.logger.Info("email sent", "email", change.Email, "type", "email changed")
+	})
+}
+
+const (
+	accessTokenCookieName  = "access_token"
+	refreshTokenCookieName = "refresh_token"
+	// refreshTokenCookiePath limits the refresh token cookie to the refresh and logout endpoints.
+	refreshTokenCookiePath = "/v1/tokens"
+)
+
+// readRefreshToken reads the refresh token from the JSON body or, in cookie token mode and only when
+// the request has no body, from the refresh token cookie.
+func (app *application) readRefreshToken(w http.ResponseWriter, r *http.Request, input *tokenInput) error {
+	cookie, err := r.Cookie(refreshTokenCookieName)
+	if app.config.Auth.CookieTokens && err == nil && r.ContentLength == 0 {
+		input.Token = cookie.Value
+		return nil
+	}
+
+	return jsonParser.ParseJSON(w, r, input)
+}
+
+// hasRefreshToken reports whether the request may carry a refresh token, in its body or, in cookie
+// token mode, in the refresh token cookie.
+func (app *application) hasRefreshToken(r *http.Request) bool {
+	if r.ContentLength != 0 {
+		return true
+	}
+
+	_, err := r.Cookie(refreshTokenCookieName)
+	return app.config.Auth.CookieTokens && err == nil
+}
+
+// requestToken returns the access token from the Authorization header or, in cookie token
+// mode and only when the header is absent, from the access token cookie.
+func (app *application) requestToken(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader != "" || !app.config.Auth.CookieTokens {
+		return app.extractTokenFromHeader(authHeader)
+	}
+
+	cookie, err := r.Cookie(accessTokenCookieName)
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// writeAuthTokens sends a newly issued token pair. In cookie token mode the tokens are set
+// as HttpOnly cookies and only their expiry is returned in the body.
+func (app *application) writeAuthTokens(w http.ResponseWriter, accessToken, refreshToken *db.Token, permissions *db.Permissions) error {
+	accessBody := map[string]any{"token": accessToken.Plain, "expiry": accessToken.Expiry, "expires_in": expiresIn(accessToken.Expiry)}
+	refreshBody := map[string]any{"token": refreshToken.Plain, "expiry": refreshToken.Expiry, "expires_in": expiresIn(refreshToken.Expiry)}
+
+	if app.config.Auth.CookieTokens {
+		setTokenCookie(w, accessTokenCookieName, "/", accessToken.Plain, accessToken.Expiry)
+		setTokenCookie(w, refreshTokenCookieName, refreshTokenCookiePath, refreshToken.Plain, refreshToken.Expiry)
+
+		delete(accessBody, "token")
+		delete(refreshBody, "token")
+	}
+
+	return app.writeJSON(w, http.StatusOK, envelope{"access_token": accessBody, "refresh_token": refreshBody, "permissions": permissions}, nil)
+}
+
+// linkTokenPlaceholder marks where the token goes in the configured link paths.
+const linkTokenPlaceholder = "{token}"
+
+// emailLink builds the absolute URL of a link in an email from one of the configured link paths,
+// relative to base, BaseURL or a redirect URL accepted by redirectBase.
+func (app *application) emailLink(base, path, token string) string {
+	return strings.TrimSuffix(base, "/") + strings.ReplaceAll(path, linkTokenPlaceholder, url.QueryEscape(token))
+}
+
+// redirectBase returns the base of the links in an email sent on behalf of a client, BaseURL unless
+// the client asked for redirectURL. That has to be an absolute URL on BaseURL's origin or one of
+// AllowedRedirectOrigins, without credentials, query or fragment, otherwise the problem is added to
+// v so that emails can't be made to point anywhere else.
+func (app *application) redirectBase(v *validator.Validator, redirectURL string) string {
+	if redirectURL == "" {
+		return app.config.BaseURL
+	}
+
+	u, err := url.Parse(redirectURL)
+	valid := err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil && u.RawQuery == "" && !u.ForceQuery && u.Fragment == ""
+	if !valid || !app.allowedRedirectOrigin(u) {
+		v.AddError("redirect_url", "must be an allowed redirect URL")
+		return ""
+	}
+
+	return u.String()
+}
+
+// allowedRedirectOrigin reports whether u is on BaseURL's origin or one of AllowedRedirectOrigins.
+func (app *application) allowedRedirectOrigin(u *url.URL) bool {
+	origin := u.Scheme + "://" + u.Host
+
+	base, err := url.Parse(app.config.BaseURL)
+	if err == nil && strings.EqualFold(origin, base.Scheme+"://"+base.Host) {
+		return true
+	}
+
+	for _, allowed := range app.config.AllowedRedirectOrigins {
+		if strings.EqualFold(origin, strings.TrimSuffix(allowed, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// activationEmailData is the data of the mail.html template, its link is relative to linkBase.
+func (app *application) activationEmailData(user *db.User, token *db.Token, linkBase string) map[string]any {
+	return map[string]any{
+		"username":        user.Username,
+		"activationToken": token.Plain,
+		"activationURL":   app.emailLink(linkBase, app.config.Links.ActivationPath, token.Plain),
+		"expiry":          token.Expiry,
+		"expiresIn":       humanDuration(time.Until(token.Expiry)),
+	}
+}
+
+// passwordResetEmailData is the data of the reset_pwd.html template, its link is relative to linkBase.
+func (app *application) passwordResetEmailData(user *db.User, token *db.Token, linkBase string) map[string]any {
+	return map[string]any{
+		"email":              user.Email,
+		"resetPasswordToken": token.Plain,
+		"resetPasswordURL":   app.emailLink(linkBase, app.config.Links.ResetPasswordPath, token.Plain),
+		"expiresIn":          humanDuration(time.Until(token.Expiry)),
+	}
+}
+
+func (app *application) passwordResetOTPEmailData(user *db.User, otp *db.Token) map[string]any {
+	return map[string]any{
+		"email":     user.Email,
+		"otp":       otp.Plain,
+		"expiresIn": humanDuration(time.Until(otp.Expiry)),
+	}
+}
+
+// humanDuration rounds d to whole days, hours or minutes for use in emails, e.g. "3 days".
+func humanDuration(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+
+	switch {
+	case d >= 24*time.Hour:
+		return plural(int(d.Round(24*time.Hour)/(24*time.Hour)), "day")
+	case d >= time.Hour:
+		return plural(int(d.Round(time.Hour)/time.Hour), "hour")
+	default:
+		return plural(max(int(d.Round(time.Minute)/time.Minute), 1), "minute")
+	}
+}
+
+// expiresIn returns the whole seconds left until expiry, so that clients with a skewed clock
+// can still schedule their refresh.
+func expiresIn(expiry time.Time) int {
+	seconds := int(time.Until(expiry).Seconds())
+	if seconds < 0 {
+		return 0
+	}
+
+	return seconds
 }
 
+// userETag identifies the representation of the user, it changes with every update since they all
+// bump the version. The ID keeps a recreated account from matching the ETag of a deleted one.
+func userETag(user *db.User) string {
+	return fmt.Sprintf(`"%d-%d"`, user.ID, user.Version)
+}
+
+// etagMatches reports whether the If-None-Match header of the request matches etag, with the weak
+// comparison that header calls for.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, value := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func setTokenCookie(w http.ResponseWriter, name, path, value string, expiry time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expiry,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// clearTokenCookies tells the browser to drop both token cookies.
+func clearTokenCookies(w http.ResponseWriter) {
+	setTokenCookie(w, accessTokenCookieName, "/", "", time.Unix(0, 0))
+	setTokenCookie(w, refreshTokenCookieName, refreshTokenCookiePath, "", time.Unix(0, 0))
+}
+
+// extractTokenFromHeader returns the token of a "Bearer <token>" Authorization header. As in RFC
+// 6750 the scheme is case-insensitive and may be followed by several spaces, surrounding
+// whitespace is ignored. Any other form, including a token containing whitespace, yields "".
 func (app *application) extractTokenFromHeader(authHeader string) string {
-	data := strings.Split(authHeader, " ")
-	if len(data) != 2 || data[0] != "Bearer" {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authHeader), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
 		return ""
 	}
 
-	return data[1]
+	token = strings.TrimLeft(token, " ")
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return ""
+	}
+
+	return token
 }
 
 func (app *application) readStringParam(r *http.Request, key string) (*string, error) {
@@ -74,3 +396,257 @@ func (app *application) readStringParam(r *http.Request, key string) (*string, e
 
 	return &username, nil
 }
+
+// readEmailParam returns the normalized email address in the URL.
+func (app *application) readEmailParam(r *http.Request) (string, error) {
+	param, err := app.readStringParam(r, "email")
+	if err != nil {
+		return "", err
+	}
+
+	dbUser := &db.User{
+		Email: *param,
+	}
+
+	dbUser.Normalize()
+
+	return dbUser.Email, nil
+}
+
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	return s
+}
+
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+
+	return i
+}
+
+// readDuration reads a duration such as "90m" or "24h".
+func (app *application) readDuration(qs url.Values, key string, defaultValue time.Duration, v *validator.Validator) time.Duration {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		v.AddError(key, "must be a duration such as 30m or 24h")
+		return defaultValue
+	}
+
+	return d
+}
+
+func (app *application) readFilters(qs url.Values, v *validator.Validator) db.Filters {
+	filters := db.Filters{
+		Page:     app.readInt(qs, "page", 1, v),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+	}
+
+	v.Check(filters.Page > 0, "page", "must be greater than zero")
+	checkPageSize(v, filters.PageSize)
+
+	return filters
+}
+
+// readCursorFilters reads the keyset pagination parameters, an absent cursor selects the first page.
+func (app *application) readCursorFilters(qs url.Values, v *validator.Validator) db.CursorFilters {
+	filters := db.CursorFilters{
+		Cursor:   app.readString(qs, "cursor", ""),
+		PageSize: app.readInt(qs, "page_size", 20, v),
+	}
+
+	checkPageSize(v, filters.PageSize)
+
+	return filters
+}
+
+// maxPageSize bounds how many records a single page of a list endpoint may hold.
+const maxPageSize = 100
+
+func checkPageSize(v *validator.Validator, pageSize int) {
+	v.Check(pageSize > 0, "page_size", "must be greater than zero")
+	v.Check(pageSize <= maxPageSize, "page_size", fmt.Sprintf("must be at most %d", maxPageSize))
+}
+
+// clientIP returns the address of the client that sent the request. Forwarding
+// headers are only trusted when the immediate peer is one of the configured
+// trusted proxies, otherwise the peer address is returned as is.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !app.isTrustedProxy(host) {
+		return host
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		// Walk from right to left, the rightmost entries were appended by our own proxies.
+		// An unparsable entry can't have come from them, the client is then known no better
+		// than the last trusted hop.
+		addrs := strings.Split(xff, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if _, err := netip.ParseAddr(addr); err != nil {
+				if i == len(addrs)-1 {
+					return host
+				}
+				return strings.TrimSpace(addrs[i+1])
+			}
+			if !app.isTrustedProxy(addr) || i == 0 {
+				return addr
+			}
+		}
+	}
+
+	// X-Real-IP is only read from proxies that don't send X-Forwarded-For at all
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		if _, err := netip.ParseAddr(realIP); err == nil {
+			return realIP
+		}
+	}
+
+	return host
+}
+
+func (app *application) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range app.config.TrustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+const maxLoggedBodyBytes = 1_048_576
+
+var sensitiveJSONKeys = map[string]bool{
+	"password":         true,
+	"current_password": true,
+	"new_password":     true,
+	"token":            true,
+	// security question answers and password reset OTPs
+	"answer": true,
+	"otp":    true,
+}
+
+// redactJSON replaces the values of sensitive keys in a JSON document so it can be logged.
+// Anything that is not valid JSON is not logged at all.
+func redactJSON(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+
+	var data any
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return "[non-JSON body omitted]"
+	}
+
+	redacted, err := json.Marshal(redactValue(data))
+	if err != nil {
+		return "[non-JSON body omitted]"
+	}
+
+	return string(redacted)
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, val := range v {
+			if sensitiveJSONKeys[strings.ToLower(key)] {
+				v[key] = "[REDACTED]"
+				continue
+			}
+			v[key] = redactValue(val)
+		}
+		return v
+	case []any:
+		for i, val := range v {
+			v[i] = redactValue(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// idempotencyFingerprint identifies the request an Idempotency-Key is sent with by its method,
+// path and payload, the parsed request body.
+func idempotencyFingerprint(r *http.Request, payload any) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+	hash.Write(body)
+
+	return hash.Sum(nil), nil
+}
+
+// storeIdempotentResponse stores the response to the request of record, which carries its key,
+// user and fingerprint.
+func (app *application) storeIdempotentResponse(ctx context.Context, record *db.IdempotencyRecord, status int, response envelope) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	record.Status = status
+	record.Response = body
+	record.Expiry = time.Now().Add(app.config.IdempotencyKeyTTL)
+
+	return app.models.Idempotency.Insert(ctx, record)
+}
+
+func (app *application) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, record *db.IdempotencyRecord) {
+	var response envelope
+
+	err := json.Unmarshal(record.Response, &response)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, record.Status, response, http.Header{"Idempotent-Replayed": []string{"true"}})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// nilIfEmpty maps an empty string to nil, used for nullable columns that clients clear by sending "".
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
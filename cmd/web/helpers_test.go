@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/validator"
 )
 
 func TestWriteJSON(t *testing.T) {
@@ -51,3 +62,647 @@ func TestWriteJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestReadInt(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		name      string
+		query     string
+		want      int
+		wantValid bool
+	}{
+		{name: "missing key uses default", query: "", want: 5, wantValid: true},
+		{name: "valid integer", query: "page=3", want: 3, wantValid: true},
+		{name: "not an integer", query: "page=abc", want: 5, wantValid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v := validator.New()
+			got := app.readInt(qs, "page", 5, v)
+
+			if got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+			if v.Valid() != tt.wantValid {
+				t.Errorf("expected valid=%v, got valid=%v", tt.wantValid, v.Valid())
+			}
+		})
+	}
+}
+
+func TestReadDuration(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		name      string
+		query     string
+		want      time.Duration
+		wantValid bool
+	}{
+		{name: "missing key uses default", query: "", want: time.Hour, wantValid: true},
+		{name: "valid duration", query: "within=90m", want: 90 * time.Minute, wantValid: true},
+		{name: "not a duration", query: "within=soon", want: time.Hour, wantValid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v := validator.New()
+			got := app.readDuration(qs, "within", time.Hour, v)
+
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+			if v.Valid() != tt.wantValid {
+				t.Errorf("expected valid=%v, got valid=%v", tt.wantValid, v.Valid())
+			}
+		})
+	}
+}
+
+func TestReadString(t *testing.T) {
+	app := &application{}
+
+	qs := url.Values{"sort": []string{"username"}}
+
+	if got := app.readString(qs, "sort", "id"); got != "username" {
+		t.Errorf("expected %q, got %q", "username", got)
+	}
+
+	if got := app.readString(qs, "order", "asc"); got != "asc" {
+		t.Errorf("expected %q, got %q", "asc", got)
+	}
+}
+
+func TestReadFilters(t *testing.T) {
+	app := &application{}
+
+	v := validator.New()
+	filters := app.readFilters(url.Values{}, v)
+	if !v.Valid() || filters.Page != 1 || filters.PageSize != 20 {
+		t.Errorf("expected default filters, got %+v (errors: %v)", filters, v.Errors)
+	}
+
+	v = validator.New()
+	app.readFilters(url.Values{"page": []string{"0"}}, v)
+	if _, ok := v.Errors["page"]; !ok {
+		t.Errorf("expected a page error, got %v", v.Errors)
+	}
+
+	v = validator.New()
+	app.readFilters(url.Values{"page_size": []string{"-1"}}, v)
+	if _, ok := v.Errors["page_size"]; !ok {
+		t.Errorf("expected a page_size error, got %v", v.Errors)
+	}
+}
+
+func TestReadCursorFilters(t *testing.T) {
+	app := &application{}
+
+	v := validator.New()
+	filters := app.readCursorFilters(url.Values{}, v)
+	if !v.Valid() || filters.Cursor != "" || filters.PageSize != 20 {
+		t.Errorf("expected default filters, got %+v (errors: %v)", filters, v.Errors)
+	}
+
+	v = validator.New()
+	filters = app.readCursorFilters(url.Values{"cursor": []string{"abc"}, "page_size": []string{"5"}}, v)
+	if !v.Valid() || filters.Cursor != "abc" || filters.PageSize != 5 {
+		t.Errorf("expected cursor filters, got %+v (errors: %v)", filters, v.Errors)
+	}
+
+	v = validator.New()
+	app.readCursorFilters(url.Values{"page_size": []string{"0"}}, v)
+	if _, ok := v.Errors["page_size"]; !ok {
+		t.Errorf("expected a page_size error, got %v", v.Errors)
+	}
+}
+
+func TestReadFiltersPageSize(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		pageSize  string
+		wantError string
+	}{
+		{"0", "must be greater than zero"},
+		{"-5", "must be greater than zero"},
+		{"101", "must be at most 100"},
+		{"1000000", "must be at most 100"},
+		{"1", ""},
+		{"100", ""},
+	}
+
+	for _, tt := range tests {
+		qs := url.Values{"page_size": []string{tt.pageSize}}
+
+		v := validator.New()
+		app.readFilters(qs, v)
+		if got := v.Errors["page_size"]; got != tt.wantError {
+			t.Errorf("readFilters with page_size %s: expected error %q, got %q", tt.pageSize, tt.wantError, got)
+		}
+
+		v = validator.New()
+		app.readCursorFilters(qs, v)
+		if got := v.Errors["page_size"]; got != tt.wantError {
+			t.Errorf("readCursorFilters with page_size %s: expected error %q, got %q", tt.pageSize, tt.wantError, got)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	app := &application{
+		config: config{
+			TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "no proxy headers",
+			remoteAddr: "203.0.113.7:5000",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "spoofed forwarded header from untrusted peer",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "spoofed real ip header from untrusted peer",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forwarded header from trusted peer",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "client spoofs forwarded header through trusted peer",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.3"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "real ip header from trusted peer",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "malformed header from trusted peer",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string]string{"X-Forwarded-For": "not-an-ip"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "garbage left of a trusted hop with a forged real ip header",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string]string{"X-Forwarded-For": "garbage, 10.0.0.3", "X-Real-IP": "198.51.100.1"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "malformed header with a forged real ip header",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string]string{"X-Forwarded-For": "not-an-ip", "X-Real-IP": "198.51.100.1"},
+			want:       "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			if got := app.clientIP(req); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBackgroundTaskCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	app := &application{
+		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	cancelled := make(chan bool, 1)
+
+	app.backgroundTask(func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+			cancelled <- false
+		}
+	})
+
+	app.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("background task did not stop after the context was cancelled")
+	}
+
+	if !<-cancelled {
+		t.Error("expected background task to observe the cancellation")
+	}
+}
+
+func TestBackgroundTaskConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	app := &application{
+		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		ctx:    ctx,
+		cancel: cancel,
+		tasks:  newTaskQueue(3, 5),
+	}
+
+	var running, maxRunning, completed atomic.Int32
+
+	for range 50 {
+		app.backgroundTask(func(ctx context.Context) {
+			n := running.Add(1)
+			defer running.Add(-1)
+
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+			completed.Add(1)
+		})
+	}
+
+	// tasks still queued when the shutdown starts must run anyway
+	app.cancel()
+	app.wg.Wait()
+
+	if got := maxRunning.Load(); got > 3 {
+		t.Errorf("expected at most 3 concurrent tasks, got %d", got)
+	}
+
+	if got := completed.Load(); got != 50 {
+		t.Errorf("expected all 50 tasks to complete, got %d", got)
+	}
+}
+
+func TestBackgroundTaskSlotsExcludeJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	app := &application{
+		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		ctx:    ctx,
+		cancel: cancel,
+		tasks:  newTaskQueue(1, 1),
+	}
+
+	app.runPeriodically("test", time.Hour, func(ctx context.Context) error { return nil })
+
+	done := make(chan struct{})
+	app.backgroundTask(func(ctx context.Context) { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a periodic job must not hold a background task slot")
+	}
+
+	app.cancel()
+	app.wg.Wait()
+}
+
+func TestRequestToken(t *testing.T) {
+	app := &application{}
+
+	newRequest := func(header, cookie string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: accessTokenCookieName, Value: cookie})
+		}
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		cookieTokens bool
+		header       string
+		cookie       string
+		want         string
+	}{
+		{name: "header", header: "Bearer header", want: "header"},
+		{name: "cookie ignored unless enabled", cookie: "cookie", want: ""},
+		{name: "cookie", cookieTokens: true, cookie: "cookie", want: "cookie"},
+		{name: "header takes precedence", cookieTokens: true, header: "Bearer header", cookie: "cookie", want: "header"},
+		{name: "neither", cookieTokens: true, want: ""},
+	}
+
+	for _, tt := range tests {
+		app.config.Auth.CookieTokens = tt.cookieTokens
+
+		got := app.requestToken(newRequest(tt.header, tt.cookie))
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestExtractTokenFromHeader(t *testing.T) {
+	app := &application{}
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "Bearer token", want: "token"},
+		{header: "bearer token", want: "token"},
+		{header: "BEARER token", want: "token"},
+		{header: "Bearer  token", want: "token"},
+		{header: "  Bearer token\t", want: "token"},
+		{header: "Bearer ", want: ""},
+		{header: "bearer ", want: ""},
+		{header: "Bearer", want: ""},
+		{header: "Bearer a b", want: ""},
+		{header: "Bearer\ttoken", want: ""},
+		{header: "Basic token", want: ""},
+		{header: "token", want: ""},
+		{header: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		got := app.extractTokenFromHeader(tt.header)
+		if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: `"1-2"`, want: true},
+		{header: `W/"1-2"`, want: true},
+		{header: `"1-1"`, want: false},
+		{header: `"2-1", "1-2"`, want: true},
+		{header: `"1-20"`, want: false},
+		{header: "*", want: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("If-None-Match", tt.header)
+		}
+
+		got := etagMatches(r, userETag(&db.User{ID: 1, Version: 2}))
+		if got != tt.want {
+			t.Errorf("%q: expected %v, got %v", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestWriteAuthTokensExpiresIn(t *testing.T) {
+	app := &application{}
+
+	accessToken := &db.Token{Plain: "access", Expiry: time.Now().Add(db.AuthTokenTime)}
+	refreshToken := &db.Token{Plain: "refresh", Expiry: time.Now().Add(db.RefreshTokenTime)}
+
+	rr := httptest.NewRecorder()
+	err := app.writeAuthTokens(rr, accessToken, refreshToken, &db.Permissions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type tokenBody struct {
+		Expiry    time.Time `json:"expiry"`
+		ExpiresIn *int      `json:"expires_in"`
+	}
+
+	var body struct {
+		AccessToken  tokenBody `json:"access_token"`
+		RefreshToken tokenBody `json:"refresh_token"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, token := range map[string]struct {
+		body tokenBody
+		ttl  time.Duration
+	}{
+		"access_token":  {body.AccessToken, db.AuthTokenTime},
+		"refresh_token": {body.RefreshToken, db.RefreshTokenTime},
+	} {
+		ttl := token.ttl
+		expiresIn := token.body.ExpiresIn
+		if expiresIn == nil {
+			t.Errorf("%s: expected expires_in to be present", key)
+			continue
+		}
+
+		if diff := int(ttl.Seconds()) - *expiresIn; diff < 0 || diff > 5 {
+			t.Errorf("%s: expected expires_in close to %d, got %d", key, int(ttl.Seconds()), *expiresIn)
+		}
+
+		if token.body.Expiry.IsZero() {
+			t.Errorf("%s: expected the absolute expiry to be kept", key)
+		}
+	}
+}
+
+func TestExpiresIn(t *testing.T) {
+	if got := expiresIn(time.Now().Add(-time.Minute)); got != 0 {
+		t.Errorf("expected an expired token to report 0, got %d", got)
+	}
+}
+
+func TestActivationEmailData(t *testing.T) {
+	app := &application{}
+	app.config.BaseURL = "https://app.example.com/"
+	app.config.Links.ActivationPath = "/activate?token={token}"
+
+	user := &db.User{Username: "testuser"}
+	token := &db.Token{Plain: "ABCDEFGHIJKLMNOPQRSTUVWXYZ", Expiry: time.Now().Add(db.ActivationTokenTime)}
+
+	data := app.activationEmailData(user, token, app.config.BaseURL)
+
+	want := map[string]any{
+		"username":        "testuser",
+		"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"activationURL":   "https://app.example.com/activate?token=ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"expiry":          token.Expiry,
+		"expiresIn":       "3 days",
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("expected %v, got %v", want, data)
+	}
+}
+
+func TestPasswordResetEmailData(t *testing.T) {
+	app := &application{}
+	app.config.BaseURL = "https://app.example.com"
+	app.config.Links.ResetPasswordPath = "/verify/{token}/password"
+
+	user := &db.User{Email: "testuser@example.com"}
+	token := &db.Token{Plain: "ABCDEFGHIJKLMNOPQRSTUVWXYZ", Expiry: time.Now().Add(db.ResetPwdTokenTime)}
+
+	data := app.passwordResetEmailData(user, token, app.config.BaseURL)
+
+	want := "https://app.example.com/verify/ABCDEFGHIJKLMNOPQRSTUVWXYZ/password"
+	if data["resetPasswordURL"] != want {
+		t.Errorf("expected %q, got %q", want, data["resetPasswordURL"])
+	}
+
+	if data["resetPasswordToken"] != token.Plain {
+		t.Errorf("expected the token %q, got %q", token.Plain, data["resetPasswordToken"])
+	}
+}
+
+func TestRedirectBase(t *testing.T) {
+	app := &application{}
+	app.config.BaseURL = "https://app.example.com"
+	app.config.AllowedRedirectOrigins = []string{"https://m.example.com", "http://localhost:8080/"}
+
+	tests := []struct {
+		redirectURL string
+		want        string
+		valid       bool
+	}{
+		{redirectURL: "", want: "https://app.example.com", valid: true},
+		{redirectURL: "https://app.example.com/signup", want: "https://app.example.com/signup", valid: true},
+		{redirectURL: "https://m.example.com", want: "https://m.example.com", valid: true},
+		{redirectURL: "https://M.Example.com/app/", want: "https://M.Example.com/app/", valid: true},
+		{redirectURL: "http://localhost:8080", want: "http://localhost:8080", valid: true},
+		{redirectURL: "https://evil.example.com", valid: false},
+		{redirectURL: "http://m.example.com", valid: false},
+		{redirectURL: "https://m.example.com.evil.com", valid: false},
+		{redirectURL: "http://localhost:9090", valid: false},
+		{redirectURL: "https://user@m.example.com", valid: false},
+		{redirectURL: "https://m.example.com/?next=https://evil.example.com", valid: false},
+		{redirectURL: "https://m.example.com/#fragment", valid: false},
+		{redirectURL: "//m.example.com", valid: false},
+		{redirectURL: "javascript:alert(1)", valid: false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+
+		got := app.redirectBase(v, tt.redirectURL)
+		if v.Valid() != tt.valid {
+			t.Errorf("%q: expected valid=%v, got valid=%v", tt.redirectURL, tt.valid, v.Valid())
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.redirectURL, tt.want, got)
+		}
+	}
+
+	v := validator.New()
+	base := app.redirectBase(v, "https://m.example.com/")
+	app.config.Links.ActivationPath = "/activate?token={token}"
+
+	want := "https://m.example.com/activate?token=ABC"
+	if got := app.emailLink(base, app.config.Links.ActivationPath, "ABC"); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{72*time.Hour - time.Second, "3 days"},
+		{24 * time.Hour, "1 day"},
+		{time.Hour, "1 hour"},
+		{90 * time.Minute, "2 hours"},
+		{15 * time.Minute, "15 minutes"},
+		{10 * time.Second, "1 minute"},
+	}
+
+	for _, tt := range tests {
+		if got := humanDuration(tt.d); got != tt.want {
+			t.Errorf("humanDuration(%s): expected %q, got %q", tt.d, tt.want, got)
+		}
+	}
+}
+
+func TestIdempotencyFingerprint(t *testing.T) {
+	fingerprint := func(method, path string, payload any) string {
+		r := httptest.NewRequest(method, path, nil)
+
+		hash, err := idempotencyFingerprint(r, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(hash)
+	}
+
+	payload := createUserInput{Username: "testuser", Email: "testuser@example.com"}
+	want := fingerprint(http.MethodPost, "/v1/users/new", payload)
+
+	if got := fingerprint(http.MethodPost, "/v1/users/new?page=2", payload); got != want {
+		t.Error("the query string must not change the fingerprint")
+	}
+
+	other := payload
+	other.Email = "other@example.com"
+
+	for name, got := range map[string]string{
+		"method":  fingerprint(http.MethodPut, "/v1/users/new", payload),
+		"path":    fingerprint(http.MethodPost, "/v1/users/other", payload),
+		"payload": fingerprint(http.MethodPost, "/v1/users/new", other),
+	} {
+		if got == want {
+			t.Errorf("a different %s must change the fingerprint", name)
+		}
+	}
+}
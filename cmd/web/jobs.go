@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+)
+
+// startJobs schedules the periodic maintenance jobs, a zero interval disables a job.
+func (app *application) startJobs() {
+	if interval := app.config.Auth.ActivationReminder.Interval; interval > 0 {
+		app.runPeriodically("activation_reminder", interval, app.sendActivationReminders)
+	}
+
+	if interval := app.config.Auth.UnactivatedPurge.Interval; interval > 0 {
+		app.runPeriodically("unactivated_purge", interval, app.purgeUnactivatedUsers)
+	}
+
+	if interval := app.config.Metrics.RefreshInterval; interval > 0 {
+		// fill the gauges right away instead of exposing zeros for the first interval
+		app.backgroundTask(func(ctx context.Context) {
+			app.runJob(ctx, "business_metrics", app.refreshMetrics)
+		})
+		app.runPeriodically("business_metrics", interval, app.refreshMetrics)
+	}
+}
+
+// runPeriodically calls fn every interval until the application context is cancelled. It is
+// tracked like a background task, so shutdown waits for a run in progress, but never holds one of
+// the background task slots.
+func (app *application) runPeriodically(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	app.goTracked(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.runJob(ctx, name, fn)
+			}
+		}
+	})
+}
+
+// runJob runs a single iteration of a job, a failing or panicking run doesn't stop the schedule.
+func (app *application) runJob(ctx context.Context, name string, fn func(ctx context.Context) error) {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.Error(fmt.Sprintf("%v", err), "job", name)
+		}
+	}()
+
+	start := time.Now()
+
+	err := fn(ctx)
+	if err != nil {
+		app.logger.Error(err.Error(), "job", name)
+		return
+	}
+
+	app.logger.Debug("job completed", "job", name, "duration", time.Since(start).String())
+}
+
+// sendActivationReminders resends the activation email to users that haven't activated their
+// account within the configured delay, up to the configured number of reminders.
+func (app *application) sendActivationReminders(ctx context.Context) error {
+	cfg := app.config.Auth.ActivationReminder
+
+	users, err := app.models.Users.GetDueActivationReminder(ctx, time.Now().Add(-cfg.After), cfg.Max)
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+
+	for _, user := range users {
+		if ctx.Err() != nil {
+			break
+		}
+
+		err := app.sendActivationReminder(ctx, user)
+		if err != nil {
+			app.logger.Error(err.Error(), "job", "activation_reminder", "user_id", user.ID)
+			continue
+		}
+
+		sent++
+	}
+
+	if sent > 0 {
+		app.logger.Info("activation reminders sent", "count", sent)
+	}
+
+	return nil
+}
+
+// sendActivationReminder replaces the user's activation token, the plain text of the
+// previous one isn't stored, and emails the new one.
+func (app *application) sendActivationReminder(ctx context.Context, user *db.User) error {
+	err := app.models.Tokens.Delete(ctx, user.ID, db.TokenScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.CreateToken(ctx, user.ID, db.ActivationTokenTime, db.TokenScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	data := app.activationEmailData(user, token, app.config.BaseURL)
+
+	err = app.sendEmail(ctx, user.ID, user.Email, "mail.html", data)
+	if err != nil {
+		return err
+	}
+
+	return app.models.Users.RecordActivationReminder(ctx, user.ID)
+}
+
+// purgeUnactivatedUsers deletes the accounts that were never activated within the configured
+// grace period.
+func (app *application) purgeUnactivatedUsers(ctx context.Context) error {
+	deleted, err := app.models.Users.DeleteUnactivatedBefore(ctx, time.Now().Add(-app.config.Auth.UnactivatedPurge.After))
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		app.logger.Info("unactivated users purged", "count", deleted)
+	}
+
+	return nil
+}
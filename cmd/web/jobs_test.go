@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPeriodically(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	app := &application{
+		ctx:    ctx,
+		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+	}
+
+	var runs atomic.Int32
+
+	app.runPeriodically("test", 5*time.Millisecond, func(ctx context.Context) error {
+		switch runs.Add(1) {
+		case 1:
+			return errors.New("failed run")
+		case 2:
+			panic("panicking run")
+		}
+		return nil
+	})
+
+	assert.Eventually(t, func() bool { return runs.Load() >= 3 }, time.Second, time.Millisecond, "failing runs must not stop the schedule")
+
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job did not stop after the context was cancelled")
+	}
+}
+
+func TestSendActivationReminders(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.Auth.ActivationReminder.After = 24 * time.Hour
+	app.config.Auth.ActivationReminder.Max = 2
+
+	mailer := app.mailer.(*recordingMailer)
+
+	createUser := func(username string, activated bool, age time.Duration) *db.User {
+		user, _ := createTestUser(t, app, username)
+
+		if !activated {
+			err := app.models.Users.Deactivate(context.Background(), user.ID)
+			assert.NoError(t, err)
+		}
+
+		_, err := app.models.DB.Exec("UPDATE users SET created_at = $1 WHERE id = $2", time.Now().Add(-age), user.ID)
+		assert.NoError(t, err)
+
+		return user
+	}
+
+	reminders := func(userID int) int {
+		var sent int
+		err := app.models.DB.QueryRow("SELECT activation_reminders_sent FROM users WHERE id = $1", userID).Scan(&sent)
+		assert.NoError(t, err)
+		return sent
+	}
+
+	stale := createUser("staleuser", false, 48*time.Hour)
+	fresh := createUser("freshuser", false, time.Hour)
+	activated := createUser("activeuser", true, 48*time.Hour)
+
+	err := app.sendActivationReminders(context.Background())
+	assert.NoError(t, err)
+
+	sent := mailer.Sent()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, stale.Email, sent[0].recipient)
+		assert.Equal(t, "mail.html", sent[0].templateFile)
+	}
+
+	assert.Equal(t, 1, reminders(stale.ID))
+	assert.Equal(t, 0, reminders(fresh.ID))
+	assert.Equal(t, 0, reminders(activated.ID))
+
+	_, err = app.models.Tokens.Get(context.Background(), stale.ID, db.TokenScopeActivation)
+	assert.NoError(t, err, "the reminder carries a new activation token")
+
+	t.Run("Reminders are spaced out", func(t *testing.T) {
+		err := app.sendActivationReminders(context.Background())
+		assert.NoError(t, err)
+
+		assert.Len(t, mailer.Sent(), 1)
+		assert.Equal(t, 1, reminders(stale.ID))
+	})
+
+	t.Run("Reminders stop at the maximum", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, err := app.models.DB.Exec("UPDATE users SET last_reminder_at = $1 WHERE id = $2", time.Now().Add(-48*time.Hour), stale.ID)
+			assert.NoError(t, err)
+
+			err = app.sendActivationReminders(context.Background())
+			assert.NoError(t, err)
+		}
+
+		assert.Len(t, mailer.Sent(), 2)
+		assert.Equal(t, 2, reminders(stale.ID))
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestPurgeUnactivatedUsers(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.Auth.UnactivatedPurge.After = 30 * 24 * time.Hour
+
+	backdate := func(user *db.User, age time.Duration) {
+		_, err := app.models.DB.Exec("UPDATE users SET created_at = $1 WHERE id = $2", time.Now().Add(-age), user.ID)
+		assert.NoError(t, err)
+	}
+
+	createUnactivated := func(username string, age time.Duration) *db.User {
+		pwd := "Test1234!"
+		user := &db.User{Username: username, Email: username + "@example.com", Password: db.Password{Plain: &pwd}}
+
+		err := app.models.Users.Create(context.Background(), user)
+		assert.NoError(t, err)
+
+		_, err = app.models.Tokens.CreateToken(context.Background(), user.ID, db.ActivationTokenTime, db.TokenScopeActivation)
+		assert.NoError(t, err)
+
+		backdate(user, age)
+		return user
+	}
+
+	stale := createUnactivated("staleuser", 31*24*time.Hour)
+	createUnactivated("freshuser", 24*time.Hour)
+
+	activated, _ := createTestUser(t, app, "activeuser")
+	backdate(activated, 60*24*time.Hour)
+
+	// deactivated by an admin after having been activated, must not be purged
+	deactivated, _ := createTestUser(t, app, "deactivateduser")
+	err := app.models.Users.Deactivate(context.Background(), deactivated.ID)
+	assert.NoError(t, err)
+	backdate(deactivated, 60*24*time.Hour)
+
+	err = app.purgeUnactivatedUsers(context.Background())
+	assert.NoError(t, err)
+
+	_, err = app.models.Users.GetByUsername(context.Background(), "staleuser")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	_, err = app.models.Tokens.Get(context.Background(), stale.ID, db.TokenScopeActivation)
+	assert.ErrorIs(t, err, db.ErrNotFound, "tokens are deleted with the user")
+
+	for _, username := range []string{"freshuser", "activeuser", "deactivateduser"} {
+		_, err = app.models.Users.GetByUsername(context.Background(), username)
+		assert.NoError(t, err, username)
+	}
+
+	t.Run("Username and email can be reused", func(t *testing.T) {
+		createUnactivated("staleuser", 0)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
@@ -6,31 +6,161 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/caarlos0/env/v11"
 	models "github.com/sushihentaime/user-management-service/internal/db"
 
 	"github.com/sushihentaime/user-management-service/internal/mail"
 
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// version, commit and buildTime identify the build, they are set with -ldflags, e.g.
+// -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
 )
 
 type application struct {
 	config config
 	logger *slog.Logger
 	models *models.Models
-	mailer *mail.Mailer
+	mailer emailSender
 	wg     sync.WaitGroup
+	// tasks queues background tasks for the worker pool, see config.MaxBackgroundTasks. Nil when unbounded.
+	tasks chan func()
+	// loginThrottle tracks failed logins per username, see config.Auth.LoginThrottle.
+	loginThrottle *loginThrottle
+	// recoveryThrottle tracks wrong security question answers per email, configured like loginThrottle.
+	recoveryThrottle *loginThrottle
+	// otpThrottle tracks wrong password reset OTPs per email, configured like loginThrottle.
+	otpThrottle *loginThrottle
+	// questionsThrottle counts security question lookups per email and per client IP, configured
+	// like loginThrottle.
+	questionsThrottle *loginThrottle
+	// refreshes shares a refresh token rotation between concurrent requests, see config.Auth.RefreshReuseGrace.
+	refreshes *refreshDeduper
+	// metrics holds the gauges exposed on /metrics, see config.Metrics.
+	metrics *businessMetrics
+	// traffic counts the requests and their sizes for /metrics.
+	traffic trafficMetrics
+	// tracerProvider records the request spans, see config.Tracing. Nil when tracing is disabled.
+	tracerProvider trace.TracerProvider
+	// ctx is cancelled once the server starts shutting down so background tasks can stop early.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// envProduction is the ENV value of production deployments.
+const envProduction = "production"
+
+const (
+	mailDryRunLog  = "log"
+	mailDryRunFile = "file"
+)
+
+const (
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+)
+
+const (
+	passwordResetLink = "link"
+	passwordResetOTP  = "otp"
+)
+
+// emailSender is implemented by *mail.Mailer and the dry run mailers, tests substitute a recorder.
+type emailSender interface {
+	Send(recipient, templateFile string, data any, opts ...mail.SendOption) error
 }
 
 type config struct {
 	Port string `env:"PORT,required"`
-	Env  string `env:"ENV,required"`
-	DB   struct {
+	// Env set to production only accepts requests made over HTTPS.
+	Env string `env:"ENV,required"`
+	// LogLevel set to DEBUG also logs redacted request and response bodies.
+	LogLevel slog.Level `env:"LOG_LEVEL" envDefault:"INFO"`
+	// SlowRequestThreshold logs a warning for every request taking longer, zero disables it.
+	SlowRequestThreshold time.Duration `env:"SLOW_REQUEST_THRESHOLD" envDefault:"1s"`
+	// TrustedProxies lists the CIDRs whose X-Forwarded-For and X-Real-IP headers are honoured.
+	TrustedProxies []netip.Prefix `env:"TRUSTED_PROXIES" envSeparator:","`
+	// BaseURL is where users reach the frontend, links in emails are built from it.
+	BaseURL string `env:"BASE_URL" envDefault:"http://localhost:3000"`
+	// Links are the frontend routes of the links in emails, relative to BaseURL. {token} is replaced
+	// with the token, e.g. "/verify/{token}".
+	Links struct {
+		ActivationPath    string `env:"LINK_ACTIVATION_PATH" envDefault:"/activate?token={token}"`
+		ResetPasswordPath string `env:"LINK_RESET_PASSWORD_PATH" envDefault:"/reset-password?token={token}"`
+		VerifyEmailPath   string `env:"LINK_VERIFY_EMAIL_PATH" envDefault:"/verify-email?token={token}"`
+		EmailRollbackPath string `env:"LINK_EMAIL_ROLLBACK_PATH" envDefault:"/email-rollback?token={token}"`
+	}
+	// AllowedRedirectOrigins are the origins besides BaseURL's that clients may point the links in
+	// emails at with redirect_url, e.g. "https://m.example.com". Any other redirect_url is rejected.
+	AllowedRedirectOrigins []string `env:"ALLOWED_REDIRECT_ORIGINS" envSeparator:","`
+	// FeatureFlags maps feature flags to the percentage of users they are enabled for, e.g.
+	// "secondary_emails=25". Users are bucketed by their ID, see featureEnabled. Flags missing from
+	// a configured value are disabled. Secondary emails are enabled for everyone by default, the
+	// flag only gates adding an address, not managing the ones already added.
+	FeatureFlags map[string]int `env:"FEATURE_FLAGS" envSeparator:"," envKeyValSeparator:"=" envDefault:"secondary_emails=100"`
+	// IdempotencyKeyTTL is how long a response is replayed for a repeated Idempotency-Key.
+	IdempotencyKeyTTL time.Duration `env:"IDEMPOTENCY_KEY_TTL" envDefault:"24h"`
+	// MaxBackgroundTasks is the number of workers running background tasks, such as sending emails.
+	// Up to BackgroundQueueSize further tasks wait for a worker, once the queue is full requests
+	// queueing a task block. Zero removes the bound, running every task in its own goroutine.
+	MaxBackgroundTasks  int `env:"MAX_BACKGROUND_TASKS" envDefault:"32"`
+	BackgroundQueueSize int `env:"BACKGROUND_QUEUE_SIZE" envDefault:"1024"`
+	// CORS answers cross-origin requests from TrustedOrigins, "*" trusting every origin. MaxAge lets
+	// browsers cache preflight results, AllowCredentials lets them send cookies and can't be combined
+	// with "*". PublicRoutes extends CORS to /health, /version and /metrics.
+	CORS struct {
+		TrustedOrigins   []string      `env:"CORS_TRUSTED_ORIGINS" envSeparator:","`
+		MaxAge           time.Duration `env:"CORS_MAX_AGE" envDefault:"0s"`
+		AllowCredentials bool          `env:"CORS_ALLOW_CREDENTIALS" envDefault:"false"`
+		PublicRoutes     bool          `env:"CORS_PUBLIC_ROUTES" envDefault:"true"`
+	}
+	Server struct {
+		ReadTimeout  time.Duration `env:"SERVER_READ_TIMEOUT" envDefault:"10s"`
+		WriteTimeout time.Duration `env:"SERVER_WRITE_TIMEOUT" envDefault:"30s"`
+		IdleTimeout  time.Duration `env:"SERVER_IDLE_TIMEOUT" envDefault:"120s"`
+		// ShutdownTimeout bounds how long in-flight requests and background tasks may take to drain.
+		ShutdownTimeout time.Duration `env:"SERVER_SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	}
+	// Metrics exposes user and token gauges on /metrics, refreshed every RefreshInterval, along with
+	// request counters. The gauges are business data, a zero interval disables them and the endpoint.
+	// Scrapers must send Token as a bearer token, it is required while the endpoint is enabled.
+	Metrics struct {
+		RefreshInterval time.Duration `env:"METRICS_REFRESH_INTERVAL" envDefault:"0s"`
+		Token           string        `env:"METRICS_TOKEN"`
+	}
+	// Tracing exports a span for every request and database call, continuing the traces of callers
+	// that send a traceparent header. Exporter is "otlp" to send them over OTLP/HTTP to the collector
+	// at Endpoint (host:port), or "stdout" to print them. SampleRatio is the share of the traces
+	// started here that are recorded, propagated traces keep their caller's decision.
+	Tracing struct {
+		Enabled     bool    `env:"TRACING_ENABLED" envDefault:"false"`
+		Exporter    string  `env:"TRACING_EXPORTER" envDefault:"otlp"`
+		Endpoint    string  `env:"TRACING_ENDPOINT" envDefault:"localhost:4318"`
+		Insecure    bool    `env:"TRACING_INSECURE" envDefault:"false"`
+		ServiceName string  `env:"TRACING_SERVICE_NAME" envDefault:"user-management-service"`
+		SampleRatio float64 `env:"TRACING_SAMPLE_RATIO" envDefault:"1"`
+	}
+	// TLS serves HTTPS when CertFile and KeyFile are set. MinVersion is "1.2" or "1.3", CipherSuites
+	// restricts the TLS 1.2 cipher suites by their standard names, empty keeps Go's secure defaults.
+	// TLS 1.3 cipher suites can't be configured.
+	TLS struct {
+		CertFile     string   `env:"TLS_CERT_FILE"`
+		KeyFile      string   `env:"TLS_KEY_FILE"`
+		MinVersion   string   `env:"TLS_MIN_VERSION" envDefault:"1.2"`
+		CipherSuites []string `env:"TLS_CIPHER_SUITES" envSeparator:","`
+	}
+	DB struct {
 		DB_HOST      string        `env:"DB_HOST,required"`
 		DB_PORT      int           `env:"DB_PORT,required"`
 		DB_USER      string        `env:"POSTGRES_USER,required"`
@@ -41,31 +171,149 @@ type config struct {
 		MaxIdleTime  time.Duration `env:"DB_CONN_MAX_IDLE_TIME,required"`
 	}
 	Mail struct {
-		Host     string `env:"SMTP_HOST,required"`
-		Port     int    `env:"SMTP_PORT,required"`
-		Username string `env:"SMTP_USERNAME,required"`
-		Password string `env:"SMTP_PASSWORD,required"`
-		Sender   string `env:"SMTP_SENDER,required"`
+		// DryRun set to "log" or "file" renders emails to the log or to files in DryRunDir
+		// instead of sending them, the SMTP connection settings are then optional.
+		DryRun    string `env:"MAIL_DRY_RUN"`
+		DryRunDir string `env:"MAIL_DRY_RUN_DIR" envDefault:"tmp/mail"`
+		Host      string `env:"SMTP_HOST"`
+		Port      int    `env:"SMTP_PORT"`
+		Username  string `env:"SMTP_USERNAME"`
+		Password  string `env:"SMTP_PASSWORD"`
+		Sender    string `env:"SMTP_SENDER,required"`
+		// SenderName, ReplyTo and BCC are optional headers added to every email.
+		SenderName string   `env:"SMTP_SENDER_NAME"`
+		ReplyTo    string   `env:"SMTP_REPLY_TO"`
+		BCC        []string `env:"SMTP_BCC" envSeparator:","`
+		// SecurityBCC receive copies of security relevant emails only, those rendered from
+		// SecurityTemplates and the notices of an email change.
+		SecurityBCC       []string `env:"SMTP_SECURITY_BCC" envSeparator:","`
+		SecurityTemplates []string `env:"SMTP_SECURITY_TEMPLATES" envSeparator:"," envDefault:"password_changed.html"`
+	}
+	Auth struct {
+		// PrivateRegistration answers a signup with an already registered email like a successful
+		// one and emails the address owner, instead of reporting the duplicate email.
+		PrivateRegistration bool `env:"AUTH_PRIVATE_REGISTRATION" envDefault:"false"`
+		// CookieTokens delivers the token pair as Secure, HttpOnly, SameSite=Strict cookies instead of
+		// in the response body, and accepts the access token cookie when no Authorization header is sent.
+		CookieTokens bool `env:"AUTH_COOKIE_TOKENS" envDefault:"false"`
+		// CSRFProtection requires the double submit CSRF token on state changing requests that
+		// carry cookies, enable it when browser clients keep their tokens in cookies.
+		CSRFProtection bool `env:"AUTH_CSRF_PROTECTION" envDefault:"false"`
+		// SingleSession revokes every other session of a user when they log in or refresh, as it
+		// always was before sessions were tracked per token. Disable it to let users stay logged
+		// in on several devices.
+		SingleSession bool `env:"AUTH_SINGLE_SESSION" envDefault:"true"`
+		// FreshAuthWindow is how long after logging in a session may be used for sensitive actions,
+		// refreshing its tokens doesn't restart it.
+		FreshAuthWindow time.Duration `env:"AUTH_FRESH_WINDOW" envDefault:"10m"`
+		// MaxSessionLifetime is how long after login an access token can be kept alive with
+		// POST /v1/tokens/extend, extended tokens never expire later than that.
+		MaxSessionLifetime time.Duration `env:"AUTH_MAX_SESSION_LIFETIME" envDefault:"168h"`
+		// SignupPermissions are granted when an account is created, ActivationPermissions once its email is verified.
+		SignupPermissions     []models.Permission `env:"AUTH_SIGNUP_PERMISSIONS" envSeparator:"," envDefault:"user:read"`
+		ActivationPermissions []models.Permission `env:"AUTH_ACTIVATION_PERMISSIONS" envSeparator:"," envDefault:"user:write"`
+		RejectWeakPasswords   bool                `env:"AUTH_REJECT_WEAK_PASSWORDS" envDefault:"false"`
+		// UsernamePattern is the anchored regular expression usernames must match, ReservedUsernames
+		// can't be registered through the API but may still be used with -create-admin.
+		UsernamePattern   string   `env:"AUTH_USERNAME_PATTERN" envDefault:"^[a-zA-Z0-9]+$"`
+		ReservedUsernames []string `env:"AUTH_RESERVED_USERNAMES" envSeparator:"," envDefault:"admin,root,support,api"`
+		// MaxUsernameLength and MaxEmailLength bound the accepted lengths, up to what the users table stores.
+		MaxUsernameLength int `env:"AUTH_MAX_USERNAME_LENGTH" envDefault:"25"`
+		MaxEmailLength    int `env:"AUTH_MAX_EMAIL_LENGTH" envDefault:"254"`
+		// MaxActiveTokens caps the live tokens per user and scope, evicting the oldest. Zero disables the cap.
+		MaxActiveTokens int `env:"AUTH_MAX_ACTIVE_TOKENS" envDefault:"10"`
+		// PermissionLookupRetries is how many times a permission lookup failing with a transient database
+		// error is retried before the request fails, waiting PermissionLookupRetryDelay longer before each
+		// attempt. Zero fails right away.
+		PermissionLookupRetries    int           `env:"AUTH_PERMISSION_LOOKUP_RETRIES" envDefault:"0"`
+		PermissionLookupRetryDelay time.Duration `env:"AUTH_PERMISSION_LOOKUP_RETRY_DELAY" envDefault:"50ms"`
+		// LoginThrottle delays logins to an account after repeated failures, a zero BaseDelay disables it.
+		LoginThrottle struct {
+			FreeAttempts int           `env:"AUTH_LOGIN_THROTTLE_FREE_ATTEMPTS" envDefault:"5"`
+			BaseDelay    time.Duration `env:"AUTH_LOGIN_THROTTLE_BASE_DELAY" envDefault:"1s"`
+			MaxDelay     time.Duration `env:"AUTH_LOGIN_THROTTLE_MAX_DELAY" envDefault:"15m"`
+			Window       time.Duration `env:"AUTH_LOGIN_THROTTLE_WINDOW" envDefault:"1h"`
+		}
+		// SecurityQuestions lets users set recovery questions and reset their password by answering
+		// them, without access to their email. Wrong answers are throttled like logins.
+		SecurityQuestions bool `env:"AUTH_SECURITY_QUESTIONS" envDefault:"false"`
+		// AccountDeletion lets users permanently delete their own account and everything that belongs
+		// to it. The audit events they took part in are kept with the user cleared unless PurgeAuditOnDeletion.
+		AccountDeletion      bool `env:"AUTH_ACCOUNT_DELETION" envDefault:"false"`
+		PurgeAuditOnDeletion bool `env:"AUTH_PURGE_AUDIT_ON_DELETION" envDefault:"false"`
+		// RefreshReuseGrace is how long after a rotation a refresh with the rotated token returns the
+		// same new pair instead of failing. Zero only shares rotations that are still in flight.
+		RefreshReuseGrace time.Duration `env:"AUTH_REFRESH_REUSE_GRACE" envDefault:"10s"`
+		// PasswordResetCooldown is the minimum time between two password reset emails to a user, requests
+		// within it are answered as usual but send nothing.
+		PasswordResetCooldown time.Duration `env:"AUTH_PASSWORD_RESET_COOLDOWN" envDefault:"5m"`
+		// UsernameRecoveryCooldown is the minimum time between two emails reminding a user of their
+		// username, requests within it are answered as usual but send nothing.
+		UsernameRecoveryCooldown time.Duration `env:"AUTH_USERNAME_RECOVERY_COOLDOWN" envDefault:"5m"`
+		// PasswordResetMode is "link" to email a reset link, or "otp" to email a short lived numeric code
+		// for clients that can't open links, redeemed together with the email address.
+		PasswordResetMode string `env:"AUTH_PASSWORD_RESET_MODE" envDefault:"link"`
+		// IdleTimeout rejects access tokens unused for longer than it even before they expire, zero
+		// disables it and with it the recording of a token's last use. LastUsedInterval throttles
+		// how often a token's last use is written.
+		IdleTimeout      time.Duration `env:"AUTH_IDLE_TIMEOUT" envDefault:"0s"`
+		LastUsedInterval time.Duration `env:"AUTH_LAST_USED_INTERVAL" envDefault:"1m"`
+		// EmailRollbackWindow is how long a replaced verified email address can be restored by the
+		// user or an admin, in case the change was made by someone who took over the account.
+		EmailRollbackWindow time.Duration `env:"AUTH_EMAIL_ROLLBACK_WINDOW" envDefault:"168h"`
+		// ImpersonationTTL is how long an access token issued to an admin impersonating a user is valid.
+		ImpersonationTTL time.Duration `env:"AUTH_IMPERSONATION_TTL" envDefault:"15m"`
+		// ActivationResendCooldown is the minimum time between two activation emails requested by a user.
+		ActivationResendCooldown time.Duration `env:"AUTH_ACTIVATION_RESEND_COOLDOWN" envDefault:"60s"`
+		// ActivationReminder resends the activation email to accounts still unactivated After their
+		// creation and previous reminder, at most Max times. A zero Interval disables the job.
+		ActivationReminder struct {
+			Interval time.Duration `env:"AUTH_ACTIVATION_REMINDER_INTERVAL" envDefault:"1h"`
+			After    time.Duration `env:"AUTH_ACTIVATION_REMINDER_AFTER" envDefault:"24h"`
+			Max      int           `env:"AUTH_ACTIVATION_REMINDER_MAX" envDefault:"3"`
+		}
+		// UnactivatedPurge deletes accounts never activated within After of their creation,
+		// freeing the username and email. A zero Interval disables the job.
+		UnactivatedPurge struct {
+			Interval time.Duration `env:"AUTH_UNACTIVATED_PURGE_INTERVAL" envDefault:"24h"`
+			After    time.Duration `env:"AUTH_UNACTIVATED_PURGE_AFTER" envDefault:"720h"`
+		}
 	}
 }
 
 func main() {
-	var envFile string
+	var (
+		envFile string
+		admin   struct {
+			create                    bool
+			username, email, password string
+		}
+	)
 
-	flag.StringVar(&envFile, "env", ".env", "Environment variables file name")
+	flag.StringVar(&envFile, "env", ".env", "Comma separated environment variable files, later files override earlier ones and the environment overrides all")
+	flag.BoolVar(&admin.create, "create-admin", false, "Create an activated admin user and exit")
+	flag.StringVar(&admin.username, "username", "", "Username of the admin user to create")
+	flag.StringVar(&admin.email, "email", "", "Email of the admin user to create")
+	flag.StringVar(&admin.password, "password", "", "Password of the admin user to create")
 	flag.Parse()
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-	err := godotenv.Load(envFile)
+	cfg, err := loadConfig(strings.Split(envFile, ","), os.Environ())
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
-	var cfg config
+	logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: cfg.LogLevel}))
 
-	err = env.Parse(&cfg)
+	rules := models.NewUserRules()
+	rules.RejectWeakPasswords = cfg.Auth.RejectWeakPasswords
+	rules.ReservedUsernames = cfg.Auth.ReservedUsernames
+	rules.MaxUsernameLength = cfg.Auth.MaxUsernameLength
+	rules.MaxEmailLength = cfg.Auth.MaxEmailLength
+
+	err = rules.SetUsernamePattern(cfg.Auth.UsernamePattern)
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
@@ -82,13 +330,66 @@ func main() {
 
 	logger.Info("Database connection established")
 
+	if admin.create {
+		user, err := createAdmin(context.Background(), models.NewModels(db, rules, cfg.Auth.MaxActiveTokens), admin.username, admin.email, admin.password)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("admin user created", "username", user.Username, "user_id", user.ID)
+		return
+	}
+
+	mailer, err := newMailer(cfg, logger)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	app := &application{
+		ctx:    ctx,
+		cancel: cancel,
 		config: cfg,
 		logger: logger,
-		models: models.NewModels(db),
-		mailer: mail.New(cfg.Mail.Host, cfg.Mail.Port, cfg.Mail.Username, cfg.Mail.Password, cfg.Mail.Sender),
+		models: models.NewModels(db, rules, cfg.Auth.MaxActiveTokens),
+		mailer: mailer,
+		loginThrottle: newLoginThrottle(cfg.Auth.LoginThrottle.FreeAttempts, cfg.Auth.LoginThrottle.BaseDelay,
+			cfg.Auth.LoginThrottle.MaxDelay, cfg.Auth.LoginThrottle.Window),
+		recoveryThrottle: newLoginThrottle(cfg.Auth.LoginThrottle.FreeAttempts, cfg.Auth.LoginThrottle.BaseDelay,
+			cfg.Auth.LoginThrottle.MaxDelay, cfg.Auth.LoginThrottle.Window),
+		otpThrottle: newLoginThrottle(cfg.Auth.LoginThrottle.FreeAttempts, cfg.Auth.LoginThrottle.BaseDelay,
+			cfg.Auth.LoginThrottle.MaxDelay, cfg.Auth.LoginThrottle.Window),
+		questionsThrottle: newLoginThrottle(cfg.Auth.LoginThrottle.FreeAttempts, cfg.Auth.LoginThrottle.BaseDelay,
+			cfg.Auth.LoginThrottle.MaxDelay, cfg.Auth.LoginThrottle.Window),
+		refreshes: newRefreshDeduper(cfg.Auth.RefreshReuseGrace),
+		metrics:   newBusinessMetrics(),
+		tasks:     newTaskQueue(cfg.MaxBackgroundTasks, cfg.BackgroundQueueSize),
 	}
 
+	if cfg.Tracing.Enabled {
+		tracerProvider, err := setupTracing(ctx, cfg)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+			defer cancel()
+
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				logger.Error("could not flush the spans", "error", err.Error())
+			}
+		}()
+
+		app.tracerProvider = tracerProvider
+	}
+
+	app.startJobs()
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -96,6 +397,26 @@ func main() {
 	}
 }
 
+// newMailer returns the SMTP mailer, or in dry run mode one that only renders the emails.
+func newMailer(cfg config, logger *slog.Logger) (emailSender, error) {
+	opts := []mail.Option{
+		mail.WithSenderName(cfg.Mail.SenderName),
+		mail.WithReplyTo(cfg.Mail.ReplyTo),
+		mail.WithBCC(cfg.Mail.BCC...),
+		mail.WithSecurityBCC(cfg.Mail.SecurityBCC...),
+		mail.WithSecurityTemplates(cfg.Mail.SecurityTemplates...),
+	}
+
+	switch cfg.Mail.DryRun {
+	case mailDryRunLog:
+		return mail.NewLogMailer(logger, cfg.Mail.Sender, opts...), nil
+	case mailDryRunFile:
+		return mail.NewFileMailer(cfg.Mail.DryRunDir, cfg.Mail.Sender, opts...)
+	default:
+		return mail.New(cfg.Mail.Host, cfg.Mail.Port, cfg.Mail.Username, cfg.Mail.Password, cfg.Mail.Sender, opts...), nil
+	}
+}
+
 func OpenDB(DBName string, maxOpenConns int, maxIdleConns int, maxIdleTime time.Duration) (*sql.DB, error) {
 	db, err := sql.Open("postgres", DBName)
 	if err != nil {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+)
+
+// businessMetrics holds the gauges exposed on /metrics. They are refreshed by the business_metrics
+// job rather than on every scrape, so that scrapes never run count queries.
+type businessMetrics struct {
+	mu             sync.RWMutex
+	users          int
+	activatedUsers int
+	tokens         map[db.TokenScope]int
+}
+
+func newBusinessMetrics() *businessMetrics {
+	return &businessMetrics{tokens: map[db.TokenScope]int{}}
+}
+
+func (m *businessMetrics) set(users, activatedUsers int, tokens map[db.TokenScope]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users = users
+	m.activatedUsers = activatedUsers
+	m.tokens = tokens
+}
+
+// writeTo renders the gauges in the Prometheus text exposition format.
+func (m *businessMetrics) writeTo(b *strings.Builder) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	gauge := func(name, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("ums_users", "Number of registered users.")
+	fmt.Fprintf(b, "ums_users %d\n", m.users)
+
+	gauge("ums_users_activated", "Number of users that activated their account.")
+	fmt.Fprintf(b, "ums_users_activated %d\n", m.activatedUsers)
+
+	gauge("ums_tokens", "Number of unexpired tokens by scope.")
+	scopes := make([]db.TokenScope, 0, len(m.tokens))
+	for scope := range m.tokens {
+		scopes = append(scopes, scope)
+	}
+	slices.Sort(scopes)
+	for _, scope := range scopes {
+		fmt.Fprintf(b, "ums_tokens{scope=%q} %d\n", scope, m.tokens[scope])
+	}
+}
+
+// trafficMetrics counts the requests served and the bytes of their bodies. The zero value is ready
+// to use.
+type trafficMetrics struct {
+	requests      atomic.Int64
+	requestBytes  atomic.Int64
+	responseBytes atomic.Int64
+}
+
+// record counts a request. requestBytes is its Content-Length, -1 when unknown.
+func (m *trafficMetrics) record(requestBytes, responseBytes int64) {
+	m.requests.Add(1)
+	if requestBytes > 0 {
+		m.requestBytes.Add(requestBytes)
+	}
+	m.responseBytes.Add(responseBytes)
+}
+
+// writeTo renders the counters in the Prometheus text exposition format.
+func (m *trafficMetrics) writeTo(b *strings.Builder) {
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+
+	counter("ums_http_requests_total", "Number of HTTP requests served.", m.requests.Load())
+	counter("ums_http_request_bytes_total", "Bytes of request bodies, as declared by their Content-Length.", m.requestBytes.Load())
+	counter("ums_http_response_bytes_total", "Bytes of response bodies written.", m.responseBytes.Load())
+}
+
+// refreshMetrics runs the count queries behind the business metrics.
+func (app *application) refreshMetrics(ctx context.Context) error {
+	users, activatedUsers, err := app.models.Users.Count(ctx)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := app.models.Tokens.CountByScope(ctx)
+	if err != nil {
+		return err
+	}
+
+	app.metrics.set(users, activatedUsers, tokens)
+
+	return nil
+}
+
+// metricsHandler serves the metrics to scrapers presenting METRICS_TOKEN as a bearer token, the
+// gauges being business data that must not be public.
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.extractTokenFromHeader(r.Header.Get("Authorization"))
+	if token == "" {
+		app.authenticationRequiredResponse(w, r)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(app.config.Metrics.Token)) != 1 {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	var b strings.Builder
+	app.metrics.writeTo(&b)
+	app.traffic.writeTo(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
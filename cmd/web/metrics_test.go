@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingUserStore struct {
+	db.UserStore
+	total, activated int
+}
+
+func (m *countingUserStore) Count(ctx context.Context) (int, int, error) {
+	return m.total, m.activated, nil
+}
+
+type countingTokenStore struct {
+	db.TokenStore
+	counts map[db.TokenScope]int
+}
+
+func (m *countingTokenStore) CountByScope(ctx context.Context) (map[db.TokenScope]int, error) {
+	return m.counts, nil
+}
+
+func TestMetrics(t *testing.T) {
+	users := &countingUserStore{total: 5, activated: 3}
+	tokens := &countingTokenStore{counts: map[db.TokenScope]int{db.TokenScopeRefresh: 2, db.TokenScopeAccess: 4}}
+
+	app := &application{
+		logger:  slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		models:  &db.Models{Users: users, Tokens: tokens},
+		metrics: newBusinessMetrics(),
+	}
+	app.config.Metrics.RefreshInterval = time.Minute
+	app.config.Metrics.Token = "scrape-token"
+	ts := newTestServer(t, app.routes())
+
+	get := func(token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := ts.Client().Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	scrape := func() string {
+		res := get(app.config.Metrics.Token)
+		defer res.Body.Close()
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, res.Header.Get("Content-Type"), "text/plain")
+
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	body := scrape()
+	assert.Contains(t, body, "# TYPE ums_users gauge\nums_users 0\n", "the gauges are zero until the first refresh")
+
+	err := app.refreshMetrics(context.Background())
+	assert.NoError(t, err)
+
+	body = scrape()
+	assert.Contains(t, body, "ums_users 5\n")
+	assert.Contains(t, body, "ums_users_activated 3\n")
+	assert.Contains(t, body, "ums_tokens{scope=\"token:access\"} 4\nums_tokens{scope=\"token:refresh\"} 2\n")
+
+	users.total, users.activated = 6, 4
+	tokens.counts = map[db.TokenScope]int{db.TokenScopeAccess: 1}
+
+	err = app.refreshMetrics(context.Background())
+	assert.NoError(t, err)
+
+	body = scrape()
+	assert.Contains(t, body, "ums_users 6\n")
+	assert.Contains(t, body, "ums_users_activated 4\n")
+	assert.Contains(t, body, "ums_tokens{scope=\"token:access\"} 1\n")
+	assert.NotContains(t, body, "token:refresh")
+	// the scrape being served isn't counted yet
+	assert.Contains(t, body, "# TYPE ums_http_requests_total counter\nums_http_requests_total 2\n")
+
+	t.Run("Scrape token is required", func(t *testing.T) {
+		res := get("")
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		res = get("wrong-token")
+		res.Body.Close()
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	})
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		app.config.Metrics.RefreshInterval = 0
+		ts := newTestServer(t, app.routes())
+
+		res, err := ts.Client().Get(ts.URL + "/metrics")
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sushihentaime/user-management-service/internal/db"
 )
@@ -22,31 +33,16 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Vary", "Authorization")
+		w.Header().Add("Vary", "Authorization")
 
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			r = app.createUserContext(r, db.AnonymousUser)
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		token := app.extractTokenFromHeader(authHeader)
-		if token == "" {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
-
-		dbToken := &db.Token{Plain: token}
-		if dbToken.ValidateToken(); !dbToken.Validator.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
+		if app.config.Auth.CookieTokens {
+			w.Header().Add("Vary", "Cookie")
 		}
 
-		user, err := app.models.Users.GetToken(db.TokenScopeAccess, db.HashToken(dbToken.Plain))
+		user, err := app.accessTokenUser(r)
 		if err != nil {
 			switch {
-			case err == db.ErrNotFound:
+			case errors.Is(err, errInvalidAccessToken):
 				app.invalidAuthenticationTokenResponse(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
@@ -59,6 +55,60 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// errInvalidAccessToken is returned by accessTokenUser when the request presents an access token
+// that is malformed, unknown, expired, idle or belongs to a locked user.
+var errInvalidAccessToken = errors.New("invalid access token")
+
+// accessTokenUser returns the user of the access token presented by the request, or the anonymous
+// user when the request presents none.
+func (app *application) accessTokenUser(r *http.Request) (*db.User, error) {
+	authHeader := r.Header.Get("Authorization")
+	_, cookieErr := r.Cookie(accessTokenCookieName)
+	if authHeader == "" && (!app.config.Auth.CookieTokens || cookieErr != nil) {
+		return db.AnonymousUser, nil
+	}
+
+	token := app.requestToken(r)
+	if token == "" {
+		return nil, errInvalidAccessToken
+	}
+
+	dbToken := &db.Token{Plain: token}
+	if dbToken.ValidateToken(); !dbToken.Validator.Valid() {
+		return nil, errInvalidAccessToken
+	}
+
+	user, err := app.models.Users.GetToken(r.Context(), db.TokenScopeAccess, db.HashToken(dbToken.Plain))
+	if err != nil {
+		switch {
+		case err == db.ErrNotFound:
+			return nil, errInvalidAccessToken
+		default:
+			return nil, err
+		}
+	}
+
+	// locking revokes the user's tokens, this covers a token issued while the lock was applied
+	if user.Locked {
+		return nil, errInvalidAccessToken
+	}
+
+	// the last use is only read for the idle timeout, without one recording it is a wasted query
+	if app.config.Auth.IdleTimeout > 0 {
+		err = app.models.Tokens.Touch(r.Context(), db.HashToken(dbToken.Plain), app.config.Auth.IdleTimeout, app.config.Auth.LastUsedInterval)
+		if err != nil {
+			switch {
+			case errors.Is(err, db.ErrTokenIdle), errors.Is(err, db.ErrNotFound):
+				return nil, errInvalidAccessToken
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	return user, nil
+}
+
 func (app *application) requireAuthUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.getUserContext(r)
@@ -89,9 +139,9 @@ func (app *application) requirePermission(next http.HandlerFunc, permissions ...
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.getUserContext(r)
 
-		userPermissions, err := app.models.Permissions.Get(user.ID)
+		userPermissions, err := app.getPermissions(r, user.ID)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
+			app.serverErrorResponse(w, r, fmt.Errorf("permission lookup for user %d: %w", user.ID, err))
 			return
 		}
 		for _, permission := range permissions {
@@ -106,10 +156,74 @@ func (app *application) requirePermission(next http.HandlerFunc, permissions ...
 	return app.requireActivatedUser(fn)
 }
 
+// getPermissions looks up the user's permissions, retrying transient database errors so that a
+// briefly degraded database doesn't fail every protected request.
+func (app *application) getPermissions(r *http.Request, userID int) (*db.Permissions, error) {
+	permissions, err := app.models.Permissions.Get(r.Context(), userID)
+
+	for attempt := 1; err != nil && db.IsTransient(err) && attempt <= app.config.Auth.PermissionLookupRetries; attempt++ {
+		app.loggerFor(r).Warn("permission lookup failed, retrying", "user_id", userID, "attempt", attempt, "error", err.Error())
+
+		select {
+		case <-time.After(time.Duration(attempt) * app.config.Auth.PermissionLookupRetryDelay):
+		case <-r.Context().Done():
+			return nil, err
+		}
+
+		permissions, err = app.models.Permissions.Get(r.Context(), userID)
+	}
+
+	return permissions, err
+}
+
+// requireFreshAuth only lets the request through when the user logged in to the token's session
+// within the configured fresh authentication window, and never for impersonation tokens.
+func (app *application) requireFreshAuth(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plain := app.requestToken(r)
+
+		token, err := app.models.Tokens.GetByHash(r.Context(), db.TokenScopeAccess, db.HashToken(plain))
+		if err != nil {
+			switch {
+			case errors.Is(err, db.ErrNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if time.Since(token.AuthenticatedAt) > app.config.Auth.FreshAuthWindow {
+			app.reauthenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireAuthUser(app.requireOwnSession(fn))
+}
+
+// requireOwnSession rejects requests made with an impersonation token, so that an admin
+// impersonating a user can't change the user's credentials or account.
+func (app *application) requireOwnSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.getUserContext(r).ImpersonatorID != 0 {
+			app.loggerFor(r).Warn("impersonation token rejected", "event", eventImpersonationRejected)
+			app.unauthorizedActionResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireAuthUser(fn)
+}
+
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
-			ip     = r.RemoteAddr
+			ip     = app.clientIP(r)
 			proto  = r.Proto
 			method = r.Method
 			uri    = r.URL.RequestURI()
@@ -117,6 +231,237 @@ func (app *application) logRequest(next http.Handler) http.Handler {
 
 		app.logger.Info("request from", "remote_addr", ip, "proto", proto, "method", method, "uri", uri)
 
+		r = app.createLoggerContext(r, app.logger.With("method", method, "uri", uri))
+
+		rec := newStatusRecorder(w)
+		start := time.Now()
+
+		next.ServeHTTP(rec, r)
+
+		duration := time.Since(start)
+		app.traffic.record(r.ContentLength, rec.bytes)
+
+		if threshold := app.config.SlowRequestThreshold; threshold > 0 && duration > threshold {
+			app.loggerFor(r).Warn("slow request", "route", method+" "+r.URL.Path, "duration", duration, "status", rec.status, "bytes", rec.bytes)
+			return
+		}
+
+		app.loggerFor(r).Info("request completed", "duration", duration, "status", rec.status, "bytes", rec.bytes)
+	})
+}
+
+// statusRecorder records the status code and the number of body bytes of the response written
+// through it. The status is 200 until the handler sets another one, as net/http does.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	// net/http ignores every call but the first
+	if !sr.wroteHeader {
+		sr.status = status
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends buffered data to the client when the wrapped writer supports it.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		sr.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the wrapped writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bodyRecorder) WriteHeader(status int) {
+	br.status = status
+	br.ResponseWriter.WriteHeader(status)
+}
+
+func (br *bodyRecorder) Write(b []byte) (int, error) {
+	br.body.Write(b)
+	return br.ResponseWriter.Write(b)
+}
+
+// logBody logs the request and response bodies with sensitive fields redacted.
+// It only does any work when the logger is enabled for debug messages.
+func (app *application) logBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.logger.Enabled(r.Context(), slog.LevelDebug) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var reqBody []byte
+		if r.Body != nil {
+			var err error
+			reqBody, err = io.ReadAll(io.LimitReader(r.Body, maxLoggedBodyBytes))
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			// put back what was read in front of whatever is left so handlers see the full body
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		app.logger.Debug("request body", "method", r.Method, "uri", r.URL.RequestURI(), "body", redactJSON(reqBody))
+		app.logger.Debug("response body", "method", r.Method, "uri", r.URL.RequestURI(), "status", rec.status, "body", redactJSON(rec.body.Bytes()))
+	})
+}
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// csrfProtect implements the double submit cookie pattern for clients that keep their
+// session in cookies. Every response without the CSRF cookie sets it, and state changing
+// requests that carry cookies must echo its value in the X-CSRF-Token header. Requests with
+// an Authorization header or without cookies can't be forged by a browser and pass through.
+func (app *application) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Cookie")
+
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil {
+			token := make([]byte, 32)
+			_, err := rand.Read(token)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			// readable by scripts on purpose, they have to copy it into the header
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    base64.RawURLEncoding.EncodeToString(token),
+				Path:     "/",
+				Secure:   true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "" || len(r.Cookies()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get(csrfHeaderName)
+		if cookie == nil || header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+			app.invalidCSRFTokenResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enableCORS lets browsers on the configured trusted origins call the API. Preflight requests are
+// answered here and never reach the router.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || !app.isTrustedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if app.config.CORS.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, HEAD, POST, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, "+csrfHeaderName)
+			if maxAge := int(app.config.CORS.MaxAge.Seconds()); maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (app *application) isTrustedOrigin(origin string) bool {
+	for _, trusted := range app.config.CORS.TrustedOrigins {
+		if trusted == "*" || trusted == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireHTTPS refuses plaintext requests in production. TLS terminated by a trusted proxy is
+// recognised from its X-Forwarded-Proto header, the header is ignored from any other peer. The
+// request is rejected rather than redirected so that the redirect can't be pointed elsewhere by a
+// forged Host header. The public routes aren't behind it, /health stays reachable for load balancer
+// checks.
+func (app *application) requireHTTPS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.Env != envProduction || app.isHTTPS(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		app.httpsRequiredResponse(w, r)
+	})
+}
+
+func (app *application) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return app.isTrustedProxy(host) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/validator"
+	"github.com/sushihentaime/user-management-service/pkg/jsonParser"
+)
+
+type securityQuestionInput struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+type setSecurityQuestionsInput struct {
+	Questions []securityQuestionInput `json:"questions" validate:"required"`
+}
+
+type securityAnswerInput struct {
+	ID     int64  `json:"id"`
+	Answer string `json:"answer"`
+}
+
+type recoverPasswordInput struct {
+	Email   string                `json:"email" validate:"required"`
+	Answers []securityAnswerInput `json:"answers" validate:"required"`
+}
+
+// setSecurityQuestionsHandler replaces the authenticated user's security questions.
+func (app *application) setSecurityQuestionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	var input setSecurityQuestionsInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	questions := make([]*db.SecurityQuestion, len(input.Questions))
+	for i, q := range input.Questions {
+		questions[i] = &db.SecurityQuestion{
+			UserID:   user.ID,
+			Question: q.Question,
+			Answer: db.Password{
+				Plain: &q.Answer,
+			},
+		}
+	}
+
+	if db.ValidateSecurityQuestions(v, questions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	for _, q := range questions {
+		err = q.SetAnswer(*q.Answer.Plain)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.SecurityQuestions.Replace(r.Context(), user.ID, questions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("security questions set", "event", eventSecurityQuestionsSet, "count", len(questions))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "security questions saved"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// recoveryQuestionsHandler returns the security questions of the account with the email, the first
+// step of recovering it without email access. An unknown email gets the same response as an account
+// without questions, and every lookup is throttled per email and per client IP.
+func (app *application) recoveryQuestionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input requestPwdResetInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dbUser := &db.User{
+		Email: input.Email,
+	}
+
+	dbUser.Normalize()
+
+	if dbUser.ValidateEmail(app.models.Rules); !dbUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, dbUser.Validator.Errors)
+		return
+	}
+
+	// a lookup never succeeds, so each one counts against the email and the IP it came from
+	keys := []string{"email:" + dbUser.Email, "ip:" + app.clientIP(r)}
+	for _, key := range keys {
+		if wait := app.questionsThrottle.Wait(key); wait > 0 {
+			app.loggerFor(r).Warn("recovery questions throttled", "event", eventRecoveryThrottled)
+			app.rateLimitResponse(w, r, wait)
+			return
+		}
+	}
+	for _, key := range keys {
+		app.questionsThrottle.Failure(key)
+	}
+
+	questions := []*db.SecurityQuestion{}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), dbUser.Email)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	default:
+		questions, err = app.models.SecurityQuestions.GetForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"questions": questions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// recoverPasswordHandler checks the answers to every security question of the account with the
+// email and, when they are all right, issues a password reset token to be used with
+// updatePasswordHandler in place of the one sent by email.
+func (app *application) recoverPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input recoverPasswordInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dbUser := &db.User{
+		Email: input.Email,
+	}
+
+	dbUser.Normalize()
+
+	if dbUser.ValidateEmail(app.models.Rules); !dbUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, dbUser.Validator.Errors)
+		return
+	}
+
+	// throttled per account like logins, the answers are usually easier to guess than a password
+	if wait := app.recoveryThrottle.Wait(dbUser.Email); wait > 0 {
+		app.loggerFor(r).Warn("recovery throttled", "event", eventRecoveryThrottled)
+		app.rateLimitResponse(w, r, wait)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), dbUser.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.recoveryThrottle.Failure(dbUser.Email)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	questions, err := app.models.SecurityQuestions.GetForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	answers := make(map[int64]string, len(input.Answers))
+	for _, a := range input.Answers {
+		answers[a.ID] = a.Answer
+	}
+
+	// every question has to be answered, an account without questions can't be recovered this way
+	correct := len(questions) > 0
+	for _, q := range questions {
+		answer, ok := answers[q.ID]
+		if !ok {
+			correct = false
+			break
+		}
+
+		match, err := q.MatchAnswer(answer)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !match {
+			correct = false
+			break
+		}
+	}
+
+	if !correct {
+		app.recoveryThrottle.Failure(dbUser.Email)
+		app.loggerFor(r).Info("recovery failed", "event", eventRecoveryFailure, "user_id", user.ID)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	app.recoveryThrottle.Success(dbUser.Email)
+
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
+
+	err = models.Tokens.Delete(r.Context(), user.ID, db.TokenScopeResetPwd)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := models.Tokens.CreateToken(r.Context(), user.ID, db.ResetPwdTokenTime, db.TokenScopeResetPwd)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.loggerFor(r).Info("account recovered with security questions", "event", eventRecoverySuccess, "user_id", user.ID)
+
+	body := envelope{
+		"reset_password_token": map[string]any{"token": token.Plain, "expiry": token.Expiry, "expires_in": expiresIn(token.Expiry)},
+	}
+
+	err = app.writeJSON(w, http.StatusOK, body, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+const usernameRecoveryMessage = "if the email address belongs to an account, its username has been sent to it"
+
+// recoverUsernameHandler emails the username of the account with the email to that address. The
+// response is the same whether or not the address belongs to an account, and the username is
+// never part of it.
+func (app *application) recoverUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	var input requestPwdResetInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dbUser := &db.User{
+		Email: input.Email,
+	}
+
+	dbUser.Normalize()
+
+	if dbUser.ValidateEmail(app.models.Rules); !dbUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, dbUser.Validator.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), dbUser.Email)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		user = nil
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil {
+		claimed, err := app.models.Users.ClaimUsernameReminderEmail(r.Context(), user.ID, app.config.Auth.UsernameRecoveryCooldown)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if claimed {
+			app.backgroundTask(func(ctx context.Context) {
+				err := app.sendEmail(ctx, user.ID, user.Email, "username_reminder.html", map[string]any{"email": user.Email, "username": user.Username})
+				if err != nil {
+					app.logger.Error(err.Error())
+					return
+				}
+
+				app.logger.Info("email sent", "email", user.Email, "type", "username reminder")
+			})
+
+			app.loggerFor(r).Info("username reminder requested", "event", eventUsernameReminderSent, "user_id", user.ID)
+		} else {
+			app.loggerFor(r).Info("username reminder throttled", "event", eventUsernameThrottled, "user_id", user.ID)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": usernameRecoveryMessage}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityQuestionRecovery(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.Auth.SecurityQuestions = true
+	ts := newTestServer(t, app.routes())
+
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+
+	questions := []securityQuestionInput{
+		{Question: "Name of your first pet?", Answer: "Mister Fluffy"},
+		{Question: "City you were born in?", Answer: "Paris"},
+	}
+
+	t.Run("Set requires authentication", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPut, "/v1/users/security-questions", "", setSecurityQuestionsInput{Questions: questions})
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Set rejects invalid questions", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPut, "/v1/users/security-questions", accessToken.Plain, setSecurityQuestionsInput{Questions: questions[:1]})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, "must contain between 2 and 5 questions", body["error"].(map[string]any)["fields"].(map[string]any)["questions"])
+	})
+
+	t.Run("Questions not set", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPost, "/v1/users/password/recover/questions", "", requestPwdResetInput{Email: user.Email})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Empty(t, body["questions"])
+
+		// an unknown email can't be told apart from an account without questions
+		status, _, unknown := ts.do(t, http.MethodPost, "/v1/users/password/recover/questions", "", requestPwdResetInput{Email: "unknown@example.com"})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, body, unknown)
+
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/password/recover", "", recoverPasswordInput{Email: user.Email, Answers: []securityAnswerInput{}})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	status, _, body := ts.do(t, http.MethodPut, "/v1/users/security-questions", accessToken.Plain, setSecurityQuestionsInput{Questions: questions})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "security questions saved", body["message"])
+
+	status, _, body = ts.do(t, http.MethodPost, "/v1/users/password/recover/questions", "", requestPwdResetInput{Email: user.Email})
+	assert.Equal(t, http.StatusOK, status)
+
+	listed := body["questions"].([]any)
+	assert.Len(t, listed, 2)
+
+	ids := make([]int64, len(listed))
+	for i, q := range listed {
+		q := q.(map[string]any)
+		assert.Equal(t, questions[i].Question, q["question"])
+		assert.NotContains(t, q, "answer")
+		ids[i] = int64(q["id"].(float64))
+	}
+
+	answer := func(t *testing.T, answers ...string) (int, envelope) {
+		input := recoverPasswordInput{Email: user.Email}
+		for i, a := range answers {
+			input.Answers = append(input.Answers, securityAnswerInput{ID: ids[i], Answer: a})
+		}
+
+		status, _, body := ts.do(t, http.MethodPost, "/v1/users/password/recover", "", input)
+		return status, body
+	}
+
+	t.Run("Wrong answer", func(t *testing.T) {
+		status, body := answer(t, "Mister Fluffy", "Lyon")
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, errCodeInvalidCredentials, body["error"].(map[string]any)["code"])
+	})
+
+	t.Run("Missing answer", func(t *testing.T) {
+		status, _ := answer(t, "Mister Fluffy")
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Unknown email", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/password/recover", "", recoverPasswordInput{Email: "unknown@example.com", Answers: []securityAnswerInput{{ID: ids[0], Answer: "x"}}})
+		assert.Equal(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Correct answers allow a password reset", func(t *testing.T) {
+		status, body := answer(t, "mister  fluffy", "PARIS")
+		assert.Equal(t, http.StatusOK, status)
+
+		resetToken := body["reset_password_token"].(map[string]any)["token"].(string)
+		assert.NotEmpty(t, resetToken)
+
+		status, _, _ = ts.do(t, http.MethodPut, "/v1/users/password/update", "", updatePwdInput{Token: resetToken, Password: "NewPass1234!"})
+		assert.Equal(t, http.StatusOK, status)
+
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/authenticate", "", loginUserInput{Username: user.Username, Password: "NewPass1234!"})
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Question lookups are throttled per email and per IP", func(t *testing.T) {
+		app.questionsThrottle = newLoginThrottle(1, time.Minute, time.Minute, time.Hour)
+
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/password/recover/questions", "", requestPwdResetInput{Email: user.Email})
+		assert.Equal(t, http.StatusOK, status)
+
+		// a different email from the same client is throttled too
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/password/recover/questions", "", requestPwdResetInput{Email: "unknown@example.com"})
+		assert.Equal(t, http.StatusTooManyRequests, status)
+	})
+
+	t.Run("Wrong answers are throttled", func(t *testing.T) {
+		app.recoveryThrottle = newLoginThrottle(1, time.Minute, time.Minute, time.Hour)
+
+		status, _ := answer(t, "wrong", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		status, _ = answer(t, "Mister Fluffy", "Paris")
+		assert.Equal(t, http.StatusTooManyRequests, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
+
+func TestSecurityQuestionRoutesDisabled(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+	ts := newTestServer(t, app.routes())
+
+	for _, path := range []string{"/v1/users/password/recover", "/v1/users/password/recover/questions"} {
+		status, _, _ := ts.do(t, http.MethodPost, path, "", nil)
+		assert.Equal(t, http.StatusNotFound, status, path)
+	}
+}
+
+func TestRecoverUsernameHandler(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.Auth.UsernameRecoveryCooldown = 5 * time.Minute
+	ts := newTestServer(t, app.routes())
+
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+
+	user, _ := createTestUser(t, app, "forgetfuluser")
+
+	t.Run("Invalid email", func(t *testing.T) {
+		status, _, _ := ts.post(t, "/v1/users/username/recover", requestPwdResetInput{Email: "invalid"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+
+	t.Run("Unknown email", func(t *testing.T) {
+		status, _, body := ts.post(t, "/v1/users/username/recover", requestPwdResetInput{Email: "unknown@example.com"})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, usernameRecoveryMessage, body["message"])
+
+		app.wg.Wait()
+		assert.Empty(t, mailer.Sent())
+	})
+
+	t.Run("Known email", func(t *testing.T) {
+		status, _, body := ts.post(t, "/v1/users/username/recover", requestPwdResetInput{Email: user.Email})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, usernameRecoveryMessage, body["message"])
+		assert.NotContains(t, body.JSON(), user.Username)
+
+		app.wg.Wait()
+		sent := mailer.Sent()
+		if assert.Len(t, sent, 1) {
+			assert.Equal(t, user.Email, sent[0].recipient)
+			assert.Equal(t, "username_reminder.html", sent[0].templateFile)
+			assert.Equal(t, user.Username, sent[0].data.(map[string]any)["username"])
+		}
+	})
+
+	t.Run("Throttled per email", func(t *testing.T) {
+		status, _, body := ts.post(t, "/v1/users/username/recover", requestPwdResetInput{Email: user.Email})
+		assert.Equal(t, http.StatusOK, status, "a throttled request still reports success")
+		assert.Equal(t, usernameRecoveryMessage, body["message"])
+
+		app.wg.Wait()
+		assert.Len(t, mailer.Sent(), 1, "the second request must not send another email")
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+)
+
+// tokenPair is the result of rotating a refresh token.
+type tokenPair struct {
+	userID       int
+	accessToken  *db.Token
+	refreshToken *db.Token
+	permissions  *db.Permissions
+}
+
+// refreshDeduper makes concurrent refreshes with the same refresh token share a single
+// rotation. Callers arriving while a rotation is in flight wait for it, and for grace
+// afterwards a retried refresh with the already rotated token gets the same pair back
+// instead of failing, so clients that fire several refreshes at once stay logged in.
+type refreshDeduper struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+	grace time.Duration
+
+	now func() time.Time
+}
+
+type refreshCall struct {
+	done     chan struct{}
+	pair     *tokenPair
+	err      error
+	finished time.Time
+}
+
+// newRefreshDeduper returns a deduper that only joins in flight rotations when grace is zero.
+func newRefreshDeduper(grace time.Duration) *refreshDeduper {
+	return &refreshDeduper{
+		calls: make(map[string]*refreshCall),
+		grace: grace,
+		now:   time.Now,
+	}
+}
+
+// Do runs rotate for key unless a rotation for key is in flight or finished successfully
+// within the grace period, in which case it returns that rotation's result.
+func (d *refreshDeduper) Do(key string, rotate func() (*tokenPair, error)) (*tokenPair, error) {
+	d.mu.Lock()
+	d.prune()
+
+	if call, ok := d.calls[key]; ok {
+		d.mu.Unlock()
+		<-call.done
+		return call.pair, call.err
+	}
+
+	call := &refreshCall{done: make(chan struct{})}
+	d.calls[key] = call
+	d.mu.Unlock()
+
+	call.pair, call.err = rotate()
+
+	d.mu.Lock()
+	call.finished = d.now()
+	// failures are not remembered, the next attempt tries again
+	if call.err != nil || d.grace <= 0 {
+		delete(d.calls, key)
+	}
+	d.mu.Unlock()
+
+	close(call.done)
+
+	return call.pair, call.err
+}
+
+// prune forgets the rotations whose grace period is over, the caller must hold mu.
+func (d *refreshDeduper) prune() {
+	now := d.now()
+
+	for key, call := range d.calls {
+		if !call.finished.IsZero() && now.Sub(call.finished) > d.grace {
+			delete(d.calls, key)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshDeduper(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	newDeduper := func() *refreshDeduper {
+		deduper := newRefreshDeduper(10 * time.Second)
+		deduper.now = func() time.Time { return now }
+		return deduper
+	}
+
+	t.Run("Concurrent callers share one rotation", func(t *testing.T) {
+		deduper := newDeduper()
+
+		var rotations atomic.Int32
+		release := make(chan struct{})
+
+		rotate := func() (*tokenPair, error) {
+			rotations.Add(1)
+			<-release
+			return &tokenPair{accessToken: &db.Token{Plain: "access"}}, nil
+		}
+
+		var wg sync.WaitGroup
+		results := make([]*tokenPair, 5)
+
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pair, err := deduper.Do("key", rotate)
+				assert.NoError(t, err)
+				results[i] = pair
+			}()
+		}
+
+		// let every caller reach Do before the rotation finishes
+		assert.Eventually(t, func() bool { return rotations.Load() == 1 }, time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), rotations.Load())
+		for _, pair := range results {
+			assert.Same(t, results[0], pair)
+		}
+	})
+
+	t.Run("Result is reused within the grace period only", func(t *testing.T) {
+		deduper := newDeduper()
+
+		var rotations int
+		rotate := func() (*tokenPair, error) {
+			rotations++
+			return &tokenPair{}, nil
+		}
+
+		first, _ := deduper.Do("key", rotate)
+
+		now = now.Add(5 * time.Second)
+		second, _ := deduper.Do("key", rotate)
+		assert.Same(t, first, second)
+		assert.Equal(t, 1, rotations)
+
+		now = now.Add(10 * time.Second)
+		third, _ := deduper.Do("key", rotate)
+		assert.NotSame(t, first, third)
+		assert.Equal(t, 2, rotations)
+	})
+
+	t.Run("Failures are not reused", func(t *testing.T) {
+		deduper := newDeduper()
+
+		_, err := deduper.Do("key", func() (*tokenPair, error) { return nil, errors.New("failed") })
+		assert.Error(t, err)
+
+		pair, err := deduper.Do("key", func() (*tokenPair, error) { return &tokenPair{}, nil })
+		assert.NoError(t, err)
+		assert.NotNil(t, pair)
+	})
+}
@@ -10,23 +10,142 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
-
+	router := app.newRouter()
 	standard := alice.New(app.authenticate)
 
-	router.HandlerFunc(http.MethodGet, "/health", app.healthCheckHandler)
+	// handle registers the handler for the route, naming the request span after it
+	handle := func(method, path string, handler http.HandlerFunc) {
+		router.HandlerFunc(method, path, traceRoute(path, handler))
+	}
+
+	// get registers the handler for HEAD as well, net/http drops the body of HEAD responses
+	get := func(path string, handler http.HandlerFunc) {
+		handle(http.MethodGet, path, handler)
+		handle(http.MethodHead, path, handler)
+	}
+
+	handle(http.MethodPost, "/v1/users/new", adaptHandler(standard.ThenFunc(app.createUserHandler)))
+	handle(http.MethodPut, "/v1/users/activate", adaptHandler(standard.ThenFunc(app.activateUserHandler)))
+	handle(http.MethodPost, "/v1/users/activate/resend", adaptHandler(standard.ThenFunc(app.requireAuthUser(app.resendActivationHandler))))
+	handle(http.MethodPost, "/v1/users/authenticate", adaptHandler(standard.ThenFunc(app.createAuthTokenHandler)))
+	handle(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/extend", adaptHandler(standard.ThenFunc(app.requireAuthUser(app.extendAuthTokenHandler))))
+	// logout authenticates the request itself, it falls back to the refresh token when the access
+	// token has expired
+	handle(http.MethodDelete, "/v1/tokens", app.deleteAuthTokenHandler)
+	handle(http.MethodPost, "/v1/users/password/reset", adaptHandler(standard.ThenFunc(app.requestPasswordResetHandler)))
+	handle(http.MethodPut, "/v1/users/password/update", adaptHandler(standard.ThenFunc(app.updatePasswordHandler)))
+	handle(http.MethodPost, "/v1/users/username/recover", adaptHandler(standard.ThenFunc(app.recoverUsernameHandler)))
+	if app.config.Auth.PasswordResetMode == passwordResetOTP {
+		handle(http.MethodPut, "/v1/users/password/update/otp", adaptHandler(standard.ThenFunc(app.updatePasswordWithOTPHandler)))
+	}
+	if app.config.Auth.SecurityQuestions {
+		handle(http.MethodPut, "/v1/users/security-questions", adaptHandler(standard.ThenFunc(app.requireFreshAuth(app.setSecurityQuestionsHandler))))
+		handle(http.MethodPost, "/v1/users/password/recover/questions", adaptHandler(standard.ThenFunc(app.recoveryQuestionsHandler)))
+		handle(http.MethodPost, "/v1/users/password/recover", adaptHandler(standard.ThenFunc(app.recoverPasswordHandler)))
+	}
+	get("/v1/users/me", adaptHandler(standard.ThenFunc(app.getCurrentUserHandler)))
+	get("/v1/users/account/:username", adaptHandler(standard.ThenFunc(app.requirePermission(app.getAccountHandler, db.PermissionReadUser))))
+	get("/v1/users/account/:username/permissions", adaptHandler(standard.ThenFunc(app.requirePermission(app.getAccountPermissionsHandler, db.PermissionReadUser))))
+	get("/v1/users/sessions", adaptHandler(standard.ThenFunc(app.requirePermission(app.listSessionsHandler, db.PermissionReadUser))))
+	get("/v1/users/email-history", adaptHandler(standard.ThenFunc(app.requireAuthUser(app.listEmailHistoryHandler))))
+	handle(http.MethodPost, "/v1/users/email-history/rollback", adaptHandler(standard.ThenFunc(app.rollbackEmailHandler)))
+	get("/v1/users/emails", adaptHandler(standard.ThenFunc(app.requireAuthUser(app.listUserEmailsHandler))))
+	handle(http.MethodPost, "/v1/users/emails", adaptHandler(standard.ThenFunc(app.requireActivatedUser(app.requireFreshAuth(app.addUserEmailHandler)))))
+	handle(http.MethodPut, "/v1/users/emails/verify", adaptHandler(standard.ThenFunc(app.verifyUserEmailHandler)))
+	handle(http.MethodDelete, "/v1/users/emails/:email", adaptHandler(standard.ThenFunc(app.requireFreshAuth(app.removeUserEmailHandler))))
+	handle(http.MethodPost, "/v1/users/emails/:email/primary", adaptHandler(standard.ThenFunc(app.requireActivatedUser(app.requireFreshAuth(app.promoteUserEmailHandler)))))
+	handle(http.MethodPut, "/v1/users/account/:username/update", adaptHandler(standard.ThenFunc(app.requirePermission(app.requireFreshAuth(app.updateAccountHandler), db.PermissionWriteUser, db.PermissionReadUser))))
+	handle(http.MethodPatch, "/v1/users/account/:username", adaptHandler(standard.ThenFunc(app.requirePermission(app.requireFreshAuth(app.patchAccountHandler), db.PermissionWriteUser, db.PermissionReadUser))))
+	handle(http.MethodPut, "/v1/users/account/:username/password", adaptHandler(standard.ThenFunc(app.requirePermission(app.requireOwnSession(app.changePasswordHandler), db.PermissionWriteUser, db.PermissionReadUser))))
+	if app.config.Auth.AccountDeletion {
+		handle(http.MethodDelete, "/v1/users/account/:username", adaptHandler(standard.ThenFunc(app.requireFreshAuth(app.deleteAccountHandler))))
+	}
+
+	handle(http.MethodPut, "/v1/admin/users/:username/status", adaptHandler(standard.ThenFunc(app.requirePermission(app.updateUserStatusHandler, db.PermissionAdminUser))))
+	get("/v1/admin/permissions", adaptHandler(standard.ThenFunc(app.requirePermission(app.listPermissionsHandler, db.PermissionAdminUser))))
+	get("/v1/admin/sessions/expiring", adaptHandler(standard.ThenFunc(app.requirePermission(app.listExpiringSessionsHandler, db.PermissionAdminUser))))
+	handle(http.MethodPost, "/v1/admin/permissions/grant", adaptHandler(standard.ThenFunc(app.requirePermission(app.grantPermissionHandler, db.PermissionAdminUser))))
+	handle(http.MethodPost, "/v1/admin/users/:username/impersonate", adaptHandler(standard.ThenFunc(app.requirePermission(app.impersonateUserHandler, db.PermissionAdminUser))))
+	handle(http.MethodDelete, "/v1/admin/users/:username/impersonate", adaptHandler(standard.ThenFunc(app.requirePermission(app.endImpersonationsHandler, db.PermissionAdminUser))))
+	handle(http.MethodPost, "/v1/admin/users/:username/lock", adaptHandler(standard.ThenFunc(app.requirePermission(app.lockUserHandler, db.PermissionAdminUser))))
+	handle(http.MethodDelete, "/v1/admin/users/:username/lock", adaptHandler(standard.ThenFunc(app.requirePermission(app.unlockUserHandler, db.PermissionAdminUser))))
+	handle(http.MethodDelete, "/v1/admin/users/:username/tokens", adaptHandler(standard.ThenFunc(app.requirePermission(app.revokeTokensHandler, db.PermissionAdminUser))))
+	handle(http.MethodPost, "/v1/admin/users/:username/email/rollback", adaptHandler(standard.ThenFunc(app.requirePermission(app.adminRollbackEmailHandler, db.PermissionAdminUser))))
+	// the email is passed in the query string, a static segment under /v1/admin/users/ would
+	// conflict with the :username routes
+	get("/v1/admin/users", adaptHandler(standard.ThenFunc(app.requirePermission(app.getUserByEmailHandler, db.PermissionAdminUser))))
+	get("/v1/admin/users/:username/emails/failed", adaptHandler(standard.ThenFunc(app.requirePermission(app.listEmailFailuresHandler, db.PermissionAdminUser))))
+
+	var handler http.Handler = router
+	if app.config.Auth.CSRFProtection {
+		handler = app.csrfProtect(handler)
+	}
+	handler = app.requireHTTPS(app.enableCORS(app.logBody(handler)))
+
+	public, publicPaths := app.publicRoutes()
+
+	handler = app.recoverPanic(app.logRequest(dispatchPublic(publicPaths, public, handler)))
+	if app.tracerProvider != nil {
+		handler = app.traceRequest(handler)
+	}
+
+	return handler
+}
+
+// publicRoutes returns the operational endpoints and their paths. They are served outside of the
+// global middleware so that HTTPS enforcement, CSRF protection, authentication or rate limiting
+// can't make a load balancer or scraper see the service as down, /metrics checks the scrape token
+// itself. CORS applies to them only when CORS_PUBLIC_ROUTES is set.
+func (app *application) publicRoutes() (http.Handler, map[string]bool) {
+	router := app.newRouter()
+	paths := map[string]bool{}
+
+	get := func(path string, handler http.HandlerFunc) {
+		router.HandlerFunc(http.MethodGet, path, traceRoute(path, handler))
+		router.HandlerFunc(http.MethodHead, path, traceRoute(path, handler))
+		paths[path] = true
+	}
+
+	get("/health", app.healthCheckHandler)
+	get("/version", app.versionHandler)
+	if app.config.Metrics.RefreshInterval > 0 {
+		get("/metrics", app.metricsHandler)
+	}
+
+	var handler http.Handler = router
+	if app.config.CORS.PublicRoutes {
+		handler = app.enableCORS(handler)
+	}
+
+	return handler, paths
+}
+
+// dispatchPublic sends requests for the public paths to public, whatever their method, and every
+// other request to protected.
+func dispatchPublic(paths map[string]bool, public, protected http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if paths[r.URL.Path] {
+			public.ServeHTTP(w, r)
+			return
+		}
+
+		protected.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) newRouter() *httprouter.Router {
+	router := httprouter.New()
 
-	router.HandlerFunc(http.MethodPost, "/v1/users/new", adaptHandler(standard.ThenFunc(app.createUserHandler)))
-	router.HandlerFunc(http.MethodPut, "/v1/users/activate", adaptHandler(standard.ThenFunc(app.activateUserHandler)))
-	router.HandlerFunc(http.MethodPost, "/v1/users/authenticate", adaptHandler(standard.ThenFunc(app.createAuthTokenHandler)))
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthTokenHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/tokens", adaptHandler(standard.ThenFunc(app.deleteAuthTokenHandler)))
-	router.HandlerFunc(http.MethodPost, "/v1/users/password/reset", adaptHandler(standard.ThenFunc(app.requestPasswordResetHandler)))
-	router.HandlerFunc(http.MethodPut, "/v1/users/password/update", adaptHandler(standard.ThenFunc(app.updatePasswordHandler)))
-	router.HandlerFunc(http.MethodGet, "/v1/users/account/:username", adaptHandler(standard.ThenFunc(app.requirePermission(app.getAccountHandler, db.PermissionReadUser))))
-	router.HandlerFunc(http.MethodPut, "/v1/users/account/:username/update", adaptHandler(standard.ThenFunc(app.requirePermission(app.updateAccountHandler, db.PermissionWriteUser, db.PermissionReadUser))))
+	// OPTIONS is answered for every route with the Allow header set by the router
+	router.HandleOPTIONS = true
+	router.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	return app.recoverPanic(app.logRequest(router))
+	return router
 }
 
 func adaptHandler(next http.Handler) http.HandlerFunc {
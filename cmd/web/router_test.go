@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterMethodHandling(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+	ts := newTestServer(t, app.routes())
+
+	send := func(t *testing.T, method, path string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		assert.NoError(t, err)
+
+		res, err := ts.Client().Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+
+		return res, body
+	}
+
+	t.Run("OPTIONS lists the allowed methods", func(t *testing.T) {
+		res, body := send(t, http.MethodOptions, "/v1/users/new")
+
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		assert.Equal(t, "OPTIONS, POST", res.Header.Get("Allow"))
+		assert.Empty(t, body)
+	})
+
+	t.Run("HEAD is served for GET routes", func(t *testing.T) {
+		res, body := send(t, http.MethodHead, "/version")
+
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		assert.Empty(t, body)
+	})
+
+	t.Run("Unknown path returns a JSON 404", func(t *testing.T) {
+		res, body := send(t, http.MethodGet, "/v1/unknown")
+
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+		var response struct {
+			Error apiError `json:"error"`
+		}
+		err := json.Unmarshal(body, &response)
+		assert.NoError(t, err)
+		assert.Equal(t, errCodeNotFound, response.Error.Code)
+		assert.NotEmpty(t, response.Error.Message)
+	})
+
+	t.Run("Unsupported method returns a JSON 405", func(t *testing.T) {
+		res, body := send(t, http.MethodGet, "/v1/users/new")
+
+		assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+		assert.Equal(t, "OPTIONS, POST", res.Header.Get("Allow"))
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+		var response struct {
+			Error apiError `json:"error"`
+		}
+		err := json.Unmarshal(body, &response)
+		assert.NoError(t, err)
+		assert.Equal(t, errCodeMethodNotAllowed, response.Error.Code)
+		assert.Contains(t, response.Error.Message, http.MethodGet)
+	})
+}
+
+func TestPublicRoutes(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+	app.config.Env = envProduction
+	app.config.CORS.TrustedOrigins = []string{"https://app.example.com"}
+
+	send := func(t *testing.T, handler http.Handler, path string) *http.Response {
+		ts := newTestServer(t, handler)
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Origin", "https://app.example.com")
+		// the public routes never look at credentials, an invalid token must not get in the way
+		req.Header.Set("Authorization", "Bearer invalid")
+
+		res, err := ts.Client().Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+
+		return res
+	}
+
+	t.Run("Reachable over plain HTTP in production", func(t *testing.T) {
+		for _, path := range []string{"/health", "/version"} {
+			res := send(t, app.routes(), path)
+			assert.Equal(t, http.StatusOK, res.StatusCode, path)
+		}
+
+		res := send(t, app.routes(), "/v1/users/me")
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("Bypass global middleware that would block them", func(t *testing.T) {
+		public, paths := app.publicRoutes()
+		limited := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			app.rateLimitResponse(w, r, time.Minute)
+		})
+		handler := dispatchPublic(paths, public, limited)
+
+		res := send(t, handler, "/health")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		res = send(t, handler, "/v1/users/me")
+		assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	})
+
+	t.Run("CORS is configurable", func(t *testing.T) {
+		app.config.CORS.PublicRoutes = true
+		res := send(t, app.routes(), "/health")
+		assert.Equal(t, "https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+
+		app.config.CORS.PublicRoutes = false
+		res = send(t, app.routes(), "/health")
+		assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+	})
+}
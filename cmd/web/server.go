@@ -2,26 +2,59 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 )
 
 // https://ieftimov.com/posts/make-resilient-golang-net-http-servers-using-timeouts-deadlines-context-cancellation/
-func (app *application) serve() error {
+func (app *application) newServer() (*http.Server, error) {
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"SERVER_READ_TIMEOUT", app.config.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", app.config.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", app.config.Server.IdleTimeout},
+		{"SERVER_SHUTDOWN_TIMEOUT", app.config.Server.ShutdownTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value <= 0 {
+			return nil, fmt.Errorf("%s must be positive, got %s", timeout.name, timeout.value)
+		}
+	}
+
+	tlsConfig, err := newTLSConfig(app.config.TLS.MinVersion, app.config.TLS.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
 	srv := &http.Server{
 		Addr:         app.config.Port,
+		TLSConfig:    tlsConfig,
 		Handler:      app.routes(),
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  app.config.Server.ReadTimeout,
+		WriteTimeout: app.config.Server.WriteTimeout,
+		IdleTimeout:  app.config.Server.IdleTimeout,
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	return srv, nil
+}
+
+func (app *application) serve() error {
+	srv, err := app.newServer()
+	if err != nil {
+		return err
+	}
+
 	shutdownError := make(chan error)
 
 	go func() {
@@ -33,24 +66,20 @@ func (app *application) serve() error {
 
 		app.logger.Info("shutting down server", "signal", s.String())
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
+		if app.cancel != nil {
+			app.cancel()
 		}
 
-		app.logger.Info("completing background tasks", "addr", srv.Addr)
-
-		app.wg.Wait()
-
-		shutdownError <- nil
+		shutdownError <- app.shutdown(srv)
 	}()
 
 	app.logger.Info("starting server", "port", app.config.Port, "env", app.config.Env)
 
-	err := srv.ListenAndServe()
+	if app.config.TLS.CertFile != "" {
+		err = srv.ListenAndServeTLS(app.config.TLS.CertFile, app.config.TLS.KeyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -64,3 +93,80 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// tlsVersions maps the TLS_MIN_VERSION values to their versions, an empty value keeps TLS 1.2.
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the server's TLS settings from the TLS_MIN_VERSION and TLS_CIPHER_SUITES values.
+// Only the secure TLS 1.2 suites known to crypto/tls are accepted.
+func newTLSConfig(minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("TLS_MIN_VERSION must be \"1.2\" or \"1.3\", got %q", minVersion)
+	}
+
+	cfg := &tls.Config{MinVersion: version}
+	if len(cipherSuites) == 0 {
+		return cfg, nil
+	}
+
+	if version == tls.VersionTLS13 {
+		return nil, errors.New("TLS_CIPHER_SUITES has no effect with TLS_MIN_VERSION 1.3, TLS 1.3 cipher suites can't be configured")
+	}
+
+	for _, name := range cipherSuites {
+		id, ok := tls12CipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES contains an unsupported cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+
+	return cfg, nil
+}
+
+func tls12CipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name && slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// shutdown stops the server and waits for in-flight requests and background tasks,
+// both within the configured drain timeout. Background tasks still running at the
+// deadline are abandoned with a warning rather than blocking the shutdown.
+func (app *application) shutdown(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.Server.ShutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("completing background tasks", "addr", srv.Addr)
+
+	start := time.Now()
+
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		app.logger.Info("background tasks completed", "duration", time.Since(start).String())
+	case <-ctx.Done():
+		app.logger.Warn("background tasks did not complete before the shutdown deadline", "duration", time.Since(start).String(), "timeout", app.config.Server.ShutdownTimeout.String())
+	}
+
+	return nil
+}
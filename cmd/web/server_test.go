@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewServer(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	app.config.Port = ":4000"
+	app.config.Server.ReadTimeout = 5 * time.Second
+	app.config.Server.WriteTimeout = 45 * time.Second
+	app.config.Server.IdleTimeout = 3 * time.Minute
+	app.config.Server.ShutdownTimeout = 30 * time.Second
+
+	srv, err := app.newServer()
+	assert.NoError(t, err)
+	assert.Equal(t, ":4000", srv.Addr)
+	assert.Equal(t, 5*time.Second, srv.ReadTimeout)
+	assert.Equal(t, 45*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 3*time.Minute, srv.IdleTimeout)
+
+	app.config.Server.WriteTimeout = 0
+
+	_, err = app.newServer()
+	assert.EqualError(t, err, "SERVER_WRITE_TIMEOUT must be positive, got 0s")
+}
+
+func TestNewServerTLS(t *testing.T) {
+	app := &application{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	app.config.Port = ":4000"
+	app.config.Server.ReadTimeout = 5 * time.Second
+	app.config.Server.WriteTimeout = 45 * time.Second
+	app.config.Server.IdleTimeout = 3 * time.Minute
+	app.config.Server.ShutdownTimeout = 30 * time.Second
+
+	t.Run("Valid policy is applied", func(t *testing.T) {
+		app.config.TLS.MinVersion = "1.2"
+		app.config.TLS.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+
+		srv, err := app.newServer()
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS12), srv.TLSConfig.MinVersion)
+		assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, srv.TLSConfig.CipherSuites)
+	})
+
+	t.Run("TLS 1.3 only", func(t *testing.T) {
+		app.config.TLS.MinVersion = "1.3"
+		app.config.TLS.CipherSuites = nil
+
+		srv, err := app.newServer()
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS13), srv.TLSConfig.MinVersion)
+		assert.Nil(t, srv.TLSConfig.CipherSuites)
+	})
+
+	t.Run("Unsupported values are rejected", func(t *testing.T) {
+		app.config.TLS.MinVersion = "1.0"
+		app.config.TLS.CipherSuites = nil
+
+		_, err := app.newServer()
+		assert.EqualError(t, err, `TLS_MIN_VERSION must be "1.2" or "1.3", got "1.0"`)
+
+		app.config.TLS.MinVersion = "1.2"
+		app.config.TLS.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+
+		_, err = app.newServer()
+		assert.EqualError(t, err, `TLS_CIPHER_SUITES contains an unsupported cipher suite "TLS_RSA_WITH_RC4_128_SHA"`)
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	testCases := []struct {
+		name     string
+		timeout  time.Duration
+		task     time.Duration
+		wantLogs string
+	}{
+		{
+			name:     "background tasks finish within the window",
+			timeout:  time.Second,
+			task:     10 * time.Millisecond,
+			wantLogs: "background tasks completed",
+		},
+		{
+			name:     "background tasks hit the deadline",
+			timeout:  20 * time.Millisecond,
+			task:     time.Second,
+			wantLogs: "background tasks did not complete before the shutdown deadline",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			app := &application{logger: slog.New(slog.NewTextHandler(&logs, nil))}
+			app.config.Port = ":4000"
+			app.config.Server.ReadTimeout = time.Second
+			app.config.Server.WriteTimeout = time.Second
+			app.config.Server.IdleTimeout = time.Second
+			app.config.Server.ShutdownTimeout = tt.timeout
+
+			srv, err := app.newServer()
+			assert.NoError(t, err)
+
+			finished := make(chan struct{})
+			app.backgroundTask(func(ctx context.Context) {
+				time.Sleep(tt.task)
+				close(finished)
+			})
+
+			err = app.shutdown(srv)
+			assert.NoError(t, err)
+			assert.Contains(t, logs.String(), tt.wantLogs)
+
+			<-finished
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockUserStore, mockTokenStore and mockPermissionStore implement only what the tests below call, any other
+// method panics on the embedded nil interface.
+type mockUserStore struct {
+	db.UserStore
+	users map[string]*db.User
+	// tokens maps a plain text access token to its user
+	tokens map[string]*db.User
+}
+
+func (m *mockUserStore) GetByUsername(ctx context.Context, username string) (*db.User, error) {
+	user, ok := m.users[username]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (m *mockUserStore) GetByID(ctx context.Context, id int) (*db.User, error) {
+	for _, user := range m.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+
+	return nil, db.ErrNotFound
+}
+
+func (m *mockUserStore) GetToken(ctx context.Context, tokenScope db.TokenScope, token []byte) (*db.User, error) {
+	for plain, user := range m.tokens {
+		if tokenScope == db.TokenScopeAccess && bytes.Equal(db.HashToken(plain), token) {
+			return user, nil
+		}
+	}
+
+	return nil, db.ErrNotFound
+}
+
+type mockTokenStore struct {
+	db.TokenStore
+}
+
+func (m *mockTokenStore) Touch(ctx context.Context, hash []byte, idleTimeout, interval time.Duration) error {
+	return nil
+}
+
+type mockPermissionStore struct {
+	db.PermissionStore
+	permissions map[int]db.Permissions
+}
+
+func (m *mockPermissionStore) Get(ctx context.Context, userID int) (*db.Permissions, error) {
+	permissions, ok := m.permissions[userID]
+	if !ok {
+		permissions = db.Permissions{}
+	}
+
+	return &permissions, nil
+}
+
+// nilPermissionStore misbehaves by returning no permissions and no error.
+type nilPermissionStore struct {
+	db.PermissionStore
+}
+
+func (m *nilPermissionStore) Get(ctx context.Context, userID int) (*db.Permissions, error) {
+	return nil, nil
+}
+
+// flakyPermissionStore fails the first failures lookups with err before behaving like mockPermissionStore.
+type flakyPermissionStore struct {
+	mockPermissionStore
+	failures int
+	err      error
+	calls    atomic.Int32
+}
+
+func (m *flakyPermissionStore) Get(ctx context.Context, userID int) (*db.Permissions, error) {
+	if int(m.calls.Add(1)) <= m.failures {
+		return nil, m.err
+	}
+
+	return m.mockPermissionStore.Get(ctx, userID)
+}
+
+func TestGetAccountHandlerWithMockStores(t *testing.T) {
+	user := &db.User{ID: 1, Username: "testuser", Email: "testuser@example.com", Activated: true}
+	token := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	app := &application{
+		ctx:    context.Background(),
+		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		models: &db.Models{
+			Users: &mockUserStore{
+				users:  map[string]*db.User{user.Username: user},
+				tokens: map[string]*db.User{token: user},
+			},
+			Tokens: &mockTokenStore{},
+			Permissions: &mockPermissionStore{
+				permissions: map[int]db.Permissions{user.ID: {db.PermissionReadUser}},
+			},
+		},
+	}
+	ts := newTestServer(t, app.routes())
+
+	status, _, body := ts.do(t, http.MethodGet, "/v1/users/account/testuser", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "testuser@example.com", body["user"].(map[string]any)["email"])
+
+	status, _, body = ts.do(t, http.MethodGet, "/v1/users/account/testuser", "ZYXWVUTSRQPONMLKJIHGFEDCBA", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, errCodeInvalidToken, body["error"].(map[string]any)["code"])
+}
+
+func TestGetCurrentUserHandlerWithMockStores(t *testing.T) {
+	user := &db.User{ID: 1, Username: "testuser", Email: "testuser@example.com", Activated: true}
+	token := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	app := &application{
+		ctx:    context.Background(),
+		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		models: &db.Models{
+			Users: &mockUserStore{
+				tokens: map[string]*db.User{token: user},
+			},
+			Tokens: &mockTokenStore{},
+			Permissions: &mockPermissionStore{
+				permissions: map[int]db.Permissions{user.ID: {db.PermissionReadUser, db.PermissionWriteUser}},
+			},
+		},
+	}
+	ts := newTestServer(t, app.routes())
+
+	t.Run("Authenticated", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodGet, "/v1/users/me", token, nil)
+		assert.Equal(t, http.StatusOK, status)
+
+		me := body["user"].(map[string]any)
+		assert.Equal(t, "testuser", me["username"])
+		assert.Equal(t, "testuser@example.com", me["email"])
+		assert.Equal(t, []any{string(db.PermissionReadUser), string(db.PermissionWriteUser)}, body["permissions"])
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		status, headers, body := ts.do(t, http.MethodGet, "/v1/users/me", "", nil)
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.Equal(t, "Bearer", headers.Get("WWW-Authenticate"))
+		assert.Equal(t, errCodeAuthenticationRequired, body["error"].(map[string]any)["code"])
+	})
+}
+
+func TestRequirePermissionWithoutPermissions(t *testing.T) {
+	user := &db.User{ID: 1, Username: "testuser", Email: "testuser@example.com", Activated: true}
+	token := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	testCases := []struct {
+		name        string
+		permissions db.PermissionStore
+	}{
+		{name: "Zero permissions", permissions: &mockPermissionStore{permissions: map[int]db.Permissions{user.ID: {}}}},
+		{name: "Nil permissions", permissions: &nilPermissionStore{}},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
+				models: &db.Models{
+					Users: &mockUserStore{
+						users:  map[string]*db.User{user.Username: user},
+						tokens: map[string]*db.User{token: user},
+					},
+					Tokens:      &mockTokenStore{},
+					Permissions: tt.permissions,
+				},
+			}
+			ts := newTestServer(t, app.routes())
+
+			status, _, body := ts.do(t, http.MethodGet, "/v1/users/account/testuser", token, nil)
+			assert.Equal(t, http.StatusForbidden, status)
+			assert.Equal(t, errCodeForbidden, body["error"].(map[string]any)["code"])
+		})
+	}
+}
+
+func TestRequirePermissionRetriesTransientErrors(t *testing.T) {
+	user := &db.User{ID: 1, Username: "testuser", Email: "testuser@example.com", Activated: true}
+	token := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	testCases := []struct {
+		name       string
+		retries    int
+		failures   int
+		err        error
+		wantStatus int
+		wantCalls  int32
+	}{
+		{name: "Transient error succeeds on retry", retries: 2, failures: 2, err: driver.ErrBadConn, wantStatus: http.StatusOK, wantCalls: 3},
+		{name: "Transient error outlasts the retries", retries: 1, failures: 2, err: driver.ErrBadConn, wantStatus: http.StatusInternalServerError, wantCalls: 2},
+		{name: "Retries disabled", retries: 0, failures: 1, err: driver.ErrBadConn, wantStatus: http.StatusInternalServerError, wantCalls: 1},
+		{name: "Other errors are not retried", retries: 2, failures: 1, err: errors.New("syntax error"), wantStatus: http.StatusInternalServerError, wantCalls: 1},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			permissions := &flakyPermissionStore{
+				mockPermissionStore: mockPermissionStore{permissions: map[int]db.Permissions{user.ID: {db.PermissionReadUser}}},
+				failures:            tt.failures,
+				err:                 tt.err,
+			}
+
+			app := &application{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewJSONHandler(&logs, nil)),
+				models: &db.Models{
+					Users: &mockUserStore{
+						users:  map[string]*db.User{user.Username: user},
+						tokens: map[string]*db.User{token: user},
+					},
+					Tokens:      &mockTokenStore{},
+					Permissions: permissions,
+				},
+			}
+			app.config.Auth.PermissionLookupRetries = tt.retries
+			app.config.Auth.PermissionLookupRetryDelay = time.Millisecond
+			ts := newTestServer(t, app.routes())
+
+			status, _, _ := ts.do(t, http.MethodGet, "/v1/users/account/testuser", token, nil)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, tt.wantCalls, permissions.calls.Load())
+
+			if tt.wantStatus == http.StatusInternalServerError {
+				assert.Contains(t, logs.String(), "permission lookup for user 1")
+			}
+		})
+	}
+}
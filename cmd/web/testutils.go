@@ -10,10 +10,12 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	models "github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/mail"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
@@ -88,14 +90,77 @@ func newTestApplication(t *testing.T) *application {
 	cfg := config{
 		Env: "testing",
 	}
+	cfg.BaseURL = "http://localhost:3000"
+	cfg.Links.ActivationPath = "/activate?token={token}"
+	cfg.Links.ResetPasswordPath = "/reset-password?token={token}"
+	cfg.Links.VerifyEmailPath = "/verify-email?token={token}"
+	cfg.Links.EmailRollbackPath = "/email-rollback?token={token}"
+	cfg.FeatureFlags = map[string]int{flagSecondaryEmails: 100}
+	cfg.IdempotencyKeyTTL = 24 * time.Hour
+	cfg.Auth.FreshAuthWindow = 10 * time.Minute
+	cfg.Auth.MaxSessionLifetime = 7 * 24 * time.Hour
+	cfg.Auth.PasswordResetMode = passwordResetLink
+	cfg.Auth.ActivationResendCooldown = time.Minute
+	cfg.Auth.ImpersonationTTL = 15 * time.Minute
+	cfg.Auth.EmailRollbackWindow = 7 * 24 * time.Hour
+	cfg.Auth.AccountDeletion = true
+	cfg.Auth.LastUsedInterval = time.Minute
+	cfg.Auth.SignupPermissions = []models.Permission{models.PermissionReadUser}
+	cfg.Auth.ActivationPermissions = []models.Permission{models.PermissionWriteUser}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
 
 	return &application{
+		ctx:    ctx,
+		cancel: cancel,
 		config: cfg,
 		logger: slog.New(slog.NewJSONHandler(io.Discard, nil)),
-		models: models.NewModels(db),
+		models: models.NewModels(db, models.NewUserRules(), 0),
+		mailer: &recordingMailer{},
+		// effectively disabled, tests that exercise throttling replace it
+		loginThrottle:     newLoginThrottle(1000, time.Second, time.Second, time.Hour),
+		recoveryThrottle:  newLoginThrottle(1000, time.Second, time.Second, time.Hour),
+		otpThrottle:       newLoginThrottle(1000, time.Second, time.Second, time.Hour),
+		questionsThrottle: newLoginThrottle(1000, time.Second, time.Second, time.Hour),
+		refreshes:         newRefreshDeduper(0),
+		metrics:           newBusinessMetrics(),
 	}
 }
 
+type sentEmail struct {
+	recipient    string
+	templateFile string
+	data         any
+}
+
+// recordingMailer stands in for the SMTP mailer and keeps every email it is asked to send.
+// When err is set every send fails with it instead.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []sentEmail
+	err  error
+}
+
+func (m *recordingMailer) Send(recipient, templateFile string, data any, opts ...mail.SendOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	m.sent = append(m.sent, sentEmail{recipient: recipient, templateFile: templateFile, data: data})
+	return nil
+}
+
+func (m *recordingMailer) Sent() []sentEmail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]sentEmail(nil), m.sent...)
+}
+
 type testServer struct {
 	*httptest.Server
 }
@@ -144,6 +209,35 @@ func (ts *testServer) put(t *testing.T, path string, data any) (int, http.Header
 	return readResponse(t, res)
 }
 
+// do sends a request with an optional JSON payload, authenticated with token when it is not empty.
+func (ts *testServer) do(t *testing.T, method, path, token string, data any) (int, http.Header, envelope) {
+	var body io.Reader
+	if data != nil {
+		jsonPayload, err := json.Marshal(data)
+		if err != nil {
+			t.Fatalf("could not marshal payload to JSON: %v", err)
+		}
+		body = bytes.NewReader(jsonPayload)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatalf("could not create %s request: %v", method, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("could not send %s request: %v", method, err)
+	}
+
+	return readResponse(t, res)
+}
+
 func readResponse(t *testing.T, res *http.Response) (int, http.Header, envelope) {
 	defer res.Body.Close()
 
@@ -177,10 +271,61 @@ func cleanup(app *application) error {
 		return err
 	}
 
+	_, err = app.models.DB.Exec("DELETE FROM idempotency_keys")
+	if err != nil {
+		return err
+	}
+
+	_, err = app.models.DB.Exec("DELETE FROM email_log")
+	if err != nil {
+		return err
+	}
+
+	_, err = app.models.DB.Exec("DELETE FROM audit_log")
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("Cleaning up...")
 	return nil
 }
 
+// createTestUser inserts an activated user holding the given permissions and returns it with a valid access token.
+func createTestUser(t *testing.T, app *application, username string, permissions ...models.Permission) (*models.User, *models.Token) {
+	pwd := "Test1234!"
+
+	user := &models.User{
+		Username: username,
+		Email:    username + "@example.com",
+		Password: models.Password{
+			Plain: &pwd,
+		},
+	}
+
+	err := app.models.Users.Create(context.Background(), user)
+	if err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+
+	err = app.models.Users.Activate(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("could not activate user: %v", err)
+	}
+	user.Activated = true
+
+	err = app.models.Permissions.Add(context.Background(), user.ID, permissions...)
+	if err != nil {
+		t.Fatalf("could not add permissions: %v", err)
+	}
+
+	token, err := app.models.Tokens.CreateToken(context.Background(), user.ID, models.AuthTokenTime, models.TokenScopeAccess)
+	if err != nil {
+		t.Fatalf("could not create access token: %v", err)
+	}
+
+	return user, token
+}
+
 func strPtr(s string) *string {
 	return &s
 }
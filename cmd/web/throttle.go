@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// loginThrottle slows down password guessing against a single account regardless
+// of where the attempts come from. The first freeAttempts failures are not
+// delayed, every further one doubles the wait starting at baseDelay, capped at
+// maxDelay. An account's failures are forgotten once it has been quiet for window.
+type loginThrottle struct {
+	mu        sync.Mutex
+	accounts  map[string]*loginFailures
+	lastPrune time.Time
+
+	freeAttempts int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+	window       time.Duration
+	// maxAccounts bounds the memory taken by attempts against many accounts within a window,
+	// the account that has been quiet the longest is forgotten to make room for another.
+	maxAccounts int
+
+	now func() time.Time
+}
+
+// maxThrottledAccounts is how many accounts a loginThrottle tracks at most.
+const maxThrottledAccounts = 100_000
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// newLoginThrottle returns a throttle that never delays anyone when baseDelay is zero.
+func newLoginThrottle(freeAttempts int, baseDelay, maxDelay, window time.Duration) *loginThrottle {
+	return &loginThrottle{
+		accounts:     make(map[string]*loginFailures),
+		freeAttempts: freeAttempts,
+		baseDelay:    baseDelay,
+		maxDelay:     maxDelay,
+		window:       window,
+		maxAccounts:  maxThrottledAccounts,
+		now:          time.Now,
+	}
+}
+
+// Wait returns how long username must still wait before the next login attempt,
+// zero meaning the attempt may proceed.
+func (t *loginThrottle) Wait(username string) time.Duration {
+	if t.baseDelay <= 0 {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failures, ok := t.accounts[username]
+	if !ok || failures.count < t.freeAttempts {
+		return 0
+	}
+
+	delay := t.baseDelay
+	for i := t.freeAttempts; i < failures.count && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, t.maxDelay)
+
+	remaining := failures.last.Add(delay).Sub(t.now())
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// Failure records a failed login attempt for username.
+func (t *loginThrottle) Failure(username string) {
+	if t.baseDelay <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.prune(now)
+
+	failures, ok := t.accounts[username]
+	if !ok || now.Sub(failures.last) > t.window {
+		if !ok && len(t.accounts) >= t.maxAccounts {
+			t.evictOldest()
+		}
+
+		failures = &loginFailures{}
+		t.accounts[username] = failures
+	}
+
+	failures.count++
+	failures.last = now
+}
+
+// Success forgets the failures of username.
+func (t *loginThrottle) Success(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.accounts, username)
+}
+
+// prune drops accounts that have been quiet for longer than the window, at most once per window.
+func (t *loginThrottle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.window {
+		return
+	}
+
+	for username, failures := range t.accounts {
+		if now.Sub(failures.last) > t.window {
+			delete(t.accounts, username)
+		}
+	}
+
+	t.lastPrune = now
+}
+
+// evictOldest forgets the account whose last failure is the oldest.
+func (t *loginThrottle) evictOldest() {
+	var (
+		oldest string
+		last   time.Time
+	)
+
+	for username, failures := range t.accounts {
+		if oldest == "" || failures.last.Before(last) {
+			oldest, last = username, failures.last
+		}
+	}
+
+	delete(t.accounts, oldest)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	newThrottle := func() *loginThrottle {
+		throttle := newLoginThrottle(3, time.Second, 10*time.Second, time.Hour)
+		throttle.now = func() time.Time { return now }
+		return throttle
+	}
+
+	t.Run("Free attempts are not delayed", func(t *testing.T) {
+		throttle := newThrottle()
+
+		for i := 0; i < 2; i++ {
+			throttle.Failure("testuser")
+		}
+
+		assert.Zero(t, throttle.Wait("testuser"))
+	})
+
+	t.Run("Delay doubles with every failure up to the maximum", func(t *testing.T) {
+		throttle := newThrottle()
+
+		for i := 0; i < 3; i++ {
+			throttle.Failure("testuser")
+		}
+		assert.Equal(t, time.Second, throttle.Wait("testuser"))
+
+		throttle.Failure("testuser")
+		assert.Equal(t, 2*time.Second, throttle.Wait("testuser"))
+
+		throttle.Failure("testuser")
+		assert.Equal(t, 4*time.Second, throttle.Wait("testuser"))
+
+		for i := 0; i < 10; i++ {
+			throttle.Failure("testuser")
+		}
+		assert.Equal(t, 10*time.Second, throttle.Wait("testuser"))
+	})
+
+	t.Run("Accounts are throttled independently", func(t *testing.T) {
+		throttle := newThrottle()
+
+		for i := 0; i < 5; i++ {
+			throttle.Failure("victim")
+		}
+
+		assert.NotZero(t, throttle.Wait("victim"))
+		assert.Zero(t, throttle.Wait("otheruser"))
+	})
+
+	t.Run("Wait shrinks as time passes", func(t *testing.T) {
+		throttle := newThrottle()
+		clock := now
+		throttle.now = func() time.Time { return clock }
+
+		for i := 0; i < 3; i++ {
+			throttle.Failure("testuser")
+		}
+
+		clock = clock.Add(400 * time.Millisecond)
+		assert.Equal(t, 600*time.Millisecond, throttle.Wait("testuser"))
+
+		clock = clock.Add(time.Second)
+		assert.Zero(t, throttle.Wait("testuser"))
+	})
+
+	t.Run("Failures are forgotten after the window", func(t *testing.T) {
+		throttle := newThrottle()
+		clock := now
+		throttle.now = func() time.Time { return clock }
+
+		for i := 0; i < 5; i++ {
+			throttle.Failure("testuser")
+		}
+
+		clock = clock.Add(2 * time.Hour)
+		throttle.Failure("testuser")
+
+		assert.Zero(t, throttle.Wait("testuser"))
+		assert.Len(t, throttle.accounts, 1)
+	})
+
+	t.Run("The account quiet the longest is evicted when full", func(t *testing.T) {
+		throttle := newThrottle()
+		throttle.maxAccounts = 2
+		clock := now
+		throttle.now = func() time.Time { return clock }
+
+		for _, username := range []string{"first", "second", "first", "third"} {
+			throttle.Failure(username)
+			clock = clock.Add(time.Minute)
+		}
+
+		assert.Len(t, throttle.accounts, 2)
+		assert.Contains(t, throttle.accounts, "first")
+		assert.Contains(t, throttle.accounts, "third")
+	})
+
+	t.Run("Success resets the account", func(t *testing.T) {
+		throttle := newThrottle()
+
+		for i := 0; i < 5; i++ {
+			throttle.Failure("testuser")
+		}
+		throttle.Success("testuser")
+
+		assert.Zero(t, throttle.Wait("testuser"))
+	})
+
+	t.Run("Zero base delay disables throttling", func(t *testing.T) {
+		throttle := newLoginThrottle(0, 0, 0, time.Hour)
+
+		throttle.Failure("testuser")
+
+		assert.Zero(t, throttle.Wait("testuser"))
+		assert.Empty(t, throttle.accounts)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracePropagator reads the trace context and baggage of inbound requests from the W3C headers.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newTracerProvider returns the tracer provider exporting to the configured exporter, see
+// config.Tracing. It has to be shut down to flush the spans still buffered.
+func newTracerProvider(ctx context.Context, cfg config) (*sdktrace.TracerProvider, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+
+	switch cfg.Tracing.Exporter {
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Tracing.Endpoint)}
+		if cfg.Tracing.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create the %s trace exporter: %w", cfg.Tracing.Exporter, err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.Tracing.ServiceName),
+		semconv.ServiceVersion(version),
+	)
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+	), nil
+}
+
+// setupTracing installs the tracer provider globally, the models record their spans with it, and
+// returns it for the request spans.
+func setupTracing(ctx context.Context, cfg config) (*sdktrace.TracerProvider, error) {
+	tp, err := newTracerProvider(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(tracePropagator)
+
+	return tp, nil
+}
+
+// traceRequest starts a server span for every request, continuing the trace propagated in its
+// headers. The span is named after the method until traceRoute names it after the matched route.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "",
+		otelhttp.WithTracerProvider(app.tracerProvider),
+		otelhttp.WithPropagators(tracePropagator),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+// traceRoute names the request span after route, the path pattern the handler is registered for,
+// so that the requests for different users are grouped together. httprouter doesn't expose the
+// matched pattern, the routes are wrapped when they are registered instead.
+func traceRoute(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+
+		next(w, r)
+	}
+}
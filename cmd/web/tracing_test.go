@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceRequest(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+
+	app := &application{
+		logger:         slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		tracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+	}
+	handler := app.routes()
+
+	// serve runs the request and returns the single span it produced
+	serve := func(t *testing.T, r *http.Request) tracetest.SpanStub {
+		exporter.Reset()
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		spans := exporter.GetSpans()
+		if !assert.Len(t, spans, 1) {
+			t.FailNow()
+		}
+
+		return spans[0]
+	}
+
+	routeOf := func(span tracetest.SpanStub) string {
+		for _, attr := range span.Attributes {
+			if attr.Key == semconv.HTTPRouteKey {
+				return attr.Value.AsString()
+			}
+		}
+		return ""
+	}
+
+	t.Run("Named after the route", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/refresh", strings.NewReader(`{"refresh_token": `))
+		r.Header.Set("Content-Type", "application/json")
+
+		span := serve(t, r)
+		assert.Equal(t, "POST /v1/tokens/refresh", span.Name)
+		assert.Equal(t, "/v1/tokens/refresh", routeOf(span))
+		assert.Contains(t, span.Attributes, attribute.Int("http.status_code", http.StatusBadRequest))
+	})
+
+	t.Run("Path parameters are kept out of the name", func(t *testing.T) {
+		span := serve(t, httptest.NewRequest(http.MethodGet, "/v1/users/account/testuser", nil))
+		assert.Equal(t, "GET /v1/users/account/:username", span.Name)
+		assert.Equal(t, "/v1/users/account/:username", routeOf(span))
+	})
+
+	t.Run("Public routes", func(t *testing.T) {
+		span := serve(t, httptest.NewRequest(http.MethodGet, "/version", nil))
+		assert.Equal(t, "GET /version", span.Name)
+	})
+
+	t.Run("Unknown route", func(t *testing.T) {
+		span := serve(t, httptest.NewRequest(http.MethodGet, "/v1/unknown", nil))
+		assert.Equal(t, "GET", span.Name)
+		assert.Empty(t, routeOf(span))
+	})
+
+	t.Run("Continues the propagated trace", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/version", nil)
+		r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		span := serve(t, r)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+		assert.True(t, span.Parent.IsRemote())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		// without a tracer provider the routes are served as before, the route names are set on
+		// the no-op span of the request context
+		app := &application{logger: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+	"github.com/sushihentaime/user-management-service/internal/validator"
+	"github.com/sushihentaime/user-management-service/pkg/jsonParser"
+)
+
+type addEmailInput struct {
+	Email       string `json:"email" validate:"required"`
+	RedirectURL string `json:"redirect_url"`
+}
+
+// listUserEmailsHandler returns the authenticated user's primary email address and their secondary
+// ones.
+func (app *application) listUserEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	emails, err := app.models.UserEmails.GetForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"primary_email": user.Email, "emails": emails}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// addUserEmailHandler adds a secondary email address to the authenticated user's account and sends
+// it the token verifying it. Users the secondary_emails flag isn't enabled for get a 404.
+func (app *application) addUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	if !app.featureEnabled(flagSecondaryEmails, user.ID) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input addEmailInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	dbUser := &db.User{
+		Email: input.Email,
+	}
+
+	dbUser.Normalize()
+
+	if dbUser.ValidateEmail(app.models.Rules); !dbUser.Validator.Valid() {
+		app.failedValidationResponse(w, r, dbUser.Validator.Errors)
+		return
+	}
+
+	linkBase := app.redirectBase(v, input.RedirectURL)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	email, token, err := app.models.UserEmails.Add(r.Context(), user.ID, dbUser.Email, db.ActivationTokenTime)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrDuplicateEmail):
+			v.AddError("email", "is already one of your email addresses")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.backgroundTask(func(ctx context.Context) {
+		data := map[string]any{
+			"username":         user.Username,
+			"email":            email.Email,
+			"verifyEmailToken": token.Plain,
+			"verifyEmailURL":   app.emailLink(linkBase, app.config.Links.VerifyEmailPath, token.Plain),
+			"expiresIn":        humanDuration(time.Until(token.Expiry)),
+		}
+
+		err := app.sendEmail(ctx, user.ID, email.Email, "verify_email.html", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		app.logger.Info("email sent", "email", email.Email, "type", "email verification")
+	})
+
+	app.loggerFor(r).Info("email added", "event", eventEmailAdded, "user_id", user.ID)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// verifyUserEmailHandler verifies the secondary email address the token of the request body was
+// sent to.
+func (app *application) verifyUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input tokenInput
+
+	err := jsonParser.ParseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.CheckRequired(&input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token := &db.Token{
+		Plain: input.Token,
+	}
+
+	if token.ValidateToken(); !token.Validator.Valid() {
+		app.failedValidationResponse(w, r, token.Validator.Errors)
+		return
+	}
+
+	email, err := app.models.UserEmails.Verify(r.Context(), db.HashToken(token.Plain))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.failedValidationResponse(w, r, map[string]string{"token": "invalid or expired verification token"})
+		case errors.Is(err, db.ErrDuplicateEmail):
+			// only the owner of the mailbox gets this far, so telling that the address is taken is fine
+			app.failedValidationResponse(w, r, map[string]string{"email": "a user with this email address already exists"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.loggerFor(r).Info("email verified", "event", eventEmailVerified, "user_id", email.UserID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// removeUserEmailHandler removes a secondary email address of the authenticated user, the primary
+// one can only be replaced.
+func (app *application) removeUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	email, err := app.readEmailParam(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	if strings.EqualFold(email, user.Email) {
+		app.failedValidationResponse(w, r, map[string]string{"email": "is the primary email address and can't be removed"})
+		return
+	}
+
+	err = app.models.UserEmails.Remove(r.Context(), user.ID, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.loggerFor(r).Info("email removed", "event", eventEmailRemoved, "user_id", user.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// promoteUserEmailHandler makes a verified secondary email address of the authenticated user their
+// primary one.
+func (app *application) promoteUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	email, err := app.readEmailParam(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	tx, err := app.models.DB.Begin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	models := app.models.WithTx(tx)
+
+	previous, err := models.UserEmails.Promote(r.Context(), user.ID, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, db.ErrEmailNotVerified):
+			app.failedValidationResponse(w, r, map[string]string{"email": "must be verified before it can be made primary"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the replaced primary can be restored like one replaced by an account update
+	change := &db.EmailChange{UserID: user.ID, Email: previous}
+
+	err = models.EmailHistory.Insert(r.Context(), change)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmailChangedNotice(change, email)
+
+	app.loggerFor(r).Info("primary email changed", "event", eventEmailPromoted, "user_id", user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "primary email address changed", "primary_email": email}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/sushihentaime/user-management-service/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserEmailHandlers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	mailer := &recordingMailer{}
+	app.mailer = mailer
+
+	user, accessToken := createTestUser(t, app, "testuser", db.PermissionReadUser)
+	other, otherToken := createTestUser(t, app, "otheruser", db.PermissionReadUser)
+
+	var verifyToken string
+
+	t.Run("Requires authentication", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/emails", "", addEmailInput{Email: "second@example.com"})
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Invalid email", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/emails", accessToken.Plain, addEmailInput{Email: "invalid"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+
+	t.Run("Add a secondary email", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPost, "/v1/users/emails", accessToken.Plain, addEmailInput{Email: " Second@Example.com "})
+		assert.Equal(t, http.StatusCreated, status)
+
+		email := body["email"].(map[string]any)
+		assert.Equal(t, "second@example.com", email["email"])
+		assert.Equal(t, false, email["verified"])
+
+		app.wg.Wait()
+		sent := mailer.Sent()
+		if assert.Len(t, sent, 1) {
+			assert.Equal(t, "second@example.com", sent[0].recipient)
+			assert.Equal(t, "verify_email.html", sent[0].templateFile)
+			verifyToken = sent[0].data.(map[string]any)["verifyEmailToken"].(string)
+		}
+
+		status, _, body = ts.do(t, http.MethodGet, "/v1/users/emails", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, user.Email, body["primary_email"])
+		assert.Len(t, body["emails"], 1)
+	})
+
+	t.Run("Uniqueness conflicts", func(t *testing.T) {
+		status, _, body := ts.do(t, http.MethodPost, "/v1/users/emails", accessToken.Plain, addEmailInput{Email: user.Email})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, "is already one of your email addresses", body["error"].(map[string]any)["fields"].(map[string]any)["email"])
+
+		// another user's address is accepted like any other, it only conflicts once verified
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/emails", accessToken.Plain, addEmailInput{Email: other.Email})
+		assert.Equal(t, http.StatusCreated, status)
+
+		app.wg.Wait()
+		sent := mailer.Sent()
+		otherVerifyToken := sent[len(sent)-1].data.(map[string]any)["verifyEmailToken"].(string)
+
+		status, _, body = ts.put(t, "/v1/users/emails/verify", tokenInput{Token: otherVerifyToken})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, "a user with this email address already exists", body["error"].(map[string]any)["fields"].(map[string]any)["email"])
+
+		status, _, _ = ts.do(t, http.MethodDelete, "/v1/users/emails/"+other.Email, accessToken.Plain, nil)
+		assert.Equal(t, http.StatusNoContent, status)
+
+		// a pending secondary address reserves nothing
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/emails", otherToken.Plain, addEmailInput{Email: "second@example.com"})
+		assert.Equal(t, http.StatusCreated, status)
+	})
+
+	t.Run("Unverified email can't be promoted", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/emails/second@example.com/primary", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+
+	t.Run("Invalid verification token", func(t *testing.T) {
+		status, _, _ := ts.put(t, "/v1/users/emails/verify", tokenInput{Token: "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+
+	t.Run("Verify the secondary email", func(t *testing.T) {
+		status, _, body := ts.put(t, "/v1/users/emails/verify", tokenInput{Token: verifyToken})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, true, body["email"].(map[string]any)["verified"])
+
+		status, _, _ = ts.put(t, "/v1/users/emails/verify", tokenInput{Token: verifyToken})
+		assert.Equal(t, http.StatusUnprocessableEntity, status, "the token can only be used once")
+
+		// a verified secondary address can't be taken by anyone else
+		status, _, body = ts.post(t, "/v1/users/new", createUserInput{Username: "newuser", Email: "second@example.com", Password: "Test1234!"})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+		assert.Equal(t, "a user with this email address already exists", body["error"].(map[string]any)["fields"].(map[string]any)["email"])
+
+		dbOther, err := app.models.Users.GetByUsername(context.Background(), other.Username)
+		assert.NoError(t, err)
+		dbOther.Email = "second@example.com"
+		assert.ErrorIs(t, app.models.Users.Update(context.Background(), dbOther), db.ErrDuplicateEmail)
+	})
+
+	t.Run("Promote the secondary email to primary", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodPost, "/v1/users/emails/unknown@example.com/primary", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+
+		status, _, body := ts.do(t, http.MethodPost, "/v1/users/emails/second@example.com/primary", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "second@example.com", body["primary_email"])
+
+		dbUser, err := app.models.Users.GetByUsername(context.Background(), user.Username)
+		assert.NoError(t, err)
+		assert.Equal(t, "second@example.com", dbUser.Email)
+
+		status, _, body = ts.do(t, http.MethodGet, "/v1/users/emails", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "second@example.com", body["primary_email"])
+
+		emails := body["emails"].([]any)
+		if assert.Len(t, emails, 1) {
+			assert.Equal(t, user.Email, emails[0].(map[string]any)["email"])
+			assert.Equal(t, true, emails[0].(map[string]any)["verified"])
+		}
+
+		// password resets go to the primary email only
+		_, err = app.models.Users.GetByEmail(context.Background(), user.Email)
+		assert.ErrorIs(t, err, db.ErrNotFound)
+	})
+
+	t.Run("Remove a secondary email", func(t *testing.T) {
+		status, _, _ := ts.do(t, http.MethodDelete, "/v1/users/emails/second@example.com", accessToken.Plain, nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, status, "the primary email can't be removed")
+
+		status, _, _ = ts.do(t, http.MethodDelete, "/v1/users/emails/"+user.Email, accessToken.Plain, nil)
+		assert.Equal(t, http.StatusNoContent, status)
+
+		status, _, _ = ts.do(t, http.MethodDelete, "/v1/users/emails/"+user.Email, accessToken.Plain, nil)
+		assert.Equal(t, http.StatusNotFound, status)
+
+		// the address is free again
+		status, _, _ = ts.do(t, http.MethodPost, "/v1/users/emails", otherToken.Plain, addEmailInput{Email: user.Email})
+		assert.Equal(t, http.StatusCreated, status)
+	})
+
+	t.Cleanup(func() {
+		err := cleanup(app)
+		assert.NoError(t, err)
+	})
+}
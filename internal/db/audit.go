@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+type AuditAction string
+
+const (
+	AuditActionImpersonate       AuditAction = "impersonate"
+	AuditActionEndImpersonations AuditAction = "end_impersonations"
+	AuditActionRevokeTokens      AuditAction = "revoke_tokens"
+	AuditActionLock              AuditAction = "lock"
+	AuditActionUnlock            AuditAction = "unlock"
+	AuditActionEmailRollback     AuditAction = "email_rollback"
+	AuditActionGrantPermission   AuditAction = "grant_permission"
+)
+
+// AuditEvent records an administrative action taken by ActorID on TargetUserID. The event outlives
+// both users, their IDs are cleared in the table when they are deleted.
+type AuditEvent struct {
+	ID           int64       `json:"id"`
+	ActorID      int         `json:"actor_id"`
+	TargetUserID int         `json:"target_user_id"`
+	Action       AuditAction `json:"action"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+type AuditModel struct {
+	DB Querier
+}
+
+func (m *AuditModel) Insert(ctx context.Context, event *AuditEvent) error {
+	query := `
+		INSERT INTO audit_log (actor_id, target_user_id, action)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	ctx, cancel := startSpan(ctx, "AuditModel.Insert", 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, event.ActorID, event.TargetUserID, event.Action).Scan(&event.ID, &event.CreatedAt)
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EmailChange is a verified email address the user replaced by another one, kept so that an
+// unwanted change, such as one made from a compromised account, can be rolled back.
+type EmailChange struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"-"`
+	Email     string    `json:"email"`
+	ChangedAt time.Time `json:"changed_at"`
+	// RollbackToken restores Email when sent back, it is only set by Insert for the link mailed
+	// to the replaced address. Just its hash is stored.
+	RollbackToken string `json:"-"`
+}
+
+type EmailHistoryModel struct {
+	DB Querier
+}
+
+// Insert records change together with a new rollback token, see EmailChange.RollbackToken.
+func (m *EmailHistoryModel) Insert(ctx context.Context, change *EmailChange) error {
+	query := `
+		INSERT INTO email_history (user_id, email, token_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, changed_at`
+
+	// the history entry expires with the rollback window rather than with the token
+	token, err := new(change.UserID, 0, "")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := startSpan(ctx, "EmailHistoryModel.Insert", 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, change.UserID, change.Email, token.Hash).Scan(&change.ID, &change.ChangedAt)
+	if err != nil {
+		return err
+	}
+
+	change.RollbackToken = token.Plain
+
+	return nil
+}
+
+// GetForUser returns the user's previous email addresses replaced after since, newest first.
+func (m *EmailHistoryModel) GetForUser(ctx context.Context, userID int, since time.Time) ([]*EmailChange, error) {
+	query := `
+		SELECT id, user_id, email, changed_at
+		FROM email_history
+		WHERE user_id = $1 AND changed_at > $2
+		ORDER BY id DESC`
+
+	ctx, cancel := startSpan(ctx, "EmailHistoryModel.GetForUser", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*EmailChange{}
+
+	for rows.Next() {
+		change := &EmailChange{}
+
+		err := rows.Scan(&change.ID, &change.UserID, &change.Email, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Rollback makes email, a previous address of the user replaced after since, the user's verified
+// email again. The entry and every later one are dropped from the history. It returns ErrNotFound
+// when no such entry exists and ErrDuplicateEmail when another user has taken the address since.
+func (m *EmailHistoryModel) Rollback(ctx context.Context, userID int, email string, since time.Time) error {
+	_, err := m.rollback(ctx, "EmailHistoryModel.Rollback", "user_id = $1 AND email = $2 AND changed_at > $3", userID, email, since)
+	return err
+}
+
+// RollbackWithToken is Rollback for the entry whose rollback token hashes to tokenHash, it returns
+// the ID of the user whose email was restored.
+func (m *EmailHistoryModel) RollbackWithToken(ctx context.Context, tokenHash []byte, since time.Time) (int, error) {
+	return m.rollback(ctx, "EmailHistoryModel.RollbackWithToken", "token_hash = $1 AND changed_at > $2", tokenHash, since)
+}
+
+// rollback restores the newest history entry matching where. A restored address that became a
+// secondary one of the user, as promoting another address leaves the replaced primary, is taken
+// back from the secondary addresses.
+func (m *EmailHistoryModel) rollback(ctx context.Context, span, where string, args ...any) (int, error) {
+	ctx, cancel := startSpan(ctx, span, 5*time.Second)
+	defer cancel()
+
+	var userID int
+
+	err := inTx(ctx, m.DB, func(tx Querier) error {
+		var (
+			id    int64
+			email string
+		)
+
+		query := fmt.Sprintf(`
+			SELECT id, user_id, email
+			FROM email_history
+			WHERE %s
+			ORDER BY id DESC
+			LIMIT 1
+			FOR UPDATE`, where)
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&id, &userID, &email)
+		if err != nil {
+			return err
+		}
+
+		// the address must leave user_emails before it can be the primary one again
+		queries := []struct {
+			query string
+			args  []any
+		}{
+			{`DELETE FROM email_history WHERE user_id = $1 AND id >= $2`, []any{userID, id}},
+			{`DELETE FROM user_emails WHERE user_id = $1 AND email = $2`, []any{userID, email}},
+			{`UPDATE users SET email = $2, activated = TRUE, activated_at = COALESCE(activated_at, NOW()), version = version + 1 WHERE id = $1`, []any{userID, email}},
+		}
+
+		for _, q := range queries {
+			_, err = tx.ExecContext(ctx, q.query, q.args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrNotFound
+		case err.Error() == "pq: duplicate key value violates unique constraint \"users_email_key\"":
+			return 0, ErrDuplicateEmail
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
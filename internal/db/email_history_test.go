@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailHistoryModel_Insert(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := EmailHistoryModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		INSERT INTO email_history (user_id, email, token_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, changed_at`)
+
+	now := time.Now().Truncate(time.Second)
+
+	mock.ExpectQuery(query).WithArgs(1, "old@example.com", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "changed_at"}).AddRow(3, now))
+
+	change := &EmailChange{UserID: 1, Email: "old@example.com"}
+
+	err := m.Insert(context.Background(), change)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), change.ID)
+	assert.True(t, now.Equal(change.ChangedAt))
+	assert.NotEmpty(t, change.RollbackToken)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmailHistoryModel_GetForUser(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := EmailHistoryModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT id, user_id, email, changed_at
+		FROM email_history
+		WHERE user_id = $1 AND changed_at > $2
+		ORDER BY id DESC`)
+
+	now := time.Now().Truncate(time.Second)
+	since := now.Add(-time.Hour)
+
+	mock.ExpectQuery(query).WithArgs(1, since).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "email", "changed_at"}).
+			AddRow(2, 1, "second@example.com", now).
+			AddRow(1, 1, "first@example.com", now.Add(-time.Minute)))
+
+	changes, err := m.GetForUser(context.Background(), 1, since)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "second@example.com", changes[0].Email)
+	assert.Equal(t, "first@example.com", changes[1].Email)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// expectRollback expects the statements restoring old@example.com from history entry 4 of user 1,
+// the last of them failing with err.
+func expectRollback(mock sqlmock.Sqlmock, err error) {
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM email_history WHERE user_id = $1 AND id >= $2`)).WithArgs(1, int64(4)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM user_emails WHERE user_id = $1 AND email = $2`)).WithArgs(1, "old@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	expect := mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET email = $2, activated = TRUE, activated_at = COALESCE(activated_at, NOW()), version = version + 1 WHERE id = $1`)).WithArgs(1, "old@example.com")
+	if err != nil {
+		expect.WillReturnError(err)
+		mock.ExpectRollback()
+		return
+	}
+
+	expect.WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestEmailHistoryModel_Rollback(t *testing.T) {
+	query := `SELECT id, user_id, email\s+FROM email_history\s+WHERE user_id = \$1 AND email = \$2 AND changed_at > \$3\s+ORDER BY id DESC\s+LIMIT 1\s+FOR UPDATE`
+	since := time.Now().Add(-time.Hour)
+
+	testCases := []struct {
+		name      string
+		selectErr error
+		updateErr error
+		wantErr   error
+	}{
+		{name: "Rolled back"},
+		{name: "Unknown email", selectErr: sql.ErrNoRows, wantErr: ErrNotFound},
+		{name: "Email taken", updateErr: errors.New("pq: duplicate key value violates unique constraint \"users_email_key\""), wantErr: ErrDuplicateEmail},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := MockDB()
+			defer db.Close()
+
+			m := EmailHistoryModel{DB: db}
+
+			mock.ExpectBegin()
+			expect := mock.ExpectQuery(query).WithArgs(1, "old@example.com", since)
+			if tt.selectErr != nil {
+				expect.WillReturnError(tt.selectErr)
+				mock.ExpectRollback()
+			} else {
+				expect.WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "email"}).AddRow(4, 1, "old@example.com"))
+				expectRollback(mock, tt.updateErr)
+			}
+
+			err := m.Rollback(context.Background(), 1, "old@example.com", since)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestEmailHistoryModel_RollbackWithToken(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := EmailHistoryModel{DB: db}
+
+	since := time.Now().Add(-time.Hour)
+	hash := HashToken("token")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, user_id, email\s+FROM email_history\s+WHERE token_hash = \$1 AND changed_at > \$2`).
+		WithArgs(hash, since).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "email"}).AddRow(4, 1, "old@example.com"))
+	expectRollback(mock, nil)
+
+	userID, err := m.RollbackWithToken(context.Background(), hash, since)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, userID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
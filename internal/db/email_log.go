@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+type EmailStatus string
+
+const (
+	EmailStatusSent   EmailStatus = "sent"
+	EmailStatusFailed EmailStatus = "failed"
+)
+
+// EmailEvent is the recorded outcome of sending one email. UserID is zero when the email
+// wasn't sent on behalf of a known user.
+type EmailEvent struct {
+	ID        int64       `json:"id"`
+	UserID    int         `json:"-"`
+	Recipient string      `json:"recipient"`
+	Template  string      `json:"template"`
+	Status    EmailStatus `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type EmailLogModel struct {
+	DB Querier
+}
+
+func (m *EmailLogModel) Insert(ctx context.Context, event *EmailEvent) error {
+	query := `
+		INSERT INTO email_log (user_id, recipient, template, status, error)
+		VALUES (NULLIF($1, 0), $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	ctx, cancel := startSpan(ctx, "EmailLogModel.Insert", 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, event.UserID, event.Recipient, event.Template, event.Status, event.Error).Scan(&event.ID, &event.CreatedAt)
+}
+
+// GetForUser returns a page of the user's email events with the status, newest first.
+func (m *EmailLogModel) GetForUser(ctx context.Context, userID int, status EmailStatus, filters Filters) ([]*EmailEvent, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, user_id, recipient, template, status, error, created_at
+		FROM email_log
+		WHERE user_id = $1 AND status = $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`
+
+	ctx, cancel := startSpan(ctx, "EmailLogModel.GetForUser", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, status, filters.Limit(), filters.Offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*EmailEvent{}
+
+	for rows.Next() {
+		event := &EmailEvent{}
+
+		err := rows.Scan(&totalRecords, &event.ID, &event.UserID, &event.Recipient, &event.Template, &event.Status, &event.Error, &event.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return events, CalculateMetadata(totalRecords, filters.Limit(), filters.Offset()), nil
+}
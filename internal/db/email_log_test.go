@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailLogModel_Insert(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := EmailLogModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		INSERT INTO email_log (user_id, recipient, template, status, error)
+		VALUES (NULLIF($1, 0), $2, $3, $4, $5)
+		RETURNING id, created_at`)
+
+	now := time.Now().Truncate(time.Second)
+
+	mock.ExpectQuery(query).WithArgs(1, "test@example.com", "mail.html", EmailStatusFailed, "connection refused").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, now))
+
+	event := &EmailEvent{UserID: 1, Recipient: "test@example.com", Template: "mail.html", Status: EmailStatusFailed, Error: "connection refused"}
+
+	err := m.Insert(context.Background(), event)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), event.ID)
+	assert.True(t, now.Equal(event.CreatedAt))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmailLogModel_GetForUser(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := EmailLogModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT count(*) OVER(), id, user_id, recipient, template, status, error, created_at
+		FROM email_log
+		WHERE user_id = $1 AND status = $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`)
+
+	now := time.Now().Truncate(time.Second)
+
+	mock.ExpectQuery(query).WithArgs(1, EmailStatusFailed, 2, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"count", "id", "user_id", "recipient", "template", "status", "error", "created_at"}).
+			AddRow(3, 1, 1, "test@example.com", "mail.html", "failed", "connection refused", now))
+
+	events, metadata, err := m.GetForUser(context.Background(), 1, EmailStatusFailed, Filters{Page: 2, PageSize: 2})
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, EmailStatusFailed, events[0].Status)
+	assert.Equal(t, "connection refused", events[0].Error)
+	assert.Equal(t, 2, metadata.CurrentPage)
+	assert.Equal(t, 3, metadata.TotalRecords)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
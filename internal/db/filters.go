@@ -0,0 +1,89 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type Filters struct {
+	Page     int
+	PageSize int
+}
+
+// CursorFilters select a page of a keyset paginated list. An empty Cursor
+// starts from the newest record.
+type CursorFilters struct {
+	Cursor   string
+	PageSize int
+}
+
+// Cursor marks the last record of a page in a list ordered by (created_at, id)
+// descending. The next page starts strictly after it.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+type Metadata struct {
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+}
+
+func (f Filters) Limit() int {
+	return f.PageSize
+}
+
+func (f Filters) Offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+// CalculateMetadata returns an empty Metadata when there are no records so that
+// list responses can omit the pagination fields entirely.
+func CalculateMetadata(totalRecords, limit, offset int) Metadata {
+	if totalRecords == 0 || limit <= 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  offset/limit + 1,
+		PageSize:     limit,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(limit))),
+		TotalRecords: totalRecords,
+	}
+}
+
+// Encode returns the cursor in an opaque, URL safe form.
+func (c Cursor) Encode() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return Cursor{CreatedAt: time.Unix(0, n), ID: id}, nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilters_LimitOffset(t *testing.T) {
+	f := Filters{Page: 3, PageSize: 20}
+
+	assert.Equal(t, 20, f.Limit())
+	assert.Equal(t, 40, f.Offset())
+}
+
+func TestCalculateMetadata(t *testing.T) {
+	tests := []struct {
+		name         string
+		totalRecords int
+		limit        int
+		offset       int
+		want         Metadata
+	}{
+		{
+			name:         "empty result set",
+			totalRecords: 0,
+			limit:        20,
+			offset:       0,
+			want:         Metadata{},
+		},
+		{
+			name:         "first page",
+			totalRecords: 45,
+			limit:        20,
+			offset:       0,
+			want:         Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 3, TotalRecords: 45},
+		},
+		{
+			name:         "last partial page",
+			totalRecords: 45,
+			limit:        20,
+			offset:       40,
+			want:         Metadata{CurrentPage: 3, PageSize: 20, FirstPage: 1, LastPage: 3, TotalRecords: 45},
+		},
+		{
+			name:         "last full page",
+			totalRecords: 40,
+			limit:        20,
+			offset:       20,
+			want:         Metadata{CurrentPage: 2, PageSize: 20, FirstPage: 1, LastPage: 2, TotalRecords: 40},
+		},
+		{
+			name:         "single record",
+			totalRecords: 1,
+			limit:        20,
+			offset:       0,
+			want:         Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CalculateMetadata(tt.totalRecords, tt.limit, tt.offset)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCursor_EncodeDecode(t *testing.T) {
+	cursor := Cursor{CreatedAt: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), ID: "a1b2c3"}
+
+	encoded := cursor.Encode()
+	assert.NotContains(t, encoded, "a1b2c3")
+
+	decoded, err := DecodeCursor(encoded)
+	assert.NoError(t, err)
+	assert.True(t, cursor.CreatedAt.Equal(decoded.CreatedAt))
+	assert.Equal(t, cursor.ID, decoded.ID)
+}
+
+func TestDecodeCursor_Invalid(t *testing.T) {
+	for _, s := range []string{"not base64!", "bm9jb2xvbg", "YWJjOmlk", "MTIzOg"} {
+		_, err := DecodeCursor(s)
+		assert.ErrorIs(t, err, ErrInvalidCursor, s)
+	}
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/validator"
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an Idempotency-Key header.
+// UserID is the user who made the request, zero for anonymous ones, and Fingerprint identifies
+// the request itself, a key sent with another user or request must not replay the outcome.
+type IdempotencyRecord struct {
+	Key         string
+	UserID      int
+	Fingerprint []byte
+	Status      int
+	Response    []byte
+	Expiry      time.Time
+	Validator   *validator.Validator
+}
+
+type IdempotencyModel struct {
+	DB Querier
+}
+
+func (i *IdempotencyRecord) ValidateKey() {
+	i.Validator = validator.New()
+
+	i.Validator.Check(i.Key != "", "Idempotency-Key", "must be provided")
+	i.Validator.Check(i.Validator.CheckStringLength(i.Key, 1, 255), "Idempotency-Key", "must be at most 255 characters long")
+}
+
+// Get returns the unexpired record stored for the key.
+func (m *IdempotencyModel) Get(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	record := &IdempotencyRecord{}
+
+	query := `
+		SELECT key, COALESCE(user_id, 0), fingerprint, status, response, expiry
+		FROM idempotency_keys
+		WHERE key = $1 AND expiry > $2`
+
+	ctx, cancel := startSpan(ctx, "IdempotencyModel.Get", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, time.Now()).Scan(&record.Key, &record.UserID, &record.Fingerprint, &record.Status, &record.Response, &record.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+// Insert stores the record, replacing an expired record with the same key.
+func (m *IdempotencyModel) Insert(ctx context.Context, record *IdempotencyRecord) error {
+	query := `
+		INSERT INTO idempotency_keys (key, user_id, fingerprint, status, response, expiry)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE
+		SET user_id = EXCLUDED.user_id, fingerprint = EXCLUDED.fingerprint, status = EXCLUDED.status, response = EXCLUDED.response, expiry = EXCLUDED.expiry, created_at = CURRENT_TIMESTAMP
+		WHERE idempotency_keys.expiry <= CURRENT_TIMESTAMP`
+
+	ctx, cancel := startSpan(ctx, "IdempotencyModel.Insert", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, record.Key, record.UserID, record.Fingerprint, record.Status, record.Response, record.Expiry)
+	return err
+}
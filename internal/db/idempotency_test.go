@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyRecord_ValidateKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{key: "", valid: false},
+		{key: "3f1c2a9e-7b1d-4c1e-9a59-2d6f0c8e4b11", valid: true},
+		{key: strings.Repeat("a", 256), valid: false},
+	}
+
+	for _, test := range tests {
+		record := &IdempotencyRecord{Key: test.key}
+		record.ValidateKey()
+
+		assert.Equal(t, test.valid, record.Validator.Valid(), "key=%q", test.key)
+	}
+}
+
+func TestIdempotencyModel_Get(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := IdempotencyModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT key, COALESCE(user_id, 0), fingerprint, status, response, expiry
+		FROM idempotency_keys
+		WHERE key = $1 AND expiry > $2`)
+
+	expiry := time.Now().Add(time.Hour)
+	rows := sqlmock.NewRows([]string{"key", "user_id", "fingerprint", "status", "response", "expiry"}).AddRow("key", 0, []byte("fingerprint"), 201, []byte(`{"token":"abc"}`), expiry)
+	mock.ExpectQuery(query).WithArgs("key", anyTime{}).WillReturnRows(rows)
+
+	record, err := m.Get(context.Background(), "key")
+	assert.NoError(t, err)
+	assert.Equal(t, 201, record.Status)
+	assert.Equal(t, []byte("fingerprint"), record.Fingerprint)
+	assert.JSONEq(t, `{"token":"abc"}`, string(record.Response))
+
+	mock.ExpectQuery(query).WithArgs("missing", anyTime{}).WillReturnError(sql.ErrNoRows)
+
+	_, err = m.Get(context.Background(), "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdempotencyModel_Insert(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := IdempotencyModel{DB: db}
+
+	record := &IdempotencyRecord{
+		Key:         "key",
+		Fingerprint: []byte("fingerprint"),
+		Status:      201,
+		Response:    []byte(`{"token":"abc"}`),
+		Expiry:      time.Now().Add(time.Hour),
+	}
+
+	query := regexp.QuoteMeta(`
+		INSERT INTO idempotency_keys (key, user_id, fingerprint, status, response, expiry)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6)`)
+
+	mock.ExpectExec(query).WithArgs(record.Key, record.UserID, record.Fingerprint, record.Status, record.Response, record.Expiry).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := m.Insert(context.Background(), record)
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
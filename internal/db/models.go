@@ -1,26 +1,199 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 var (
 	ErrNotFound = errors.New("not found")
 )
 
+// IsTransient reports whether err is a database failure that may not happen again, such as a
+// dropped connection, a timeout, a server running out of resources or a serialization failure,
+// so that the query is worth retrying.
+func IsTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// connection exception, insufficient resources, operator intervention
+		case "08", "53", "57":
+			return true
+		}
+
+		// serialization failure, deadlock detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// UserStore, TokenStore, PermissionStore, SecurityQuestionStore and UserEmailStore are implemented
+// by the Postgres backed models, handler tests can substitute their own implementations. Their
+// methods take the context of the caller for tracing, see startSpan.
+type UserStore interface {
+	Create(ctx context.Context, user *User) error
+	Insert(ctx context.Context, user *User) error
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	GetByID(ctx context.Context, id int) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Taken(ctx context.Context, username, email string) (bool, bool, error)
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, id int) error
+	DeleteAccount(ctx context.Context, id int, purgeAudit bool) error
+	GetToken(ctx context.Context, tokenScope TokenScope, token []byte) (*User, error)
+	Activate(ctx context.Context, userID int) error
+	Deactivate(ctx context.Context, userID int) error
+	Lock(ctx context.Context, userID int) error
+	Unlock(ctx context.Context, userID int) error
+	GetDueActivationReminder(ctx context.Context, olderThan time.Time, maxReminders int) ([]*User, error)
+	RecordActivationReminder(ctx context.Context, userID int) error
+	DeleteUnactivatedBefore(ctx context.Context, t time.Time) (int64, error)
+	ClaimActivationResend(ctx context.Context, userID int, cooldown time.Duration) (bool, time.Duration, error)
+	ClaimPasswordResetEmail(ctx context.Context, userID int, cooldown time.Duration) (bool, error)
+	ClaimUsernameReminderEmail(ctx context.Context, userID int, cooldown time.Duration) (bool, error)
+	Count(ctx context.Context) (int, int, error)
+}
+
+type TokenStore interface {
+	CreateToken(ctx context.Context, userID int, ttl time.Duration, scope TokenScope) (*Token, error)
+	CreatePair(ctx context.Context, userID int, authenticatedAt time.Time) (*Token, *Token, error)
+	CreateOTP(ctx context.Context, userID int, ttl time.Duration, scope TokenScope) (*Token, error)
+	Delete(ctx context.Context, userID int, scope TokenScope) error
+	DeleteAllForUser(ctx context.Context, userID int, scopes ...TokenScope) error
+	DeleteOtherSessions(ctx context.Context, userID int, keep []byte) error
+	DeletePair(ctx context.Context, refreshHash []byte) error
+	DeleteByHash(ctx context.Context, hash []byte) error
+	CreateImpersonationToken(ctx context.Context, userID, impersonatorID int, ttl time.Duration) (*Token, error)
+	Extend(ctx context.Context, hash []byte, ttl, maxLifetime time.Duration) (*Token, error)
+	DeleteImpersonationTokens(ctx context.Context, userID int) error
+	Touch(ctx context.Context, hash []byte, idleTimeout, interval time.Duration) error
+	LockUserTokens(ctx context.Context, tx *sql.Tx, userID int) error
+	Get(ctx context.Context, userID int, scope TokenScope) (*Token, error)
+	GetByHash(ctx context.Context, scope TokenScope, hash []byte) (*Token, error)
+	Lookup(ctx context.Context, hash []byte) (*Token, error)
+	IncrementAttempts(ctx context.Context, hash []byte) (int, error)
+	CountByScope(ctx context.Context) (map[TokenScope]int, error)
+	GetSessions(ctx context.Context, userID int, filters Filters) ([]*Session, Metadata, error)
+	GetSessionsAfter(ctx context.Context, userID int, filters CursorFilters) ([]*Session, Metadata, error)
+	GetExpiringSoon(ctx context.Context, within time.Duration) ([]*Token, error)
+}
+
+type SecurityQuestionStore interface {
+	Replace(ctx context.Context, userID int, questions []*SecurityQuestion) error
+	GetForUser(ctx context.Context, userID int) ([]*SecurityQuestion, error)
+}
+
+type UserEmailStore interface {
+	GetForUser(ctx context.Context, userID int) ([]*UserEmail, error)
+	Add(ctx context.Context, userID int, email string, ttl time.Duration) (*UserEmail, *Token, error)
+	Verify(ctx context.Context, tokenHash []byte) (*UserEmail, error)
+	Remove(ctx context.Context, userID int, email string) error
+	Promote(ctx context.Context, userID int, email string) (string, error)
+}
+
+type PermissionStore interface {
+	Add(ctx context.Context, userID int, permissions ...Permission) error
+	Get(ctx context.Context, userID int) (*Permissions, error)
+	ListAll(ctx context.Context) (Permissions, error)
+}
+
+var (
+	_ UserStore             = (*UserModel)(nil)
+	_ TokenStore            = (*TokenModel)(nil)
+	_ PermissionStore       = (*PermissionModel)(nil)
+	_ SecurityQuestionStore = (*SecurityQuestionModel)(nil)
+	_ UserEmailStore        = (*UserEmailModel)(nil)
+)
+
+// Querier runs the statements of the models, it is the connection pool or a transaction, see
+// Models.WithTx.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// inTx runs fn in a transaction on q and commits it when fn succeeds. When q already is a
+// transaction, fn joins it and committing is left to the owner of q.
+func inTx(ctx context.Context, q Querier, fn func(tx Querier) error) error {
+	db, ok := q.(*sql.DB)
+	if !ok {
+		return fn(q)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 type Models struct {
-	Users       UserModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	DB          *sql.DB
+	Users             UserStore
+	Permissions       PermissionStore
+	Tokens            TokenStore
+	Idempotency       IdempotencyModel
+	EmailLog          EmailLogModel
+	Audit             AuditModel
+	SecurityQuestions SecurityQuestionStore
+	EmailHistory      EmailHistoryModel
+	UserEmails        UserEmailStore
+	// Rules are what users are validated against before they are stored.
+	Rules *UserRules
+	DB    *sql.DB
+
+	maxActiveTokens int
 }
 
-func NewModels(db *sql.DB) *Models {
+// NewModels returns the models of the connection pool, maxActiveTokens is TokenModel.MaxActive.
+func NewModels(db *sql.DB, rules *UserRules, maxActiveTokens int) *Models {
+	models := newModels(db, maxActiveTokens)
+	models.Rules = rules
+	models.DB = db
+
+	return models
+}
+
+func newModels(q Querier, maxActiveTokens int) *Models {
 	return &Models{
-		Users:       UserModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		DB:          db,
+		Users:             &UserModel{DB: q},
+		Permissions:       &PermissionModel{DB: q},
+		Tokens:            &TokenModel{DB: q, MaxActive: maxActiveTokens},
+		Idempotency:       IdempotencyModel{DB: q},
+		EmailLog:          EmailLogModel{DB: q},
+		Audit:             AuditModel{DB: q},
+		SecurityQuestions: &SecurityQuestionModel{DB: q},
+		EmailHistory:      EmailHistoryModel{DB: q},
+		UserEmails:        &UserEmailModel{DB: q},
+		maxActiveTokens:   maxActiveTokens,
 	}
 }
+
+// WithTx returns the models running their statements in tx, so that the changes made through
+// several of them are committed or rolled back together. DB stays the connection pool.
+func (m *Models) WithTx(tx *sql.Tx) *Models {
+	models := newModels(tx, m.maxActiveTokens)
+	models.Rules = m.Rules
+	models.DB = m.DB
+
+	return models
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	_ "embed"
+	"strings"
+	"unicode"
+)
+
+//go:embed weak_passwords.txt
+var weakPasswordList string
+
+var weakPasswords = func() map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.Fields(weakPasswordList) {
+		words[word] = true
+	}
+	return words
+}()
+
+// sequences that are considered too easy to guess when four or more consecutive characters appear
+var passwordSequences = []string{
+	"abcdefghijklmnopqrstuvwxyz",
+	"0123456789",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+}
+
+const minSequenceLength = 4
+
+// IsWeakPassword reports whether the password is built around a common word or
+// an easily guessed pattern, even if it satisfies the character class rules.
+func IsWeakPassword(plain string) bool {
+	lower := strings.ToLower(plain)
+
+	// "Password1!" and "!!Welcome2024" both boil down to a dictionary word
+	base := strings.TrimFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if weakPasswords[base] {
+		return true
+	}
+
+	return hasRepeatedRun(lower) || hasSequence(lower)
+}
+
+func hasRepeatedRun(s string) bool {
+	run := 1
+	for i := 1; i < len(s); i++ {
+		if s[i] == s[i-1] {
+			run++
+			if run >= minSequenceLength {
+				return true
+			}
+		} else {
+			run = 1
+		}
+	}
+	return false
+}
+
+func hasSequence(s string) bool {
+	for i := 0; i+minSequenceLength <= len(s); i++ {
+		chunk := s[i : i+minSequenceLength]
+		reversed := reverse(chunk)
+		for _, seq := range passwordSequences {
+			if strings.Contains(seq, chunk) || strings.Contains(seq, reversed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
@@ -2,7 +2,6 @@ package db
 
 import (
 	"context"
-	"database/sql"
 	"time"
 
 	"github.com/lib/pq"
@@ -14,18 +13,29 @@ type Permissions []Permission
 const (
 	PermissionReadUser  Permission = "user:read"
 	PermissionWriteUser Permission = "user:write"
+	PermissionAdminUser Permission = "admin:user"
 )
 
+// Valid reports whether p is one of the permissions defined above.
+func (p Permission) Valid() bool {
+	switch p {
+	case PermissionReadUser, PermissionWriteUser, PermissionAdminUser:
+		return true
+	}
+	return false
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB Querier
 }
 
-func (m *PermissionModel) Add(userID int, permissions ...Permission) error {
+func (m *PermissionModel) Add(ctx context.Context, userID int, permissions ...Permission) error {
 	query := `
 		INSERT INTO user_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.name = ANY($2)`
+		SELECT $1, permissions.id FROM permissions WHERE permissions.name = ANY($2)
+		ON CONFLICT DO NOTHING`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "PermissionModel.Add", 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(permissions))
@@ -35,7 +45,7 @@ func (m *PermissionModel) Add(userID int, permissions ...Permission) error {
 	return nil
 }
 
-func (m *PermissionModel) Get(userID int) (*Permissions, error) {
+func (m *PermissionModel) Get(ctx context.Context, userID int) (*Permissions, error) {
 	query := `
 		SELECT permissions.name
 		FROM permissions
@@ -43,7 +53,7 @@ func (m *PermissionModel) Get(userID int) (*Permissions, error) {
 		INNER JOIN users ON user_permissions.user_id = users.id
 		WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "PermissionModel.Get", 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -52,7 +62,8 @@ func (m *PermissionModel) Get(userID int) (*Permissions, error) {
 	}
 	defer rows.Close()
 
-	var permissions Permissions
+	// an empty, non-nil slice so that callers can use the result without checking and it encodes as []
+	permissions := Permissions{}
 	for rows.Next() {
 		var permission Permission
 		err := rows.Scan(&permission)
@@ -69,7 +80,44 @@ func (m *PermissionModel) Get(userID int) (*Permissions, error) {
 	return &permissions, nil
 }
 
+// ListAll returns every permission defined in the permissions table, ordered by name.
+func (m *PermissionModel) ListAll(ctx context.Context) (Permissions, error) {
+	query := `
+		SELECT name
+		FROM permissions
+		ORDER BY name`
+
+	ctx, cancel := startSpan(ctx, "PermissionModel.ListAll", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission Permission
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
 func (p *Permissions) Include(permission Permission) bool {
+	if p == nil {
+		return false
+	}
+
 	for _, p := range *p {
 		if p == permission {
 			return true
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"regexp"
 	"testing"
 
@@ -16,11 +17,12 @@ func TestPermissionModel_Add(t *testing.T) {
 
 	query := regexp.QuoteMeta(`
 		INSERT INTO user_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.name = ANY($2)`)
+		SELECT $1, permissions.id FROM permissions WHERE permissions.name = ANY($2)
+		ON CONFLICT DO NOTHING`)
 
 	mock.ExpectExec(query).WithArgs(1, pq.Array([]string{"user:read", "user:write"})).WillReturnResult(sqlmock.NewResult(1, 0))
 
-	err := m.Add(1, PermissionReadUser, PermissionWriteUser)
+	err := m.Add(context.Background(), 1, PermissionReadUser, PermissionWriteUser)
 	if err != nil {
 		t.Errorf("failed to add permissions: %v", err)
 	}
@@ -49,7 +51,7 @@ func TestPermissionModel_Get(t *testing.T) {
 
 	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(rows)
 
-	permissions, err := m.Get(1)
+	permissions, err := m.Get(context.Background(), 1)
 	if err != nil {
 		t.Errorf("failed to get permissions: %v", err)
 	}
@@ -62,3 +64,103 @@ func TestPermissionModel_Get(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestPermissionModel_GetNone(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := PermissionModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT permissions.name
+		FROM permissions
+		INNER JOIN user_permissions ON permissions.id = user_permissions.permission_id
+		INNER JOIN users ON user_permissions.user_id = users.id
+		WHERE users.id = $1`)
+
+	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"name"}))
+
+	permissions, err := m.Get(context.Background(), 1)
+	if err != nil {
+		t.Errorf("failed to get permissions: %v", err)
+	}
+
+	if permissions == nil || *permissions == nil {
+		t.Fatalf("expected an empty, non-nil permissions slice")
+	}
+
+	if len(*permissions) != 0 {
+		t.Errorf("expected 0 permissions, got %d", len(*permissions))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPermissionModel_ListAll(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := PermissionModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT name
+		FROM permissions
+		ORDER BY name`)
+
+	rows := sqlmock.NewRows([]string{"name"}).
+		AddRow("admin:user").
+		AddRow("user:read").
+		AddRow("user:write")
+
+	mock.ExpectQuery(query).WillReturnRows(rows)
+
+	permissions, err := m.ListAll(context.Background())
+	if err != nil {
+		t.Errorf("failed to list permissions: %v", err)
+	}
+
+	if len(permissions) != 3 || permissions[0] != PermissionAdminUser {
+		t.Errorf("expected the 3 permissions ordered by name, got %v", permissions)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPermissions_Include(t *testing.T) {
+	permissions := &Permissions{PermissionReadUser}
+
+	if !permissions.Include(PermissionReadUser) {
+		t.Errorf("expected %q to be included", PermissionReadUser)
+	}
+
+	if permissions.Include(PermissionAdminUser) {
+		t.Errorf("expected %q not to be included", PermissionAdminUser)
+	}
+
+	if (&Permissions{}).Include(PermissionReadUser) {
+		t.Errorf("expected empty permissions to include nothing")
+	}
+
+	var nilPermissions *Permissions
+	if nilPermissions.Include(PermissionReadUser) {
+		t.Errorf("expected nil permissions to include nothing")
+	}
+}
+
+func TestPermission_Valid(t *testing.T) {
+	for _, p := range []Permission{PermissionReadUser, PermissionWriteUser, PermissionAdminUser} {
+		if !p.Valid() {
+			t.Errorf("expected %q to be valid", p)
+		}
+	}
+
+	for _, p := range []Permission{"", "user:delete", "USER:READ"} {
+		if p.Valid() {
+			t.Errorf("expected %q to be invalid", p)
+		}
+	}
+}
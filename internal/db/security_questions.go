@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sushihentaime/user-management-service/internal/validator"
+
+	"github.com/lib/pq"
+)
+
+const (
+	MinSecurityQuestions = 2
+	MaxSecurityQuestions = 5
+
+	maxSecurityQuestionLength = 200
+	// bcrypt only hashes the first 72 bytes
+	maxSecurityAnswerBytes = 72
+)
+
+// SecurityQuestion is an account recovery question. The answer is stored as a bcrypt hash of its
+// normalized form, so that case and spacing don't matter when it is given back.
+type SecurityQuestion struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"-"`
+	Question  string    `json:"question"`
+	Answer    Password  `json:"-"`
+	CreatedAt time.Time `json:"-"`
+}
+
+type SecurityQuestionModel struct {
+	DB Querier
+}
+
+func normalizeAnswer(answer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(answer), " "))
+}
+
+// SetAnswer hashes the answer, Answer.Plain keeps it as given.
+func (q *SecurityQuestion) SetAnswer(plain string) error {
+	err := q.Answer.Set(normalizeAnswer(plain))
+	if err != nil {
+		return err
+	}
+
+	q.Answer.Plain = &plain
+
+	return nil
+}
+
+func (q *SecurityQuestion) MatchAnswer(plain string) (bool, error) {
+	return q.Answer.Compare(normalizeAnswer(plain))
+}
+
+// ValidateSecurityQuestions checks a user's complete set of questions, their answers are taken
+// from Answer.Plain.
+func ValidateSecurityQuestions(v *validator.Validator, questions []*SecurityQuestion) {
+	v.Check(len(questions) >= MinSecurityQuestions && len(questions) <= MaxSecurityQuestions, "questions", fmt.Sprintf("must contain between %d and %d questions", MinSecurityQuestions, MaxSecurityQuestions))
+
+	seen := make(map[string]bool, len(questions))
+	for _, q := range questions {
+		question := strings.TrimSpace(q.Question)
+		v.Check(question != "", "questions", "must not contain an empty question")
+		v.Check(utf8.RuneCountInString(question) <= maxSecurityQuestionLength, "questions", fmt.Sprintf("must not contain a question longer than %d characters", maxSecurityQuestionLength))
+		v.Check(!seen[strings.ToLower(question)], "questions", "must not contain the same question twice")
+		seen[strings.ToLower(question)] = true
+
+		var answer string
+		if q.Answer.Plain != nil {
+			answer = normalizeAnswer(*q.Answer.Plain)
+		}
+		v.Check(answer != "", "questions", "must not contain an empty answer")
+		v.Check(len(answer) <= maxSecurityAnswerBytes, "questions", fmt.Sprintf("must not contain an answer longer than %d bytes", maxSecurityAnswerBytes))
+	}
+}
+
+// Replace stores the questions as the user's complete set, dropping any previous ones. The answers
+// must have been set with SetAnswer.
+func (m *SecurityQuestionModel) Replace(ctx context.Context, userID int, questions []*SecurityQuestion) error {
+	texts := make([]string, len(questions))
+	hashes := make([][]byte, len(questions))
+	for i, q := range questions {
+		texts[i] = strings.TrimSpace(q.Question)
+		hashes[i] = q.Answer.hash
+	}
+
+	query := `
+		WITH deleted AS (
+			DELETE FROM security_questions WHERE user_id = $1
+		)
+		INSERT INTO security_questions (user_id, question, answer_hash)
+		SELECT $1, q.question, q.answer_hash
+		FROM unnest($2::text[], $3::bytea[]) WITH ORDINALITY AS q(question, answer_hash, position)
+		ORDER BY q.position`
+
+	ctx, cancel := startSpan(ctx, "SecurityQuestionModel.Replace", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(texts), pq.Array(hashes))
+	return err
+}
+
+// GetForUser returns the user's questions in the order they were set, none when the user hasn't
+// set any.
+func (m *SecurityQuestionModel) GetForUser(ctx context.Context, userID int) ([]*SecurityQuestion, error) {
+	query := `
+		SELECT id, user_id, question, answer_hash, created_at
+		FROM security_questions
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := startSpan(ctx, "SecurityQuestionModel.GetForUser", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	questions := []*SecurityQuestion{}
+
+	for rows.Next() {
+		q := &SecurityQuestion{}
+
+		err := rows.Scan(&q.ID, &q.UserID, &q.Question, &q.Answer.hash, &q.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		questions = append(questions, q)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return questions, nil
+}
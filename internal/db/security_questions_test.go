@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sushihentaime/user-management-service/internal/validator"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityQuestion_MatchAnswer(t *testing.T) {
+	q := &SecurityQuestion{Question: "Name of your first pet?"}
+
+	err := q.SetAnswer("  Mister   Fluffy ")
+	assert.NoError(t, err)
+	assert.Equal(t, "  Mister   Fluffy ", *q.Answer.Plain)
+
+	for answer, want := range map[string]bool{
+		"mister fluffy":   true,
+		"MISTER FLUFFY":   true,
+		"Mister\tFluffy":  true,
+		"misterfluffy":    false,
+		"mister fluffy 2": false,
+	} {
+		match, err := q.MatchAnswer(answer)
+		assert.NoError(t, err)
+		assert.Equal(t, want, match, answer)
+	}
+}
+
+func TestValidateSecurityQuestions(t *testing.T) {
+	question := func(text, answer string) *SecurityQuestion {
+		return &SecurityQuestion{Question: text, Answer: Password{Plain: &answer}}
+	}
+
+	testCases := []struct {
+		name      string
+		questions []*SecurityQuestion
+		wantError string
+	}{
+		{
+			name:      "Valid",
+			questions: []*SecurityQuestion{question("First pet?", "Fluffy"), question("Birth city?", "Paris")},
+		},
+		{
+			name:      "Too few",
+			questions: []*SecurityQuestion{question("First pet?", "Fluffy")},
+			wantError: "must contain between 2 and 5 questions",
+		},
+		{
+			name:      "Empty question",
+			questions: []*SecurityQuestion{question("First pet?", "Fluffy"), question(" ", "Paris")},
+			wantError: "must not contain an empty question",
+		},
+		{
+			name:      "Repeated question",
+			questions: []*SecurityQuestion{question("First pet?", "Fluffy"), question("first pet? ", "Rex")},
+			wantError: "must not contain the same question twice",
+		},
+		{
+			name:      "Blank answer",
+			questions: []*SecurityQuestion{question("First pet?", "Fluffy"), question("Birth city?", "  ")},
+			wantError: "must not contain an empty answer",
+		},
+		{
+			name:      "Long answer",
+			questions: []*SecurityQuestion{question("First pet?", "Fluffy"), question("Birth city?", strings.Repeat("a", 73))},
+			wantError: "must not contain an answer longer than 72 bytes",
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateSecurityQuestions(v, tt.questions)
+
+			if tt.wantError == "" {
+				assert.True(t, v.Valid(), v.Errors)
+				return
+			}
+			assert.Equal(t, tt.wantError, v.Errors["questions"])
+		})
+	}
+}
+
+func TestSecurityQuestionModel_Replace(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := SecurityQuestionModel{DB: db}
+
+	q1 := &SecurityQuestion{Question: " First pet? ", Answer: Password{hash: []byte("hash1")}}
+	q2 := &SecurityQuestion{Question: "Birth city?", Answer: Password{hash: []byte("hash2")}}
+
+	query := regexp.QuoteMeta(`
+		WITH deleted AS (
+			DELETE FROM security_questions WHERE user_id = $1
+		)
+		INSERT INTO security_questions (user_id, question, answer_hash)
+		SELECT $1, q.question, q.answer_hash
+		FROM unnest($2::text[], $3::bytea[]) WITH ORDINALITY AS q(question, answer_hash, position)
+		ORDER BY q.position`)
+
+	mock.ExpectExec(query).
+		WithArgs(1, pq.Array([]string{"First pet?", "Birth city?"}), pq.Array([][]byte{[]byte("hash1"), []byte("hash2")})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err := m.Replace(context.Background(), 1, []*SecurityQuestion{q1, q2})
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSecurityQuestionModel_GetForUser(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := SecurityQuestionModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT id, user_id, question, answer_hash, created_at
+		FROM security_questions
+		WHERE user_id = $1
+		ORDER BY id`)
+
+	now := time.Now().Truncate(time.Second)
+
+	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "question", "answer_hash", "created_at"}).
+			AddRow(3, 1, "First pet?", []byte("hash1"), now).
+			AddRow(4, 1, "Birth city?", []byte("hash2"), now))
+
+	questions, err := m.GetForUser(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, questions, 2)
+	assert.Equal(t, int64(3), questions[0].ID)
+	assert.Equal(t, "Birth city?", questions[1].Question)
+	assert.Equal(t, []byte("hash2"), questions[1].Answer.hash)
+
+	mock.ExpectQuery(query).WithArgs(2).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "question", "answer_hash", "created_at"}))
+
+	questions, err = m.GetForUser(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.Empty(t, questions)
+	assert.NotNil(t, questions)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
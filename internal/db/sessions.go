@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+)
+
+// Session is an access token as shown to its owner. The token itself is never
+// exposed, the ID is the hex encoded hash.
+type Session struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// GetSessions returns a page of the user's unexpired access tokens, newest first.
+func (m *TokenModel) GetSessions(ctx context.Context, userID int, filters Filters) ([]*Session, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), hash, created_at, expiry
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE user_id = $1 AND scopes.name = $2 AND expiry > $3
+		ORDER BY created_at DESC, hash DESC
+		LIMIT $4 OFFSET $5`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.GetSessions", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, TokenScopeAccess, time.Now(), filters.Limit(), filters.Offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var hash []byte
+		session := &Session{}
+
+		err := rows.Scan(&totalRecords, &hash, &session.CreatedAt, &session.Expiry)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		session.ID = hex.EncodeToString(hash)
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return sessions, CalculateMetadata(totalRecords, filters.Limit(), filters.Offset()), nil
+}
+
+// GetSessionsAfter is the keyset paginated variant of GetSessions. The returned
+// Metadata carries the cursor of the next page, which is empty on the last page.
+func (m *TokenModel) GetSessionsAfter(ctx context.Context, userID int, filters CursorFilters) ([]*Session, Metadata, error) {
+	query := `
+		SELECT hash, created_at, expiry
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE user_id = $1 AND scopes.name = $2 AND expiry > $3`
+
+	// one extra row tells whether there is a next page
+	args := []any{userID, TokenScopeAccess, time.Now(), filters.PageSize + 1}
+
+	if filters.Cursor != "" {
+		cursor, err := DecodeCursor(filters.Cursor)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		hash, err := hex.DecodeString(cursor.ID)
+		if err != nil {
+			return nil, Metadata{}, ErrInvalidCursor
+		}
+
+		query += `
+		AND (created_at, hash) < ($5, $6)`
+		args = append(args, cursor.CreatedAt, hash)
+	}
+
+	query += `
+		ORDER BY created_at DESC, hash DESC
+		LIMIT $4`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.GetSessionsAfter", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var hash []byte
+		session := &Session{}
+
+		err := rows.Scan(&hash, &session.CreatedAt, &session.Expiry)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		session.ID = hex.EncodeToString(hash)
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := Metadata{PageSize: filters.PageSize}
+
+	if len(sessions) > filters.PageSize {
+		sessions = sessions[:filters.PageSize]
+
+		last := sessions[len(sessions)-1]
+		metadata.NextCursor = Cursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+
+	return sessions, metadata, nil
+}
+
+// MaxExpiringTokens caps the tokens returned by GetExpiringSoon.
+const MaxExpiringTokens = 1000
+
+// GetExpiringSoon returns the unexpired access tokens of every user expiring within the duration,
+// ordered by user and then expiry, at most MaxExpiringTokens of them. Impersonation tokens are
+// left out, they aren't sessions of the user.
+func (m *TokenModel) GetExpiringSoon(ctx context.Context, within time.Duration) ([]*Token, error) {
+	query := `
+		SELECT hash, user_id, expiry, created_at
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE scopes.name = $1 AND expiry > $2 AND expiry <= $3 AND impersonator_id IS NULL
+		ORDER BY user_id, expiry, hash
+		LIMIT $4`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.GetExpiringSoon", 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	rows, err := m.DB.QueryContext(ctx, query, TokenScopeAccess, now, now.Add(within), MaxExpiringTokens)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		token := &Token{Scope: TokenScopeAccess}
+
+		err := rows.Scan(&token.Hash, &token.UserID, &token.Expiry, &token.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenModel_GetSessions(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT count(*) OVER(), hash, created_at, expiry
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE user_id = $1 AND scopes.name = $2 AND expiry > $3
+		ORDER BY created_at DESC, hash DESC
+		LIMIT $4 OFFSET $5`)
+
+	now := time.Now().Truncate(time.Second)
+
+	rows := sqlmock.NewRows([]string{"count", "hash", "created_at", "expiry"}).
+		AddRow(3, []byte{0x03}, now, now.Add(AuthTokenTime)).
+		AddRow(3, []byte{0x02}, now.Add(-time.Minute), now.Add(AuthTokenTime))
+
+	mock.ExpectQuery(query).WithArgs(1, TokenScopeAccess, anyTime{}, 2, 0).WillReturnRows(rows)
+
+	sessions, metadata, err := m.GetSessions(context.Background(), 1, Filters{Page: 1, PageSize: 2})
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "03", sessions[0].ID)
+	assert.Equal(t, "02", sessions[1].ID)
+	assert.Equal(t, Metadata{CurrentPage: 1, PageSize: 2, FirstPage: 1, LastPage: 2, TotalRecords: 3}, metadata)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_GetSessionsAfter(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	firstPageQuery := regexp.QuoteMeta(`
+		SELECT hash, created_at, expiry
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE user_id = $1 AND scopes.name = $2 AND expiry > $3
+		ORDER BY created_at DESC, hash DESC
+		LIMIT $4`)
+
+	nextPageQuery := regexp.QuoteMeta(`
+		SELECT hash, created_at, expiry
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE user_id = $1 AND scopes.name = $2 AND expiry > $3
+		AND (created_at, hash) < ($5, $6)
+		ORDER BY created_at DESC, hash DESC
+		LIMIT $4`)
+
+	now := time.Now().Truncate(time.Second)
+	expiry := now.Add(AuthTokenTime)
+
+	// the first page fetches one extra row to detect that more pages follow
+	mock.ExpectQuery(firstPageQuery).WithArgs(1, TokenScopeAccess, anyTime{}, 3).WillReturnRows(
+		sqlmock.NewRows([]string{"hash", "created_at", "expiry"}).
+			AddRow([]byte{0x03}, now, expiry).
+			AddRow([]byte{0x02}, now, expiry).
+			AddRow([]byte{0x01}, now.Add(-time.Minute), expiry))
+
+	sessions, metadata, err := m.GetSessionsAfter(context.Background(), 1, CursorFilters{PageSize: 2})
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+	assert.NotEmpty(t, metadata.NextCursor)
+
+	cursor, err := DecodeCursor(metadata.NextCursor)
+	assert.NoError(t, err)
+	assert.Equal(t, "02", cursor.ID)
+	assert.True(t, now.Equal(cursor.CreatedAt))
+
+	mock.ExpectQuery(nextPageQuery).WithArgs(1, TokenScopeAccess, anyTime{}, 3, anyTime{}, []byte{0x02}).WillReturnRows(
+		sqlmock.NewRows([]string{"hash", "created_at", "expiry"}).
+			AddRow([]byte{0x01}, now.Add(-time.Minute), expiry))
+
+	sessions, metadata, err = m.GetSessionsAfter(context.Background(), 1, CursorFilters{Cursor: metadata.NextCursor, PageSize: 2})
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, hex.EncodeToString([]byte{0x01}), sessions[0].ID)
+	assert.Empty(t, metadata.NextCursor)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_GetSessionsAfterInvalidCursor(t *testing.T) {
+	db, _ := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	_, _, err := m.GetSessionsAfter(context.Background(), 1, CursorFilters{Cursor: Cursor{CreatedAt: time.Now(), ID: "zz"}.Encode(), PageSize: 2})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	_, _, err = m.GetSessionsAfter(context.Background(), 1, CursorFilters{Cursor: "%%%", PageSize: 2})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+// timeWithin matches a time argument within a second of want.
+type timeWithin struct {
+	want time.Time
+}
+
+func (a timeWithin) Match(v driver.Value) bool {
+	got, ok := v.(time.Time)
+	return ok && got.Sub(a.want).Abs() < time.Second
+}
+
+func TestTokenModel_GetExpiringSoon(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT hash, user_id, expiry, created_at
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE scopes.name = $1 AND expiry > $2 AND expiry <= $3 AND impersonator_id IS NULL
+		ORDER BY user_id, expiry, hash
+		LIMIT $4`)
+
+	now := time.Now()
+
+	rows := sqlmock.NewRows([]string{"hash", "user_id", "expiry", "created_at"}).
+		AddRow([]byte{1}, 1, now.Add(10*time.Minute), now.Add(-time.Hour)).
+		AddRow([]byte{2}, 2, now.Add(50*time.Minute), now.Add(-time.Hour))
+	mock.ExpectQuery(query).WithArgs(TokenScopeAccess, timeWithin{now}, timeWithin{now.Add(time.Hour)}, MaxExpiringTokens).WillReturnRows(rows)
+
+	tokens, err := m.GetExpiringSoon(context.Background(), time.Hour)
+	assert.NoError(t, err)
+	assert.Len(t, tokens, 2)
+	assert.Equal(t, 1, tokens[0].UserID)
+	assert.Equal(t, []byte{1}, tokens[0].Hash)
+	assert.Equal(t, TokenScopeAccess, tokens[0].Scope)
+	assert.Equal(t, 2, tokens[1].UserID)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
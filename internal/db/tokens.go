@@ -6,35 +6,77 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sushihentaime/user-management-service/internal/validator"
+
+	"github.com/lib/pq"
 )
 
 type TokenScope string
 
 const (
-	TokenScopeAccess     TokenScope    = "token:access"
-	TokenScopeRefresh    TokenScope    = "token:refresh"
-	TokenScopeActivation TokenScope    = "token:activate"
-	TokenScopeResetPwd   TokenScope    = "token:resetpwd"
-	AuthTokenTime        time.Duration = 24 * time.Hour
-	RefreshTokenTime     time.Duration = 7 * 24 * time.Hour
-	ActivationTokenTime  time.Duration = 3 * 24 * time.Hour
-	ResetPwdTokenTime    time.Duration = 1 * time.Hour
+	TokenScopeAccess      TokenScope    = "token:access"
+	TokenScopeRefresh     TokenScope    = "token:refresh"
+	TokenScopeActivation  TokenScope    = "token:activate"
+	TokenScopeResetPwd    TokenScope    = "token:resetpwd"
+	TokenScopeResetPwdOTP TokenScope    = "token:resetpwd-otp"
+	AuthTokenTime         time.Duration = 24 * time.Hour
+	RefreshTokenTime      time.Duration = 7 * 24 * time.Hour
+	ActivationTokenTime   time.Duration = 3 * 24 * time.Hour
+	ResetPwdTokenTime     time.Duration = 1 * time.Hour
+	ResetPwdOTPTime       time.Duration = 10 * time.Minute
+	// OTPLength is the number of digits of a one-time password.
+	OTPLength = 6
+	// MaxTokenAttempts is how many failed redemptions a token survives before it is revoked.
+	MaxTokenAttempts = 5
 )
 
+// Valid reports whether s is one of the token scopes defined above.
+func (s TokenScope) Valid() bool {
+	switch s {
+	case TokenScopeAccess, TokenScopeRefresh, TokenScopeActivation, TokenScopeResetPwd, TokenScopeResetPwdOTP:
+		return true
+	}
+	return false
+}
+
+// tokenRotationLock is the first key of the advisory lock taken by LockUserTokens, keeping it apart
+// from any other advisory locks held on the same user ID. The email address locks of the
+// user_emails triggers use 2.
+const tokenRotationLock = 1
+
+// ErrTokenIdle is returned by Touch for a token that went unused for longer than the idle timeout.
+var ErrTokenIdle = errors.New("token idle")
+
 type Token struct {
-	Plain     string               `json:"token"`
-	Hash      []byte               `json:"-"`
-	UserID    int                  `json:"-"`
-	Expiry    time.Time            `json:"expiry"`
-	Scope     TokenScope           `json:"-"`
-	Validator *validator.Validator `json:"-"`
+	Plain     string     `json:"token"`
+	Hash      []byte     `json:"-"`
+	UserID    int        `json:"-"`
+	Expiry    time.Time  `json:"expiry"`
+	CreatedAt time.Time  `json:"-"`
+	Scope     TokenScope `json:"-"`
+	// AuthenticatedAt is when the user logged in to start the session, carried over when the
+	// refresh token is rotated or the access token extended. Fresh authentication is judged by it.
+	AuthenticatedAt time.Time `json:"-"`
+	// ImpersonatorID is the admin an impersonation token was issued to, zero for other tokens.
+	ImpersonatorID int `json:"-"`
+	// RefreshHash is the hash of the refresh token an access token was issued with, see CreatePair.
+	RefreshHash []byte               `json:"-"`
+	Validator   *validator.Validator `json:"-"`
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB Querier
+	// MaxActive caps how many tokens of a scope a user may hold at once, the oldest being evicted
+	// when a new one is created. Zero means unlimited.
+	MaxActive int
 }
 
 func HashToken(token string) []byte {
@@ -49,11 +91,15 @@ func new(userID int, ttl time.Duration, scope TokenScope) (*Token, error) {
 		return nil, err
 	}
 
+	now := time.Now()
+
 	token := &Token{
-		Plain:  base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		Plain:           base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+		UserID:          userID,
+		Expiry:          now.Add(ttl),
+		CreatedAt:       now,
+		Scope:           scope,
+		AuthenticatedAt: now,
 	}
 
 	token.Hash = HashToken(token.Plain)
@@ -61,6 +107,42 @@ func new(userID int, ttl time.Duration, scope TokenScope) (*Token, error) {
 	return token, nil
 }
 
+// HashOTP hashes a one-time password of the user. An OTP has too few possible values to identify a
+// token on its own, so its hash is salted with the user ID and it is only ever looked up together
+// with the user.
+func HashOTP(userID int, otp string) []byte {
+	return HashToken(strconv.Itoa(userID) + ":" + otp)
+}
+
+func newOTP(userID int, ttl time.Duration, scope TokenScope) (*Token, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(math.Pow10(OTPLength))))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	token := &Token{
+		Plain:           fmt.Sprintf("%0*d", OTPLength, n),
+		UserID:          userID,
+		Expiry:          now.Add(ttl),
+		CreatedAt:       now,
+		Scope:           scope,
+		AuthenticatedAt: now,
+	}
+
+	token.Hash = HashOTP(userID, token.Plain)
+
+	return token, nil
+}
+
+func (t *Token) ValidateOTP() {
+	t.Validator = validator.New()
+
+	t.Validator.Check(t.Plain != "", "otp", "must be provided")
+	t.Validator.Check(len(t.Plain) == OTPLength && strings.Trim(t.Plain, "0123456789") == "", "otp", fmt.Sprintf("must be %d digits", OTPLength))
+}
+
 func (t *Token) ValidateToken() {
 	t.Validator = validator.New()
 
@@ -68,25 +150,39 @@ func (t *Token) ValidateToken() {
 	t.Validator.Check(len(t.Plain) == 26, "token", "must be 26 bytes long")
 }
 
-func (m *TokenModel) insert(token *Token) error {
+func (m *TokenModel) insert(ctx context.Context, token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope_id)
-		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4))`
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, impersonator_id, refresh_hash, authenticated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4), $5, NULLIF($6, 0), $7, $8)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "TokenModel.insert", 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	_, err := m.DB.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope, token.CreatedAt, token.ImpersonatorID, token.RefreshHash, token.AuthenticatedAt)
 	return err
 }
 
-func (m *TokenModel) CreateToken(userID int, ttl time.Duration, scope TokenScope) (*Token, error) {
+// create inserts the token and evicts the user's oldest tokens of its scope past MaxActive.
+func (m *TokenModel) create(ctx context.Context, token *Token) error {
+	err := m.insert(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if m.MaxActive > 0 {
+		return m.evictOldest(ctx, token.UserID, token.Scope, m.MaxActive, token.Hash)
+	}
+
+	return nil
+}
+
+func (m *TokenModel) CreateToken(ctx context.Context, userID int, ttl time.Duration, scope TokenScope) (*Token, error) {
 	token, err := new(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.insert(token)
+	err = m.create(ctx, token)
 	if err != nil {
 		return nil, err
 	}
@@ -94,32 +190,343 @@ func (m *TokenModel) CreateToken(userID int, ttl time.Duration, scope TokenScope
 	return token, nil
 }
 
-func (m *TokenModel) Delete(userID int, scope TokenScope) error {
+// CreatePair issues the access and refresh token of a session the user authenticated at
+// authenticatedAt, the time of the login and not of a rotation. The access token is tied to the
+// refresh token, so that DeletePair revokes both when the refresh token is rotated.
+func (m *TokenModel) CreatePair(ctx context.Context, userID int, authenticatedAt time.Time) (*Token, *Token, error) {
+	refreshToken, err := new(userID, RefreshTokenTime, TokenScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken.AuthenticatedAt = authenticatedAt
+
+	err = m.create(ctx, refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accessToken, err := new(userID, AuthTokenTime, TokenScopeAccess)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accessToken.RefreshHash = refreshToken.Hash
+	accessToken.AuthenticatedAt = authenticatedAt
+
+	err = m.create(ctx, accessToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// CreateOTP issues a numeric one-time password of OTPLength digits, the user's previous OTPs of the
+// scope are revoked.
+func (m *TokenModel) CreateOTP(ctx context.Context, userID int, ttl time.Duration, scope TokenScope) (*Token, error) {
+	token, err := newOTP(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Delete(ctx, userID, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// CreateImpersonationToken issues an access token for the user on behalf of the impersonating admin.
+// It isn't subject to MaxActive so that it never evicts one of the user's own sessions.
+func (m *TokenModel) CreateImpersonationToken(ctx context.Context, userID, impersonatorID int, ttl time.Duration) (*Token, error) {
+	token, err := new(userID, ttl, TokenScopeAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ImpersonatorID = impersonatorID
+
+	err = m.insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Extend replaces the unexpired access token with the hash by a new one valid for ttl, but never
+// past maxLifetime after the session began. The new token keeps the creation and authentication
+// time of the old one, so that an extended session neither counts as a fresh login nor outlives
+// maxLifetime. It returns
+// ErrNotFound when the old token is unknown, expired, already at the end of the session or an
+// impersonation token, which lasts no longer than it was issued for.
+func (m *TokenModel) Extend(ctx context.Context, hash []byte, ttl, maxLifetime time.Duration) (*Token, error) {
+	token, err := new(0, ttl, TokenScopeAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		WITH old AS (
+			DELETE FROM tokens
+			WHERE hash = $1
+			AND scope_id = (SELECT id FROM scopes WHERE name = $2)
+			AND expiry > NOW()
+			AND created_at > NOW() - make_interval(secs => $5)
+			AND impersonator_id IS NULL
+			RETURNING user_id, scope_id, created_at, refresh_hash, authenticated_at
+		)
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, refresh_hash, authenticated_at)
+		SELECT $3, user_id, LEAST($4, created_at + make_interval(secs => $5)), scope_id, created_at, refresh_hash, authenticated_at
+		FROM old
+		RETURNING user_id, expiry, created_at, authenticated_at`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.Extend", 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, hash, TokenScopeAccess, token.Hash, token.Expiry, maxLifetime.Seconds()).Scan(&token.UserID, &token.Expiry, &token.CreatedAt, &token.AuthenticatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+// DeleteImpersonationTokens revokes every impersonation token issued for the user.
+func (m *TokenModel) DeleteImpersonationTokens(ctx context.Context, userID int) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND impersonator_id IS NOT NULL`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.DeleteImpersonationTokens", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Touch records that the token is being used. It fails with ErrTokenIdle when idleTimeout is positive
+// and the token was last used longer ago than that. The write is skipped while the previous use is
+// more recent than interval, so that busy clients don't cause an update per request.
+func (m *TokenModel) Touch(ctx context.Context, hash []byte, idleTimeout, interval time.Duration) error {
+	var lastUsedAt time.Time
+
+	query := `
+		SELECT last_used_at
+		FROM tokens
+		WHERE hash = $1`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.Touch", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash).Scan(&lastUsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNotFound
+		default:
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	if idleTimeout > 0 && now.Sub(lastUsedAt) > idleTimeout {
+		return ErrTokenIdle
+	}
+
+	if now.Sub(lastUsedAt) < interval {
+		return nil
+	}
+
+	query = `
+		UPDATE tokens
+		SET last_used_at = $2
+		WHERE hash = $1`
+
+	_, err = m.DB.ExecContext(ctx, query, hash, now)
+	return err
+}
+
+// evictOldest deletes all but the newest keep tokens of the scope for the user. The token hashed
+// to newHash, the one just issued, counts towards keep but is never deleted, created_at only has
+// a precision of seconds and ties are broken by the insertion order.
+func (m *TokenModel) evictOldest(ctx context.Context, userID int, scope TokenScope, keep int, newHash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash
+			FROM tokens
+			WHERE user_id = $1 AND scope_id = (SELECT id FROM scopes WHERE name = $2) AND hash <> $3
+			ORDER BY created_at DESC, id DESC
+			OFFSET $4
+		)`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.evictOldest", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, scope, newHash, keep-1)
+	return err
+}
+
+func (m *TokenModel) Delete(ctx context.Context, userID int, scope TokenScope) error {
 	query := `
 		DELETE FROM tokens
 		WHERE user_id = $1 AND scope_id = (SELECT id FROM scopes WHERE name = $2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "TokenModel.Delete", 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, scope)
 	return err
 }
 
-// Get the token from the database regardless of it being expired or not
-func (m *TokenModel) Get(userID int, scope TokenScope) (*Token, error) {
+// DeleteAllForUser removes every token of the given scopes in a single statement,
+// so either all of the user's sessions are revoked or none are.
+func (m *TokenModel) DeleteAllForUser(ctx context.Context, userID int, scopes ...TokenScope) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope_id IN (SELECT id FROM scopes WHERE name = ANY($2))`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.DeleteAllForUser", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(scopes))
+	return err
+}
+
+// DeleteOtherSessions removes the user's access and refresh tokens except the access token with
+// the hash. Its refresh token is removed too, so the kept session can't be refreshed.
+func (m *TokenModel) DeleteOtherSessions(ctx context.Context, userID int, keep []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND hash <> $2
+		AND scope_id IN (SELECT id FROM scopes WHERE name = ANY($3))`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.DeleteOtherSessions", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, keep, pq.Array([]TokenScope{TokenScopeAccess, TokenScopeRefresh}))
+	return err
+}
+
+// DeletePair revokes the refresh token with the hash and the access tokens issued with it.
+func (m *TokenModel) DeletePair(ctx context.Context, refreshHash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 OR refresh_hash = $1`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.DeletePair", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, refreshHash)
+	return err
+}
+
+func (m *TokenModel) DeleteByHash(ctx context.Context, hash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.DeleteByHash", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash)
+	return err
+}
+
+// LockUserTokens takes a transaction scoped advisory lock on the user's tokens, blocking until any
+// other transaction holding it commits or rolls back.
+func (m *TokenModel) LockUserTokens(ctx context.Context, tx *sql.Tx, userID int) error {
+	query := `SELECT pg_advisory_xact_lock($1, $2)`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.LockUserTokens", 3*time.Second)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, query, tokenRotationLock, userID)
+	return err
+}
+
+// Get the most recent token of the scope from the database regardless of it being expired or not
+func (m *TokenModel) Get(ctx context.Context, userID int, scope TokenScope) (*Token, error) {
+	token := &Token{}
+
+	query := `
+		SELECT hash, user_id, expiry, scopes.name, created_at
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE user_id = $1 AND scopes.name = $2
+		ORDER BY expiry DESC
+		LIMIT 1`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.Get", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, scope).Scan(&token.Hash, &token.UserID, &token.Expiry, &token.Scope, &token.CreatedAt)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+// GetByHash returns the token of the scope matching the hash regardless of it being expired or not
+func (m *TokenModel) GetByHash(ctx context.Context, scope TokenScope, hash []byte) (*Token, error) {
+	token := &Token{}
+
+	query := `
+		SELECT hash, user_id, expiry, scopes.name, created_at, authenticated_at
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE hash = $1 AND scopes.name = $2`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.GetByHash", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash, scope).Scan(&token.Hash, &token.UserID, &token.Expiry, &token.Scope, &token.CreatedAt, &token.AuthenticatedAt)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+// Lookup returns the token matching the hash whatever its scope and expiry.
+func (m *TokenModel) Lookup(ctx context.Context, hash []byte) (*Token, error) {
 	token := &Token{}
 
 	query := `
-		SELECT hash, user_id, expiry, scopes.name
+		SELECT hash, user_id, expiry, scopes.name, created_at
 		FROM tokens
 		INNER JOIN scopes ON tokens.scope_id = scopes.id
-		WHERE user_id = $1 AND scopes.name = $2`
+		WHERE hash = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "TokenModel.Lookup", 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, userID, scope).Scan(&token.Hash, &token.UserID, &token.Expiry, &token.Scope)
+	err := m.DB.QueryRowContext(ctx, query, hash).Scan(&token.Hash, &token.UserID, &token.Expiry, &token.Scope, &token.CreatedAt)
 	if err != nil {
 		switch {
 		case err == sql.ErrNoRows:
@@ -131,3 +538,67 @@ func (m *TokenModel) Get(userID int, scope TokenScope) (*Token, error) {
 
 	return token, nil
 }
+
+// IncrementAttempts records a failed redemption of the token and returns the number of failures so far.
+func (m *TokenModel) IncrementAttempts(ctx context.Context, hash []byte) (int, error) {
+	var attempts int
+
+	query := `
+		UPDATE tokens
+		SET attempts = attempts + 1
+		WHERE hash = $1
+		RETURNING attempts`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.IncrementAttempts", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash).Scan(&attempts)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return 0, ErrNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return attempts, nil
+}
+
+// CountByScope returns the number of unexpired tokens of every scope, scopes without any count zero.
+func (m *TokenModel) CountByScope(ctx context.Context) (map[TokenScope]int, error) {
+	query := `
+		SELECT s.name, COUNT(t.hash)
+		FROM scopes s
+		LEFT JOIN tokens t ON t.scope_id = s.id AND t.expiry > $1
+		GROUP BY s.name`
+
+	ctx, cancel := startSpan(ctx, "TokenModel.CountByScope", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[TokenScope]int{}
+	for rows.Next() {
+		var (
+			scope TokenScope
+			count int
+		)
+
+		err := rows.Scan(&scope, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[scope] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
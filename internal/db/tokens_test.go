@@ -1,6 +1,8 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"regexp"
@@ -8,6 +10,7 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -48,6 +51,69 @@ func TestNewToken(t *testing.T) {
 	if token.Expiry.Before(time.Now().Add(23 * time.Hour)) {
 		t.Error("Token should expire in 24 hours")
 	}
+
+	assert.WithinDuration(t, time.Now(), token.CreatedAt, time.Second)
+	assert.Equal(t, AuthTokenTime, token.Expiry.Sub(token.CreatedAt))
+}
+
+func TestNewOTP(t *testing.T) {
+	token, err := newOTP(1, ResetPwdOTPTime, TokenScopeResetPwdOTP)
+	assert.NoError(t, err)
+
+	assert.Regexp(t, `^[0-9]{6}$`, token.Plain)
+	assert.Equal(t, HashOTP(1, token.Plain), token.Hash)
+	assert.Equal(t, TokenScopeResetPwdOTP, token.Scope)
+	assert.Equal(t, ResetPwdOTPTime, token.Expiry.Sub(token.CreatedAt))
+
+	token.ValidateOTP()
+	assert.True(t, token.Validator.Valid())
+}
+
+func TestHashOTP(t *testing.T) {
+	assert.Equal(t, HashOTP(1, "123456"), HashOTP(1, "123456"))
+	assert.NotEqual(t, HashOTP(1, "123456"), HashOTP(2, "123456"), "the same OTP of two users must not collide")
+	assert.NotEqual(t, HashToken("123456"), HashOTP(1, "123456"))
+}
+
+func TestToken_ValidateOTP(t *testing.T) {
+	for otp, want := range map[string]string{
+		"012345":  "",
+		"":        "must be provided",
+		"12345":   "must be 6 digits",
+		"1234567": "must be 6 digits",
+		"12a456":  "must be 6 digits",
+		" 12345":  "must be 6 digits",
+	} {
+		token := &Token{Plain: otp}
+		token.ValidateOTP()
+		assert.Equal(t, want, token.Validator.Errors["otp"], otp)
+	}
+}
+
+func TestTokenModel_CreateOTP(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db, MaxActive: 2}
+
+	deleteQuery := regexp.QuoteMeta(`
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope_id = (SELECT id FROM scopes WHERE name = $2)`)
+
+	insertQuery := regexp.QuoteMeta(`
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, impersonator_id, refresh_hash, authenticated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4), $5, NULLIF($6, 0), $7, $8)`)
+
+	mock.ExpectExec(deleteQuery).WithArgs(1, TokenScopeResetPwdOTP).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertQuery).WithArgs(sqlmock.AnyArg(), 1, anyTime{}, TokenScopeResetPwdOTP, anyTime{}, 0, []byte(nil), anyTime{}).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	token, err := m.CreateOTP(context.Background(), 1, ResetPwdOTPTime, TokenScopeResetPwdOTP)
+	assert.NoError(t, err)
+	assert.Len(t, token.Plain, OTPLength)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
 }
 
 func TestTokenModel_Insert(t *testing.T) {
@@ -62,12 +128,12 @@ func TestTokenModel_Insert(t *testing.T) {
 	}
 
 	query := regexp.QuoteMeta(`
-		INSERT INTO tokens (hash, user_id, expiry, scope_id)
-		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4))`)
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, impersonator_id, refresh_hash, authenticated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4), $5, NULLIF($6, 0), $7, $8)`)
 
-	mock.ExpectExec(query).WithArgs(token.Hash, token.UserID, token.Expiry, token.Scope).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(query).WithArgs(token.Hash, token.UserID, token.Expiry, token.Scope, token.CreatedAt, 0, token.RefreshHash, token.AuthenticatedAt).WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err = m.insert(token)
+	err = m.insert(context.Background(), token)
 	if err != nil {
 		t.Error(err)
 	}
@@ -89,7 +155,255 @@ func TestTokenModel_Delete(t *testing.T) {
 
 	mock.ExpectExec(query).WithArgs(1, TokenScopeAccess).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	err := m.Delete(1, TokenScopeAccess)
+	err := m.Delete(context.Background(), 1, TokenScopeAccess)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_DeleteAllForUser(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope_id IN (SELECT id FROM scopes WHERE name = ANY($2))`)
+
+	mock.ExpectExec(query).WithArgs(1, pq.Array([]TokenScope{TokenScopeAccess, TokenScopeRefresh})).WillReturnResult(sqlmock.NewResult(0, 4))
+
+	err := m.DeleteAllForUser(context.Background(), 1, TokenScopeAccess, TokenScopeRefresh)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_DeleteOtherSessions(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	keep := HashToken("myToken")
+
+	query := regexp.QuoteMeta(`
+		DELETE FROM tokens
+		WHERE user_id = $1 AND hash <> $2
+		AND scope_id IN (SELECT id FROM scopes WHERE name = ANY($3))`)
+
+	mock.ExpectExec(query).WithArgs(1, keep, pq.Array([]TokenScope{TokenScopeAccess, TokenScopeRefresh})).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	err := m.DeleteOtherSessions(context.Background(), 1, keep)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_DeleteByHash(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	hash := HashToken("myToken")
+
+	query := regexp.QuoteMeta(`
+		DELETE FROM tokens
+		WHERE hash = $1`)
+
+	mock.ExpectExec(query).WithArgs(hash).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := m.DeleteByHash(context.Background(), hash)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_LockUserTokens(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_xact_lock($1, $2)`)).WithArgs(tokenRotationLock, 1).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.LockUserTokens(context.Background(), tx, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Error(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_GetByHash(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	hash := HashToken("myToken")
+	expiry := time.Now().Add(AuthTokenTime)
+
+	query := regexp.QuoteMeta(`
+		SELECT hash, user_id, expiry, scopes.name, created_at, authenticated_at
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE hash = $1 AND scopes.name = $2`)
+
+	createdAt := time.Now()
+	authenticatedAt := createdAt.Add(-time.Hour)
+
+	rows := sqlmock.NewRows([]string{"hash", "user_id", "expiry", "name", "created_at", "authenticated_at"}).AddRow(hash, 1, expiry, TokenScopeAccess, createdAt, authenticatedAt)
+	mock.ExpectQuery(query).WithArgs(hash, TokenScopeAccess).WillReturnRows(rows)
+
+	token, err := m.GetByHash(context.Background(), TokenScopeAccess, hash)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, 1, token.UserID)
+	assert.Equal(t, TokenScopeAccess, token.Scope)
+	assert.Equal(t, expiry, token.Expiry)
+	assert.Equal(t, createdAt, token.CreatedAt)
+	assert.Equal(t, authenticatedAt, token.AuthenticatedAt)
+
+	mock.ExpectQuery(query).WithArgs(hash, TokenScopeRefresh).WillReturnError(sql.ErrNoRows)
+
+	_, err = m.GetByHash(context.Background(), TokenScopeRefresh, hash)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_IncrementAttempts(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	hash := HashToken("myToken")
+
+	query := regexp.QuoteMeta(`
+		UPDATE tokens
+		SET attempts = attempts + 1
+		WHERE hash = $1
+		RETURNING attempts`)
+
+	mock.ExpectQuery(query).WithArgs(hash).WillReturnRows(sqlmock.NewRows([]string{"attempts"}).AddRow(3))
+
+	attempts, err := m.IncrementAttempts(context.Background(), hash)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	mock.ExpectQuery(query).WithArgs(hash).WillReturnError(sql.ErrNoRows)
+
+	_, err = m.IncrementAttempts(context.Background(), hash)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_CreateTokenEvictsOldest(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db, MaxActive: 2}
+
+	insertQuery := regexp.QuoteMeta(`
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, impersonator_id, refresh_hash, authenticated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4), $5, NULLIF($6, 0), $7, $8)`)
+
+	evictQuery := regexp.QuoteMeta(`
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash
+			FROM tokens
+			WHERE user_id = $1 AND scope_id = (SELECT id FROM scopes WHERE name = $2) AND hash <> $3
+			ORDER BY created_at DESC, id DESC
+			OFFSET $4
+		)`)
+
+	mock.ExpectExec(insertQuery).WithArgs(sqlmock.AnyArg(), 1, anyTime{}, TokenScopeResetPwd, anyTime{}, 0, []byte(nil), anyTime{}).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(evictQuery).WithArgs(1, TokenScopeResetPwd, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	token, err := m.CreateToken(context.Background(), 1, ResetPwdTokenTime, TokenScopeResetPwd)
+	assert.NoError(t, err)
+	assert.NotNil(t, token)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_CreateTokenUnlimited(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	insertQuery := regexp.QuoteMeta(`
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, impersonator_id, refresh_hash, authenticated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4), $5, NULLIF($6, 0), $7, $8)`)
+
+	mock.ExpectExec(insertQuery).WithArgs(sqlmock.AnyArg(), 1, anyTime{}, TokenScopeAccess, anyTime{}, 0, []byte(nil), anyTime{}).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	_, err := m.CreateToken(context.Background(), 1, AuthTokenTime, TokenScopeAccess)
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_DeletePair(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	hash := HashToken("myToken")
+
+	query := regexp.QuoteMeta(`
+		DELETE FROM tokens
+		WHERE hash = $1 OR refresh_hash = $1`)
+
+	mock.ExpectExec(query).WithArgs(hash).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err := m.DeletePair(context.Background(), hash)
 	if err != nil {
 		t.Error(err)
 	}
@@ -98,3 +412,242 @@ func TestTokenModel_Delete(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestTokenModel_CreatePair(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	insertQuery := regexp.QuoteMeta(`
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, impersonator_id, refresh_hash, authenticated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4), $5, NULLIF($6, 0), $7, $8)`)
+
+	// a rotated pair keeps the time the user logged in
+	authenticatedAt := time.Now().Add(-time.Hour)
+
+	mock.ExpectExec(insertQuery).WithArgs(sqlmock.AnyArg(), 1, anyTime{}, TokenScopeRefresh, anyTime{}, 0, []byte(nil), authenticatedAt).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertQuery).WithArgs(sqlmock.AnyArg(), 1, anyTime{}, TokenScopeAccess, anyTime{}, 0, sqlmock.AnyArg(), authenticatedAt).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	accessToken, refreshToken, err := m.CreatePair(context.Background(), 1, authenticatedAt)
+	assert.NoError(t, err)
+	assert.Equal(t, authenticatedAt, accessToken.AuthenticatedAt)
+	assert.Equal(t, authenticatedAt, refreshToken.AuthenticatedAt)
+	assert.Equal(t, TokenScopeAccess, accessToken.Scope)
+	assert.Equal(t, TokenScopeRefresh, refreshToken.Scope)
+	assert.Equal(t, refreshToken.Hash, accessToken.RefreshHash)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_CreateImpersonationToken(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db, MaxActive: 1}
+
+	insertQuery := regexp.QuoteMeta(`
+		INSERT INTO tokens (hash, user_id, expiry, scope_id, created_at, impersonator_id, refresh_hash, authenticated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM scopes WHERE name = $4), $5, NULLIF($6, 0), $7, $8)`)
+
+	// no eviction follows, the user's own sessions are left alone
+	mock.ExpectExec(insertQuery).WithArgs(sqlmock.AnyArg(), 1, anyTime{}, TokenScopeAccess, anyTime{}, 2, []byte(nil), anyTime{}).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	token, err := m.CreateImpersonationToken(context.Background(), 1, 2, 15*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, token.ImpersonatorID)
+	assert.Equal(t, TokenScopeAccess, token.Scope)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_DeleteImpersonationTokens(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		DELETE FROM tokens
+		WHERE user_id = $1 AND impersonator_id IS NOT NULL`)
+
+	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := m.DeleteImpersonationTokens(context.Background(), 1)
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_Extend(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	query := `WITH old AS \(\s+DELETE FROM tokens[\s\S]+AND impersonator_id IS NULL[\s\S]+INSERT INTO tokens`
+	hash := HashToken("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	createdAt := time.Now().Add(-time.Hour)
+
+	t.Run("Extended", func(t *testing.T) {
+		expiry := time.Now().Add(AuthTokenTime)
+		mock.ExpectQuery(query).WithArgs(hash, TokenScopeAccess, sqlmock.AnyArg(), anyTime{}, (48 * time.Hour).Seconds()).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "expiry", "created_at", "authenticated_at"}).AddRow(1, expiry, createdAt, createdAt))
+
+		token, err := m.Extend(context.Background(), hash, AuthTokenTime, 48*time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, token.UserID)
+		assert.Equal(t, expiry, token.Expiry)
+		assert.Equal(t, createdAt, token.CreatedAt, "the session start must be kept")
+		assert.Equal(t, createdAt, token.AuthenticatedAt, "the login time must be kept")
+		assert.Equal(t, HashToken(token.Plain), token.Hash)
+		assert.NotEqual(t, hash, token.Hash)
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		mock.ExpectQuery(query).WillReturnError(sql.ErrNoRows)
+
+		_, err := m.Extend(context.Background(), hash, AuthTokenTime, 48*time.Hour)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_Touch(t *testing.T) {
+	selectQuery := regexp.QuoteMeta(`
+		SELECT last_used_at
+		FROM tokens
+		WHERE hash = $1`)
+
+	updateQuery := regexp.QuoteMeta(`
+		UPDATE tokens
+		SET last_used_at = $2
+		WHERE hash = $1`)
+
+	hash := HashToken("myToken")
+
+	testCases := []struct {
+		name       string
+		lastUsed   time.Duration
+		wantUpdate bool
+		wantErr    error
+	}{
+		{name: "Recently used", lastUsed: 30 * time.Second},
+		{name: "Used before the interval", lastUsed: 5 * time.Minute, wantUpdate: true},
+		{name: "Idle", lastUsed: 2 * time.Hour, wantErr: ErrTokenIdle},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := MockDB()
+			defer db.Close()
+
+			m := TokenModel{DB: db}
+
+			mock.ExpectQuery(selectQuery).WithArgs(hash).WillReturnRows(sqlmock.NewRows([]string{"last_used_at"}).AddRow(time.Now().Add(-tt.lastUsed)))
+			if tt.wantUpdate {
+				mock.ExpectExec(updateQuery).WithArgs(hash, anyTime{}).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			err := m.Touch(context.Background(), hash, time.Hour, time.Minute)
+			assert.Equal(t, tt.wantErr, err)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	t.Run("Idle timeout disabled", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := TokenModel{DB: db}
+
+		mock.ExpectQuery(selectQuery).WithArgs(hash).WillReturnRows(sqlmock.NewRows([]string{"last_used_at"}).AddRow(time.Now().Add(-48 * time.Hour)))
+		mock.ExpectExec(updateQuery).WithArgs(hash, anyTime{}).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := m.Touch(context.Background(), hash, 0, time.Minute)
+		assert.NoError(t, err)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestTokenScope_Valid(t *testing.T) {
+	for _, scope := range []TokenScope{TokenScopeAccess, TokenScopeRefresh, TokenScopeActivation, TokenScopeResetPwd, TokenScopeResetPwdOTP} {
+		assert.True(t, scope.Valid(), scope)
+	}
+
+	for _, scope := range []TokenScope{"", "token:unknown", "resetpwd"} {
+		assert.False(t, scope.Valid(), scope)
+	}
+}
+
+func TestTokenModel_Lookup(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	hash := HashToken("myToken")
+	expiry := time.Now().Add(AuthTokenTime)
+
+	query := regexp.QuoteMeta(`
+		SELECT hash, user_id, expiry, scopes.name, created_at
+		FROM tokens
+		INNER JOIN scopes ON tokens.scope_id = scopes.id
+		WHERE hash = $1`)
+
+	mock.ExpectQuery(query).WithArgs(hash).WillReturnRows(
+		sqlmock.NewRows([]string{"hash", "user_id", "expiry", "name", "created_at"}).AddRow(hash, 1, expiry, TokenScopeAccess, time.Now()))
+
+	token, err := m.Lookup(context.Background(), hash)
+	assert.NoError(t, err)
+	assert.Equal(t, TokenScopeAccess, token.Scope)
+	assert.Equal(t, 1, token.UserID)
+
+	mock.ExpectQuery(query).WithArgs(hash).WillReturnError(sql.ErrNoRows)
+
+	_, err = m.Lookup(context.Background(), hash)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenModel_CountByScope(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := TokenModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT s.name, COUNT(t.hash)
+		FROM scopes s
+		LEFT JOIN tokens t ON t.scope_id = s.id AND t.expiry > $1
+		GROUP BY s.name`)
+
+	mock.ExpectQuery(query).WithArgs(anyTime{}).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "count"}).AddRow(TokenScopeAccess, 3).AddRow(TokenScopeRefresh, 0))
+
+	counts, err := m.CountByScope(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[TokenScope]int{TokenScopeAccess: 3, TokenScopeRefresh: 0}, counts)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
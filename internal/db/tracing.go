@@ -0,0 +1,27 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records a span for every model method as a child of the span in the context it is called
+// with. It uses the global tracer provider, which drops the spans until tracing is enabled.
+var tracer = otel.Tracer("github.com/sushihentaime/user-management-service/internal/db")
+
+// startSpan starts the span of the model method name and derives the context of its queries from
+// ctx. They keep its values, the span among them, but not its cancellation or deadline, a query is
+// only bounded by timeout. The returned function ends the span.
+func startSpan(ctx context.Context, name string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, span := tracer.Start(context.WithoutCancel(ctx), name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	return ctx, func() {
+		cancel()
+		span.End()
+	}
+}
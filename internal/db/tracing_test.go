@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStartSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	// tracer only follows the first provider set globally, no other test may set one
+	otel.SetTracerProvider(tp)
+
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserEmailModel{DB: db}
+
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM user_emails`)).WithArgs(1, "second@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	// the span outlives the cancellation of the request context
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	assert.NoError(t, m.Remove(cancelled, 1, "second@example.com"))
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 2) {
+		span := spans[0]
+		assert.Equal(t, "UserEmailModel.Remove", span.Name)
+		assert.Equal(t, trace.SpanKindClient, span.SpanKind)
+		assert.Contains(t, span.Attributes, semconv.DBSystemPostgreSQL)
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrEmailNotVerified is returned by Promote for a secondary email address that wasn't verified.
+var ErrEmailNotVerified = errors.New("email not verified")
+
+// UserEmail is a secondary email address of a user. The primary one is the email of the user, the
+// only one used to log in, reset the password and send notifications to.
+type UserEmail struct {
+	ID        int64     `json:"-"`
+	UserID    int       `json:"-"`
+	Email     string    `json:"email"`
+	Verified  bool      `json:"verified"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type UserEmailModel struct {
+	DB Querier
+}
+
+// GetForUser returns the secondary email addresses of the user, oldest first.
+func (m *UserEmailModel) GetForUser(ctx context.Context, userID int) ([]*UserEmail, error) {
+	query := `
+		SELECT id, user_id, email, verified, created_at
+		FROM user_emails
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := startSpan(ctx, "UserEmailModel.GetForUser", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*UserEmail{}
+
+	for rows.Next() {
+		email := &UserEmail{}
+
+		err := rows.Scan(&email.ID, &email.UserID, &email.Email, &email.Verified, &email.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// Add adds email as an unverified secondary address of the user and returns the token verifying
+// it, valid for ttl. Adding an address the user is still verifying replaces its token. Other users'
+// addresses only conflict once verified, see Verify, so that adding one doesn't tell whether it is
+// registered. It returns ErrDuplicateEmail when the user already has the address.
+func (m *UserEmailModel) Add(ctx context.Context, userID int, email string, ttl time.Duration) (*UserEmail, *Token, error) {
+	token, err := new(userID, ttl, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := startSpan(ctx, "UserEmailModel.Add", 3*time.Second)
+	defer cancel()
+
+	userEmail := &UserEmail{UserID: userID, Email: email}
+
+	err = inTx(ctx, m.DB, func(tx Querier) error {
+		var primary bool
+
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND email = $2)`, userID, email).Scan(&primary)
+		if err != nil {
+			return err
+		}
+
+		if primary {
+			return ErrDuplicateEmail
+		}
+
+		query := `
+			INSERT INTO user_emails (user_id, email, token_hash, token_expiry)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, email) DO UPDATE
+			SET token_hash = EXCLUDED.token_hash, token_expiry = EXCLUDED.token_expiry
+			WHERE NOT user_emails.verified
+			RETURNING id, created_at`
+
+		err = tx.QueryRowContext(ctx, query, userID, email, token.Hash, token.Expiry).Scan(&userEmail.ID, &userEmail.CreatedAt)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrDuplicateEmail
+			default:
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return userEmail, token, nil
+}
+
+// Verify marks the secondary address the unexpired token was issued for as verified. It returns
+// ErrNotFound when the token doesn't match any and ErrDuplicateEmail when another user has the
+// address, as their primary email or as a verified secondary one.
+func (m *UserEmailModel) Verify(ctx context.Context, tokenHash []byte) (*UserEmail, error) {
+	query := `
+		UPDATE user_emails
+		SET verified = TRUE, token_hash = NULL, token_expiry = NULL
+		WHERE token_hash = $1 AND token_expiry > NOW()
+		RETURNING id, user_id, email, verified, created_at`
+
+	ctx, cancel := startSpan(ctx, "UserEmailModel.Verify", 3*time.Second)
+	defer cancel()
+
+	email := &UserEmail{}
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash).Scan(&email.ID, &email.UserID, &email.Email, &email.Verified, &email.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		case err.Error() == "pq: duplicate key value violates unique constraint \"user_emails_verified_email_key\"":
+			return nil, ErrDuplicateEmail
+		default:
+			return nil, err
+		}
+	}
+
+	return email, nil
+}
+
+// Remove removes a secondary address of the user, it returns ErrNotFound when the user has no such
+// secondary address.
+func (m *UserEmailModel) Remove(ctx context.Context, userID int, email string) error {
+	query := `
+		DELETE FROM user_emails
+		WHERE user_id = $1 AND email = $2`
+
+	ctx, cancel := startSpan(ctx, "UserEmailModel.Remove", 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, email)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Promote makes the verified secondary address email the primary email of the user, the previous
+// primary email becoming a verified secondary one, and returns the previous primary email. It
+// returns ErrNotFound when the user has no such secondary address and ErrEmailNotVerified when it
+// wasn't verified.
+func (m *UserEmailModel) Promote(ctx context.Context, userID int, email string) (string, error) {
+	ctx, cancel := startSpan(ctx, "UserEmailModel.Promote", 5*time.Second)
+	defer cancel()
+
+	var previous string
+
+	err := inTx(ctx, m.DB, func(tx Querier) error {
+		var verified bool
+
+		err := tx.QueryRowContext(ctx, `SELECT verified FROM user_emails WHERE user_id = $1 AND email = $2 FOR UPDATE`, userID, email).Scan(&verified)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNotFound
+			default:
+				return err
+			}
+		}
+
+		if !verified {
+			return ErrEmailNotVerified
+		}
+
+		err = tx.QueryRowContext(ctx, `SELECT email FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&previous)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNotFound
+			default:
+				return err
+			}
+		}
+
+		// the secondary row goes first and the previous primary email comes back last, the addresses
+		// must never be in both tables at once
+		queries := []struct {
+			query string
+			args  []any
+		}{
+			{`DELETE FROM user_emails WHERE user_id = $1 AND email = $2`, []any{userID, email}},
+			{`UPDATE users SET email = $2, version = version + 1 WHERE id = $1`, []any{userID, email}},
+			{`INSERT INTO user_emails (user_id, email, verified) VALUES ($1, $2, TRUE)`, []any{userID, previous}},
+		}
+
+		for _, q := range queries {
+			_, err = tx.ExecContext(ctx, q.query, q.args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return previous, nil
+}
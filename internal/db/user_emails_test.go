@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserEmailModel_Add(t *testing.T) {
+	primaryQuery := regexp.QuoteMeta(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND email = $2)`)
+	insertQuery := regexp.QuoteMeta(`
+			INSERT INTO user_emails (user_id, email, token_hash, token_expiry)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, email) DO UPDATE
+			SET token_hash = EXCLUDED.token_hash, token_expiry = EXCLUDED.token_expiry
+			WHERE NOT user_emails.verified
+			RETURNING id, created_at`)
+
+	t.Run("Added", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserEmailModel{DB: db}
+
+		now := time.Now().Truncate(time.Second)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(primaryQuery).WithArgs(1, "second@example.com").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery(insertQuery).WithArgs(1, "second@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(4, now))
+		mock.ExpectCommit()
+
+		email, token, err := m.Add(context.Background(), 1, "second@example.com", time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), email.ID)
+		assert.Equal(t, "second@example.com", email.Email)
+		assert.False(t, email.Verified)
+		assert.Len(t, token.Plain, 26)
+		assert.Equal(t, HashToken(token.Plain), token.Hash)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Second)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Primary email of the user", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserEmailModel{DB: db}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(primaryQuery).WithArgs(1, "testuser@example.com").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectRollback()
+
+		_, _, err := m.Add(context.Background(), 1, "testuser@example.com", time.Hour)
+		assert.ErrorIs(t, err, ErrDuplicateEmail)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Verified secondary email of the user", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserEmailModel{DB: db}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(primaryQuery).WithArgs(1, "second@example.com").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery(insertQuery).WithArgs(1, "second@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		_, _, err := m.Add(context.Background(), 1, "second@example.com", time.Hour)
+		assert.ErrorIs(t, err, ErrDuplicateEmail)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUserEmailModel_Verify(t *testing.T) {
+	query := regexp.QuoteMeta(`
+		UPDATE user_emails
+		SET verified = TRUE, token_hash = NULL, token_expiry = NULL
+		WHERE token_hash = $1 AND token_expiry > NOW()
+		RETURNING id, user_id, email, verified, created_at`)
+
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserEmailModel{DB: db}
+
+	now := time.Now().Truncate(time.Second)
+	hash := HashToken("token")
+
+	mock.ExpectQuery(query).WithArgs(hash).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "user_id", "email", "verified", "created_at"}).AddRow(4, 1, "second@example.com", true, now))
+
+	email, err := m.Verify(context.Background(), hash)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, email.UserID)
+	assert.True(t, email.Verified)
+
+	mock.ExpectQuery(query).WithArgs(hash).WillReturnError(sql.ErrNoRows)
+
+	_, err = m.Verify(context.Background(), hash)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	mock.ExpectQuery(query).WithArgs(hash).WillReturnError(errors.New("pq: duplicate key value violates unique constraint \"user_emails_verified_email_key\""))
+
+	_, err = m.Verify(context.Background(), hash)
+	assert.ErrorIs(t, err, ErrDuplicateEmail)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUserEmailModel_Remove(t *testing.T) {
+	query := regexp.QuoteMeta(`
+		DELETE FROM user_emails
+		WHERE user_id = $1 AND email = $2`)
+
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserEmailModel{DB: db}
+
+	mock.ExpectExec(query).WithArgs(1, "second@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(1, "unknown@example.com").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, m.Remove(context.Background(), 1, "second@example.com"))
+	assert.ErrorIs(t, m.Remove(context.Background(), 1, "unknown@example.com"), ErrNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUserEmailModel_Promote(t *testing.T) {
+	selectSecondary := regexp.QuoteMeta(`SELECT verified FROM user_emails WHERE user_id = $1 AND email = $2 FOR UPDATE`)
+	selectPrimary := regexp.QuoteMeta(`SELECT email FROM users WHERE id = $1 FOR UPDATE`)
+
+	t.Run("Promoted", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserEmailModel{DB: db}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectSecondary).WithArgs(1, "second@example.com").WillReturnRows(sqlmock.NewRows([]string{"verified"}).AddRow(true))
+		mock.ExpectQuery(selectPrimary).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("first@example.com"))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM user_emails WHERE user_id = $1 AND email = $2`)).WithArgs(1, "second@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET email = $2, version = version + 1 WHERE id = $1`)).WithArgs(1, "second@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_emails (user_id, email, verified) VALUES ($1, $2, TRUE)`)).WithArgs(1, "first@example.com").WillReturnResult(sqlmock.NewResult(5, 1))
+		mock.ExpectCommit()
+
+		previous, err := m.Promote(context.Background(), 1, "second@example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "first@example.com", previous)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Not verified", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserEmailModel{DB: db}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectSecondary).WithArgs(1, "second@example.com").WillReturnRows(sqlmock.NewRows([]string{"verified"}).AddRow(false))
+		mock.ExpectRollback()
+
+		_, err := m.Promote(context.Background(), 1, "second@example.com")
+		assert.ErrorIs(t, err, ErrEmailNotVerified)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Unknown email", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserEmailModel{DB: db}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectSecondary).WithArgs(1, "unknown@example.com").WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		_, err := m.Promote(context.Background(), 1, "unknown@example.com")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/sushihentaime/user-management-service/internal/validator"
 
@@ -15,9 +19,12 @@ import (
 var (
 	ErrDuplicateUsername = errors.New("duplicate username")
 	ErrDuplicateEmail    = errors.New("duplicate email")
+	// ErrEditConflict means the record was modified since it was read, see Update.
+	ErrEditConflict = errors.New("edit conflict")
+	// ErrActivatedBefore means the user was activated once, an activation email can't reactivate them.
+	ErrActivatedBefore = errors.New("activated before")
 
 	EmailRX       = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
-	UsernameRX    = regexp.MustCompile("^[a-zA-Z0-9]+$")
 	UppercaseRX   = regexp.MustCompile("[A-Z]")
 	LowercaseRX   = regexp.MustCompile("[a-z]")
 	NumberRX      = regexp.MustCompile("[0-9]")
@@ -25,15 +32,87 @@ var (
 	AnonymousUser = &User{}
 )
 
+const DefaultUsernamePattern = "^[a-zA-Z0-9]+$"
+
+// UsernameLengthLimit and EmailLengthLimit are the longest values the users table accepts, 254 is
+// the longest address that fits in an SMTP path.
+const (
+	UsernameLengthLimit = 64
+	EmailLengthLimit    = 254
+)
+
+// UserRules are the configurable rules users are validated against. Models holds them, so that
+// every application, and every test, can have its own.
+type UserRules struct {
+	// RejectWeakPasswords additionally rejects passwords that pass the character rules but are
+	// easy to guess.
+	RejectWeakPasswords bool
+	// ReservedUsernames can't be registered, compared case insensitively, see IsReservedUsername.
+	ReservedUsernames []string
+	// MaxUsernameLength and MaxEmailLength may be lowered but not raised past the limits enforced
+	// by the users table.
+	MaxUsernameLength int
+	MaxEmailLength    int
+
+	usernameRX        *regexp.Regexp
+	usernameRXMessage string
+}
+
+// NewUserRules returns the default rules, usernames are letters and numbers up to 25 characters.
+func NewUserRules() *UserRules {
+	return &UserRules{
+		MaxUsernameLength: 25,
+		MaxEmailLength:    EmailLengthLimit,
+		usernameRX:        regexp.MustCompile(DefaultUsernamePattern),
+		usernameRXMessage: "must contain only letters and numbers",
+	}
+}
+
+// SetUsernamePattern replaces the pattern usernames must match. The pattern should be anchored,
+// otherwise it only has to match part of the username.
+func (r *UserRules) SetUsernamePattern(pattern string) error {
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid username pattern: %w", err)
+	}
+
+	r.usernameRX = rx
+	if pattern == DefaultUsernamePattern {
+		r.usernameRXMessage = "must contain only letters and numbers"
+	} else {
+		r.usernameRXMessage = "must contain only allowed characters"
+	}
+
+	return nil
+}
+
+func (r *UserRules) IsReservedUsername(username string) bool {
+	for _, reserved := range r.ReservedUsernames {
+		if strings.EqualFold(username, reserved) {
+			return true
+		}
+	}
+
+	return false
+}
+
 type User struct {
-	ID        int                  `json:"id"`
-	Username  string               `json:"username"`
-	Email     string               `json:"email"`
-	Password  Password             `json:"-"`
-	Activated bool                 `json:"activated"`
-	CreatedAt time.Time            `json:"-"`
-	Version   int                  `json:"-"`
-	Validator *validator.Validator `json:"-"`
+	ID        int      `json:"id"`
+	Username  string   `json:"username"`
+	Email     string   `json:"email"`
+	Password  Password `json:"-"`
+	Activated bool     `json:"activated"`
+	// Locked is set by an admin to suspend the account, locked users can't log in.
+	Locked bool `json:"locked"`
+	// DisplayName and AvatarURL are optional profile fields, nil when unset.
+	DisplayName *string              `json:"display_name"`
+	AvatarURL   *string              `json:"avatar_url"`
+	CreatedAt   time.Time            `json:"-"`
+	Version     int                  `json:"-"`
+	Validator   *validator.Validator `json:"-"`
+	// ImpersonatorID is the admin acting as the user when GetToken looked up an impersonation
+	// token, zero otherwise.
+	ImpersonatorID int `json:"-"`
 }
 
 type Password struct {
@@ -42,7 +121,7 @@ type Password struct {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB Querier
 }
 
 func (p *Password) Set(plain string) error {
@@ -72,18 +151,19 @@ func (p *Password) Compare(plain string) (bool, error) {
 	return true, nil
 }
 
-func (u *User) validateUsername() {
+func (u *User) validateUsername(rules *UserRules) {
 	u.Validator.Check(u.Username != "", "username", "must be provided")
-	u.Validator.Check(u.Validator.CheckStringLength(u.Username, 3, 25), "username", "must be 3-25 characters long")
-	u.Validator.Check(UsernameRX.MatchString(u.Username), "username", "must contain only letters and numbers")
+	u.Validator.Check(u.Validator.CheckStringLength(u.Username, 3, rules.MaxUsernameLength), "username", fmt.Sprintf("must be 3-%d characters long", rules.MaxUsernameLength))
+	u.Validator.Check(rules.usernameRX.MatchString(u.Username), "username", rules.usernameRXMessage)
 }
 
-func (u *User) validateEmail() {
+func (u *User) validateEmail(rules *UserRules) {
 	u.Validator.Check(u.Email != "", "email", "must be provided")
 	u.Validator.Check(EmailRX.MatchString(u.Email), "email", "must be a valid email address")
+	u.Validator.Check(utf8.RuneCountInString(u.Email) <= rules.MaxEmailLength, "email", fmt.Sprintf("must not be more than %d characters long", rules.MaxEmailLength))
 }
 
-func (u *User) validatePassword() {
+func (u *User) validatePassword(rules *UserRules) {
 	if u.Password.Plain == nil {
 		return
 	}
@@ -91,53 +171,80 @@ func (u *User) validatePassword() {
 	value := len(*u.Password.Plain) >= 8 && len(*u.Password.Plain) <= 72 && UppercaseRX.MatchString(*u.Password.Plain) && LowercaseRX.MatchString(*u.Password.Plain) && NumberRX.MatchString(*u.Password.Plain) && SymbolRX.MatchString(*u.Password.Plain)
 
 	u.Validator.Check(value, "password", "must be 8-72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol")
+
+	if rules.RejectWeakPasswords {
+		u.Validator.Check(!IsWeakPassword(*u.Password.Plain), "password", "must not be a common word or an easily guessed pattern")
+	}
+}
+
+func (u *User) validateProfile() {
+	if u.DisplayName != nil {
+		u.Validator.Check(utf8.RuneCountInString(*u.DisplayName) <= 50, "display_name", "must not be more than 50 characters long")
+	}
+
+	if u.AvatarURL != nil && *u.AvatarURL != "" {
+		avatarURL, err := url.Parse(*u.AvatarURL)
+		valid := err == nil && (avatarURL.Scheme == "https" || avatarURL.Scheme == "http") && avatarURL.Host != ""
+		u.Validator.Check(valid, "avatar_url", "must be a valid http or https URL")
+		u.Validator.Check(len(*u.AvatarURL) <= 2048, "avatar_url", "must not be more than 2048 bytes long")
+	}
+}
+
+// Normalize trims the whitespace around the username and email and lowercases the email, so that
+// they are validated and stored the way they are looked up. The password is left as is, whitespace
+// may be part of it.
+func (u *User) Normalize() {
+	u.Username = strings.TrimSpace(u.Username)
+	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
 }
 
-func (u *User) ValidateUser() {
+func (u *User) ValidateUser(rules *UserRules) {
 	u.Validator = validator.New()
 
-	u.validateUsername()
-	u.validateEmail()
-	u.validatePassword()
+	u.validateUsername(rules)
+	u.validateEmail(rules)
+	u.validatePassword(rules)
 }
 
-func (u *User) ValidateEmail() {
+func (u *User) ValidateEmail(rules *UserRules) {
 	u.Validator = validator.New()
 
-	u.validateEmail()
+	u.validateEmail(rules)
 }
 
-func (u *User) ValidatePassword() {
+func (u *User) ValidatePassword(rules *UserRules) {
 	u.Validator = validator.New()
 
-	u.validatePassword()
+	u.validatePassword(rules)
 }
 
-func (u *User) ValidateLoginUser() {
+func (u *User) ValidateLoginUser(rules *UserRules) {
 	u.Validator = validator.New()
 
-	u.validateUsername()
-	u.validatePassword()
+	u.validateUsername(rules)
+	u.validatePassword(rules)
 }
 
-func (u *User) ValidateUpdateUser() {
+func (u *User) ValidateUpdateUser(rules *UserRules) {
 	u.Validator = validator.New()
 
 	if u.Email != "" {
-		u.validateEmail()
+		u.validateEmail(rules)
 	}
-	if *u.Password.Plain != "" {
-		u.validatePassword()
+	if u.Password.Plain != nil && *u.Password.Plain != "" {
+		u.validatePassword(rules)
 	}
+
+	u.validateProfile()
 }
 
-func (m *UserModel) Create(user *User) error {
+func (m *UserModel) Create(ctx context.Context, user *User) error {
 	err := user.Password.Set(*user.Password.Plain)
 	if err != nil {
 		return err
 	}
 
-	err = m.Insert(user)
+	err = m.Insert(ctx, user)
 	if err != nil {
 		return err
 	}
@@ -145,7 +252,7 @@ func (m *UserModel) Create(user *User) error {
 	return nil
 }
 
-func (m *UserModel) Insert(user *User) error {
+func (m *UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
 		INSERT INTO users (username, email, password_hash) 
 		VALUES ($1, $2, $3)
@@ -157,7 +264,7 @@ func (m *UserModel) Insert(user *User) error {
 		user.Password.hash,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "UserModel.Insert", 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
@@ -176,18 +283,18 @@ func (m *UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m *UserModel) GetByUsername(username string) (*User, error) {
+func (m *UserModel) GetByUsername(ctx context.Context, username string) (*User, error) {
 	var user User
 
 	query := `
-		SELECT id, username, email, activated, password_hash, version
+		SELECT id, username, email, activated, locked, password_hash, version, display_name, avatar_url
 		FROM users
 		WHERE username = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "UserModel.GetByUsername", 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.Email, &user.Activated, &user.Password.hash, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.Email, &user.Activated, &user.Locked, &user.Password.hash, &user.Version, &user.DisplayName, &user.AvatarURL)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -200,18 +307,65 @@ func (m *UserModel) GetByUsername(username string) (*User, error) {
 	return &user, nil
 }
 
-func (m *UserModel) GetByEmail(email string) (*User, error) {
+// GetByID returns the user with the public fields set, the password hash isn't read. It serves the
+// flows that start from a token, which only carries the user ID.
+func (m *UserModel) GetByID(ctx context.Context, id int) (*User, error) {
 	var user User
 
 	query := `
-		SELECT id, username, email, activated
+		SELECT id, username, email, activated, locked, version, display_name, avatar_url, created_at
+		FROM users
+		WHERE id = $1`
+
+	ctx, cancel := startSpan(ctx, "UserModel.GetByID", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Username, &user.Email, &user.Activated, &user.Locked, &user.Version, &user.DisplayName, &user.AvatarURL, &user.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Taken reports whether the username and the email are already registered, the email counting as
+// taken when it is a verified secondary address of a user too. The unique constraints remain the guard
+// against concurrent signups, this only lets both conflicts be reported at once.
+func (m *UserModel) Taken(ctx context.Context, username, email string) (bool, bool, error) {
+	var usernameTaken, emailTaken bool
+
+	query := `
+		SELECT EXISTS(SELECT 1 FROM users WHERE username = $1),
+			EXISTS(SELECT 1 FROM users WHERE email = $2) OR EXISTS(SELECT 1 FROM user_emails WHERE email = $2 AND verified)`
+
+	ctx, cancel := startSpan(ctx, "UserModel.Taken", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, username, email).Scan(&usernameTaken, &emailTaken)
+	if err != nil {
+		return false, false, err
+	}
+
+	return usernameTaken, emailTaken, nil
+}
+
+func (m *UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	var user User
+
+	query := `
+		SELECT id, username, email, activated, created_at
 		FROM users
 		WHERE email = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "UserModel.GetByEmail", 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Activated)
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&user.ID, &user.Username, &user.Email, &user.Activated, &user.CreatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -223,29 +377,32 @@ func (m *UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-// Update can only modify the email and password_hash fields of a user.
-func (m *UserModel) Update(user *User) error {
+// Update can only modify the email, password_hash and profile fields of a user.
+func (m *UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
-		SET email = $1, password_hash = $2, version = version + 1
-		WHERE id = $3 AND version = $4
+		SET email = $1, password_hash = $2, display_name = $3, avatar_url = $4, version = version + 1
+		WHERE id = $5 AND version = $6
 		RETURNING version`
 
 	args := []any{
 		user.Email,
 		user.Password.hash,
+		user.DisplayName,
+		user.AvatarURL,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "UserModel.Update", 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
+		// no row matched the version the caller read, someone else updated the user in between
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrNotFound
+			return ErrEditConflict
 		case err.Error() == "pq: duplicate key value violates unique constraint \"users_email_key\"":
 			return ErrDuplicateEmail
 		default:
@@ -255,12 +412,12 @@ func (m *UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m *UserModel) Delete(id int) error {
+func (m *UserModel) Delete(ctx context.Context, id int) error {
 	query := `
 		DELETE FROM users
 		WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "UserModel.Delete", 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, id)
@@ -276,20 +433,65 @@ func (m *UserModel) Delete(id int) error {
 	return nil
 }
 
-func (m *UserModel) GetToken(tokenScope TokenScope, token []byte) (*User, error) {
+// DeleteAccount deletes the user together with everything that belongs to them in a single
+// transaction, dependent rows first so that no foreign key is left to cascade. The audit events
+// the user took part in are kept with the user cleared unless purgeAudit is set.
+func (m *UserModel) DeleteAccount(ctx context.Context, id int, purgeAudit bool) error {
+	queries := []string{
+		`DELETE FROM tokens WHERE user_id = $1 OR impersonator_id = $1`,
+		`DELETE FROM user_permissions WHERE user_id = $1`,
+		`DELETE FROM security_questions WHERE user_id = $1`,
+		`DELETE FROM email_history WHERE user_id = $1`,
+		`DELETE FROM email_log WHERE user_id = $1`,
+		`DELETE FROM user_emails WHERE user_id = $1`,
+	}
+	if purgeAudit {
+		queries = append(queries, `DELETE FROM audit_log WHERE actor_id = $1 OR target_user_id = $1`)
+	}
+
+	ctx, cancel := startSpan(ctx, "UserModel.DeleteAccount", 5*time.Second)
+	defer cancel()
+
+	return inTx(ctx, m.DB, func(tx Querier) error {
+		for _, query := range queries {
+			_, err := tx.ExecContext(ctx, query, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		return nil
+	})
+}
+
+func (m *UserModel) GetToken(ctx context.Context, tokenScope TokenScope, token []byte) (*User, error) {
 	var user User
 
 	query := `
-		SELECT u.id, u.username, u.email, u.activated
+		SELECT u.id, u.username, u.email, u.activated, u.locked, u.version, u.display_name, u.avatar_url, COALESCE(t.impersonator_id, 0)
 		FROM users u
 		INNER JOIN tokens t ON u.id = t.user_id
 		INNER JOIN scopes s ON t.scope_id = s.id
 		WHERE t.hash = $1 AND s.name = $2 AND t.expiry > $3`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "UserModel.GetToken", 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, token, tokenScope, time.Now()).Scan(&user.ID, &user.Username, &user.Email, &user.Activated)
+	err := m.DB.QueryRowContext(ctx, query, token, tokenScope, time.Now()).Scan(&user.ID, &user.Username, &user.Email, &user.Activated, &user.Locked, &user.Version, &user.DisplayName, &user.AvatarURL, &user.ImpersonatorID)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -302,13 +504,15 @@ func (m *UserModel) GetToken(tokenScope TokenScope, token []byte) (*User, error)
 	return &user, nil
 }
 
-func (m *UserModel) Activate(userID int) error {
+// Activate marks the user as activated. activated_at keeps the first activation so that
+// accounts deactivated later are never mistaken for ones that were never activated.
+func (m *UserModel) Activate(ctx context.Context, userID int) error {
 	query := `
 		UPDATE users
-		SET activated = TRUE
+		SET activated = TRUE, activated_at = COALESCE(activated_at, NOW()), version = version + 1
 		WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := startSpan(ctx, "UserModel.Activate", 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID)
@@ -324,6 +528,244 @@ func (m *UserModel) Activate(userID int) error {
 	return nil
 }
 
+func (m *UserModel) Deactivate(ctx context.Context, userID int) error {
+	query := `
+		UPDATE users
+		SET activated = FALSE, version = version + 1
+		WHERE id = $1`
+
+	ctx, cancel := startSpan(ctx, "UserModel.Deactivate", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Lock suspends the account, the caller is expected to revoke the user's tokens as well.
+func (m *UserModel) Lock(ctx context.Context, userID int) error {
+	query := `
+		UPDATE users
+		SET locked = TRUE, version = version + 1
+		WHERE id = $1`
+
+	ctx, cancel := startSpan(ctx, "UserModel.Lock", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (m *UserModel) Unlock(ctx context.Context, userID int) error {
+	query := `
+		UPDATE users
+		SET locked = FALSE, version = version + 1
+		WHERE id = $1`
+
+	ctx, cancel := startSpan(ctx, "UserModel.Unlock", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Count returns the number of registered users and how many of them are activated.
+func (m *UserModel) Count(ctx context.Context) (int, int, error) {
+	var total, activated int
+
+	query := `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE activated)
+		FROM users`
+
+	ctx, cancel := startSpan(ctx, "UserModel.Count", 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&total, &activated)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return total, activated, nil
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
+
+// GetDueActivationReminder returns the never activated users created before olderThan that have
+// been sent fewer than maxReminders reminders, the last of them also before olderThan. Users an
+// admin deactivated are left alone.
+func (m *UserModel) GetDueActivationReminder(ctx context.Context, olderThan time.Time, maxReminders int) ([]*User, error) {
+	query := `
+		SELECT id, username, email
+		FROM users
+		WHERE activated = FALSE
+		AND activated_at IS NULL
+		AND created_at < $1
+		AND activation_reminders_sent < $2
+		AND (last_reminder_at IS NULL OR last_reminder_at < $1)
+		ORDER BY id`
+
+	ctx, cancel := startSpan(ctx, "UserModel.GetDueActivationReminder", 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, olderThan, maxReminders)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		user := &User{}
+
+		err := rows.Scan(&user.ID, &user.Username, &user.Email)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (m *UserModel) RecordActivationReminder(ctx context.Context, userID int) error {
+	query := `
+		UPDATE users
+		SET activation_reminders_sent = activation_reminders_sent + 1, last_reminder_at = NOW(), last_activation_sent_at = NOW()
+		WHERE id = $1`
+
+	ctx, cancel := startSpan(ctx, "UserModel.RecordActivationReminder", 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// DeleteUnactivatedBefore deletes the users created before t that have never been activated,
+// their tokens and permissions go with them. It returns the number of users deleted.
+func (m *UserModel) DeleteUnactivatedBefore(ctx context.Context, t time.Time) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE activated = FALSE AND activated_at IS NULL AND created_at < $1`
+
+	ctx, cancel := startSpan(ctx, "UserModel.DeleteUnactivatedBefore", 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ClaimActivationResend records that an activation email is being sent to the user unless
+// the previous one was sent less than cooldown ago, in which case it returns false and how
+// long is left of the cooldown. It returns ErrActivatedBefore for a user who was activated once,
+// such as one an admin deactivated.
+func (m *UserModel) ClaimActivationResend(ctx context.Context, userID int, cooldown time.Duration) (bool, time.Duration, error) {
+	query := `
+		UPDATE users
+		SET last_activation_sent_at = NOW()
+		WHERE id = $1 AND activated_at IS NULL AND last_activation_sent_at <= NOW() - make_interval(secs => $2)
+		RETURNING id`
+
+	ctx, cancel := startSpan(ctx, "UserModel.ClaimActivationResend", 3*time.Second)
+	defer cancel()
+
+	var id int
+
+	err := m.DB.QueryRowContext(ctx, query, userID, cooldown.Seconds()).Scan(&id)
+	if err == nil {
+		return true, 0, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, 0, err
+	}
+
+	query = `
+		SELECT last_activation_sent_at, activated_at IS NOT NULL
+		FROM users
+		WHERE id = $1`
+
+	var (
+		lastSentAt      time.Time
+		activatedBefore bool
+	)
+
+	err = m.DB.QueryRowContext(ctx, query, userID).Scan(&lastSentAt, &activatedBefore)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, 0, ErrNotFound
+		default:
+			return false, 0, err
+		}
+	}
+
+	if activatedBefore {
+		return false, 0, ErrActivatedBefore
+	}
+
+	return false, time.Until(lastSentAt.Add(cooldown)), nil
+}
+
+// ClaimPasswordResetEmail records that a password reset email is being sent to the user unless
+// the previous one was sent less than cooldown ago, in which case it returns false.
+func (m *UserModel) ClaimPasswordResetEmail(ctx context.Context, userID int, cooldown time.Duration) (bool, error) {
+	query := `
+		UPDATE users
+		SET last_reset_sent_at = NOW()
+		WHERE id = $1 AND (last_reset_sent_at IS NULL OR last_reset_sent_at <= NOW() - make_interval(secs => $2))
+		RETURNING id`
+
+	ctx, cancel := startSpan(ctx, "UserModel.ClaimPasswordResetEmail", 3*time.Second)
+	defer cancel()
+
+	var id int
+
+	err := m.DB.QueryRowContext(ctx, query, userID, cooldown.Seconds()).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// ClaimUsernameReminderEmail records that an email with their username is being sent to the user
+// unless the previous one was sent less than cooldown ago, in which case it returns false.
+func (m *UserModel) ClaimUsernameReminderEmail(ctx context.Context, userID int, cooldown time.Duration) (bool, error) {
+	query := `
+		UPDATE users
+		SET last_username_sent_at = NOW()
+		WHERE id = $1 AND (last_username_sent_at IS NULL OR last_username_sent_at <= NOW() - make_interval(secs => $2))
+		RETURNING id`
+
+	ctx, cancel := startSpan(ctx, "UserModel.ClaimUsernameReminderEmail", 3*time.Second)
+	defer cancel()
+
+	var id int
+
+	err := m.DB.QueryRowContext(ctx, query, userID, cooldown.Seconds()).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
@@ -1,10 +1,12 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"log"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -56,13 +58,15 @@ func TestUser_ValidateUsername(t *testing.T) {
 		{username: "InvalidUsername", valid: true},             // Username with uppercase
 	}
 
+	rules := NewUserRules()
+
 	for _, test := range tests {
 		u := &User{
 			Username:  test.username,
 			Validator: validator.New(),
 		}
 
-		u.validateUsername()
+		u.validateUsername(rules)
 
 		if u.Validator.Valid() != test.valid {
 			t.Errorf("expected valid=%v, got valid=%v for username=%s", test.valid, u.Validator.Valid(), test.username)
@@ -70,27 +74,85 @@ func TestUser_ValidateUsername(t *testing.T) {
 	}
 }
 
+func TestUser_ValidateUsernameCustomPattern(t *testing.T) {
+	rules := NewUserRules()
+
+	err := rules.SetUsernamePattern(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{username: "valid_username", valid: true},    // Underscore
+		{username: "valid-user.name", valid: true},   // Hyphen and dot
+		{username: "_leading", valid: false},         // Must start with a letter or number
+		{username: "invalid username", valid: false}, // Space is still rejected
+	}
+
+	for _, test := range tests {
+		u := &User{
+			Username:  test.username,
+			Validator: validator.New(),
+		}
+
+		u.validateUsername(rules)
+
+		if u.Validator.Valid() != test.valid {
+			t.Errorf("expected valid=%v, got valid=%v for username=%s", test.valid, u.Validator.Valid(), test.username)
+		}
+	}
+}
+
+func TestSetUsernamePatternInvalid(t *testing.T) {
+	rules := NewUserRules()
+
+	err := rules.SetUsernamePattern("^[a-z")
+	if err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+
+	if rules.usernameRX.String() != DefaultUsernamePattern {
+		t.Errorf("expected the pattern to be unchanged, got %s", rules.usernameRX.String())
+	}
+}
+
+func TestIsReservedUsername(t *testing.T) {
+	rules := NewUserRules()
+	rules.ReservedUsernames = []string{"admin", "root"}
+
+	assert.True(t, rules.IsReservedUsername("admin"))
+	assert.True(t, rules.IsReservedUsername("Root"))
+	assert.False(t, rules.IsReservedUsername("administrator"))
+}
+
 func TestUser_ValidateEmail(t *testing.T) {
 	tests := []struct {
 		email string
 		valid bool
 	}{
-		{email: "", valid: false},                   // Empty email
-		{email: "invalid", valid: false},            // Invalid email
-		{email: "invalid@", valid: false},           // Invalid email
-		{email: "invalid.com", valid: false},        // Invalid email
-		{email: "invalid@invalid", valid: false},    // Invalid email
-		{email: "invalid@invalid.", valid: false},   // Invalid email
-		{email: "invalid@invalid.com", valid: true}, // Valid email
+		{email: "", valid: false},                                        // Empty email
+		{email: "invalid", valid: false},                                 // Invalid email
+		{email: "invalid@", valid: false},                                // Invalid email
+		{email: "invalid.com", valid: false},                             // Invalid email
+		{email: "invalid@invalid", valid: false},                         // Invalid email
+		{email: "invalid@invalid.", valid: false},                        // Invalid email
+		{email: "invalid@invalid.com", valid: true},                      // Valid email
+		{email: strings.Repeat("a", 242) + "@example.com", valid: true},  // 254 characters
+		{email: strings.Repeat("a", 243) + "@example.com", valid: false}, // Over-length email
 	}
 
+	rules := NewUserRules()
+
 	for _, test := range tests {
 		u := &User{
 			Email:     test.email,
 			Validator: validator.New(),
 		}
 
-		u.validateEmail()
+		u.validateEmail(rules)
 
 		if u.Validator.Valid() != test.valid {
 			t.Errorf("expected valid=%v, got valid=%v for email=%s", test.valid, u.Validator.Valid(), test.email)
@@ -98,6 +160,43 @@ func TestUser_ValidateEmail(t *testing.T) {
 	}
 }
 
+func TestUser_Normalize(t *testing.T) {
+	password := " Test1234! "
+
+	u := &User{
+		Username: " testuser\t",
+		Email:    " TestUser@Example.COM ",
+		Password: Password{
+			Plain: &password,
+		},
+	}
+
+	u.Normalize()
+
+	assert.Equal(t, "testuser", u.Username)
+	assert.Equal(t, "testuser@example.com", u.Email)
+	assert.Equal(t, " Test1234! ", *u.Password.Plain)
+}
+
+func TestUser_ValidateLengthLimits(t *testing.T) {
+	rules := NewUserRules()
+	rules.MaxUsernameLength, rules.MaxEmailLength = 10, 20
+
+	u := &User{
+		Username:  "averylongusername",
+		Email:     "averylongname@example.com",
+		Validator: validator.New(),
+	}
+
+	u.validateUsername(rules)
+	u.validateEmail(rules)
+
+	assert.Equal(t, map[string]string{
+		"username": "must be 3-10 characters long",
+		"email":    "must not be more than 20 characters long",
+	}, u.Validator.Errors)
+}
+
 func TestUser_ValidatePassword(t *testing.T) {
 	tests := []struct {
 		password string
@@ -113,13 +212,15 @@ func TestUser_ValidatePassword(t *testing.T) {
 		{password: "Password 1234", valid: false}, // Password with space
 	}
 
+	rules := NewUserRules()
+
 	for _, test := range tests {
 		u := &User{
 			Password:  Password{Plain: &test.password},
 			Validator: validator.New(),
 		}
 
-		u.validatePassword()
+		u.validatePassword(rules)
 
 		if u.Validator.Valid() != test.valid {
 			t.Errorf("expected valid=%v, got valid=%v for password=%s", test.valid, u.Validator.Valid(), test.password)
@@ -183,7 +284,7 @@ func TestUserModel_Insert(t *testing.T) {
 
 	mock.ExpectQuery(query).WithArgs(dataUser.Username, dataUser.Email, dataUser.Password.hash).WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "version"}).AddRow(1, time.Now(), 1))
 
-	err = m.Insert(dataUser)
+	err = m.Insert(context.Background(), dataUser)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -208,14 +309,14 @@ func TestUserModel_GetByUsername(t *testing.T) {
 	m := UserModel{DB: db}
 
 	query := regexp.QuoteMeta(
-		`SELECT id, username, email, activated, password_hash, version
+		`SELECT id, username, email, activated, locked, password_hash, version, display_name, avatar_url
 		FROM users
 		WHERE username = $1`)
 
-	rows := sqlmock.NewRows([]string{"id", "username", "email", "activated", "password_hash", "version"}).AddRow(1, dataUser.Username, dataUser.Email, false, dataUser.Password.hash, 1)
+	rows := sqlmock.NewRows([]string{"id", "username", "email", "activated", "locked", "password_hash", "version", "display_name", "avatar_url"}).AddRow(1, dataUser.Username, dataUser.Email, false, true, dataUser.Password.hash, 1, "Test User", nil)
 	mock.ExpectQuery(query).WithArgs(dataUser.Username).WillReturnRows(rows)
 
-	user, err := m.GetByUsername(dataUser.Username)
+	user, err := m.GetByUsername(context.Background(), dataUser.Username)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -229,7 +330,89 @@ func TestUserModel_GetByUsername(t *testing.T) {
 	assert.Equal(t, expectedDataUser.Username, user.Username)
 	assert.Equal(t, expectedDataUser.Email, user.Email)
 	assert.Equal(t, expectedDataUser.Activated, user.Activated)
+	assert.True(t, user.Locked)
 	assert.Equal(t, expectedDataUser.Version, user.Version)
+	assert.Equal(t, "Test User", *user.DisplayName)
+	assert.Nil(t, user.AvatarURL)
+}
+
+func TestUserModel_GetByID(t *testing.T) {
+	query := regexp.QuoteMeta(
+		`SELECT id, username, email, activated, locked, version, display_name, avatar_url, created_at
+		FROM users
+		WHERE id = $1`)
+
+	t.Run("Found", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserModel{DB: db}
+
+		createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+		rows := sqlmock.NewRows([]string{"id", "username", "email", "activated", "locked", "version", "display_name", "avatar_url", "created_at"}).AddRow(1, dataUser.Username, dataUser.Email, true, false, 2, nil, "https://example.com/avatar.png", createdAt)
+		mock.ExpectQuery(query).WithArgs(1).WillReturnRows(rows)
+
+		user, err := m.GetByID(context.Background(), 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.ID)
+		assert.Equal(t, dataUser.Username, user.Username)
+		assert.Equal(t, dataUser.Email, user.Email)
+		assert.True(t, user.Activated)
+		assert.False(t, user.Locked)
+		assert.Equal(t, 2, user.Version)
+		assert.Nil(t, user.DisplayName)
+		assert.Equal(t, "https://example.com/avatar.png", *user.AvatarURL)
+		assert.True(t, createdAt.Equal(user.CreatedAt))
+		assert.Nil(t, user.Password.hash)
+
+		err = mock.ExpectationsWereMet()
+		if err != nil {
+			t.Errorf("there were unfulfilled expectations: %v", err)
+		}
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		db, mock := MockDB()
+		defer db.Close()
+
+		m := UserModel{DB: db}
+
+		mock.ExpectQuery(query).WithArgs(2).WillReturnError(sql.ErrNoRows)
+
+		user, err := m.GetByID(context.Background(), 2)
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.Nil(t, user)
+
+		err = mock.ExpectationsWereMet()
+		if err != nil {
+			t.Errorf("there were unfulfilled expectations: %v", err)
+		}
+	})
+}
+
+func TestUserModel_Taken(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT EXISTS(SELECT 1 FROM users WHERE username = $1),
+			EXISTS(SELECT 1 FROM users WHERE email = $2) OR EXISTS(SELECT 1 FROM user_emails WHERE email = $2 AND verified)`)
+
+	rows := sqlmock.NewRows([]string{"username", "email"}).AddRow(true, false)
+	mock.ExpectQuery(query).WithArgs(dataUser.Username, dataUser.Email).WillReturnRows(rows)
+
+	usernameTaken, emailTaken, err := m.Taken(context.Background(), dataUser.Username, dataUser.Email)
+	assert.NoError(t, err)
+	assert.True(t, usernameTaken)
+	assert.False(t, emailTaken)
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
 }
 
 func TestUserModel_GetByEmail(t *testing.T) {
@@ -239,14 +422,16 @@ func TestUserModel_GetByEmail(t *testing.T) {
 	m := UserModel{DB: db}
 
 	query := regexp.QuoteMeta(
-		`SELECT id, username, email, activated
+		`SELECT id, username, email, activated, created_at
 		FROM users
 		WHERE email = $1`)
 
-	rows := sqlmock.NewRows([]string{"id", "username", "email", "activated"}).AddRow(1, dataUser.Username, dataUser.Email, false)
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	rows := sqlmock.NewRows([]string{"id", "username", "email", "activated", "created_at"}).AddRow(1, dataUser.Username, dataUser.Email, false, createdAt)
 	mock.ExpectQuery(query).WithArgs(dataUser.Email).WillReturnRows(rows)
 
-	user, err := m.GetByEmail(dataUser.Email)
+	user, err := m.GetByEmail(context.Background(), dataUser.Email)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -260,6 +445,7 @@ func TestUserModel_GetByEmail(t *testing.T) {
 	assert.Equal(t, expectedDataUser.Username, user.Username)
 	assert.Equal(t, expectedDataUser.Email, user.Email)
 	assert.Equal(t, expectedDataUser.Activated, user.Activated)
+	assert.True(t, createdAt.Equal(user.CreatedAt))
 }
 
 func TestUserModel_Update(t *testing.T) {
@@ -275,14 +461,14 @@ func TestUserModel_Update(t *testing.T) {
 
 	query := regexp.QuoteMeta(
 		`UPDATE users
-		SET email = $1, password_hash = $2, version = version + 1
-		WHERE id = $3 AND version = $4
+		SET email = $1, password_hash = $2, display_name = $3, avatar_url = $4, version = version + 1
+		WHERE id = $5 AND version = $6
 		RETURNING version`)
 
 	rows := sqlmock.NewRows([]string{"version"}).AddRow(2)
-	mock.ExpectQuery(query).WithArgs(updatedDataUser.Email, updatedDataUser.Password.hash, 1, 1).WillReturnRows(rows)
+	mock.ExpectQuery(query).WithArgs(updatedDataUser.Email, updatedDataUser.Password.hash, updatedDataUser.DisplayName, updatedDataUser.AvatarURL, 1, 1).WillReturnRows(rows)
 
-	err = m.Update(updatedDataUser)
+	err = m.Update(context.Background(), updatedDataUser)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -297,6 +483,32 @@ func TestUserModel_Update(t *testing.T) {
 	assert.Equal(t, 1, updatedDataUser.ID)
 }
 
+func TestUserModel_UpdateEditConflict(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(
+		`UPDATE users
+		SET email = $1, password_hash = $2, display_name = $3, avatar_url = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`)
+
+	staleUser := &User{ID: 1, Email: "testuser2@example.com", Version: 1}
+
+	mock.ExpectQuery(query).WithArgs(staleUser.Email, staleUser.Password.hash, staleUser.DisplayName, staleUser.AvatarURL, 1, 1).WillReturnError(sql.ErrNoRows)
+
+	err := m.Update(context.Background(), staleUser)
+	assert.ErrorIs(t, err, ErrEditConflict)
+	assert.Equal(t, 1, staleUser.Version)
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
 func TestUserModel_Delete(t *testing.T) {
 	db, mock := MockDB()
 	defer db.Close()
@@ -309,7 +521,7 @@ func TestUserModel_Delete(t *testing.T) {
 
 	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	err := m.Delete(1)
+	err := m.Delete(context.Background(), 1)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -320,6 +532,61 @@ func TestUserModel_Delete(t *testing.T) {
 	}
 }
 
+func TestUserModel_DeleteAccount(t *testing.T) {
+	dependents := []string{
+		`DELETE FROM tokens WHERE user_id = $1 OR impersonator_id = $1`,
+		`DELETE FROM user_permissions WHERE user_id = $1`,
+		`DELETE FROM security_questions WHERE user_id = $1`,
+		`DELETE FROM email_history WHERE user_id = $1`,
+		`DELETE FROM email_log WHERE user_id = $1`,
+		`DELETE FROM user_emails WHERE user_id = $1`,
+	}
+	purgeAudit := `DELETE FROM audit_log WHERE actor_id = $1 OR target_user_id = $1`
+	deleteUser := `DELETE FROM users WHERE id = $1`
+
+	tests := []struct {
+		name       string
+		purgeAudit bool
+		deleted    int64
+		wantErr    error
+	}{
+		{name: "Audit events kept", deleted: 1},
+		{name: "Audit events purged", purgeAudit: true, deleted: 1},
+		{name: "Unknown user", deleted: 0, wantErr: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := MockDB()
+			defer db.Close()
+
+			m := UserModel{DB: db}
+
+			mock.ExpectBegin()
+			for _, query := range dependents {
+				mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			if tt.purgeAudit {
+				mock.ExpectExec(regexp.QuoteMeta(purgeAudit)).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+			}
+			mock.ExpectExec(regexp.QuoteMeta(deleteUser)).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, tt.deleted))
+			if tt.wantErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err := m.DeleteAccount(context.Background(), 1, tt.purgeAudit)
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Errorf("there were unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
 func TestUserModel_Activate(t *testing.T) {
 	db, mock := MockDB()
 	defer db.Close()
@@ -328,12 +595,12 @@ func TestUserModel_Activate(t *testing.T) {
 
 	query := regexp.QuoteMeta(
 		`UPDATE users
-		SET activated = TRUE
+		SET activated = TRUE, activated_at = COALESCE(activated_at, NOW()), version = version + 1
 		WHERE id = $1`)
 
 	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
 
-	err := m.Activate(1)
+	err := m.Activate(context.Background(), 1)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -344,6 +611,215 @@ func TestUserModel_Activate(t *testing.T) {
 	}
 }
 
+func TestUserModel_Deactivate(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(
+		`UPDATE users
+		SET activated = FALSE, version = version + 1
+		WHERE id = $1`)
+
+	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := m.Deactivate(context.Background(), 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_Lock(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(
+		`UPDATE users
+		SET locked = TRUE, version = version + 1
+		WHERE id = $1`)
+
+	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := m.Lock(context.Background(), 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_Unlock(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(
+		`UPDATE users
+		SET locked = FALSE, version = version + 1
+		WHERE id = $1`)
+
+	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := m.Unlock(context.Background(), 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_GetDueActivationReminder(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	olderThan := time.Now().Add(-24 * time.Hour)
+
+	query := regexp.QuoteMeta(
+		`SELECT id, username, email
+		FROM users
+		WHERE activated = FALSE
+		AND activated_at IS NULL
+		AND created_at < $1
+		AND activation_reminders_sent < $2
+		AND (last_reminder_at IS NULL OR last_reminder_at < $1)
+		ORDER BY id`)
+
+	rows := sqlmock.NewRows([]string{"id", "username", "email"}).
+		AddRow(1, "testuser", "testuser@example.com").
+		AddRow(2, "otheruser", "otheruser@example.com")
+
+	mock.ExpectQuery(query).WithArgs(olderThan, 3).WillReturnRows(rows)
+
+	users, err := m.GetDueActivationReminder(context.Background(), olderThan, 3)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if len(users) != 2 || users[1].Username != "otheruser" {
+		t.Errorf("unexpected users: %+v", users)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_RecordActivationReminder(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(
+		`UPDATE users
+		SET activation_reminders_sent = activation_reminders_sent + 1, last_reminder_at = NOW(), last_activation_sent_at = NOW()
+		WHERE id = $1`)
+
+	mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := m.RecordActivationReminder(context.Background(), 1)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_DeleteUnactivatedBefore(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	before := time.Now().Add(-30 * 24 * time.Hour)
+
+	query := regexp.QuoteMeta(
+		`DELETE FROM users
+		WHERE activated = FALSE AND activated_at IS NULL AND created_at < $1`)
+
+	mock.ExpectExec(query).WithArgs(before).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	deleted, err := m.DeleteUnactivatedBefore(context.Background(), before)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if deleted != 2 {
+		t.Errorf("expected 2 deleted users, got %d", deleted)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_ClaimActivationResend(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	updateQuery := regexp.QuoteMeta(
+		`UPDATE users
+		SET last_activation_sent_at = NOW()
+		WHERE id = $1 AND activated_at IS NULL AND last_activation_sent_at <= NOW() - make_interval(secs => $2)
+		RETURNING id`)
+
+	selectQuery := regexp.QuoteMeta(
+		`SELECT last_activation_sent_at, activated_at IS NOT NULL
+		FROM users
+		WHERE id = $1`)
+
+	mock.ExpectQuery(updateQuery).WithArgs(1, float64(60)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	claimed, retryAfter, err := m.ClaimActivationResend(context.Background(), 1, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Zero(t, retryAfter)
+
+	mock.ExpectQuery(updateQuery).WithArgs(1, float64(60)).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"last_activation_sent_at", "activated_before"}).AddRow(time.Now().Add(-20*time.Second), false))
+
+	claimed, retryAfter, err = m.ClaimActivationResend(context.Background(), 1, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.InDelta(t, 40*time.Second, retryAfter, float64(2*time.Second))
+
+	mock.ExpectQuery(updateQuery).WithArgs(1, float64(60)).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(selectQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"last_activation_sent_at", "activated_before"}).AddRow(time.Now().Add(-time.Hour), true))
+
+	claimed, _, err = m.ClaimActivationResend(context.Background(), 1, time.Minute)
+	assert.ErrorIs(t, err, ErrActivatedBefore)
+	assert.False(t, claimed)
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
 func TestUserModel_GetToken(t *testing.T) {
 	db, mock := MockDB()
 	defer db.Close()
@@ -354,16 +830,16 @@ func TestUserModel_GetToken(t *testing.T) {
 	token := []byte("token")
 
 	query := regexp.QuoteMeta(`
-		SELECT u.id, u.username, u.email, u.activated
+		SELECT u.id, u.username, u.email, u.activated, u.locked, u.version, u.display_name, u.avatar_url, COALESCE(t.impersonator_id, 0)
 		FROM users u
 		INNER JOIN tokens t ON u.id = t.user_id
 		INNER JOIN scopes s ON t.scope_id = s.id
 		WHERE t.hash = $1 AND s.name = $2 AND t.expiry > $3`)
 
-	rows := sqlmock.NewRows([]string{"id", "username", "email", "activated"}).AddRow(1, "testuser", "testuser@example.com", true)
+	rows := sqlmock.NewRows([]string{"id", "username", "email", "activated", "locked", "version", "display_name", "avatar_url", "impersonator_id"}).AddRow(1, "testuser", "testuser@example.com", true, false, 3, nil, nil, 7)
 	mock.ExpectQuery(query).WithArgs(token, tokenScope, anyTime{}).WillReturnRows(rows)
 
-	user, err := m.GetToken(tokenScope, token)
+	user, err := m.GetToken(context.Background(), tokenScope, token)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -384,4 +860,214 @@ func TestUserModel_GetToken(t *testing.T) {
 	assert.Equal(t, expectedUser.Username, user.Username)
 	assert.Equal(t, expectedUser.Email, user.Email)
 	assert.Equal(t, expectedUser.Activated, user.Activated)
+	assert.Equal(t, 3, user.Version)
+	assert.Equal(t, 7, user.ImpersonatorID)
+}
+
+func TestUser_ValidateWeakPassword(t *testing.T) {
+	tests := []struct {
+		password   string
+		rejectWeak bool
+		valid      bool
+	}{
+		{password: "Password1!", rejectWeak: false, valid: true},           // Weak but check disabled
+		{password: "Password1!", rejectWeak: true, valid: false},           // Dictionary word
+		{password: "!!Welcome2024", rejectWeak: true, valid: false},        // Dictionary word with padding
+		{password: "Aaaaaaa1!", rejectWeak: true, valid: false},            // Repeated characters
+		{password: "Xyz1234!mnq", rejectWeak: true, valid: false},          // Sequential digits
+		{password: "Qwertyui9!", rejectWeak: true, valid: false},           // Keyboard row
+		{password: "Tr0ub4dor&3x", rejectWeak: true, valid: true},          // Strong password
+		{password: "correct-H0rse-battery", rejectWeak: true, valid: true}, // Strong passphrase
+	}
+
+	for _, test := range tests {
+		rules := NewUserRules()
+		rules.RejectWeakPasswords = test.rejectWeak
+
+		u := &User{
+			Password:  Password{Plain: &test.password},
+			Validator: validator.New(),
+		}
+
+		u.validatePassword(rules)
+
+		if u.Validator.Valid() != test.valid {
+			t.Errorf("expected valid=%v, got valid=%v for password=%s (errors: %v)", test.valid, u.Validator.Valid(), test.password, u.Validator.Errors)
+		}
+	}
+}
+
+func TestUser_ValidateUpdateUserProfile(t *testing.T) {
+	empty := ""
+
+	tests := []struct {
+		name        string
+		displayName *string
+		avatarURL   *string
+		wantErrors  map[string]string
+	}{
+		{
+			name:        "valid profile",
+			displayName: strPtr("Test User"),
+			avatarURL:   strPtr("https://example.com/avatar.png"),
+			wantErrors:  map[string]string{},
+		},
+		{
+			name:        "fields cleared",
+			displayName: &empty,
+			avatarURL:   &empty,
+			wantErrors:  map[string]string{},
+		},
+		{
+			name:        "display name too long",
+			displayName: strPtr(strings.Repeat("ü", 51)),
+			wantErrors:  map[string]string{"display_name": "must not be more than 50 characters long"},
+		},
+		{
+			name:       "avatar url without scheme",
+			avatarURL:  strPtr("example.com/avatar.png"),
+			wantErrors: map[string]string{"avatar_url": "must be a valid http or https URL"},
+		},
+		{
+			name:       "avatar url with unsupported scheme",
+			avatarURL:  strPtr("javascript:alert(1)"),
+			wantErrors: map[string]string{"avatar_url": "must be a valid http or https URL"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := &User{
+				Password:    Password{Plain: &empty},
+				DisplayName: test.displayName,
+				AvatarURL:   test.avatarURL,
+			}
+
+			user.ValidateUpdateUser(NewUserRules())
+			assert.Equal(t, test.wantErrors, user.Validator.Errors)
+		})
+	}
+}
+
+func TestUser_ValidateUpdateUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       *User
+		wantErrors map[string]string
+	}{
+		{
+			name:       "nil password",
+			user:       &User{Email: "test@example.com"},
+			wantErrors: map[string]string{},
+		},
+		{
+			name:       "nil password with invalid email",
+			user:       &User{Email: "not an email"},
+			wantErrors: map[string]string{"email": "must be a valid email address"},
+		},
+		{
+			name:       "empty password",
+			user:       &User{Password: Password{Plain: strPtr("")}},
+			wantErrors: map[string]string{},
+		},
+		{
+			name:       "weak password",
+			user:       &User{Password: Password{Plain: strPtr("short")}},
+			wantErrors: map[string]string{"password": "must be 8-72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.NotPanics(t, func() { test.user.ValidateUpdateUser(NewUserRules()) })
+			assert.Equal(t, test.wantErrors, test.user.Validator.Errors)
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestUserModel_ClaimPasswordResetEmail(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(
+		`UPDATE users
+		SET last_reset_sent_at = NOW()
+		WHERE id = $1 AND (last_reset_sent_at IS NULL OR last_reset_sent_at <= NOW() - make_interval(secs => $2))
+		RETURNING id`)
+
+	mock.ExpectQuery(query).WithArgs(1, float64(300)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	claimed, err := m.ClaimPasswordResetEmail(context.Background(), 1, 5*time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	mock.ExpectQuery(query).WithArgs(1, float64(300)).WillReturnError(sql.ErrNoRows)
+
+	claimed, err = m.ClaimPasswordResetEmail(context.Background(), 1, 5*time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_ClaimUsernameReminderEmail(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(
+		`UPDATE users
+		SET last_username_sent_at = NOW()
+		WHERE id = $1 AND (last_username_sent_at IS NULL OR last_username_sent_at <= NOW() - make_interval(secs => $2))
+		RETURNING id`)
+
+	mock.ExpectQuery(query).WithArgs(1, float64(300)).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	claimed, err := m.ClaimUsernameReminderEmail(context.Background(), 1, 5*time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	mock.ExpectQuery(query).WithArgs(1, float64(300)).WillReturnError(sql.ErrNoRows)
+
+	claimed, err = m.ClaimUsernameReminderEmail(context.Background(), 1, 5*time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
+}
+
+func TestUserModel_Count(t *testing.T) {
+	db, mock := MockDB()
+	defer db.Close()
+
+	m := UserModel{DB: db}
+
+	query := regexp.QuoteMeta(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE activated)
+		FROM users`)
+
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"count", "count"}).AddRow(5, 3))
+
+	total, activated, err := m.Count(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 5, total)
+	assert.Equal(t, 3, activated)
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Errorf("there were unfulfilled expectations: %v", err)
+	}
 }
@@ -0,0 +1,80 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// Categories of a SendError, match them with errors.Is.
+var (
+	// ErrTransient is a failure that may not happen again, such as a timeout, a dropped connection or
+	// a 4xx SMTP reply. Sending the message again later may succeed.
+	ErrTransient = errors.New("transient mail failure")
+	// ErrPermanent is a failure that will happen again, such as a rejected recipient, a 5xx SMTP
+	// reply or a template that can't be rendered.
+	ErrPermanent = errors.New("permanent mail failure")
+)
+
+// SendError is returned by Mailer.Send for every failure, Transient tells its category.
+type SendError struct {
+	Err       error
+	Transient bool
+}
+
+func (e *SendError) Error() string {
+	if e.Transient {
+		return fmt.Sprintf("%s: %v", ErrTransient, e.Err)
+	}
+
+	return fmt.Sprintf("%s: %v", ErrPermanent, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the category of the error, ErrTransient or ErrPermanent.
+func (e *SendError) Is(target error) bool {
+	return (target == ErrTransient && e.Transient) || (target == ErrPermanent && !e.Transient)
+}
+
+// IsTransient reports whether err is a SendError worth retrying.
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
+
+// classify wraps an error of sending a message into a SendError of the right category. Errors it
+// doesn't recognise are permanent, so that they are never retried forever.
+func classify(err error) *SendError {
+	cause := err
+
+	// the SMTP client's errors are wrapped without Unwrap
+	var sendErr *mail.SendError
+	if errors.As(cause, &sendErr) {
+		cause = sendErr.Cause
+	}
+
+	var protoErr *textproto.Error
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case errors.As(cause, &protoErr):
+		// 4xx replies are transient negative completions, 5xx permanent ones (RFC 5321)
+		return &SendError{Err: err, Transient: protoErr.Code >= 400 && protoErr.Code < 500}
+	case errors.As(cause, &netErr) && netErr.Timeout():
+		return &SendError{Err: err, Transient: true}
+	case errors.As(cause, &opErr):
+		// the server couldn't be reached or closed the connection
+		return &SendError{Err: err, Transient: true}
+	case errors.Is(cause, io.EOF), errors.Is(cause, io.ErrUnexpectedEOF):
+		return &SendError{Err: err, Transient: true}
+	default:
+		return &SendError{Err: err}
+	}
+}
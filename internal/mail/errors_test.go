@@ -0,0 +1,130 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/go-mail/mail/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, timeoutErr := (&net.Dialer{}).DialContext(ctx, "tcp", "192.0.2.1:25")
+
+	testCases := []struct {
+		name          string
+		err           error
+		wantTransient bool
+	}{
+		{name: "mailbox busy", err: &textproto.Error{Code: 450, Msg: "4.2.1 mailbox temporarily unavailable"}, wantTransient: true},
+		{name: "service not available", err: &textproto.Error{Code: 421, Msg: "4.3.2 service shutting down"}, wantTransient: true},
+		{name: "unknown recipient", err: &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}},
+		{name: "authentication failed", err: &textproto.Error{Code: 535, Msg: "5.7.8 bad credentials"}},
+		{name: "wrapped by the SMTP client", err: &mail.SendError{Cause: &textproto.Error{Code: 451, Msg: "4.7.1 try again later"}}, wantTransient: true},
+		{name: "timeout", err: timeoutErr, wantTransient: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, wantTransient: true},
+		{name: "connection dropped", err: io.EOF, wantTransient: true},
+		{name: "invalid address", err: &mail.SendError{Cause: errors.New(`gomail: invalid address "To": mail: no angle-addr`)}},
+		{name: "unknown", err: errors.New("something went wrong")},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classify(tt.err)
+
+			assert.Equal(t, tt.wantTransient, IsTransient(err))
+			assert.Equal(t, tt.wantTransient, errors.Is(err, ErrTransient))
+			assert.Equal(t, !tt.wantTransient, errors.Is(err, ErrPermanent))
+			assert.ErrorIs(t, err, tt.err, "the cause must be kept")
+		})
+	}
+}
+
+// fakeSMTPServer accepts a single connection and answers RCPT TO with rcptReply, every other
+// command succeeds.
+func fakeSMTPServer(t *testing.T, rcptReply string) (string, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				fmt.Fprint(conn, "250 localhost\r\n")
+			case strings.HasPrefix(cmd, "RCPT"):
+				fmt.Fprint(conn, rcptReply+"\r\n")
+			case strings.HasPrefix(cmd, "QUIT"):
+				fmt.Fprint(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestMailer_SendErrors(t *testing.T) {
+	data := map[string]any{"activationToken": "token"}
+
+	t.Run("Rejected recipient", func(t *testing.T) {
+		host, port := fakeSMTPServer(t, "550 5.1.1 no such user")
+
+		err := New(host, port, "", "", "noreply@acme.com").Send("unknown@example.com", "mail.html", data)
+
+		var sendErr *SendError
+		assert.ErrorAs(t, err, &sendErr)
+		assert.ErrorIs(t, err, ErrPermanent)
+	})
+
+	t.Run("Greylisted recipient", func(t *testing.T) {
+		host, port := fakeSMTPServer(t, "451 4.7.1 greylisted, try again later")
+
+		err := New(host, port, "", "", "noreply@acme.com").Send("testuser@example.com", "mail.html", data)
+		assert.ErrorIs(t, err, ErrTransient)
+	})
+
+	t.Run("Server unreachable", func(t *testing.T) {
+		// nothing listens on the port once the listener is closed
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		err = New("127.0.0.1", port, "", "", "noreply@acme.com").Send("testuser@example.com", "mail.html", data)
+		assert.ErrorIs(t, err, ErrTransient)
+	})
+
+	t.Run("Unknown template", func(t *testing.T) {
+		err := New("localhost", 25, "", "", "noreply@acme.com").Send("testuser@example.com", "missing.html", data)
+		assert.ErrorIs(t, err, ErrPermanent)
+	})
+}
@@ -3,7 +3,16 @@ package mail
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"fmt"
 	"html/template"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -12,56 +21,268 @@ import (
 //go:embed templates
 var templateFS embed.FS
 
+var ErrMissingBody = errors.New("email template must define a plainBody or htmlBody")
+
+// fileNameRX matches the characters of a recipient address not kept in FileMailer file names.
+var fileNameRX = regexp.MustCompile(`[^a-zA-Z0-9@._-]`)
+
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	dialer     *mail.Dialer
+	templates  fs.FS
+	sender     string
+	senderName string
+	replyTo    string
+	bcc        []string
+	// securityBCC receive copies of the messages rendered from securityTemplates or sent with
+	// WithSecurityCopy, on top of bcc.
+	securityBCC       []string
+	securityTemplates map[string]bool
+}
+
+// Option customises the headers of every message sent by the Mailer.
+type Option func(*Mailer)
+
+// WithSenderName sets the display name shown alongside the sender address.
+func WithSenderName(name string) Option {
+	return func(m *Mailer) {
+		m.senderName = name
+	}
+}
+
+func WithReplyTo(address string) Option {
+	return func(m *Mailer) {
+		m.replyTo = address
+	}
+}
+
+// WithBCC blind copies every message to the given addresses, e.g. for auditing.
+func WithBCC(addresses ...string) Option {
+	return func(m *Mailer) {
+		m.bcc = append(m.bcc, addresses...)
+	}
+}
+
+// WithSecurityBCC blind copies security relevant messages to the given addresses, e.g. for
+// compliance monitoring. Messages are security relevant when rendered from one of the templates
+// given to WithSecurityTemplates or sent with WithSecurityCopy.
+func WithSecurityBCC(addresses ...string) Option {
+	return func(m *Mailer) {
+		m.securityBCC = append(m.securityBCC, addresses...)
+	}
+}
+
+// WithSecurityTemplates designates the templates whose messages are always security relevant.
+func WithSecurityTemplates(templateFiles ...string) Option {
+	return func(m *Mailer) {
+		for _, templateFile := range templateFiles {
+			m.securityTemplates[templateFile] = true
+		}
+	}
+}
+
+// SendOption customises a single message, unlike Option which applies to every message.
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	subject      string
+	securityCopy bool
+}
+
+// WithSubject overrides the subject rendered from the template's subject block. An empty
+// subject keeps the template's.
+func WithSubject(subject string) SendOption {
+	return func(o *sendOptions) {
+		o.subject = subject
+	}
 }
 
-func New(host string, port int, username, password, sender string) *Mailer {
+// WithSecurityCopy marks a message as security relevant, for templates that are only sometimes,
+// such as an activation email sent after an email change.
+func WithSecurityCopy() SendOption {
+	return func(o *sendOptions) {
+		o.securityCopy = true
+	}
+}
+
+func New(host string, port int, username, password, sender string, opts ...Option) *Mailer {
 	dialer := mail.NewDialer(host, port, username, password)
 	dialer.Timeout = 5 * time.Second
 
-	return &Mailer{
-		dialer: dialer,
-		sender: sender,
+	m := &Mailer{
+		dialer:            dialer,
+		templates:         templateFS,
+		sender:            sender,
+		securityTemplates: map[string]bool{},
 	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
 }
 
-func (m *Mailer) Send(recipient, templateFile string, data any) error {
-	t, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+// Send renders the template and sends the message. Errors are *SendError, telling transient
+// failures worth retrying from permanent ones.
+func (m *Mailer) Send(recipient, templateFile string, data any, opts ...SendOption) error {
+	msg, err := m.newMessage(recipient, templateFile, data, opts...)
 	if err != nil {
-		return err
+		return &SendError{Err: err}
+	}
+
+	err = m.dialer.DialAndSend(msg)
+	if err != nil {
+		return classify(err)
+	}
+
+	return nil
+}
+
+func (m *Mailer) newMessage(recipient, templateFile string, data any, opts ...SendOption) (*mail.Message, error) {
+	var options sendOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	t, err := template.New("email").ParseFS(m.templates, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
 	}
 
 	subject := new(bytes.Buffer)
 	err = t.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	// templates may define either body or both, but never neither
+	plainBody, err := executeOptional(t, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody, err := executeOptional(t, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	if plainBody == nil && htmlBody == nil {
+		return nil, ErrMissingBody
+	}
+
+	msg := mail.NewMessage()
+	if m.senderName != "" {
+		msg.SetAddressHeader("From", m.sender, m.senderName)
+	} else {
+		msg.SetHeader("From", m.sender)
+	}
+	msg.SetHeader("To", recipient)
+	if m.replyTo != "" {
+		msg.SetHeader("Reply-To", m.replyTo)
+	}
+	bcc := m.bcc
+	if options.securityCopy || m.securityTemplates[templateFile] {
+		bcc = append(slices.Clip(bcc), m.securityBCC...)
+	}
+	if len(bcc) > 0 {
+		msg.SetHeader("Bcc", bcc...)
+	}
+	if options.subject != "" {
+		msg.SetHeader("Subject", options.subject)
+	} else {
+		msg.SetHeader("Subject", subject.String())
+	}
+
+	switch {
+	case plainBody != nil && htmlBody != nil:
+		msg.SetBody("text/plain", plainBody.String())
+		msg.AddAlternative("text/html", htmlBody.String())
+	case plainBody != nil:
+		msg.SetBody("text/plain", plainBody.String())
+	default:
+		msg.SetBody("text/html", htmlBody.String())
+	}
+
+	return msg, nil
+}
+
+// executeOptional renders the named template, returning nil if the template is not defined.
+func executeOptional(t *template.Template, name string, data any) (*bytes.Buffer, error) {
+	if t.Lookup(name) == nil {
+		return nil, nil
+	}
+
+	buf := new(bytes.Buffer)
+	err := t.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// FileMailer renders emails like Mailer but writes each one to a .eml file in a directory
+// instead of sending it, for local development without an SMTP server.
+type FileMailer struct {
+	renderer *Mailer
+	dir      string
+}
+
+func NewFileMailer(dir, sender string, opts ...Option) (*FileMailer, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileMailer{renderer: New("", 0, "", "", sender, opts...), dir: dir}, nil
+}
+
+func (m *FileMailer) Send(recipient, templateFile string, data any, opts ...SendOption) error {
+	msg, err := m.renderer.newMessage(recipient, templateFile, data, opts...)
 	if err != nil {
 		return err
 	}
 
-	plainBody := new(bytes.Buffer)
-	err = t.ExecuteTemplate(plainBody, "plainBody", data)
+	name := fmt.Sprintf("%s-%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"),
+		strings.TrimSuffix(templateFile, filepath.Ext(templateFile)), fileNameRX.ReplaceAllString(recipient, "_"))
+
+	f, err := os.OpenFile(filepath.Join(m.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
 	if err != nil {
 		return err
 	}
 
-	htmlBody := new(bytes.Buffer)
-	err = t.ExecuteTemplate(htmlBody, "htmlBody", data)
+	_, err = msg.WriteTo(f)
 	if err != nil {
+		f.Close()
 		return err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	return f.Close()
+}
 
-	err = m.dialer.DialAndSend(msg)
+// LogMailer renders emails like Mailer but logs them instead of sending them.
+type LogMailer struct {
+	renderer *Mailer
+	logger   *slog.Logger
+}
+
+func NewLogMailer(logger *slog.Logger, sender string, opts ...Option) *LogMailer {
+	return &LogMailer{renderer: New("", 0, "", "", sender, opts...), logger: logger}
+}
+
+func (m *LogMailer) Send(recipient, templateFile string, data any, opts ...SendOption) error {
+	msg, err := m.renderer.newMessage(recipient, templateFile, data, opts...)
 	if err != nil {
 		return err
 	}
 
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info("email not sent, mailer is in dry run mode", "recipient", recipient, "template", templateFile, "message", buf.String())
+
 	return nil
 }
@@ -0,0 +1,249 @@
+package mail
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailer_NewMessageHeaders(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com",
+		WithSenderName("Acme Security"),
+		WithReplyTo("support@acme.com"),
+		WithBCC("audit@acme.com"),
+	)
+
+	msg, err := m.newMessage("testuser@example.com", "mail.html", map[string]any{"activationToken": "token"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{`"Acme Security" <noreply@acme.com>`}, msg.GetHeader("From"))
+	assert.Equal(t, []string{"support@acme.com"}, msg.GetHeader("Reply-To"))
+	assert.Equal(t, []string{"audit@acme.com"}, msg.GetHeader("Bcc"))
+	assert.Equal(t, []string{"testuser@example.com"}, msg.GetHeader("To"))
+
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "Reply-To: support@acme.com")
+}
+
+func TestMailer_SecurityBCC(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com",
+		WithBCC("audit@acme.com"),
+		WithSecurityBCC("security@acme.com"),
+		WithSecurityTemplates("password_changed.html"),
+	)
+
+	testCases := []struct {
+		name         string
+		templateFile string
+		opts         []SendOption
+		want         []string
+	}{
+		{name: "routine email", templateFile: "mail.html", want: []string{"audit@acme.com"}},
+		{name: "designated template", templateFile: "password_changed.html", want: []string{"audit@acme.com", "security@acme.com"}},
+		{name: "explicit flag", templateFile: "mail.html", opts: []SendOption{WithSecurityCopy()}, want: []string{"audit@acme.com", "security@acme.com"}},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := m.newMessage("testuser@example.com", tt.templateFile, map[string]any{"username": "testuser"}, tt.opts...)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, msg.GetHeader("Bcc"))
+		})
+	}
+
+	t.Run("Without a security mailbox", func(t *testing.T) {
+		m := New("localhost", 25, "", "", "noreply@acme.com", WithSecurityTemplates("password_changed.html"))
+
+		msg, err := m.newMessage("testuser@example.com", "password_changed.html", map[string]any{"username": "testuser"})
+		assert.NoError(t, err)
+		assert.Empty(t, msg.GetHeader("Bcc"))
+	})
+}
+
+func TestMailer_NewMessageDefaults(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com")
+
+	msg, err := m.newMessage("testuser@example.com", "mail.html", map[string]any{"activationToken": "token"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"noreply@acme.com"}, msg.GetHeader("From"))
+	assert.Empty(t, msg.GetHeader("Reply-To"))
+	assert.Empty(t, msg.GetHeader("Bcc"))
+}
+
+func TestMailer_NewMessageSubject(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com")
+	data := map[string]any{"activationToken": "token"}
+
+	msg, err := m.newMessage("testuser@example.com", "mail.html", data)
+	assert.NoError(t, err)
+	defaultSubject := msg.GetHeader("Subject")
+	assert.NotEmpty(t, defaultSubject)
+
+	msg, err = m.newMessage("testuser@example.com", "mail.html", data, WithSubject("Welcome to Acme"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Welcome to Acme"}, msg.GetHeader("Subject"))
+
+	msg, err = m.newMessage("testuser@example.com", "mail.html", data, WithSubject(""))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultSubject, msg.GetHeader("Subject"), "an empty subject keeps the template's")
+}
+
+func TestMailer_OptionalBodies(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com")
+	m.templates = fstest.MapFS{
+		"templates/html_only.html":  {Data: []byte(`{{define "subject"}}Hi{{end}}{{define "htmlBody"}}<p>Hello {{.name}}</p>{{end}}`)},
+		"templates/plain_only.html": {Data: []byte(`{{define "subject"}}Hi{{end}}{{define "plainBody"}}Hello {{.name}}{{end}}`)},
+		"templates/no_body.html":    {Data: []byte(`{{define "subject"}}Hi{{end}}`)},
+	}
+
+	tests := []struct {
+		template        string
+		wantErr         error
+		wantContentType string
+	}{
+		{template: "html_only.html", wantContentType: "text/html"},
+		{template: "plain_only.html", wantContentType: "text/plain"},
+		{template: "no_body.html", wantErr: ErrMissingBody},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			msg, err := m.newMessage("testuser@example.com", tt.template, map[string]any{"name": "testuser"})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			var buf bytes.Buffer
+			_, err = msg.WriteTo(&buf)
+			assert.NoError(t, err)
+			assert.Contains(t, buf.String(), "Content-Type: "+tt.wantContentType)
+			assert.Contains(t, buf.String(), "Hello testuser")
+			assert.NotContains(t, buf.String(), "multipart/alternative")
+		})
+	}
+}
+
+func TestMailer_EmbeddedTemplates(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com")
+
+	templates := map[string]map[string]any{
+		"mail.html":                 {"username": "testuser", "activationToken": "token", "activationURL": "https://app.example.com/activate?token=token", "expiresIn": "3 days"},
+		"reset_pwd.html":            {"email": "testuser@example.com", "resetPasswordToken": "token", "resetPasswordURL": "https://app.example.com/reset-password?token=token", "expiresIn": "45 minutes"},
+		"reset_pwd_otp.html":        {"email": "testuser@example.com", "otp": "012345", "expiresIn": "10 minutes"},
+		"password_changed.html":     {"email": "testuser@example.com"},
+		"email_changed.html":        {"email": "testuser@example.com", "newEmail": "new@example.com", "rollbackToken": "token", "rollbackURL": "https://app.example.com/email-rollback?token=token", "expiresIn": "7 days"},
+		"registration_attempt.html": {"email": "testuser@example.com"},
+		"username_reminder.html":    {"email": "testuser@example.com", "username": "testuser"},
+		"verify_email.html":         {"username": "testuser", "email": "second@example.com", "verifyEmailToken": "token", "verifyEmailURL": "http://localhost:3000/verify-email?token=token", "expiresIn": "3 days"},
+	}
+
+	for name, data := range templates {
+		t.Run(name, func(t *testing.T) {
+			msg, err := m.newMessage("testuser@example.com", name, data)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, msg.GetHeader("Subject"))
+		})
+	}
+}
+
+func TestMailer_ActivationTemplate(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com")
+
+	data := map[string]any{
+		"username":        "testuser",
+		"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"activationURL":   "https://app.example.com/activate?token=ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"expiresIn":       "3 days",
+	}
+
+	msg, err := m.newMessage("testuser@example.com", "mail.html", data)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	assert.NoError(t, err)
+
+	// the bodies are quoted-printable encoded, undo the soft line breaks before matching
+	body := strings.ReplaceAll(strings.ReplaceAll(buf.String(), "=\r\n", ""), "=3D", "=")
+	assert.Contains(t, body, "Hi testuser,")
+	assert.Contains(t, body, "https://app.example.com/activate?token=ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	assert.Contains(t, body, `<a href="https://app.example.com/activate?token=ABCDEFGHIJKLMNOPQRSTUVWXYZ">`)
+	assert.Contains(t, body, "expire in 3 days")
+}
+
+func TestFileMailer_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+
+	m, err := NewFileMailer(dir, "noreply@acme.com")
+	assert.NoError(t, err)
+
+	m.renderer.templates = fstest.MapFS{
+		"templates/plain_only.html": {Data: []byte(`{{define "subject"}}Activate{{end}}{{define "plainBody"}}Token {{.token}}{{end}}`)},
+	}
+
+	err = m.Send("test user@example.com", "plain_only.html", map[string]any{"token": "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+	assert.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if !assert.Len(t, entries, 1) {
+		return
+	}
+	assert.True(t, strings.HasSuffix(entries[0].Name(), "-plain_only-test_user@example.com.eml"), entries[0].Name())
+
+	content, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "To: test user@example.com")
+	assert.Contains(t, string(content), "Subject: Activate")
+	assert.Contains(t, string(content), "Token ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
+func TestLogMailer_Send(t *testing.T) {
+	var buf bytes.Buffer
+
+	m := NewLogMailer(slog.New(slog.NewJSONHandler(&buf, nil)), "noreply@acme.com")
+	m.renderer.templates = fstest.MapFS{
+		"templates/plain_only.html": {Data: []byte(`{{define "subject"}}Activate{{end}}{{define "plainBody"}}Token {{.token}}{{end}}`)},
+	}
+
+	err := m.Send("testuser@example.com", "plain_only.html", map[string]any{"token": "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+	assert.NoError(t, err)
+
+	logs := buf.String()
+	assert.Contains(t, logs, `"recipient":"testuser@example.com"`)
+	assert.Contains(t, logs, `"template":"plain_only.html"`)
+	assert.Contains(t, logs, "Token ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
+func TestMailer_ResetPasswordTemplate(t *testing.T) {
+	m := New("localhost", 25, "", "", "noreply@acme.com")
+
+	data := map[string]any{
+		"email":              "testuser@example.com",
+		"resetPasswordToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"resetPasswordURL":   "https://app.example.com/verify/ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		"expiresIn":          "45 minutes",
+	}
+
+	msg, err := m.newMessage("testuser@example.com", "reset_pwd.html", data)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	assert.NoError(t, err)
+
+	body := strings.ReplaceAll(strings.ReplaceAll(buf.String(), "=\r\n", ""), "=3D", "=")
+	assert.Contains(t, body, `<a href="https://app.example.com/verify/ABCDEFGHIJKLMNOPQRSTUVWXYZ">`)
+	assert.Contains(t, body, "expire in 45 minutes")
+}
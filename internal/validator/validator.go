@@ -1,5 +1,10 @@
 package validator
 
+import (
+	"reflect"
+	"strings"
+)
+
 type Validator struct {
 	Errors map[string]string
 }
@@ -27,3 +32,28 @@ func (v *Validator) Check(ok bool, field, message string) {
 func (v *Validator) CheckStringLength(s string, min, max int) bool {
 	return len(s) >= min && len(s) <= max
 }
+
+// CheckRequired adds a "must be provided" error for every field of the struct
+// pointed to by dst that is tagged `validate:"required"` and holds its zero value.
+// Errors are keyed by the field's JSON name so they match the request payload.
+func (v *Validator) CheckRequired(dst any) {
+	rv := reflect.Indirect(reflect.ValueOf(dst))
+	if rv.Kind() != reflect.Struct {
+		return
+	}
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.Tag.Get("validate") != "required" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		v.Check(!rv.Field(i).IsZero(), name, "must be provided")
+	}
+}
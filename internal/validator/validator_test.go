@@ -0,0 +1,57 @@
+package validator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidator_CheckRequired(t *testing.T) {
+	type input struct {
+		Username  string `json:"username" validate:"required"`
+		Password  string `json:"password,omitempty" validate:"required"`
+		Activated *bool  `json:"activated" validate:"required"`
+		Nickname  string `json:"nickname"`
+		Untagged  string `validate:"required"`
+	}
+
+	activated := false
+
+	testCases := []struct {
+		name       string
+		input      input
+		wantErrors map[string]string
+	}{
+		{
+			name:       "all required fields provided",
+			input:      input{Username: "testuser", Password: "Test1234!", Activated: &activated, Untagged: "x"},
+			wantErrors: map[string]string{},
+		},
+		{
+			name:  "missing fields are reported by their JSON name",
+			input: input{Nickname: "tester"},
+			wantErrors: map[string]string{
+				"username":  "must be provided",
+				"password":  "must be provided",
+				"activated": "must be provided",
+				"Untagged":  "must be provided",
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New()
+			v.CheckRequired(&tt.input)
+
+			assert.Equal(t, tt.wantErrors, v.Errors)
+		})
+	}
+}
+
+func TestValidator_CheckRequiredNonStruct(t *testing.T) {
+	v := New()
+	v.CheckRequired("not a struct")
+
+	assert.True(t, v.Valid())
+}
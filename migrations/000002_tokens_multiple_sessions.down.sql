@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS idx_tokens_user_id_scope_id;
+
+ALTER TABLE tokens DROP CONSTRAINT IF EXISTS tokens_pkey;
+
+DELETE FROM tokens t
+USING tokens newer
+WHERE t.user_id = newer.user_id AND t.scope_id = newer.scope_id
+    AND (t.expiry < newer.expiry OR (t.expiry = newer.expiry AND t.ctid < newer.ctid));
+
+ALTER TABLE tokens ADD PRIMARY KEY (user_id, scope_id);
+
+ALTER TABLE tokens ALTER COLUMN hash DROP NOT NULL;
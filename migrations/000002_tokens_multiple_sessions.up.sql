@@ -0,0 +1,7 @@
+ALTER TABLE tokens DROP CONSTRAINT IF EXISTS tokens_pkey;
+
+ALTER TABLE tokens ALTER COLUMN hash SET NOT NULL;
+
+ALTER TABLE tokens ADD PRIMARY KEY (hash);
+
+CREATE INDEX IF NOT EXISTS idx_tokens_user_id_scope_id ON tokens (user_id, scope_id);
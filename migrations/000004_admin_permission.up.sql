@@ -0,0 +1,4 @@
+INSERT INTO permissions (name)
+VALUES
+    ('admin:user')
+ON CONFLICT (name) DO NOTHING;
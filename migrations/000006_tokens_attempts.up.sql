@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
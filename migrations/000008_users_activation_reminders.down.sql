@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS last_reminder_at;
+ALTER TABLE users DROP COLUMN IF EXISTS activation_reminders_sent;
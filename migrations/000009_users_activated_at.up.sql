@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activated_at TIMESTAMP(0) WITH TIME ZONE;
+UPDATE users SET activated_at = created_at WHERE activated = TRUE AND activated_at IS NULL;
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_activation_sent_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_reset_sent_at TIMESTAMP(0) WITH TIME ZONE;
@@ -0,0 +1,4 @@
+INSERT INTO scopes (name)
+VALUES
+    ('token:resetpwd-otp')
+ON CONFLICT (name) DO NOTHING;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS email_history (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email CITEXT NOT NULL,
+    token_hash BYTEA NOT NULL UNIQUE,
+    changed_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_history_user_id ON email_history (user_id, changed_at DESC);
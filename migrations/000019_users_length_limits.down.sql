@@ -0,0 +1,3 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_length;
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_username_length;
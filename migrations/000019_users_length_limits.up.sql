@@ -0,0 +1,3 @@
+ALTER TABLE users ADD CONSTRAINT users_username_length CHECK (char_length(username) <= 64);
+
+ALTER TABLE users ADD CONSTRAINT users_email_length CHECK (char_length(email) <= 254);
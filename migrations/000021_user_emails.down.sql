@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS users_email_unique ON users;
+DROP FUNCTION IF EXISTS users_email_unique;
+DROP TABLE IF EXISTS user_emails;
+DROP FUNCTION IF EXISTS user_emails_email_unique;
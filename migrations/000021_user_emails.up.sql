@@ -0,0 +1,51 @@
+CREATE TABLE IF NOT EXISTS user_emails (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email CITEXT NOT NULL CHECK (char_length(email) <= 254),
+    verified BOOLEAN NOT NULL DEFAULT FALSE,
+    token_hash BYTEA UNIQUE,
+    token_expiry TIMESTAMP(0) WITH TIME ZONE,
+    created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, email)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_emails_user_id ON user_emails (user_id);
+
+-- any number of users may be verifying the same address, only one of them can end up with it
+CREATE UNIQUE INDEX IF NOT EXISTS user_emails_verified_email_key ON user_emails (email) WHERE verified;
+
+-- An address belongs to a single account, either as its primary email in users or as a verified
+-- secondary one in user_emails. An unverified secondary address reserves nothing, so that adding
+-- one doesn't tell whether the address is registered. Both triggers take a transaction scoped
+-- advisory lock on the address, its first key 2 keeping it apart from the other advisory locks, so
+-- that concurrent writes to the two tables see each other. The errors raised look like those of
+-- the unique constraints so that they are reported the same way.
+CREATE OR REPLACE FUNCTION users_email_unique() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(2, hashtext(lower(NEW.email::text)));
+    IF EXISTS (SELECT 1 FROM user_emails WHERE email = NEW.email AND verified) THEN
+        RAISE unique_violation USING MESSAGE = 'duplicate key value violates unique constraint "users_email_key"';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_email_unique
+BEFORE INSERT OR UPDATE OF email ON users
+FOR EACH ROW EXECUTE FUNCTION users_email_unique();
+
+CREATE OR REPLACE FUNCTION user_emails_email_unique() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.verified THEN
+        PERFORM pg_advisory_xact_lock(2, hashtext(lower(NEW.email::text)));
+        IF EXISTS (SELECT 1 FROM users WHERE email = NEW.email) THEN
+            RAISE unique_violation USING MESSAGE = 'duplicate key value violates unique constraint "user_emails_verified_email_key"';
+        END IF;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_emails_email_unique
+BEFORE INSERT OR UPDATE OF email, verified ON user_emails
+FOR EACH ROW EXECUTE FUNCTION user_emails_email_unique();
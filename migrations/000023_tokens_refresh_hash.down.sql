@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_tokens_refresh_hash;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS refresh_hash;
@@ -0,0 +1,3 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS refresh_hash BYTEA;
+
+CREATE INDEX IF NOT EXISTS idx_tokens_refresh_hash ON tokens (refresh_hash);
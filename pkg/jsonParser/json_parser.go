@@ -9,12 +9,29 @@ import (
 	"strings"
 )
 
-func ParseJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+// Option changes how ParseJSON decodes the request body.
+type Option func(*json.Decoder)
+
+// UseNumber decodes numbers into interface{} values as json.Number instead of float64, so that
+// integers larger than 2^53 keep their precision. Typed fields such as int64 are not affected.
+func UseNumber() Option {
+	return func(d *json.Decoder) {
+		d.UseNumber()
+	}
+}
+
+// ParseJSON decodes a single JSON value from the request body into dst, rejecting unknown fields
+// and bodies larger than 1MB. By default numbers decode to float64 when dst holds an interface{},
+// pass UseNumber to keep them as json.Number.
+func ParseJSON(w http.ResponseWriter, r *http.Request, dst any, opts ...Option) error {
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
+	for _, opt := range opts {
+		opt(decoder)
+	}
 
 	err := decoder.Decode(dst)
 	if err != nil {
@@ -27,7 +44,7 @@ func ParseJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 		case errors.As(err, &syntaxError):
 			return fmt.Errorf("request body contains badly-formed JSON (at character %d)", syntaxError.Offset)
 		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("request body contains badly-formed JSON")
+			return errors.New("request body contains badly-formed JSON (unexpected end of input, the body may be truncated)")
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
 				return fmt.Errorf("request body contains an invalid value for the %q field", unmarshalTypeError.Field)
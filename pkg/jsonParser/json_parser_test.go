@@ -2,6 +2,7 @@ package jsonParser
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -64,6 +65,26 @@ func TestParseJSON(t *testing.T) {
 		}
 	})
 
+	t.Run("Truncated JSON", func(t *testing.T) {
+		body := bytes.NewBufferString(`{"name": "Jo`)
+		req, err := http.NewRequest("POST", "/api", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+
+		var data struct {
+			Name string `json:"name"`
+		}
+		err = ParseJSON(recorder, req, &data)
+
+		expected := "request body contains badly-formed JSON (unexpected end of input, the body may be truncated)"
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected error %q, but got %v", expected, err)
+		}
+	})
+
 	t.Run("Invalid JSON type", func(t *testing.T) {
 		// Create a mock HTTP request with an invalid JSON type
 		body := bytes.NewBufferString(`{"name": "John", "age": "thirty"}`)
@@ -173,4 +194,53 @@ func TestParseJSON(t *testing.T) {
 			t.Error("Expected ParseJSON to return an error for multiple JSON values in request body")
 		}
 	})
+	t.Run("Large integer with UseNumber", func(t *testing.T) {
+		// 2^53 + 1 can't be represented exactly by a float64
+		body := bytes.NewBufferString(`{"id": 9007199254740993}`)
+		req, err := http.NewRequest("POST", "/api", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+
+		var data struct {
+			ID any `json:"id"`
+		}
+		err = ParseJSON(recorder, req, &data, UseNumber())
+		if err != nil {
+			t.Fatalf("ParseJSON returned an error: %v", err)
+		}
+
+		id, ok := data.ID.(json.Number)
+		if !ok {
+			t.Fatalf("Expected id to be a json.Number, but got %T", data.ID)
+		}
+
+		if id.String() != "9007199254740993" {
+			t.Errorf("Expected id to be %q, but got %q", "9007199254740993", id.String())
+		}
+	})
+
+	t.Run("Large integer without UseNumber", func(t *testing.T) {
+		body := bytes.NewBufferString(`{"id": 9007199254740993}`)
+		req, err := http.NewRequest("POST", "/api", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+
+		var data struct {
+			ID any `json:"id"`
+		}
+		err = ParseJSON(recorder, req, &data)
+		if err != nil {
+			t.Fatalf("ParseJSON returned an error: %v", err)
+		}
+
+		if _, ok := data.ID.(float64); !ok {
+			t.Errorf("Expected id to be a float64 by default, but got %T", data.ID)
+		}
+	})
 }